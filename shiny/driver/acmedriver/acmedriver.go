@@ -0,0 +1,90 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package acmedriver provides a shiny driver for programs run from the
+// acme(1) text editor, where /dev/draw may not be available. Each shiny
+// window is an acme window, and the keyboard and mouse events that acme
+// reports for it through its event file, as described in acme(4), are
+// sent to the shiny window.
+//
+// An acme window only holds text, so the driver is only useful for tools
+// that need the events. Nothing that's drawn is shown, and buffers and
+// textures can't be created.
+package acmedriver // import "github.com/niconan/shiny-plan9/shiny/driver/acmedriver"
+
+import (
+	"errors"
+	"image"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/niconan/shiny-plan9/shiny/screen"
+)
+
+// Root is the directory that acme's file system is mounted on.
+var Root = "/mnt/acme"
+
+// IsAcme reports whether the program was run from acme, which sets
+// $winid for the commands that it runs and serves its files in Root.
+func IsAcme() bool {
+	if os.Getenv("winid") == "" {
+		return false
+	}
+	_, err := os.Stat(path.Join(Root, "index"))
+	return err == nil
+}
+
+// Main calls f with a screen whose windows are acme windows. It returns
+// when f returns, after deleting any windows that weren't released.
+func Main(f func(screen.Screen)) {
+	s := &screenImpl{}
+	defer s.release()
+	f(s)
+}
+
+var errNoImages = errors.New("acmedriver: an acme window can't show images")
+
+type screenImpl struct {
+	mu      sync.Mutex
+	windows []*windowImpl
+}
+
+func (s *screenImpl) NewBuffer(size image.Point) (screen.Buffer, error) {
+	return nil, errNoImages
+}
+
+func (s *screenImpl) NewTexture(size image.Point) (screen.Texture, error) {
+	return nil, errNoImages
+}
+
+func (s *screenImpl) NewWindow(opts *screen.NewWindowOptions) (screen.Window, error) {
+	w, err := newWindow(s, opts.GetTitle())
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// removeWindow forgets w, which has been released.
+func (s *screenImpl) removeWindow(w *windowImpl) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, win := range s.windows {
+		if win == w {
+			s.windows = append(s.windows[:i], s.windows[i+1:]...)
+			return
+		}
+	}
+}
+
+// release deletes the windows that are left.
+func (s *screenImpl) release() {
+	s.mu.Lock()
+	windows := append([]*windowImpl(nil), s.windows...)
+	s.mu.Unlock()
+	for _, w := range windows {
+		w.Release()
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acmedriver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+
+	"golang.org/x/mobile/event/key"
+	"golang.org/x/mobile/event/mouse"
+)
+
+// An Event is a message from an acme window's event file, as described in
+// acme(4). Every message is sent to the shiny window as it is, before the
+// key or mouse events that it's translated to, so that the application
+// can tell what text they were for.
+type Event struct {
+	// Origin is what caused the event: 'E' for a write to the body or
+	// tag file, 'F' for acme's own actions on the window, 'K' for the
+	// keyboard, and 'M' for the mouse.
+	Origin byte
+	// Type is what happened: 'D' when text was deleted, 'I' when it was
+	// inserted, 'L' when it was looked at with button 3, and 'X' when it
+	// was executed with button 2. Capital letters are for the body, and
+	// lower case ones for the tag.
+	Type byte
+	// Q0 and Q1 are the positions, in runes, of the start and end of the
+	// text that the event is for.
+	Q0, Q1 int
+	// Flag has the extra information described in acme(4).
+	Flag int
+	// Text is the text, which is empty if it's too long to be sent.
+	Text string
+}
+
+// The flags of 'X' and 'L' events which readEvent handles.
+const (
+	// flagExpanded means that another event follows, with the text that
+	// the null string at Q0 was expanded to.
+	flagExpanded = 2
+	// flagChorded means that two more events follow, with the argument
+	// that was chorded with button 1 and where it came from.
+	flagChorded = 8
+)
+
+// readEvent reads one message from an event file:
+//
+//	c1 c2 q0 q1 flag nr text
+//
+// where c1 and c2 are single characters, the numbers are separated by
+// spaces, text is nr runes long, and the message ends with a newline.
+func readEvent(r *bufio.Reader) (Event, error) {
+	var e Event
+	var err error
+	if e.Origin, err = r.ReadByte(); err != nil {
+		return e, err
+	}
+	if e.Type, err = r.ReadByte(); err != nil {
+		return e, unexpectedEOF(err)
+	}
+	var nr int
+	for _, p := range []*int{&e.Q0, &e.Q1, &e.Flag, &nr} {
+		s, err := r.ReadString(' ')
+		if err != nil {
+			return e, unexpectedEOF(err)
+		}
+		if *p, err = strconv.Atoi(s[:len(s)-1]); err != nil || *p < 0 {
+			return e, fmt.Errorf("acmedriver: bad number %q in %c%c event", s, e.Origin, e.Type)
+		}
+	}
+	text := make([]rune, nr)
+	for i := range text {
+		if text[i], _, err = r.ReadRune(); err != nil {
+			return e, unexpectedEOF(err)
+		}
+	}
+	e.Text = string(text)
+	if c, err := r.ReadByte(); err != nil {
+		return e, unexpectedEOF(err)
+	} else if c != '\n' {
+		return e, fmt.Errorf("acmedriver: %c%c event doesn't end with a newline", e.Origin, e.Type)
+	}
+	return e, nil
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF instead of io.EOF, for when
+// the event file ends in the middle of a message.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// A sender receives the events for a window.
+type sender interface {
+	Send(event interface{})
+}
+
+// readEvents reads the events from r and sends them, and the key and
+// mouse events they're translated to, to w until r is closed or can't be
+// read. Acme closes the event file when it deletes the window.
+//
+// Execute and look events are written back to acme with wr afterwards,
+// which makes it do what it usually would with them, such as running its
+// own commands like Del, or searching for the text.
+func readEvents(r io.Reader, wr io.Writer, w sender) {
+	br := bufio.NewReader(r)
+	for {
+		e, err := readEvent(br)
+		if err != nil {
+			return
+		}
+		orig := e
+		if e.Type == 'X' || e.Type == 'x' || e.Type == 'L' || e.Type == 'l' {
+			if e.Flag&flagExpanded != 0 {
+				x, err := readEvent(br)
+				if err != nil {
+					return
+				}
+				e.Q0, e.Q1, e.Text = x.Q0, x.Q1, x.Text
+			}
+			if e.Flag&flagChorded != 0 {
+				// the argument isn't used.
+				for i := 0; i < 2; i++ {
+					if _, err := readEvent(br); err != nil {
+						return
+					}
+				}
+			}
+		}
+
+		w.Send(e)
+		for _, ev := range translate(e) {
+			w.Send(ev)
+		}
+
+		switch e.Type {
+		case 'X', 'x', 'L', 'l':
+			fmt.Fprintf(wr, "%c%c%d %d\n", orig.Origin, orig.Type, orig.Q0, orig.Q1)
+		}
+	}
+}
+
+// translate returns the key or mouse events for e. Text that's typed is
+// sent as a key press for each rune, and text that's deleted by typing as
+// a backspace for each rune. Executing and looking at text with the
+// mouse are sent as a click of the middle and right buttons. The mouse
+// events have no position, since acme only reports the text.
+func translate(e Event) []interface{} {
+	var evs []interface{}
+	switch {
+	case e.Origin == 'K' && (e.Type == 'I' || e.Type == 'i'):
+		for _, r := range e.Text {
+			evs = append(evs, key.Event{Rune: r, Code: runeCode(r), Direction: key.DirPress})
+		}
+	case e.Origin == 'K' && (e.Type == 'D' || e.Type == 'd'):
+		for i := e.Q0; i < e.Q1; i++ {
+			evs = append(evs, key.Event{Rune: -1, Code: key.CodeDeleteBackspace, Direction: key.DirPress})
+		}
+	case e.Origin == 'M' && (e.Type == 'X' || e.Type == 'x'):
+		evs = append(evs, click(mouse.ButtonMiddle)...)
+	case e.Origin == 'M' && (e.Type == 'L' || e.Type == 'l'):
+		evs = append(evs, click(mouse.ButtonRight)...)
+	}
+	return evs
+}
+
+func click(b mouse.Button) []interface{} {
+	return []interface{}{
+		mouse.Event{Button: b, Direction: mouse.DirPress},
+		mouse.Event{Button: b, Direction: mouse.DirRelease},
+	}
+}
+
+// runeCode returns the key code for the runes that have one that isn't
+// a letter or a number.
+func runeCode(r rune) key.Code {
+	switch r {
+	case '\n':
+		return key.CodeReturnEnter
+	case '\t':
+		return key.CodeTab
+	case ' ':
+		return key.CodeSpacebar
+	}
+	return key.CodeUnknown
+}
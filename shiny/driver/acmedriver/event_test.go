@@ -0,0 +1,84 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acmedriver
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/mobile/event/key"
+	"golang.org/x/mobile/event/mouse"
+)
+
+type recorder struct{ events []interface{} }
+
+func (r *recorder) Send(e interface{}) { r.events = append(r.events, e) }
+
+func TestReadEvent(t *testing.T) {
+	for _, tc := range []struct {
+		msg  string
+		want Event
+	}{
+		{"KI5 6 0 1 a\n", Event{'K', 'I', 5, 6, 0, "a"}},
+		// the text is counted in runes, and can hold anything.
+		{"Mx0 9 1 3 é \n\n", Event{'M', 'x', 0, 9, 1, "é \n"}},
+		{"ED0 10 0 0 \n", Event{'E', 'D', 0, 10, 0, ""}},
+	} {
+		e, err := readEvent(bufio.NewReader(strings.NewReader(tc.msg)))
+		if err != nil {
+			t.Errorf("%q: %v", tc.msg, err)
+			continue
+		}
+		if e != tc.want {
+			t.Errorf("%q: got %+v, want %+v", tc.msg, e, tc.want)
+		}
+	}
+
+	for _, msg := range []string{"KI5 6 0 2 a\n", "KI5 x 0 1 a\n", "KI5 6 0 1 ab\n", "K"} {
+		if _, err := readEvent(bufio.NewReader(strings.NewReader(msg))); err == nil || err == io.EOF {
+			t.Errorf("%q: got %v, want an error", msg, err)
+		}
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	msgs := "KI0 2 0 2 a\n\n" +
+		"KD0 3 0 0 \n" +
+		"MX10 13 1 3 Del\n" +
+		// a look at the word around the null string at 20.
+		"ML20 20 2 0 \nML18 23 0 5 hello\n" +
+		"MX0 3 8 3 Get\nMX0 0 0 4 file\nMX0 0 0 6 :1,$+0\n"
+	var written bytes.Buffer
+	var r recorder
+	readEvents(strings.NewReader(msgs), &written, &r)
+
+	press := func(r rune, c key.Code) key.Event { return key.Event{Rune: r, Code: c, Direction: key.DirPress} }
+	backspace := press(-1, key.CodeDeleteBackspace)
+	click := func(b mouse.Button) []interface{} {
+		return []interface{}{mouse.Event{Button: b, Direction: mouse.DirPress}, mouse.Event{Button: b, Direction: mouse.DirRelease}}
+	}
+	want := []interface{}{
+		Event{'K', 'I', 0, 2, 0, "a\n"}, press('a', key.CodeUnknown), press('\n', key.CodeReturnEnter),
+		Event{'K', 'D', 0, 3, 0, ""}, backspace, backspace, backspace,
+		Event{'M', 'X', 10, 13, 1, "Del"},
+	}
+	want = append(want, click(mouse.ButtonMiddle)...)
+	want = append(want, Event{'M', 'L', 18, 23, 2, "hello"})
+	want = append(want, click(mouse.ButtonRight)...)
+	want = append(want, Event{'M', 'X', 0, 3, 8, "Get"})
+	want = append(want, click(mouse.ButtonMiddle)...)
+	if !reflect.DeepEqual(r.events, want) {
+		t.Errorf("got events\n%v\nwant\n%v", r.events, want)
+	}
+
+	// acme is left to handle the mouse events as usual.
+	if got, want := written.String(), "MX10 13\nML20 20\nMX0 3\n"; got != want {
+		t.Errorf("wrote %q back, want %q", got, want)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acmedriver
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/niconan/shiny-plan9/shiny/driver/internal/event"
+	"github.com/niconan/shiny-plan9/shiny/driver/internal/lifecycler"
+	"github.com/niconan/shiny-plan9/shiny/screen"
+	"golang.org/x/image/math/f64"
+)
+
+type windowImpl struct {
+	s *screenImpl
+	event.Deque
+	lifecycler lifecycler.State
+
+	// ctl and events are the window's ctl and event files.
+	ctl    io.WriteCloser
+	events io.ReadWriteCloser
+
+	releaseOnce sync.Once
+}
+
+// newWindow opens a new acme window called title, and starts sending its
+// events to the returned window.
+func newWindow(s *screenImpl, title string) (*windowImpl, error) {
+	ctl, err := os.OpenFile(path.Join(Root, "new", "ctl"), os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("acmedriver: new window: %v", err)
+	}
+	// the first field of the ctl file is the window's ID.
+	buf := make([]byte, 256)
+	n, err := ctl.Read(buf)
+	fields := strings.Fields(string(buf[:n]))
+	if err != nil || len(fields) == 0 {
+		ctl.Close()
+		return nil, fmt.Errorf("acmedriver: read window ID: %q, %v", buf[:n], err)
+	}
+	events, err := os.OpenFile(path.Join(Root, fields[0], "event"), os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintf(ctl, "delete\n")
+		ctl.Close()
+		return nil, fmt.Errorf("acmedriver: open events: %v", err)
+	}
+	if title != "" {
+		fmt.Fprintf(ctl, "name %s\n", title)
+	}
+
+	return startWindow(s, ctl, events), nil
+}
+
+// startWindow adds a window to s for the acme window with the already
+// opened ctl and event files, and starts sending it the events.
+func startWindow(s *screenImpl, ctl io.WriteCloser, events io.ReadWriteCloser) *windowImpl {
+	w := &windowImpl{s: s, ctl: ctl, events: events}
+	// the window is added before its events are read, so that it can't
+	// be removed before it has been.
+	s.mu.Lock()
+	s.windows = append(s.windows, w)
+	s.mu.Unlock()
+	w.lifecycler.SetVisible(true)
+	w.lifecycler.SetFocused(true)
+	w.lifecycler.SendEvent(w, nil)
+	// the events are read until the file is closed by Release, or by
+	// acme when the window is deleted, such as with Del. Either way the
+	// window is gone, and it's released to tell the application.
+	go func() {
+		readEvents(events, events, w)
+		w.Release()
+	}()
+	return w
+}
+
+// Release deletes the acme window, and sends the window a
+// lifecycle.StageDead event. It's also called when the acme window has
+// been deleted, or its events can't be read any more.
+func (w *windowImpl) Release() {
+	w.releaseOnce.Do(func() {
+		fmt.Fprintf(w.ctl, "delete\n")
+		w.ctl.Close()
+		w.events.Close()
+		w.s.removeWindow(w)
+		w.lifecycler.SetDead(true)
+		w.lifecycler.SendEvent(w, nil)
+	})
+}
+
+// Publish does nothing, since an acme window can't show what's drawn.
+func (w *windowImpl) Publish() screen.PublishResult { return screen.PublishResult{} }
+
+// The drawing methods do nothing, for the same reason.
+
+func (w *windowImpl) Upload(dp image.Point, src screen.Buffer, sr image.Rectangle) {}
+func (w *windowImpl) Fill(dr image.Rectangle, src color.Color, op draw.Op)         {}
+func (w *windowImpl) Draw(src2dst f64.Aff3, src screen.Texture, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
+}
+func (w *windowImpl) DrawUniform(src2dst f64.Aff3, src color.Color, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
+}
+func (w *windowImpl) Copy(dp image.Point, src screen.Texture, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
+}
+func (w *windowImpl) Scale(dr image.Rectangle, src screen.Texture, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
+}
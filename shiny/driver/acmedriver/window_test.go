@@ -0,0 +1,127 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acmedriver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"golang.org/x/mobile/event/lifecycle"
+)
+
+// fakeFile is an acme file that's read from r, and records what's written
+// to it.
+type fakeFile struct {
+	r io.Reader
+
+	mu      sync.Mutex
+	written bytes.Buffer
+	closed  bool
+}
+
+func (f *fakeFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+
+func (f *fakeFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.written.Write(p)
+}
+
+func (f *fakeFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// waitDead returns the events that w is sent up to its lifecycle.Event to
+// StageDead.
+func waitDead(w *windowImpl) []interface{} {
+	var evs []interface{}
+	for {
+		e := w.NextEvent()
+		evs = append(evs, e)
+		if l, ok := e.(lifecycle.Event); ok && l.To == lifecycle.StageDead {
+			return evs
+		}
+	}
+}
+
+func TestWindowDeleted(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		events io.Reader
+	}{
+		// acme closes the event file once Del has deleted the window.
+		{"Del", strings.NewReader("MX10 13 1 3 Del\n")},
+		{"EOF", strings.NewReader("")},
+		{"error", io.MultiReader(strings.NewReader("KI0 1 0 1 a\n"), iotest.ErrReader(errors.New("hungup")))},
+	} {
+		s := &screenImpl{}
+		ctl, events := &fakeFile{r: strings.NewReader("")}, &fakeFile{r: tc.events}
+		w := startWindow(s, ctl, events)
+
+		evs := waitDead(w)
+		if e := evs[0].(lifecycle.Event); e.To != lifecycle.StageFocused {
+			t.Errorf("%s: first event is %v, want the window to be focused", tc.name, e)
+		}
+		s.mu.Lock()
+		n := len(s.windows)
+		s.mu.Unlock()
+		if n != 0 {
+			t.Errorf("%s: the screen still has %d windows", tc.name, n)
+		}
+		ctl.mu.Lock()
+		if !ctl.closed {
+			t.Errorf("%s: the ctl file wasn't closed", tc.name)
+		}
+		ctl.mu.Unlock()
+		if tc.name == "Del" {
+			// the Del is still sent, and acme is left to run it.
+			if _, ok := evs[1].(Event); !ok {
+				t.Errorf("%s: got %v before StageDead, want the Del event", tc.name, evs[1])
+			}
+			events.mu.Lock()
+			if got, want := events.written.String(), "MX10 13\n"; got != want {
+				t.Errorf("%s: wrote %q back, want %q", tc.name, got, want)
+			}
+			events.mu.Unlock()
+		}
+	}
+}
+
+// blockingReader blocks reads until it's closed.
+type blockingReader struct{ closed chan struct{} }
+
+func (r blockingReader) Read(p []byte) (int, error) {
+	<-r.closed
+	return 0, io.EOF
+}
+
+func TestWindowRelease(t *testing.T) {
+	s := &screenImpl{}
+	closed := make(chan struct{})
+	ctl, events := &fakeFile{r: strings.NewReader("")}, &fakeFile{r: blockingReader{closed}}
+	w := startWindow(s, ctl, events)
+
+	w.Release()
+	close(closed)
+	waitDead(w)
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	if got := ctl.written.String(); got != "delete\n" {
+		t.Errorf("wrote %q to ctl, want a delete", got)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.windows) != 0 {
+		t.Errorf("the screen still has %d windows", len(s.windows))
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import "fmt"
+
+// A DrawBatch collects messages for /dev/draw/n/data and sends them with
+// as few writes as possible. Each write to /dev/draw is a round trip when
+// it's imported over 9P, so sending many small messages together, such
+// as a run of 'd' messages, can be much faster than SendMessage.
+//
+// The messages are the same as for SendMessage, and the same rules apply
+// to the image IDs in them. A DrawBatch isn't safe for concurrent use.
+type DrawBatch struct {
+	d *DrawCtrler
+	// buf holds the messages that have been appended, and ends is where
+	// each of them ends in buf, so that they're never split between
+	// writes.
+	buf  []byte
+	ends []int
+}
+
+// NewBatch returns an empty batch of messages for d.
+func (d *DrawCtrler) NewBatch() *DrawBatch {
+	return &DrawBatch{d: d}
+}
+
+// Append adds the message with the command cmd and the arguments val to
+// the batch, to be sent by the next Flush. val is copied, so it can be
+// reused as soon as Append returns. It returns b, so that calls can be
+// chained.
+func (b *DrawBatch) Append(cmd byte, val []byte) *DrawBatch {
+	b.buf = append(b.buf, cmd)
+	b.buf = append(b.buf, val...)
+	b.ends = append(b.ends, len(b.buf))
+	return b
+}
+
+// Len returns the number of messages waiting to be sent.
+func (b *DrawBatch) Len() int {
+	return len(b.ends)
+}
+
+// Flush sends the messages in the batch, packing as many whole messages
+// into each write as fit in the connection's iounit. A message that's
+// bigger than the iounit by itself is written alone, and is rejected by
+// the server the same as it would be by SendMessage. The batch is empty
+// afterwards, even if a write failed.
+func (b *DrawBatch) Flush() error {
+	d := b.d
+	defer func() {
+		b.buf, b.ends = b.buf[:0], b.ends[:0]
+	}()
+	d.drawMu.Lock()
+	defer d.drawMu.Unlock()
+	d.appMessages++
+	d.bufMu.Lock()
+	defer d.bufMu.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	start, i := 0, 0
+	for i < len(b.ends) {
+		// always take the first message, and then any more that fit.
+		first := i
+		end := b.ends[i]
+		for i++; i < len(b.ends) && (d.iounitSize <= 0 || b.ends[i]-start <= d.iounitSize); i++ {
+			end = b.ends[i]
+		}
+		if _, err := d.data.Write(b.buf[start:end]); err != nil {
+			// as in writeMessage, only a lost connection stops
+			// the messages after it.
+			werr := fmt.Errorf("write batch of %d messages: %w", i-first, err)
+			if connLost(err) {
+				d.err = werr
+			}
+			return werr
+		}
+		for _, e := range b.ends[first:i] {
+			d.count(b.buf[start:e])
+			start = e
+		}
+	}
+	return nil
+}
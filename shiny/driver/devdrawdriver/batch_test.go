@@ -0,0 +1,70 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDrawBatch(t *testing.T) {
+	// each 'd' message is 45 bytes, so two fit in an iounit of 100.
+	d, f := newTestCtrler(100)
+	b := d.NewBatch()
+	arg := make([]byte, 44)
+	for i := 0; i < 5; i++ {
+		arg[0] = byte(i)
+		b.Append('d', arg)
+	}
+	if b.Len() != 5 || len(f.msgs) != 0 {
+		t.Fatalf("batch has %d messages and %d were sent before Flush", b.Len(), len(f.msgs))
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.msgs) != 3 {
+		t.Fatalf("got %d writes, want 3", len(f.msgs))
+	}
+	// the messages are whole, and in the order they were appended.
+	all := bytes.Join(f.msgs, nil)
+	for i := 0; i < 5; i++ {
+		m := all[i*45:]
+		if m[0] != 'd' || m[1] != byte(i) {
+			t.Errorf("message %d is %q %d, want 'd' %d", i, m[0], m[1], i)
+		}
+	}
+	if got := d.Stats().Messages['d']; got != 5 {
+		t.Errorf("counted %d 'd' messages, want 5", got)
+	}
+
+	// the batch can be used again, and a message bigger than the
+	// iounit goes alone.
+	f.msgs = nil
+	b.Append('v', nil).Append('y', make([]byte, 200)).Append('v', nil)
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.cmds(), "vyv"; got != want || len(f.msgs[1]) != 201 {
+		t.Errorf("got writes %q, want %q", got, want)
+	}
+	if b.Len() != 0 {
+		t.Errorf("batch has %d messages after Flush", b.Len())
+	}
+}
+
+func TestDrawBatchError(t *testing.T) {
+	d := NewDrawCtrlerFromTransport(&failingData{}, 65535)
+	b := d.NewBatch().Append('v', nil)
+	if err := b.Flush(); err == nil {
+		t.Fatal("expected an error from a failed write")
+	}
+	// the connection is broken for everything afterwards.
+	if err := d.SendMessage('v', nil); err == nil {
+		t.Errorf("SendMessage succeeded after the batch failed")
+	}
+	if b.Len() != 0 {
+		t.Errorf("batch has %d messages after a failed Flush", b.Len())
+	}
+}
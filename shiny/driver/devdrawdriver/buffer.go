@@ -5,7 +5,9 @@
 package devdrawdriver
 
 import (
+	"errors"
 	"image"
+	"image/draw"
 )
 
 // Just use an in-memory RGBA image as a buffer. It'll
@@ -15,6 +17,22 @@ type bufferImpl struct {
 	i *image.RGBA
 }
 
+// StridedBuffer gives the distance in bytes between rows of a buffer
+// created by this driver, for callers that write into the pixels directly:
+//
+//	b.(devdrawdriver.StridedBuffer).Stride()
+type StridedBuffer interface {
+	Stride() int
+}
+
+// CopyBuffer converts an image in another format, such as one decoded
+// from a PNG or JPEG file, into a buffer created by this driver:
+//
+//	err := b.(devdrawdriver.CopyBuffer).CopyFrom(img)
+type CopyBuffer interface {
+	CopyFrom(src image.Image) error
+}
+
 func (b *bufferImpl) Release() {
 	b.i = nil
 	// the image will get garbage collected
@@ -31,3 +49,19 @@ func (b *bufferImpl) Bounds() image.Rectangle {
 func (b *bufferImpl) Size() image.Point {
 	return b.i.Bounds().Size()
 }
+
+// Stride returns the stride of the buffer's RGBA image.
+func (b *bufferImpl) Stride() int {
+	return b.i.Stride
+}
+
+// CopyFrom replaces the buffer's pixels with src, with the top left of
+// src's bounds at the top left of the buffer. Anything that src doesn't
+// cover is left as it was.
+func (b *bufferImpl) CopyFrom(src image.Image) error {
+	if b.i == nil {
+		return errors.New("copy to buffer: buffer has been released")
+	}
+	draw.Draw(b.i, b.i.Bounds(), src, src.Bounds().Min, draw.Src)
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// arrowCursor is rio's arrow, in the format of a Plan 9 Cursor: the
+// offset of the image from the pointer, and the 16x16 bitmaps of the
+// pixels that are white (clr) and black (set), two bytes to a row.
+var arrowCursor = struct {
+	offset   image.Point
+	clr, set [32]byte
+}{
+	offset: image.Pt(-1, -1),
+	clr: [32]byte{
+		0xFF, 0xFF, 0x80, 0x01, 0x80, 0x02, 0x80, 0x0C,
+		0x80, 0x10, 0x80, 0x10, 0x80, 0x08, 0x80, 0x04,
+		0x80, 0x02, 0x80, 0x01, 0x80, 0x02, 0x8C, 0x04,
+		0x92, 0x08, 0x91, 0x10, 0xA0, 0xA0, 0xC0, 0x40,
+	},
+	set: [32]byte{
+		0x00, 0x00, 0x7F, 0xFE, 0x7F, 0xFC, 0x7F, 0xF0,
+		0x7F, 0xE0, 0x7F, 0xE0, 0x7F, 0xF0, 0x7F, 0xF8,
+		0x7F, 0xFC, 0x7F, 0xFE, 0x7F, 0xFC, 0x73, 0xF8,
+		0x61, 0xF0, 0x60, 0xE0, 0x40, 0x40, 0x00, 0x00,
+	},
+}
+
+// cursorRect is the rectangle of the cursor's image.
+var cursorRect = image.Rect(0, 0, 16, 16)
+
+// cursorImage returns arrowCursor as an image, which is transparent
+// outside of the arrow.
+func cursorImage() *image.RGBA {
+	img := image.NewRGBA(cursorRect)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			bit := byte(0x80 >> uint(x%8))
+			i := 2*y + x/8
+			switch {
+			case arrowCursor.set[i]&bit != 0:
+				img.SetRGBA(x, y, color.RGBA{0, 0, 0, 0xff})
+			case arrowCursor.clr[i]&bit != 0:
+				img.SetRGBA(x, y, color.RGBA{0xff, 0xff, 0xff, 0xff})
+			}
+		}
+	}
+	return img
+}
+
+// moveCursor records that the pointer is at p, in the coordinates of the
+// Plan 9 window, and draws the software cursor there. The cursor's image
+// is allocated the first time.
+func (s *screenImpl) moveCursor(p image.Point) {
+	s.windowsMu.Lock()
+	if s.cursorId == 0 {
+		s.cursorId = s.ctl.AllocBuffer(0, false, cursorRect, cursorRect, color.Transparent)
+		s.ctl.replaceRGBA(s.cursorId, cursorRect, cursorImage())
+	}
+	moved := p != s.cursorPos
+	s.cursorPos = p
+	// the frame is composited again, which paints over the cursor where
+	// it was and draws it at p.
+	s.stale = s.stale || moved
+	frame := s.windowFrame
+	s.windowsMu.Unlock()
+	if moved {
+		redrawWindow(s, frame)
+	}
+}
+
+// drawCursorLocked composites the software cursor onto the Plan 9 window,
+// whose rectangle is r, after the windows, and records where it was drawn
+// so that the next frame can paint over it. It must be called with
+// windowsMu and ctl.drawMu held.
+func (s *screenImpl) drawCursorLocked(r image.Rectangle) error {
+	if s.cursorId == 0 {
+		return nil
+	}
+	origin := r.Min.Add(s.cursorPos).Add(arrowCursor.offset)
+	dr := cursorRect.Add(origin).Intersect(r)
+	if dr.Empty() {
+		return nil
+	}
+	s.cursorDrawn = dr
+	sp := dr.Min.Sub(origin)
+	args := make([]byte, 44)
+	// the cursor is its own mask, so only the arrow is drawn.
+	binary.LittleEndian.PutUint32(args[4:], s.cursorId)
+	binary.LittleEndian.PutUint32(args[8:], s.cursorId)
+	for i, v := range []int{dr.Min.X, dr.Min.Y, dr.Max.X, dr.Max.Y, sp.X, sp.Y, sp.X, sp.Y} {
+		binary.LittleEndian.PutUint32(args[12+4*i:], uint32(v))
+	}
+	return s.ctl.sendOpMessage(draw.Over, 'd', args)
+}
@@ -0,0 +1,104 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/niconan/shiny-plan9/shiny/screen"
+)
+
+func TestSoftwareCursor(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(100, 100, 300, 300))
+	s.opts.SoftwareCursor = true
+	win, _ := s.NewWindow(nil)
+	w := win.(*windowImpl)
+	w.Publish()
+
+	f.msgs = nil
+	s.moveCursor(image.Pt(10, 20))
+	// the arrow is drawn over the window, with its tip on the pointer.
+	var last []byte
+	for _, m := range f.msgs {
+		if m[0] == 'd' {
+			last = m[1:]
+		}
+	}
+	if last == nil {
+		t.Fatalf("got messages %q, want the cursor drawn", f.cmds())
+	}
+	dst, src, mask := binary.LittleEndian.Uint32(last), binary.LittleEndian.Uint32(last[4:]), binary.LittleEndian.Uint32(last[8:])
+	if dst != 0 || src != s.cursorId || mask != s.cursorId || s.cursorId == 0 {
+		t.Errorf("drew %d into %d with mask %d, want the cursor %d into 0", src, dst, mask, s.cursorId)
+	}
+	if r, want := msgRect(last[12:]), image.Rect(109, 119, 125, 135); r != want {
+		t.Errorf("cursor drawn at %v, want %v", r, want)
+	}
+
+	// publishing again keeps the cursor on top.
+	w.Fill(image.Rect(0, 0, 10, 10), color.Black, draw.Src)
+	f.msgs = nil
+	w.Publish()
+	if last := lastDraw(f); last == nil || binary.LittleEndian.Uint32(last[5:]) != s.cursorId {
+		t.Errorf("got messages %q publishing, want the cursor drawn last", f.cmds())
+	}
+
+	// it's clipped to the Plan 9 window at the edge.
+	s.moveCursor(image.Pt(195, 0))
+	if r := msgRect(lastDraw(f)[13:]); r != image.Rect(294, 100, 300, 115) {
+		t.Errorf("cursor drawn at %v at the edge", r)
+	}
+
+	// it isn't drawn again if the pointer didn't move.
+	f.msgs = nil
+	s.moveCursor(image.Pt(195, 0))
+	if len(f.msgs) != 0 {
+		t.Errorf("got messages %q without moving", f.cmds())
+	}
+}
+
+// lastDraw returns the last 'd' message sent to f, or nil if there isn't
+// one.
+func lastDraw(f *fakeData) []byte {
+	for i := len(f.msgs) - 1; i >= 0; i-- {
+		if f.msgs[i][0] == 'd' {
+			return f.msgs[i]
+		}
+	}
+	return nil
+}
+
+func TestSoftwareCursorTrail(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 200, 200))
+	s.opts.SoftwareCursor = true
+	// the window doesn't cover where the cursor starts.
+	win, _ := s.NewWindow(&screen.NewWindowOptions{Width: 50, Height: 50})
+	win.Publish()
+	s.moveCursor(image.Pt(150, 150))
+	s.moveCursor(image.Pt(10, 10))
+
+	// image 0 starts out red, so that the background is told apart from
+	// what was there.
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	img := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	draw.Draw(img, img.Rect, image.NewUniform(red), image.ZP, draw.Src)
+	render(f.msgs, img)
+	black, white := color.RGBA{0, 0, 0, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff}
+	// the arrow's second row is black from its second pixel.
+	if got := img.RGBAAt(11, 10); got != black {
+		t.Errorf("got %v at the cursor, want %v", got, black)
+	}
+	if got := img.RGBAAt(151, 150); got != white {
+		t.Errorf("got %v where the cursor was, want the background %v", got, white)
+	}
+	// the rest of what was there is left alone.
+	if got := img.RGBAAt(100, 100); got != red {
+		t.Errorf("got %v away from the cursor, want %v", got, red)
+	}
+}
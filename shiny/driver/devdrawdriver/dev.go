@@ -0,0 +1,143 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// DevRoot is the directory that the device files used by the driver
+// (draw, mouse, cons, wctl, winname, etc) are opened from. It can be
+// changed before calling Main if the window system is mounted somewhere
+// other than /dev, such as under drawterm or a custom bind.
+var DevRoot = "/dev"
+
+// devFS opens the device files.
+type devFS interface {
+	OpenFile(name string, flag int) (io.ReadWriteCloser, error)
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int) (io.ReadWriteCloser, error) {
+	return os.OpenFile(name, flag, 0)
+}
+
+// devfs is the devFS used to open every device. It's only replaced by
+// tests.
+var devfs devFS = osFS{}
+
+// wsysDir is the directory that the window system's files (everything
+// but draw) are opened from instead of DevRoot, if it isn't empty. It's
+// set by useWsys.
+var wsysDir string
+
+// wsysMountpoint is where $wsys is mounted, the same place as window(1)
+// uses.
+const wsysMountpoint = "/mnt/wsys"
+
+// mountWsys mounts the window system posted in the file srv on dir with a
+// new window. It's only replaced by tests.
+var mountWsys = mountSrv
+
+// useWsys mounts the window system named by $wsys when the namespace has
+// no window of its own, such as in a cpu(1) session. rio sets $wsys in
+// every window it makes, but those already have their files in DevRoot
+// and are used as they are. If $wsys isn't set or can't be mounted, the
+// files are opened from DevRoot as usual.
+func useWsys() {
+	wsys := os.Getenv("wsys")
+	if wsys == "" {
+		return
+	}
+	if f, err := openDev("winname", os.O_RDONLY); err == nil {
+		f.Close()
+		return
+	}
+	if err := mountWsys(wsys, wsysMountpoint); err != nil {
+		Log.Warnf("mount $wsys %s: %v, using %s", wsys, err, DevRoot)
+		return
+	}
+	wsysDir = wsysMountpoint
+}
+
+// devPath returns the full path of the device file name. /dev/draw is a
+// kernel device, so it's always under DevRoot even when the window
+// system's files come from $wsys.
+func devPath(name string) string {
+	if wsysDir != "" && name != "draw" && !strings.HasPrefix(name, "draw/") {
+		return path.Join(wsysDir, name)
+	}
+	return path.Join(DevRoot, name)
+}
+
+// openDev opens the device file name relative to DevRoot.
+func openDev(name string, flag int) (io.ReadWriteCloser, error) {
+	return devfs.OpenFile(devPath(name), flag)
+}
+
+// devRetryTimeout is how long openDevRetry keeps trying to open a file
+// which doesn't exist, and devRetryDelay is how long it waits before the
+// first retry. The delay doubles after every retry.
+var (
+	devRetryTimeout = 2 * time.Second
+	devRetryDelay   = 10 * time.Millisecond
+)
+
+// openDevRetry opens the file name (which is a full path, unlike for
+// openDev) with backoff while it doesn't exist, for up to devRetryTimeout.
+// This tolerates a program being started before the window system has
+// finished setting up its namespace. Any other error is returned right
+// away.
+func openDevRetry(name string, flag int) (io.ReadWriteCloser, error) {
+	deadline := time.Now().Add(devRetryTimeout)
+	delay := devRetryDelay
+	for {
+		f, err := devfs.OpenFile(name, flag)
+		if err == nil || !os.IsNotExist(err) || time.Now().Add(delay).After(deadline) {
+			return f, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// closeOnDone closes c once done is closed, since closing a device file
+// is the only way to interrupt a blocking read of it. The returned stop
+// function is to be deferred by the reader, so that nothing is left
+// waiting for done once the reader has returned by itself. c isn't closed
+// by closeOnDone after stop has returned.
+func closeOnDone(c io.Closer, done <-chan struct{}) (stop func()) {
+	stopped := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-done:
+			c.Close()
+		case <-stopped:
+		}
+	}()
+	return func() {
+		close(stopped)
+		<-exited
+	}
+}
+
+// readProc returns the contents of the proc(3) file name, which is a full
+// path.
+func readProc(name string) ([]byte, error) {
+	f, err := devfs.OpenFile(name, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,14 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package devdrawdriver
+
+import "errors"
+
+// mountSrv can only mount a window system on Plan 9.
+func mountSrv(srv, dir string) error {
+	return errors.New("mount: not supported on this system")
+}
@@ -0,0 +1,23 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build plan9
+
+package devdrawdriver
+
+import (
+	"os"
+	"syscall"
+)
+
+// mountSrv mounts the 9P service posted in the file srv on dir, replacing
+// it. The attach name "new" asks rio for a new window.
+func mountSrv(srv, dir string) error {
+	f, err := os.OpenFile(srv, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return syscall.Mount(int(f.Fd()), -1, dir, syscall.MREPL, "new")
+}
@@ -0,0 +1,382 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFS is a devFS which serves files from memory, and records the
+// name of every file that was opened, and the last fakeData that was
+// returned for it and the flags that it was opened with. The device
+// goroutines open their files at the same time, so mu protects opened,
+// data and flags while they're running.
+type fakeFS struct {
+	files  map[string]string
+	opened []string
+	data   map[string]*fakeData
+	flags  map[string]int
+	mu     sync.Mutex
+}
+
+func (f *fakeFS) OpenFile(name string, flag int) (io.ReadWriteCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.opened = append(f.opened, name)
+	content, ok := f.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	d := &fakeData{}
+	d.reads.WriteString(content)
+	if f.data == nil {
+		f.data = make(map[string]*fakeData)
+		f.flags = make(map[string]int)
+	}
+	f.data[name] = d
+	f.flags[name] = flag
+	return d, nil
+}
+
+// useFS makes the driver open its devices from fs until the test
+// finishes.
+func useFS(t *testing.T, fs devFS) {
+	old := devfs
+	devfs = fs
+	t.Cleanup(func() { devfs = old })
+}
+
+func TestDevRoot(t *testing.T) {
+	fs := &fakeFS{files: map[string]string{
+		"/mnt/term/dev/wctl": "          0           0         640         480 current visible",
+	}}
+	useFS(t, fs)
+	defer func(old string) { DevRoot = old }(DevRoot)
+	DevRoot = "/mnt/term/dev"
+
+	if _, err := readWctl(4); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.opened) != 1 || fs.opened[0] != "/mnt/term/dev/wctl" {
+		t.Errorf("opened %v, want [/mnt/term/dev/wctl]", fs.opened)
+	}
+}
+
+func TestWsys(t *testing.T) {
+	useLogger(t)
+	defer func(old func(string, string) error) { mountWsys = old }(mountWsys)
+	t.Cleanup(func() { wsysDir = "" })
+	var mounted []string
+	mountWsys = func(srv, dir string) error {
+		mounted = append(mounted, srv+" "+dir)
+		return nil
+	}
+	t.Setenv("wsys", "/srv/rio.glenda.123")
+
+	// a rio window uses its own files.
+	useFS(t, &fakeFS{files: map[string]string{"/dev/winname": "window.1"}})
+	useWsys()
+	if len(mounted) != 0 || devPath("wctl") != "/dev/wctl" {
+		t.Fatalf("mounted %v with /dev/winname present", mounted)
+	}
+
+	// without a window, the files come from $wsys but draw doesn't.
+	fs := &fakeFS{files: map[string]string{
+		"/mnt/wsys/wctl": "          0           0         640         480 current visible",
+	}}
+	useFS(t, fs)
+	useWsys()
+	if want := []string{"/srv/rio.glenda.123 /mnt/wsys"}; fmt.Sprint(mounted) != fmt.Sprint(want) {
+		t.Fatalf("mounted %v, want %v", mounted, want)
+	}
+	if _, err := readWctl(4); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.opened[len(fs.opened)-1]; got != "/mnt/wsys/wctl" {
+		t.Errorf("opened %s, want /mnt/wsys/wctl", got)
+	}
+	for name, want := range map[string]string{
+		"mouse":    "/mnt/wsys/mouse",
+		"winname":  "/mnt/wsys/winname",
+		"draw/new": "/dev/draw/new",
+	} {
+		if got := devPath(name); got != want {
+			t.Errorf("devPath(%q) = %s, want %s", name, got, want)
+		}
+	}
+
+	// a failed mount falls back to /dev.
+	wsysDir = ""
+	mountWsys = func(srv, dir string) error { return errors.New("mount rejected") }
+	useWsys()
+	if got := devPath("wctl"); got != "/dev/wctl" {
+		t.Errorf("devPath(wctl) = %s after a failed mount, want /dev/wctl", got)
+	}
+}
+
+// flakyFS is a devFS which fails to open each file in fails with err the
+// given number of times before opening it from fakeFS.
+type flakyFS struct {
+	*fakeFS
+	fails map[string]int
+	err   error
+}
+
+func (f *flakyFS) OpenFile(name string, flag int) (io.ReadWriteCloser, error) {
+	if f.fails[name] > 0 {
+		f.fails[name]--
+		f.opened = append(f.opened, name)
+		return nil, &os.PathError{Op: "open", Path: name, Err: f.err}
+	}
+	return f.fakeFS.OpenFile(name, flag)
+}
+
+// drawFS returns a fakeFS with the files that NewDrawCtrler opens.
+// /dev/draw/3/ctl isn't one of them, since /dev/draw/new is already the
+// connection's ctl file, and devdraw refuses to open it twice.
+func drawFS() *fakeFS {
+	return &fakeFS{files: map[string]string{
+		"/dev/draw/new":    ctlString(3, 0, "x8r8g8b8", 0, 0, 0, 1024, 768, 0, 0, 1024, 768),
+		"/dev/draw/3/data": "",
+		fmt.Sprintf("/proc/%d/fd", os.Getpid()): "/usr/glenda\n" +
+			"  3 rw M    8 (0000000000000001     0 00)  8192        0 /dev/draw/3/data\n",
+	}}
+}
+
+func TestNewDrawCtrlerRetry(t *testing.T) {
+	defer func(old time.Duration) { devRetryDelay = old }(devRetryDelay)
+	devRetryDelay = time.Millisecond
+
+	fs := &flakyFS{fakeFS: drawFS(), err: os.ErrNotExist, fails: map[string]int{
+		"/dev/draw/new":    3,
+		"/dev/draw/3/data": 2,
+	}}
+	useFS(t, fs)
+	d, msg, err := NewDrawCtrler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.N != 3 || msg.N != 3 || d.iounitSize != 8192 {
+		t.Errorf("got connection %d with iounit %d, want 3 with 8192", d.N, d.iounitSize)
+	}
+	// the display's size is kept after the ctl message has been read.
+	if got := d.LastCtl(); got == nil || *got != *msg || got.DisplaySize != image.Rect(0, 0, 1024, 768) {
+		t.Errorf("LastCtl() = %+v, want the message from /dev/draw/new", got)
+	}
+
+	// a permanent error isn't retried.
+	fs = &flakyFS{fakeFS: drawFS(), err: os.ErrPermission, fails: map[string]int{
+		"/dev/draw/new": 1,
+	}}
+	useFS(t, fs)
+	if _, _, err := NewDrawCtrler(); err == nil {
+		t.Errorf("expected an error when /dev/draw/new can't be opened")
+	}
+	if len(fs.opened) != 1 {
+		t.Errorf("opened %v, want only one attempt", fs.opened)
+	}
+}
+
+func TestNewDrawCtrlerClosesOnError(t *testing.T) {
+	for _, fd := range []string{
+		// the iounit can't be found.
+		"/usr/glenda\n",
+		"/usr/glenda\n  3 rw M    8 (0000000000000001     0 00)  big        0 /dev/draw/3/data\n",
+	} {
+		fs := drawFS()
+		fs.files[fmt.Sprintf("/proc/%d/fd", os.Getpid())] = fd
+		useFS(t, fs)
+		if _, _, err := NewDrawCtrler(); err == nil {
+			t.Fatalf("expected an error without the iounit in %q", fd)
+		}
+		for _, name := range []string{"/dev/draw/new", "/dev/draw/3/data"} {
+			if !fs.data[name].closed {
+				t.Errorf("%s was left open", name)
+			}
+		}
+	}
+
+	// on success, data and ctl stay open, and ctl is the file that
+	// /dev/draw/new was opened as.
+	fs := drawFS()
+	useFS(t, fs)
+	d, _, err := NewDrawCtrler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.data["/dev/draw/3/data"].closed || fs.data["/dev/draw/new"].closed {
+		t.Errorf("data or ctl was closed by a successful NewDrawCtrler")
+	}
+	if d.ctl != fs.data["/dev/draw/new"] || fs.flags["/dev/draw/new"] != os.O_RDWR {
+		t.Errorf("ctl is not /dev/draw/new opened for reading and writing")
+	}
+	for _, name := range fs.opened {
+		if name == "/dev/draw/3/ctl" {
+			t.Errorf("opened %s as well as /dev/draw/new", name)
+		}
+	}
+}
+
+// hungupFS is a fakeFS whose /dev/draw data file refuses messages that
+// start with one of the bytes in refuse.
+type hungupFS struct {
+	*fakeFS
+	refuse string
+}
+
+func (f *hungupFS) OpenFile(name string, flag int) (io.ReadWriteCloser, error) {
+	file, err := f.fakeFS.OpenFile(name, flag)
+	if err != nil || name != "/dev/draw/3/data" {
+		return file, err
+	}
+	return hungupData{file.(*fakeData), f.refuse}, nil
+}
+
+type hungupData struct {
+	*fakeData
+	refuse string
+}
+
+func (d hungupData) Write(p []byte) (int, error) {
+	if len(p) > 0 && strings.IndexByte(d.refuse, p[0]) >= 0 {
+		return 0, errors.New("i/o on hungup channel")
+	}
+	return d.fakeData.Write(p)
+}
+
+func TestNewScreenImplClosesOnError(t *testing.T) {
+	useLogger(t)
+	for _, tc := range []struct {
+		name    string
+		winname bool
+		refuse  string
+	}{
+		// the window can't be attached without /dev/winname.
+		{"attach", false, ""},
+		{"screen", true, "A"},
+	} {
+		fs := drawFS()
+		if tc.winname {
+			fs.files["/dev/winname"] = "window.1"
+		}
+		useFS(t, &hungupFS{fs, tc.refuse})
+		if _, err := newScreenImpl(DevdrawOptions{}); err == nil {
+			t.Fatalf("%s: got no error", tc.name)
+		}
+		for _, name := range []string{"/dev/draw/new", "/dev/draw/3/data"} {
+			if !fs.data[name].closed {
+				t.Errorf("%s: %s was left open", tc.name, name)
+			}
+		}
+	}
+}
+
+func TestScreenInfoFromCtl(t *testing.T) {
+	fs := drawFS()
+	fs.files["/dev/draw/new"] = ctlString(3, 0, "x8r8g8b8", 0, 0, 0, 1920, 1080, 10, 20, 1900, 1060)
+	fs.files["/dev/winname"] = "window.5"
+	useFS(t, fs)
+	s, err := newScreenImpl(DevdrawOptions{IOUnitSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ScreenInfo{
+		ChannelFormat: "x8r8g8b8",
+		DisplaySize:   image.Rect(0, 0, 1920, 1080),
+		Clipping:      image.Rect(10, 20, 1900, 1060),
+		IOUnitSize:    4096,
+	}
+	if got := s.Info(); got != want {
+		t.Errorf("Info() = %+v, want %+v", got, want)
+	}
+}
+
+// winnameFS is a fakeFS whose /dev/winname names each window in names in
+// turn, as though the process were moved between windows, and then
+// keeps naming the last one.
+type winnameFS struct {
+	*fakeFS
+	names []string
+}
+
+func (f *winnameFS) OpenFile(name string, flag int) (io.ReadWriteCloser, error) {
+	if name == "/dev/winname" {
+		f.mu.Lock()
+		f.files[name] = f.names[0]
+		if len(f.names) > 1 {
+			f.names = f.names[1:]
+		}
+		f.mu.Unlock()
+	}
+	return f.fakeFS.OpenFile(name, flag)
+}
+
+func TestAttachWindowRetry(t *testing.T) {
+	useLogger(t)
+	for _, tc := range []struct {
+		names    []string
+		attached string
+		want     string
+	}{
+		{[]string{"window.1"}, "n", "window.1"},
+		// it was read before the move and again after.
+		{[]string{"window.1", "window.2"}, "nn", "window.2"},
+		// it gives up after 3 attempts with the last that was attached.
+		{[]string{"window.1", "window.2", "window.3", "window.4"}, "nnn", "window.3"},
+	} {
+		fs := &winnameFS{fakeFS: drawFS(), names: tc.names}
+		useFS(t, fs)
+		s, err := newScreenImpl(DevdrawOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := fs.data["/dev/draw/3/data"]
+		if got := strings.TrimRight(f.cmds(), "A"); got != tc.attached || s.winname != tc.want {
+			t.Errorf("%v: sent %q and attached %q, want %q and %q", tc.names, got, s.winname, tc.attached, tc.want)
+		}
+		last := f.msgs[len(tc.attached)-1]
+		if got := string(last[6:]); got != tc.want {
+			t.Errorf("%v: last 'n' message named %q, want %q", tc.names, got, tc.want)
+		}
+	}
+}
+
+// closeCounter sends on closed every time it is closed.
+type closeCounter struct{ closed chan struct{} }
+
+func (c closeCounter) Close() error {
+	c.closed <- struct{}{}
+	return nil
+}
+
+func TestCloseOnDone(t *testing.T) {
+	c := closeCounter{make(chan struct{}, 2)}
+	done := make(chan struct{})
+	closeOnDone(c, done)
+	close(done)
+	select {
+	case <-c.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not closed after done was closed")
+	}
+
+	// once the reader has returned, closing done does nothing more.
+	done = make(chan struct{})
+	closeOnDone(c, done)()
+	close(done)
+	select {
+	case <-c.closed:
+		t.Error("closed after it was stopped")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
@@ -0,0 +1,515 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawsim
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+)
+
+// The errors that /dev/draw returns, with devdraw's wording.
+var (
+	errShortDraw    = errors.New("short draw message")
+	errShortRead    = errors.New("draw read too short")
+	errNoImage      = errors.New("unknown id for draw image")
+	errNoScreen     = errors.New("unknown id for draw screen")
+	errImageExists  = errors.New("image id in use")
+	errScreenExists = errors.New("screen id in use")
+	errReadOutside  = errors.New("readimage outside image")
+	errWriteOutside = errors.New("writeimage outside image")
+	errNotFont      = errors.New("image not a font")
+	errIndex        = errors.New("character index out of range")
+	errNoName       = errors.New("no image with that name")
+	errHungup       = errors.New("i/o on hungup channel")
+)
+
+// msgSizes are the sizes of the arguments of the messages that the data
+// file handles, not counting the command byte or the variable part at
+// the end of some of them.
+var msgSizes = map[byte]int{
+	'A': 13, 'F': 4, 'O': 1, 'b': 50, 'c': 21, 'd': 44, 'e': 44, 'E': 44,
+	'f': 4, 'i': 9, 'l': 36, 'L': 44, 'n': 5, 'r': 20, 's': 46, 'v': 0,
+	'x': 58, 'y': 20, 'Y': 20,
+}
+
+// conn is a connection to /dev/draw, made by opening /dev/draw/new.
+type conn struct {
+	id     int
+	images map[uint32]*drawImage
+	// op is the compositing operator for the next drawing message, set
+	// by an 'O' message.
+	op uint8
+	// readback is the reply to the last 'r' message, until it's read.
+	readback []byte
+	// selected is the image that the next read of ctl describes.
+	selected uint32
+	// refs is how many of the connection's files are open, and dataOpen
+	// is whether one of them is the data file.
+	refs     int
+	dataOpen bool
+	hungup   bool
+}
+
+// screen is a screen allocated by an 'A' message. Screen IDs are shared by
+// every connection.
+type screen struct {
+	c     *conn
+	image *drawImage
+}
+
+// newConn makes a new connection, with image 0 as the display, and
+// returns its ctl file.
+func (s *Sim) newConn() (io.ReadWriteCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextConn++
+	c := &conn{
+		id:     s.nextConn,
+		images: map[uint32]*drawImage{0: {pix: s.display, r: s.display.r, clipr: s.display.r}},
+		op:     opSoverD,
+		refs:   1,
+	}
+	s.conns[c.id] = c
+	return &ctlFile{drawFile{s: s, c: c}}, nil
+}
+
+// openConn opens the file name, such as "data", of the connection n.
+func (s *Sim) openConn(n int, name string) (io.ReadWriteCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.conns[n]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	f := drawFile{s: s, c: c}
+	switch name {
+	case "ctl":
+		c.refs++
+		return &ctlFile{f}, nil
+	case "data":
+		c.refs++
+		c.dataOpen = true
+		return &dataFile{f}, nil
+	case "refresh":
+		c.refs++
+		return &refreshFile{f}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// release forgets c and everything that was allocated on it.
+func (s *Sim) release(c *conn) {
+	for id, scr := range s.screens {
+		if scr.c == c {
+			delete(s.screens, id)
+		}
+	}
+	delete(s.conns, c.id)
+}
+
+// drawFile is what the files of a connection have in common.
+type drawFile struct {
+	s      *Sim
+	c      *conn
+	closed bool
+}
+
+// check returns the error from using f, if it can't be. It must be called
+// with s.mu held.
+func (f *drawFile) check() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.c.hungup {
+		return errHungup
+	}
+	return nil
+}
+
+func (f *drawFile) Close() error {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	if f.c.refs--; f.c.refs == 0 && !f.c.hungup {
+		f.s.release(f.c)
+	}
+	f.s.changed.Broadcast()
+	return nil
+}
+
+// ctlFile is /dev/draw/new, or /dev/draw/n/ctl.
+type ctlFile struct{ drawFile }
+
+// Read describes the image that the last write selected, or the display.
+func (f *ctlFile) Read(p []byte) (int, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	id := f.c.selected
+	f.c.selected = 0
+	i, ok := f.c.images[id]
+	if !ok {
+		return 0, errNoImage
+	}
+	repl := 0
+	if i.repl {
+		repl = 1
+	}
+	msg := fmt.Sprintf("%11d %11d %11s %11d %11d %11d %11d %11d %11d %11d %11d %11d ",
+		f.c.id, id, i.pix.f, repl, i.r.Min.X, i.r.Min.Y, i.r.Max.X, i.r.Max.Y,
+		i.clipr.Min.X, i.clipr.Min.Y, i.clipr.Max.X, i.clipr.Max.Y)
+	if len(p) < len(msg) {
+		return 0, errShortRead
+	}
+	return copy(p, msg), nil
+}
+
+// Write selects the image, whose 4 byte ID is p, for the next read.
+func (f *ctlFile) Write(p []byte) (int, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	if len(p) != 4 {
+		return 0, errors.New("unknown draw control request")
+	}
+	id := binary.LittleEndian.Uint32(p)
+	if _, ok := f.c.images[id]; !ok {
+		return 0, errNoImage
+	}
+	f.c.selected = id
+	return len(p), nil
+}
+
+// refreshFile is /dev/draw/n/refresh. The simulator never has anything to
+// refresh, so reads block until it's closed.
+type refreshFile struct{ drawFile }
+
+func (f *refreshFile) Read(p []byte) (int, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	for f.check() == nil {
+		f.s.changed.Wait()
+	}
+	if f.closed {
+		return 0, io.EOF
+	}
+	return 0, f.check()
+}
+
+func (f *refreshFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// dataFile is /dev/draw/n/data.
+type dataFile struct{ drawFile }
+
+// Read returns the reply to the last 'r' message. As with 9P, no more
+// than the iounit is read at once, and devdraw fails a read of less than
+// the whole reply.
+func (f *dataFile) Read(p []byte) (int, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	if f.c.readback == nil {
+		return 0, io.EOF
+	}
+	reply := f.c.readback
+	f.c.readback = nil
+	if n := f.s.iounit(); len(p) > n {
+		p = p[:n]
+	}
+	if len(p) < len(reply) {
+		return 0, errShortRead
+	}
+	return copy(p, reply), nil
+}
+
+// Write handles the messages in p. The kernel splits a write that's bigger
+// than the iounit, and devdraw fails one that ends part of the way
+// through a message, so the same is done here. The messages before one
+// that's rejected have still been handled.
+func (f *dataFile) Write(p []byte) (int, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	for n := 0; n < len(p); {
+		end := n + f.s.iounit()
+		if end > len(p) {
+			end = len(p)
+		}
+		for m := p[n:end]; len(m) > 0; {
+			size, err := f.s.message(f.c, m)
+			if err != nil {
+				f.s.errs = append(f.s.errs, fmt.Errorf("draw/%d/data: '%c' message: %v", f.c.id, m[0], err))
+				return n, err
+			}
+			m = m[1+size:]
+		}
+		n = end
+	}
+	return len(p), nil
+}
+
+// image returns the image id of c.
+func (c *conn) image(id uint32) (*drawImage, error) {
+	if i, ok := c.images[id]; ok {
+		return i, nil
+	}
+	return nil, errNoImage
+}
+
+func getRect(b []byte) image.Rectangle {
+	return image.Rectangle{getPoint(b), getPoint(b[8:])}
+}
+
+func getPoint(b []byte) image.Point {
+	return image.Pt(int(int32(binary.LittleEndian.Uint32(b))), int(int32(binary.LittleEndian.Uint32(b[4:]))))
+}
+
+// message handles the message at the start of m on the connection c, and
+// returns the size of its arguments. It must be called with s.mu held.
+func (s *Sim) message(c *conn, m []byte) (int, error) {
+	cmd, a := m[0], m[1:]
+	size, ok := msgSizes[cmd]
+	if !ok {
+		return 0, errors.New("bad draw command")
+	}
+	if len(a) < size {
+		return 0, errShortDraw
+	}
+	u32 := binary.LittleEndian.Uint32
+	// the drawing messages use the operator that the last 'O' message
+	// set, and put it back to the default.
+	op := c.op
+	switch cmd {
+	case 'd', 'e', 'E', 'L', 's', 'x':
+		c.op = opSoverD
+	}
+
+	switch cmd {
+	case 'A':
+		// A id[4] imageid[4] fillid[4] public[1]
+		id := u32(a)
+		if _, ok := s.screens[id]; ok {
+			return 0, errScreenExists
+		}
+		i, err := c.image(u32(a[4:]))
+		if err != nil {
+			return 0, err
+		}
+		if _, err := c.image(u32(a[8:])); err != nil {
+			return 0, err
+		}
+		s.screens[id] = &screen{c: c, image: i}
+
+	case 'F':
+		// F id[4]
+		if scr, ok := s.screens[u32(a)]; !ok || scr.c != c {
+			return 0, errNoScreen
+		}
+		delete(s.screens, u32(a))
+
+	case 'O':
+		// O op[1]
+		c.op = a[0]
+
+	case 'b':
+		// b id[4] screenid[4] refresh[1] chan[4] repl[1] r[4*4] clipr[4*4] color[4]
+		id := u32(a)
+		if _, ok := c.images[id]; ok {
+			return 0, errImageExists
+		}
+		f, err := parseFormat(u32(a[9:]))
+		if err != nil {
+			return 0, err
+		}
+		i := &drawImage{r: getRect(a[14:]), clipr: getRect(a[30:]), repl: a[13] != 0}
+		// the colour is sent as 0xRRGGBBAA.
+		rgba := u32(a[46:])
+		col := color.RGBA{uint8(rgba >> 24), uint8(rgba >> 16), uint8(rgba >> 8), uint8(rgba)}
+		if sid := u32(a[4:]); sid != 0 {
+			// a window is drawn straight onto its screen's image.
+			// Windows aren't layered, or given a backing store.
+			scr, ok := s.screens[sid]
+			if !ok {
+				return 0, errNoScreen
+			}
+			if scr.image.pix.f.desc != f.desc {
+				return 0, errBadChan
+			}
+			i.pix = scr.image.pix
+		} else {
+			i.pix = newPixels(f, i.r)
+		}
+		i.pix.fill(i.r, f.pixel(col))
+		c.images[id] = i
+
+	case 'c':
+		// c dstid[4] repl[1] clipr[4*4]
+		i, err := c.image(u32(a))
+		if err != nil {
+			return 0, err
+		}
+		i.repl = a[4] != 0
+		i.clipr = getRect(a[5:])
+
+	case 'd':
+		// d dstid[4] srcid[4] maskid[4] dstr[4*4] srcp[2*4] maskp[2*4]
+		var imgs [3]*drawImage
+		for j := range imgs {
+			var err error
+			if imgs[j], err = c.image(u32(a[4*j:])); err != nil {
+				return 0, err
+			}
+		}
+		composite(imgs[0], imgs[1], imgs[2], getRect(a[12:]), getPoint(a[28:]), getPoint(a[36:]), op)
+
+	case 'e', 'E', 'L':
+		// e dstid[4] srcid[4] ...
+		// L dstid[4] p0[2*4] p1[2*4] end0[4] end1[4] thick[4] srcid[4] sp[2*4]
+		src := 4
+		if cmd == 'L' {
+			src = 32
+		}
+		for _, off := range []int{0, src} {
+			if _, err := c.image(u32(a[off:])); err != nil {
+				return 0, err
+			}
+		}
+
+	case 'f':
+		// f id[4]
+		if _, err := c.image(u32(a)); err != nil {
+			return 0, err
+		}
+		delete(c.images, u32(a))
+
+	case 'i':
+		// i id[4] n[4] ascent[1]
+		i, err := c.image(u32(a))
+		if err != nil {
+			return 0, err
+		}
+		i.nchars = int(u32(a[4:]))
+
+	case 'l':
+		// l cacheid[4] srcid[4] index[2] r[4*4] sp[2*4] left[1] width[1]
+		cache, err := c.image(u32(a))
+		if err != nil {
+			return 0, err
+		}
+		if _, err := c.image(u32(a[4:])); err != nil {
+			return 0, err
+		}
+		if cache.nchars == 0 {
+			return 0, errNotFont
+		}
+		if int(binary.LittleEndian.Uint16(a[8:])) >= cache.nchars {
+			return 0, errIndex
+		}
+
+	case 'n':
+		// n id[4] j[1] name[j]
+		j := int(a[4])
+		if len(a) < 5+j {
+			return 0, errShortDraw
+		}
+		size += j
+		if string(a[5:5+j]) != s.winname {
+			return 0, errNoName
+		}
+		// the window's image is the part of the display that it
+		// covers. Attaching a name to an ID that's already in use,
+		// as the driver does with ID 0, replaces what it refers to.
+		c.images[u32(a)] = &drawImage{pix: s.display, r: s.window, clipr: s.window}
+
+	case 'r':
+		// r id[4] r[4*4]
+		i, err := c.image(u32(a))
+		if err != nil {
+			return 0, err
+		}
+		r := getRect(a[4:])
+		if !r.In(i.r) {
+			return 0, errReadOutside
+		}
+		c.readback = i.pix.unload(r)
+
+	case 's', 'x':
+		// s dstid[4] srcid[4] fontid[4] p[2*4] clipr[4*4] sp[2*4] n[2] index[n*2]
+		// x dstid[4] srcid[4] fontid[4] p[2*4] clipr[4*4] sp[2*4] n[2] bgid[4] bgp[2*4] index[n*2]
+		n := int(binary.LittleEndian.Uint16(a[44:]))
+		if len(a) < size+2*n {
+			return 0, errShortDraw
+		}
+		ids := []int{0, 4}
+		if cmd == 'x' {
+			ids = append(ids, 46)
+		}
+		for _, off := range ids {
+			if _, err := c.image(u32(a[off:])); err != nil {
+				return 0, err
+			}
+		}
+		font, err := c.image(u32(a[8:]))
+		if err != nil {
+			return 0, err
+		}
+		if font.nchars == 0 {
+			return 0, errNotFont
+		}
+		for k := 0; k < n; k++ {
+			if int(binary.LittleEndian.Uint16(a[size+2*k:])) >= font.nchars {
+				return 0, errIndex
+			}
+		}
+		size += 2 * n
+
+	case 'v':
+		s.flushed = s.display.clone()
+
+	case 'y', 'Y':
+		// y id[4] r[4*4] buf[x*1]
+		// Y id[4] r[4*4] buf[x*1]
+		i, err := c.image(u32(a))
+		if err != nil {
+			return 0, err
+		}
+		r := getRect(a[4:])
+		if !r.In(i.r) {
+			return 0, errWriteOutside
+		}
+		n := bytesPerLine(r, i.pix.f.depth) * r.Dy()
+		data := a[size:]
+		if cmd == 'Y' {
+			out := make([]byte, n)
+			if n, err = decompress(out, data); err != nil {
+				return 0, err
+			}
+			data = out
+		} else if len(data) < n {
+			return 0, errShortDraw
+		}
+		i.pix.load(r, data)
+		size += n
+	}
+	return size, nil
+}
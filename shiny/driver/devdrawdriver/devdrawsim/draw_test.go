@@ -0,0 +1,329 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawsim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+const chanABGR32 = 0x48281808
+
+// msg builds a message from cmd and its arguments, which are each a
+// uint32, a byte, an image.Rectangle, an image.Point or a []byte.
+func msg(cmd byte, args ...interface{}) []byte {
+	b := []byte{cmd}
+	le := binary.LittleEndian
+	for _, a := range args {
+		switch a := a.(type) {
+		case uint32:
+			b = le.AppendUint32(b, a)
+		case byte:
+			b = append(b, a)
+		case image.Rectangle:
+			for _, v := range []int{a.Min.X, a.Min.Y, a.Max.X, a.Max.Y} {
+				b = le.AppendUint32(b, uint32(v))
+			}
+		case image.Point:
+			b = le.AppendUint32(le.AppendUint32(b, uint32(a.X)), uint32(a.Y))
+		case []byte:
+			b = append(b, a...)
+		default:
+			panic("bad argument")
+		}
+	}
+	return b
+}
+
+// alloc returns a 'b' message for an off screen a8b8g8r8 image filled
+// with rgba, which is 0xRRGGBBAA.
+func alloc(id uint32, repl byte, r, clipr image.Rectangle, rgba uint32) []byte {
+	return msg('b', id, uint32(0), byte(0), uint32(chanABGR32), repl, r, clipr, rgba)
+}
+
+// open makes a connection to s, and returns its ctl and data files.
+func open(t *testing.T, s *Sim) (ctl, data io.ReadWriteCloser) {
+	t.Helper()
+	ctl, err := s.OpenFile("/dev/draw/new", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the connection's number is the first field of its ctl file.
+	buf := make([]byte, 256)
+	n, err := ctl.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = s.OpenFile("/dev/draw/"+strings.Fields(string(buf[:n]))[0]+"/data", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctl, data
+}
+
+func write(t *testing.T, f io.Writer, msgs ...[]byte) {
+	t.Helper()
+	if _, err := f.Write(bytes.Join(msgs, nil)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCtl(t *testing.T) {
+	s := New(image.Rect(0, 0, 640, 480), image.Rect(10, 10, 110, 110))
+	ctl, data := open(t, s)
+	buf := make([]byte, 256)
+	n, err := ctl.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Fields(string(buf[:n])), strings.Fields("1 0 x8r8g8b8 0 0 0 640 480 0 0 640 480"); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("read %q from /dev/draw/new, want the display", buf[:n])
+	}
+	if n != 12*12 {
+		t.Errorf("read %d bytes, want 12 fields of 12", n)
+	}
+
+	write(t, data, alloc(2, 1, image.Rect(0, 0, 1, 1), image.Rect(-5, -5, 5, 5), 0))
+	if _, err := ctl.Write(le32(2)); err != nil {
+		t.Fatal(err)
+	}
+	n, _ = ctl.Read(buf)
+	if got := strings.Join(strings.Fields(string(buf[:n])), " "); got != "1 2 a8b8g8r8 1 0 0 1 1 -5 -5 5 5" {
+		t.Errorf("image 2 is %q", got)
+	}
+	// it's the display again after the read.
+	n, _ = ctl.Read(buf)
+	if got := strings.Fields(string(buf[:n])); got[1] != "0" {
+		t.Errorf("read %q after describing image 2, want the display", got)
+	}
+	if _, err := ctl.Write(le32(3)); err != errNoImage {
+		t.Errorf("selecting an unknown image: got %v, want %v", err, errNoImage)
+	}
+}
+
+func le32(v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
+
+func TestDraw(t *testing.T) {
+	s := New(image.Rect(0, 0, 64, 48), image.Rect(10, 10, 50, 40))
+	_, data := open(t, s)
+	r := image.Rect(0, 0, 2, 2)
+	pix := []byte{
+		0xFF, 0, 0, 0xFF, 0, 0xFF, 0, 0xFF,
+		0, 0, 0xFF, 0xFF, 0, 0, 0, 0,
+	}
+	write(t, data,
+		alloc(2, 0, r, r, 0),
+		msg('y', uint32(2), r, pix),
+		// a mask that's half transparent everywhere.
+		alloc(3, 1, image.Rect(0, 0, 1, 1), image.Rect(-1e6, -1e6, 1e6, 1e6), 0x00000080),
+		msg('n', uint32(0), byte(len("window.1.1")), []byte("window.1.1")),
+		msg('d', uint32(0), uint32(2), uint32(2), image.Rect(20, 20, 22, 22), image.Pt(0, 0), image.Pt(0, 0)),
+		msg('d', uint32(0), uint32(2), uint32(3), image.Rect(30, 20, 32, 22), image.Pt(0, 0), image.Pt(0, 0)),
+		// the destination is clipped to the window.
+		msg('d', uint32(0), uint32(2), uint32(2), image.Rect(9, 20, 11, 22), image.Pt(0, 0), image.Pt(0, 0)),
+	)
+	if got := s.Screen().RGBAAt(20, 20); got != (color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}) {
+		t.Errorf("the display changed before it was flushed: %v", got)
+	}
+	write(t, data, msg('v'))
+	m := s.Screen()
+	for _, tc := range []struct {
+		p    image.Point
+		want color.RGBA
+	}{
+		{image.Pt(20, 20), color.RGBA{0xFF, 0, 0, 0xFF}},
+		{image.Pt(21, 20), color.RGBA{0, 0xFF, 0, 0xFF}},
+		{image.Pt(20, 21), color.RGBA{0, 0, 0xFF, 0xFF}},
+		// the transparent pixel leaves the display as it was.
+		{image.Pt(21, 21), color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}},
+		{image.Pt(30, 20), color.RGBA{0xFF, 0x7F, 0x7F, 0xFF}},
+		{image.Pt(9, 20), color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}},
+		{image.Pt(10, 20), color.RGBA{0, 0xFF, 0, 0xFF}},
+	} {
+		if got := m.RGBAAt(tc.p.X, tc.p.Y); got != tc.want {
+			t.Errorf("pixel at %v is %v, want %v", tc.p, got, tc.want)
+		}
+	}
+
+	// the pixels are read back as they were written.
+	write(t, data, msg('r', uint32(2), r))
+	got := make([]byte, 100)
+	n, err := data.Read(got)
+	if err != nil || !bytes.Equal(got[:n], pix) {
+		t.Errorf("read back % x, %v, want % x", got[:n], err, pix)
+	}
+	// the display is x8r8g8b8.
+	write(t, data, msg('r', uint32(0), image.Rect(20, 20, 21, 21)))
+	if n, _ := data.Read(got); !bytes.Equal(got[:n], []byte{0, 0, 0xFF, 0}) {
+		t.Errorf("read back % x from the display, want red", got[:n])
+	}
+	if len(s.Errors()) != 0 {
+		t.Errorf("got errors %v", s.Errors())
+	}
+}
+
+func TestDrawOp(t *testing.T) {
+	s := New(image.Rect(0, 0, 8, 8), image.Rect(0, 0, 8, 8))
+	_, data := open(t, s)
+	one := image.Rect(0, 0, 1, 1)
+	write(t, data,
+		alloc(2, 0, one, one, 0xFF0000FF),
+		alloc(3, 0, one, one, 0x00000080),
+		alloc(4, 0, one, one, 0xFFFFFFFF),
+		// S replaces the destination, even with alpha.
+		msg('O', byte(opSinD|opSoutD)),
+		msg('d', uint32(2), uint32(3), uint32(4), one, image.ZP, image.ZP),
+		// and the operator only lasts for one message.
+		msg('d', uint32(4), uint32(3), uint32(4), one, image.ZP, image.ZP),
+		msg('r', uint32(2), one),
+	)
+	got := make([]byte, 4)
+	if _, err := data.Read(got); err != nil || !bytes.Equal(got, []byte{0, 0, 0, 0x80}) {
+		t.Errorf("S drew % x, %v, want the source", got, err)
+	}
+	write(t, data, msg('r', uint32(4), one))
+	if _, err := data.Read(got); err != nil || !bytes.Equal(got, []byte{0x7F, 0x7F, 0x7F, 0xFF}) {
+		t.Errorf("SoverD drew % x, %v, want white half covered by black", got, err)
+	}
+}
+
+func TestDrawRepl(t *testing.T) {
+	s := New(image.Rect(0, 0, 8, 8), image.Rect(0, 0, 8, 8))
+	_, data := open(t, s)
+	// a 2x1 tile, red then green, which is only replicated across.
+	tile := image.Rect(0, 0, 2, 1)
+	dst := image.Rect(0, 0, 5, 2)
+	write(t, data,
+		alloc(2, 1, tile, image.Rect(0, 0, 100, 1), 0),
+		msg('y', uint32(2), tile, []byte{0xFF, 0, 0, 0xFF, 0, 0xFF, 0, 0xFF}),
+		alloc(3, 0, dst, dst, 0),
+		msg('d', uint32(3), uint32(2), uint32(2), dst, image.Pt(1, 0), image.Pt(1, 0)),
+		msg('r', uint32(3), dst),
+	)
+	got := make([]byte, 5*2*4)
+	if _, err := data.Read(got); err != nil {
+		t.Fatal(err)
+	}
+	r, g := []byte{0xFF, 0, 0, 0xFF}, []byte{0, 0xFF, 0, 0xFF}
+	want := bytes.Join([][]byte{g, r, g, r, g, make([]byte, 5*4)}, nil)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	s := New(image.Rect(0, 0, 8, 8), image.Rect(0, 0, 8, 8))
+	_, data := open(t, s)
+	r := image.Rect(0, 0, 4, 1)
+	// a literal pixel, then 12 bytes copied from 4 back, then a 'v'
+	// which has to be found after the compressed data.
+	compressed := []byte{0x83, 1, 2, 3, 4, 9<<2 | 0, 3}
+	write(t, data,
+		alloc(2, 0, r, r, 0),
+		msg('Y', uint32(2), r, compressed),
+		msg('v'),
+		msg('r', uint32(2), r),
+	)
+	got := make([]byte, 16)
+	if _, err := data.Read(got); err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Repeat([]byte{1, 2, 3, 4}, 4); !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+
+	if _, err := data.Write(msg('Y', uint32(2), r, []byte{0x83, 1, 2, 3, 4, 9<<2 | 0, 4})); err != errBadCompression {
+		t.Errorf("back reference before the start: got %v, want %v", err, errBadCompression)
+	}
+}
+
+func TestRejected(t *testing.T) {
+	s := New(image.Rect(0, 0, 8, 8), image.Rect(0, 0, 8, 8))
+	s.IOUnit = 64
+	_, data := open(t, s)
+	one := image.Rect(0, 0, 1, 1)
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+		want error
+	}{
+		{"unknown image", msg('f', uint32(7)), errNoImage},
+		{"image in use", alloc(0, 0, one, one, 0), errImageExists},
+		{"short", msg('f', []byte{1, 0}), errShortDraw},
+		{"split by the iounit", bytes.Join([][]byte{alloc(2, 0, one, one, 0), alloc(3, 0, one, one, 0)}, nil), errShortDraw},
+		{"outside", msg('r', uint32(0), image.Rect(0, 0, 9, 1)), errReadOutside},
+		{"unknown name", msg('n', uint32(5), byte(1), []byte("x")), errNoName},
+		{"unknown screen", msg('F', uint32(3)), errNoScreen},
+		{"not a font", msg('l', uint32(2), uint32(2), []byte{0, 0}, one, image.ZP, byte(0), byte(1)), errNotFont},
+	} {
+		if _, err := data.Write(tc.msg); err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	// the image in the first half of the split write was allocated.
+	if _, err := data.Write(msg('f', uint32(2))); err != nil {
+		t.Errorf("freeing image 2: %v", err)
+	}
+	if got := len(s.Errors()); got != 8 {
+		t.Errorf("recorded %d errors, want 8: %v", got, s.Errors())
+	}
+
+	// a read that's smaller than the reply fails.
+	write(t, data, msg('r', uint32(0), image.Rect(0, 0, 2, 1)))
+	if _, err := data.Read(make([]byte, 4)); err != errShortRead {
+		t.Errorf("short read: got %v, want %v", err, errShortRead)
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	s := New(image.Rect(0, 0, 8, 8), image.Rect(0, 0, 8, 8))
+	ctl, data := open(t, s)
+	write(t, data, msg('A', uint32(1), uint32(0), uint32(0), byte(0)))
+	proc := readAll(t, s, "/proc/42/fd")
+	if !strings.Contains(proc, " 8192 ") || !strings.HasSuffix(proc, " /dev/draw/1/data\n") {
+		t.Errorf("/proc/42/fd is %q, want the data file with its iounit", proc)
+	}
+
+	ctl.Close()
+	data.Close()
+	if n := s.Conns(); n != 0 {
+		t.Errorf("%d connections are open", n)
+	}
+	if _, err := s.OpenFile("/dev/draw/1/data", os.O_RDWR); !os.IsNotExist(err) {
+		t.Errorf("opening the closed connection's data file: got %v, want it not to exist", err)
+	}
+	// the screen was freed along with the connection.
+	_, data = open(t, s)
+	if _, err := data.Write(msg('A', uint32(1), uint32(0), uint32(0), byte(0))); err != nil {
+		t.Errorf("allocating screen 1 again: %v", err)
+	}
+
+	s.Hangup()
+	if _, err := data.Write(msg('v')); err != errHungup {
+		t.Errorf("writing after a hangup: got %v, want %v", err, errHungup)
+	}
+}
+
+func readAll(t *testing.T, s *Sim, name string) string {
+	t.Helper()
+	f, err := s.OpenFile(name, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,431 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawsim
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"strconv"
+)
+
+// The channel types in a channel descriptor, as described in image(6).
+const (
+	cRed = iota
+	cGreen
+	cBlue
+	cGrey
+	cAlpha
+	cMap
+	cIgnore
+)
+
+// chanNames are the letters that name the channel types in the string
+// form of a channel descriptor, such as "x8r8g8b8".
+const chanNames = "rgbkamx"
+
+// chanXRGB32 is the channel descriptor of the display, x8r8g8b8, which is
+// what rio usually runs on.
+const chanXRGB32 = 0x68081828
+
+var errBadChan = errors.New("bad channel descriptor")
+
+// channel is one of the channels of a pixel format.
+type channel struct {
+	typ  uint
+	bits uint
+}
+
+// format is the pixel format given by a channel descriptor.
+type format struct {
+	desc uint32
+	// chans are the channels from the least significant bits of a pixel
+	// up, which is the opposite order to the descriptor's.
+	chans []channel
+	depth int
+	alpha bool
+}
+
+// parseFormat returns the format of the channel descriptor desc, as sent
+// in a 'b' message.
+func parseFormat(desc uint32) (format, error) {
+	f := format{desc: desc}
+	for d := desc; d != 0; d >>= 8 {
+		c := channel{typ: uint(d>>4) & 15, bits: uint(d & 15)}
+		if c.typ > cIgnore || c.bits == 0 {
+			return format{}, errBadChan
+		}
+		f.chans = append(f.chans, c)
+		f.depth += int(c.bits)
+		f.alpha = f.alpha || c.typ == cAlpha
+	}
+	// a pixel has to take up a whole number of bytes, or a byte a whole
+	// number of pixels.
+	switch f.depth {
+	case 1, 2, 4, 8, 16, 24, 32:
+		return f, nil
+	}
+	return format{}, errBadChan
+}
+
+// String returns the descriptor in the form that ctl files use.
+func (f format) String() string {
+	var b []byte
+	for i := len(f.chans) - 1; i >= 0; i-- {
+		b = append(b, chanNames[f.chans[i].typ])
+		b = strconv.AppendUint(b, uint64(f.chans[i].bits), 10)
+	}
+	return string(b)
+}
+
+// rgba returns the colour of the pixel value v. The colours in an image
+// with an alpha channel are premultiplied, the same as color.RGBA, and
+// ones without are opaque. A colour map is treated as grey, since the
+// simulator doesn't have Plan 9's colour map.
+func (f format) rgba(v uint32) color.RGBA {
+	c := color.RGBA{A: 0xFF}
+	for _, ch := range f.chans {
+		max := uint32(1)<<ch.bits - 1
+		x := uint8(v & max * 0xFF / max)
+		v >>= ch.bits
+		switch ch.typ {
+		case cRed:
+			c.R = x
+		case cGreen:
+			c.G = x
+		case cBlue:
+			c.B = x
+		case cGrey, cMap:
+			c.R, c.G, c.B = x, x, x
+		case cAlpha:
+			c.A = x
+		}
+	}
+	return c
+}
+
+// pixel returns the pixel value of the colour c. The alpha of c is
+// dropped if the format has no alpha channel.
+func (f format) pixel(c color.RGBA) uint32 {
+	var v uint32
+	shift := uint(0)
+	for _, ch := range f.chans {
+		var x uint8
+		switch ch.typ {
+		case cRed:
+			x = c.R
+		case cGreen:
+			x = c.G
+		case cBlue:
+			x = c.B
+		case cGrey, cMap:
+			x = grey(c)
+		case cAlpha:
+			x = c.A
+		}
+		max := uint32(1)<<ch.bits - 1
+		v |= (uint32(x)*max + 0x7F) / 0xFF << shift
+		shift += ch.bits
+	}
+	return v
+}
+
+// coverage returns how much a mask with the colour c lets through: its
+// alpha if the format has an alpha channel, or else its grey level.
+func (f format) coverage(c color.RGBA) uint8 {
+	if f.alpha {
+		return c.A
+	}
+	return grey(c)
+}
+
+func grey(c color.RGBA) uint8 {
+	return uint8((299*uint32(c.R) + 587*uint32(c.G) + 114*uint32(c.B)) / 1000)
+}
+
+// floor8 and ceil8 round a number of bits down and up to a whole byte.
+func floor8(b int) int {
+	if b < 0 {
+		return -ceil8(-b)
+	}
+	return b &^ 7
+}
+
+func ceil8(b int) int {
+	if b < 0 {
+		return -floor8(-b)
+	}
+	return (b + 7) &^ 7
+}
+
+// bytesPerLine is the length of a row of r in the layout of 'y' and 'r'
+// messages, where a row starts with the byte that holds its first pixel
+// and ends with the one that holds its last.
+func bytesPerLine(r image.Rectangle, depth int) int {
+	return (ceil8(r.Max.X*depth) - floor8(r.Min.X*depth)) / 8
+}
+
+// getPixel returns the pixel value at bit in row. Pixels smaller than a
+// byte are packed from its most significant bit, and bigger ones are
+// little endian.
+func getPixel(row []byte, bit, depth int) uint32 {
+	if depth >= 8 {
+		var v uint32
+		for i := 0; i < depth/8; i++ {
+			v |= uint32(row[bit/8+i]) << (8 * uint(i))
+		}
+		return v
+	}
+	shift := uint(8 - depth - bit%8)
+	return uint32(row[bit/8]>>shift) & (1<<uint(depth) - 1)
+}
+
+// setPixel is the counterpart of getPixel.
+func setPixel(row []byte, bit, depth int, v uint32) {
+	if depth >= 8 {
+		for i := 0; i < depth/8; i++ {
+			row[bit/8+i] = byte(v >> (8 * uint(i)))
+		}
+		return
+	}
+	shift := uint(8 - depth - bit%8)
+	m := byte(1<<uint(depth)-1) << shift
+	row[bit/8] = row[bit/8]&^m | byte(v)<<shift&m
+}
+
+// pixels is the memory that holds an image's pixels, in the same layout
+// as 'y' and 'r' messages. More than one image can share it, such as
+// the window that an 'n' message names, which is part of the display.
+type pixels struct {
+	f    format
+	r    image.Rectangle
+	data []byte
+}
+
+func newPixels(f format, r image.Rectangle) *pixels {
+	return &pixels{f: f, r: r, data: make([]byte, bytesPerLine(r, f.depth)*r.Dy())}
+}
+
+// row returns the row y, and the bit in it that the pixel at x starts at.
+func (p *pixels) row(x, y int) ([]byte, int) {
+	bpl := bytesPerLine(p.r, p.f.depth)
+	return p.data[(y-p.r.Min.Y)*bpl:], x*p.f.depth - floor8(p.r.Min.X*p.f.depth)
+}
+
+func (p *pixels) at(x, y int) uint32 {
+	row, bit := p.row(x, y)
+	return getPixel(row, bit, p.f.depth)
+}
+
+func (p *pixels) set(x, y int, v uint32) {
+	row, bit := p.row(x, y)
+	setPixel(row, bit, p.f.depth, v)
+}
+
+// fill sets the pixels in r to v.
+func (p *pixels) fill(r image.Rectangle, v uint32) {
+	r = r.Intersect(p.r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			p.set(x, y, v)
+		}
+	}
+}
+
+// load sets the pixels in r from data, which is in the layout of a 'y'
+// message. Any part of r outside p is skipped.
+func (p *pixels) load(r image.Rectangle, data []byte) {
+	bpl := bytesPerLine(r, p.f.depth)
+	in := r.Intersect(p.r)
+	for y := in.Min.Y; y < in.Max.Y; y++ {
+		row := data[(y-r.Min.Y)*bpl:]
+		for x := in.Min.X; x < in.Max.X; x++ {
+			p.set(x, y, getPixel(row, x*p.f.depth-floor8(r.Min.X*p.f.depth), p.f.depth))
+		}
+	}
+}
+
+// unload is the counterpart of load, for an 'r' message.
+func (p *pixels) unload(r image.Rectangle) []byte {
+	bpl := bytesPerLine(r, p.f.depth)
+	data := make([]byte, bpl*r.Dy())
+	in := r.Intersect(p.r)
+	for y := in.Min.Y; y < in.Max.Y; y++ {
+		row := data[(y-r.Min.Y)*bpl:]
+		for x := in.Min.X; x < in.Max.X; x++ {
+			setPixel(row, x*p.f.depth-floor8(r.Min.X*p.f.depth), p.f.depth, p.at(x, y))
+		}
+	}
+	return data
+}
+
+// rgba returns a copy of the pixels as an image.RGBA.
+func (p *pixels) rgba() *image.RGBA {
+	m := image.NewRGBA(p.r)
+	for y := p.r.Min.Y; y < p.r.Max.Y; y++ {
+		for x := p.r.Min.X; x < p.r.Max.X; x++ {
+			m.SetRGBA(x, y, p.f.rgba(p.at(x, y)))
+		}
+	}
+	return m
+}
+
+func (p *pixels) clone() *pixels {
+	return &pixels{f: p.f, r: p.r, data: append([]byte(nil), p.data...)}
+}
+
+// drawImage is what an image ID refers to.
+type drawImage struct {
+	pix   *pixels
+	r     image.Rectangle
+	clipr image.Rectangle
+	repl  bool
+	// nchars is the number of characters in the font cache that an 'i'
+	// message made the image into, or 0 if it isn't one.
+	nchars int
+}
+
+// sample returns the colour of i at p, which is wrapped into i.r if i is
+// replicated. It reports false if p is clipped.
+func (i *drawImage) sample(p image.Point) (color.RGBA, bool) {
+	if !p.In(i.clipr) {
+		return color.RGBA{}, false
+	}
+	if i.repl {
+		if i.r.Empty() {
+			return color.RGBA{}, false
+		}
+		p.X = i.r.Min.X + mod(p.X-i.r.Min.X, i.r.Dx())
+		p.Y = i.r.Min.Y + mod(p.Y-i.r.Min.Y, i.r.Dy())
+	}
+	if !p.In(i.r) || !p.In(i.pix.r) {
+		return color.RGBA{}, false
+	}
+	return i.pix.f.rgba(i.pix.at(p.X, p.Y)), true
+}
+
+func mod(a, b int) int {
+	if a %= b; a < 0 {
+		a += b
+	}
+	return a
+}
+
+// The bits of the compositing operators, as described in draw(2).
+const (
+	opDoutS = 1 << iota
+	opSoutD
+	opDinS
+	opSinD
+	opSoverD = opSinD | opSoutD | opDoutS
+)
+
+// composite does the work of a 'd' message, which draws src through mask
+// into r of dst with the compositing operator op. sp and mp are the
+// points of src and mask that are drawn at r.Min. Every point of r that
+// is clipped in dst, src or mask is left as it was. Each channel of the
+// destination becomes
+//
+//	m*(S*Fs + D*Fd) + (1-m)*D
+//
+// where m is the coverage of the mask, S and D are the source and
+// destination, and Fs and Fd are given by the bits of op.
+func composite(dst, src, mask *drawImage, r image.Rectangle, sp, mp image.Point, op uint8) {
+	// sp and mp stay lined up with r.Min when r is clipped.
+	sp, mp = sp.Sub(r.Min), mp.Sub(r.Min)
+	r = r.Intersect(dst.r).Intersect(dst.clipr).Intersect(dst.pix.r)
+	// every pixel is worked out before any is set, since src or mask
+	// may be dst, or share its pixels.
+	type result struct {
+		p image.Point
+		v uint32
+	}
+	var out []result
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			p := image.Pt(x, y)
+			s, ok := src.sample(sp.Add(p))
+			if !ok {
+				continue
+			}
+			mc, ok := mask.sample(mp.Add(p))
+			if !ok {
+				continue
+			}
+			m := uint32(mask.pix.f.coverage(mc))
+			dc := dst.pix.f.rgba(dst.pix.at(x, y))
+			var fs, fd uint32
+			if op&opSinD != 0 {
+				fs += uint32(dc.A)
+			}
+			if op&opSoutD != 0 {
+				fs += 0xFF - uint32(dc.A)
+			}
+			if op&opDinS != 0 {
+				fd += uint32(s.A)
+			}
+			if op&opDoutS != 0 {
+				fd += 0xFF - uint32(s.A)
+			}
+			blend := func(s, d uint8) uint8 {
+				v := (uint32(s)*fs + uint32(d)*fd) / 0xFF
+				if v > 0xFF {
+					v = 0xFF
+				}
+				return uint8((m*v + (0xFF-m)*uint32(d)) / 0xFF)
+			}
+			c := color.RGBA{blend(s.R, dc.R), blend(s.G, dc.G), blend(s.B, dc.B), blend(s.A, dc.A)}
+			out = append(out, result{p, dst.pix.f.pixel(c)})
+		}
+	}
+	for _, o := range out {
+		dst.pix.set(o.p.X, o.p.Y, o.v)
+	}
+}
+
+var errBadCompression = errors.New("bad compressed image data")
+
+// decompress decodes the start of data, which is compressed as described
+// in image(6), into out, and returns how many bytes of data that took. A
+// byte with its top bit set is followed by that many bytes, less 0x80 and
+// plus 1, which are copied as they are. Any other byte and the one after
+// it copy what's already been decoded: the top 6 bits are the length,
+// less 3, and the other 10 how far back it starts, less 1.
+func decompress(out, data []byte) (int, error) {
+	o, i := 0, 0
+	for o < len(out) {
+		if i >= len(data) {
+			return 0, errShortDraw
+		}
+		c := data[i]
+		if c&0x80 != 0 {
+			n := int(c&0x7F) + 1
+			if i+1+n > len(data) {
+				return 0, errShortDraw
+			}
+			if o+n > len(out) {
+				return 0, errBadCompression
+			}
+			copy(out[o:], data[i+1:i+1+n])
+			i += 1 + n
+			o += n
+			continue
+		}
+		if i+1 >= len(data) {
+			return 0, errShortDraw
+		}
+		n := int(c>>2) + 3
+		off := (int(c&3)<<8 | int(data[i+1])) + 1
+		if off > o || o+n > len(out) {
+			return 0, errBadCompression
+		}
+		for j := 0; j < n; j++ {
+			out[o] = out[o-off]
+			o++
+		}
+		i += 2
+	}
+	return i, nil
+}
@@ -0,0 +1,478 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package devdrawsim simulates the files that a Plan 9 program running in
+// a rio window uses to draw and read input, so that the devdraw driver
+// can be tested without a Plan 9 kernel.
+//
+// A Sim serves /dev/draw, as draw(3) describes it, and the window's
+// files from rio(4): /dev/mouse, /dev/cons, /dev/consctl, /dev/kbd,
+// /dev/wctl, /dev/winname, /dev/label and /dev/snarf, along with
+// /proc/n/fd for the iounit of the draw data files. Messages to /dev/draw
+// are checked as devdraw checks them, and the ones that draw images are
+// drawn, apart from text, lines and ellipses. Input is sent to the
+// program with methods such as Mouse and Type.
+package devdrawsim // import "github.com/niconan/shiny-plan9/shiny/driver/devdrawdriver/devdrawsim"
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Sim is a simulated Plan 9 window, along with the display that it's on.
+// Its files are opened with OpenFile.
+type Sim struct {
+	// IOUnit is the iounit of the draw data files, which is 8192 by
+	// default. It must be set before a file is opened.
+	IOUnit int
+	// NoKbd makes /dev/kbd not exist, as on Plan 9 other than 9front, so
+	// that the keyboard is read from /dev/cons. It must be set before a
+	// file is opened.
+	NoKbd bool
+
+	start time.Time
+
+	mu sync.Mutex
+	// changed is broadcast when a file is closed, or the state in
+	// /dev/wctl changes.
+	changed *sync.Cond
+	display *pixels
+	// flushed is the display as it was at the last 'v' message.
+	flushed *pixels
+	window  image.Rectangle
+	winname string
+	wingen  int
+	current bool
+	// wctlGen is incremented whenever the state in /dev/wctl changes.
+	wctlGen  int
+	conns    map[int]*conn
+	nextConn int
+	screens  map[uint32]*screen
+	errs     []error
+	label    string
+	snarf    string
+	mouse    image.Point
+	inputs   map[string]*input
+}
+
+// New returns a Sim with a display covering display, and a window,
+// including its border, covering window. The display is filled with white.
+func New(display, window image.Rectangle) *Sim {
+	f, _ := parseFormat(chanXRGB32)
+	s := &Sim{
+		IOUnit:  8192,
+		start:   time.Now(),
+		display: newPixels(f, display),
+		window:  window,
+		current: true,
+		conns:   make(map[int]*conn),
+		screens: make(map[uint32]*screen),
+		inputs:  make(map[string]*input),
+	}
+	s.changed = sync.NewCond(&s.mu)
+	s.wingen = 1
+	s.winname = "window.1.1"
+	s.display.fill(display, f.pixel(color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}))
+	s.flushed = s.display.clone()
+	for _, name := range []string{"mouse", "cons", "kbd"} {
+		s.inputs[name] = &input{name: name, queue: make(chan []byte, 256)}
+	}
+	return s
+}
+
+// iounit returns the iounit of the draw data files. It must be called
+// with s.mu held.
+func (s *Sim) iounit() int {
+	if s.IOUnit <= 0 {
+		return 8192
+	}
+	return s.IOUnit
+}
+
+var (
+	drawFileRE = regexp.MustCompile(`^/dev/draw/([0-9]+)/([a-z]+)$`)
+	procFdRE   = regexp.MustCompile(`^/proc/[0-9]+/fd$`)
+)
+
+// OpenFile opens the file name, which is a full path such as
+// "/dev/mouse". flag is only used to tell whether a file that's written
+// is truncated first. A file that isn't simulated doesn't exist.
+func (s *Sim) OpenFile(name string, flag int) (io.ReadWriteCloser, error) {
+	name = path.Clean(name)
+	if name == "/dev/draw/new" {
+		return s.newConn()
+	}
+	if m := drawFileRE.FindStringSubmatch(name); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		f, err := s.openConn(n, m[2])
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		return f, nil
+	}
+	if procFdRE.MatchString(name) {
+		return &textFile{r: strings.NewReader(s.procFd())}, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch name {
+	case "/dev/winname":
+		return &textFile{r: strings.NewReader(s.winname)}, nil
+	case "/dev/wctl":
+		return &wctlFile{s: s, gen: -1}, nil
+	case "/dev/consctl":
+		return &consctlFile{}, nil
+	case "/dev/label":
+		return s.openText(&s.label, flag), nil
+	case "/dev/snarf":
+		return s.openText(&s.snarf, flag), nil
+	case "/dev/mouse", "/dev/cons", "/dev/kbd":
+		if name == "/dev/kbd" && s.NoKbd {
+			break
+		}
+		return s.inputs[path.Base(name)].open()
+	}
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
+
+// procFd returns the contents of /proc/n/fd, as described in proc(3),
+// with a line for each open draw data file.
+func (s *Sim) procFd() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []int
+	for id, c := range s.conns {
+		if c.dataOpen {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	var b strings.Builder
+	b.WriteString("/usr/glenda\n")
+	for i, id := range ids {
+		fmt.Fprintf(&b, "%3d rw i %4d (%016x %5d %02x) %5d %8d /dev/draw/%d/data\n", 3+i, 0, id, 0, 0, s.iounit(), 0, id)
+	}
+	return b.String()
+}
+
+// Screen returns a copy of the display, as it was after the last 'v'
+// message that flushed it.
+func (s *Sim) Screen() *image.RGBA {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushed.rgba()
+}
+
+// Window returns the window's rectangle, including its border.
+func (s *Sim) Window() image.Rectangle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.window
+}
+
+// Errors returns the errors from every message that /dev/draw rejected.
+// A program can have reasons to send one, such as looking for a free
+// screen ID, so it doesn't have to be a bug.
+func (s *Sim) Errors() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]error(nil), s.errs...)
+}
+
+// Conns returns the number of open connections to /dev/draw.
+func (s *Sim) Conns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Label returns what was last written to /dev/label.
+func (s *Sim) Label() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.label
+}
+
+// Snarf returns the contents of the snarf buffer.
+func (s *Sim) Snarf() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snarf
+}
+
+// SetSnarf replaces the contents of the snarf buffer with text.
+func (s *Sim) SetSnarf(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snarf = text
+}
+
+// Hangup breaks every connection to /dev/draw, as though the server had
+// gone away. Everything that was allocated on them is freed, and their
+// open files fail from then on.
+func (s *Sim) Hangup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.hungup = true
+		s.release(c)
+	}
+	s.changed.Broadcast()
+}
+
+// Mouse moves the mouse to p, in display coordinates, with the buttons in
+// the mask buttons held down.
+func (s *Sim) Mouse(p image.Point, buttons int) {
+	s.mu.Lock()
+	s.mouse = p
+	s.mu.Unlock()
+	s.send("mouse", s.mouseMsg('m', p, buttons))
+}
+
+// mouseMsg returns a message read from /dev/mouse, in rio's format.
+func (s *Sim) mouseMsg(typ byte, p image.Point, buttons int) []byte {
+	msec := time.Since(s.start) / time.Millisecond
+	return []byte(fmt.Sprintf("%c%11d %11d %11d %11d ", typ, p.X, p.Y, buttons, msec))
+}
+
+// Type types the runes in text, each as a key that's pressed and
+// released.
+func (s *Sim) Type(text string) {
+	for _, r := range text {
+		if s.NoKbd {
+			s.send("cons", []byte(string(r)))
+			continue
+		}
+		s.send("kbd", []byte("k"+string(r)+"\x00"))
+		s.send("kbd", []byte("c"+string(r)+"\x00"))
+		s.send("kbd", []byte("K\x00"))
+	}
+}
+
+// Resize moves the window to r, including its border, as rio does when
+// it's resized: the window's image is replaced by one with a new name, a
+// resize message is sent to /dev/mouse, and /dev/wctl reports the change.
+func (s *Sim) Resize(r image.Rectangle) {
+	s.mu.Lock()
+	s.resizeLocked(r)
+	p := s.mouse
+	s.mu.Unlock()
+	s.send("mouse", s.mouseMsg('r', p, 0))
+}
+
+func (s *Sim) resizeLocked(r image.Rectangle) {
+	s.window = r
+	s.wingen++
+	s.winname = fmt.Sprintf("window.1.%d", s.wingen)
+	s.wctlGen++
+	s.changed.Broadcast()
+}
+
+// SetCurrent makes the window the current one, which has the keyboard,
+// or not.
+func (s *Sim) SetCurrent(current bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = current
+	s.wctlGen++
+	s.changed.Broadcast()
+}
+
+// send queues msg to be read from the input file name. It blocks if too
+// many messages are waiting to be read, as rio eventually does.
+func (s *Sim) send(name string, msg []byte) {
+	s.inputs[name].queue <- msg
+}
+
+// input is a file that the program reads input from, such as /dev/mouse.
+// The messages for it are queued until it's read, and each read returns
+// one.
+type input struct {
+	name  string
+	queue chan []byte
+
+	mu   sync.Mutex
+	busy bool
+}
+
+// open opens the file, which only one program can have open at a time.
+// What's read from it comes through a net.Pipe, which is written by a
+// goroutine from the queue until the file is closed.
+func (in *input) open() (io.ReadWriteCloser, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.busy {
+		return nil, &os.PathError{Op: "open", Path: "/dev/" + in.name, Err: os.ErrExist}
+	}
+	in.busy = true
+	client, server := net.Pipe()
+	closed := make(chan struct{})
+	go func() {
+		defer server.Close()
+		for {
+			select {
+			case msg := <-in.queue:
+				if _, err := server.Write(msg); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return &inputFile{Conn: client, in: in, closed: closed}, nil
+}
+
+type inputFile struct {
+	net.Conn
+	in     *input
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (f *inputFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *inputFile) Close() error {
+	err := os.ErrClosed
+	f.once.Do(func() {
+		err = f.Conn.Close()
+		close(f.closed)
+		f.in.mu.Lock()
+		f.in.busy = false
+		f.in.mu.Unlock()
+	})
+	return err
+}
+
+// wctlFile is /dev/wctl. The first read returns the window's state, and
+// each one after that blocks until it's changed.
+type wctlFile struct {
+	s      *Sim
+	gen    int
+	closed bool
+}
+
+func (f *wctlFile) Read(p []byte) (int, error) {
+	s := f.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for f.gen == s.wctlGen && !f.closed {
+		s.changed.Wait()
+	}
+	if f.closed {
+		return 0, io.EOF
+	}
+	f.gen = s.wctlGen
+	current := "notcurrent"
+	if s.current {
+		current = "current"
+	}
+	r := s.window
+	msg := fmt.Sprintf("%11d %11d %11d %11d %11s %11s ", r.Min.X, r.Min.Y, r.Max.X, r.Max.Y, current, "visible")
+	return copy(p, msg), nil
+}
+
+// Write handles the commands from rio(4) that change the window's state:
+// resize with -r, current, top and bottom.
+func (f *wctlFile) Write(p []byte) (int, error) {
+	fields := strings.Fields(string(p))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("bad wctl message")
+	}
+	switch {
+	case len(fields) == 6 && fields[0] == "resize" && fields[1] == "-r":
+		var c [4]int
+		for i := range c {
+			var err error
+			if c[i], err = strconv.Atoi(fields[2+i]); err != nil {
+				return 0, fmt.Errorf("bad wctl message")
+			}
+		}
+		f.s.Resize(image.Rect(c[0], c[1], c[2], c[3]))
+	case len(fields) == 1 && fields[0] == "current":
+		f.s.SetCurrent(true)
+	case len(fields) == 1 && (fields[0] == "top" || fields[0] == "bottom"):
+	default:
+		return 0, fmt.Errorf("bad wctl message")
+	}
+	return len(p), nil
+}
+
+func (f *wctlFile) Close() error {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	f.closed = true
+	f.s.changed.Broadcast()
+	return nil
+}
+
+// consctlFile is /dev/consctl, which only takes rawon and rawoff.
+type consctlFile struct{}
+
+func (consctlFile) Read(p []byte) (int, error) { return 0, os.ErrPermission }
+
+func (consctlFile) Write(p []byte) (int, error) {
+	switch string(p) {
+	case "rawon", "rawoff":
+		return len(p), nil
+	}
+	return 0, fmt.Errorf("unknown control message")
+}
+
+func (consctlFile) Close() error { return nil }
+
+// openText opens a file whose contents are *text. It must be called with
+// s.mu held.
+func (s *Sim) openText(text *string, flag int) *textFile {
+	f := &textFile{r: strings.NewReader(*text)}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		f.set = func(b []byte) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			*text = string(b)
+		}
+	}
+	return f
+}
+
+// textFile is a file whose contents are read from a copy taken when it was
+// opened. If set isn't nil, it's passed what was written when the file is
+// closed.
+type textFile struct {
+	r   *strings.Reader
+	w   bytes.Buffer
+	set func([]byte)
+}
+
+func (f *textFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+
+func (f *textFile) Write(p []byte) (int, error) {
+	if f.set == nil {
+		return 0, os.ErrPermission
+	}
+	return f.w.Write(p)
+}
+
+func (f *textFile) Close() error {
+	if f.set != nil {
+		f.set(f.w.Bytes())
+		f.set = nil
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawsim
+
+import (
+	"image"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// read returns what one read of f returns.
+func read(t *testing.T, f io.Reader) string {
+	t.Helper()
+	buf := make([]byte, 256)
+	n, err := f.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func openFile(t *testing.T, s *Sim, name string, flag int) io.ReadWriteCloser {
+	t.Helper()
+	f, err := s.OpenFile(name, flag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestMouse(t *testing.T) {
+	s := New(image.Rect(0, 0, 640, 480), image.Rect(10, 10, 110, 110))
+	// what's sent before the file is opened waits for it.
+	s.Mouse(image.Pt(20, 30), 1)
+	mouse := openFile(t, s, "/dev/mouse", os.O_RDONLY)
+	if _, err := s.OpenFile("/dev/mouse", os.O_RDONLY); !os.IsExist(err) {
+		t.Errorf("opening /dev/mouse twice: got %v, want it to be in use", err)
+	}
+	got := strings.Fields(read(t, mouse))
+	if len(got) != 5 || got[0] != "m" || got[1] != "20" || got[2] != "30" || got[3] != "1" {
+		t.Errorf("read %q, want a move to (20, 30) with button 1", got)
+	}
+
+	wctl := openFile(t, s, "/dev/wctl", os.O_RDWR)
+	if got := strings.Fields(read(t, wctl)); strings.Join(got, " ") != "10 10 110 110 current visible" {
+		t.Errorf("read %q from /dev/wctl", got)
+	}
+	// the next read waits for the window to change.
+	changed := make(chan string)
+	go func() {
+		buf := make([]byte, 256)
+		n, _ := wctl.Read(buf)
+		changed <- string(buf[:n])
+	}()
+	select {
+	case got := <-changed:
+		t.Fatalf("read %q from /dev/wctl before it changed", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if _, err := io.WriteString(openFile(t, s, "/dev/wctl", os.O_WRONLY), "resize -r 0 0 200 100"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(<-changed); strings.Join(got[:4], " ") != "0 0 200 100" {
+		t.Errorf("read %q after the resize", got)
+	}
+	if got := read(t, mouse); got[0] != 'r' {
+		t.Errorf("read %q from /dev/mouse after the resize, want an 'r' message", got)
+	}
+	if got := read(t, openFile(t, s, "/dev/winname", os.O_RDONLY)); got != "window.1.2" {
+		t.Errorf("the window's name is %q after the resize, want a new one", got)
+	}
+}
+
+func TestType(t *testing.T) {
+	s := New(image.Rect(0, 0, 640, 480), image.Rect(10, 10, 110, 110))
+	kbd := openFile(t, s, "/dev/kbd", os.O_RDONLY)
+	s.Type("é")
+	for _, want := range []string{"ké\x00", "cé\x00", "K\x00"} {
+		if got := read(t, kbd); got != want {
+			t.Errorf("read %q from /dev/kbd, want %q", got, want)
+		}
+	}
+
+	s = New(image.Rect(0, 0, 640, 480), image.Rect(10, 10, 110, 110))
+	s.NoKbd = true
+	if _, err := s.OpenFile("/dev/kbd", os.O_RDONLY); !os.IsNotExist(err) {
+		t.Errorf("opening /dev/kbd with NoKbd: got %v, want it not to exist", err)
+	}
+	cons := openFile(t, s, "/dev/cons", os.O_RDONLY)
+	s.Type("é")
+	if got := read(t, cons); got != "é" {
+		t.Errorf("read %q from /dev/cons", got)
+	}
+}
+
+func TestSnarf(t *testing.T) {
+	s := New(image.Rect(0, 0, 640, 480), image.Rect(10, 10, 110, 110))
+	s.SetSnarf("old")
+	f := openFile(t, s, "/dev/snarf", os.O_WRONLY|os.O_TRUNC)
+	io.WriteString(f, "new")
+	// it's only replaced once the file is closed.
+	if got := s.Snarf(); got != "old" {
+		t.Errorf("snarf is %q while it's being written", got)
+	}
+	f.Close()
+	if got := read(t, openFile(t, s, "/dev/snarf", os.O_RDONLY)); got != "new" {
+		t.Errorf("read %q from /dev/snarf", got)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	f, err := parseFormat(0x31) // k1
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.String() != "k1" || f.depth != 1 {
+		t.Errorf("got %v with depth %d, want k1", f, f.depth)
+	}
+	// pixels smaller than a byte are packed from the top bit, and rows
+	// start with the byte that holds their first pixel, which isn't the
+	// first bit of the byte here.
+	p := newPixels(f, image.Rect(3, 0, 13, 2))
+	p.load(image.Rect(4, 1, 12, 2), []byte{0x0F, 0xF0})
+	if got := p.unload(image.Rect(0, 1, 16, 2)); got[0] != 0x0F || got[1] != 0xF0 {
+		t.Errorf("unloaded % x, want 0f f0", got)
+	}
+	if got := p.unload(image.Rect(5, 1, 6, 2)); got[0] != 0x04 {
+		t.Errorf("unloaded % x for x=5, want 04", got)
+	}
+	if _, err := parseFormat(0x37); err != errBadChan {
+		t.Errorf("k7: got %v, want %v", err, errBadChan)
+	}
+}
@@ -13,32 +13,145 @@ import (
 	"image/color"
 	"image/draw"
 	"io"
-	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 )
 
+// NoScreen is returned, wrapped with more detail, by AllocScreen when
+// every screen ID that it tries is in use. That usually means that
+// earlier sessions on the same /dev/draw connection leaked their screens
+// by not freeing them.
 var NoScreen error = errors.New("Could not allocate screen")
 
+// drawTransport is the channel that a DrawCtrler sends its messages over
+// and reads image data back from, normally /dev/draw/n/data. Each Write
+// is one or more complete messages, as described in draw(3).
+type drawTransport interface {
+	Read(p []byte) (int, error)
+	Write(p []byte) (int, error)
+	Close() error
+}
+
 // A DrawCtrler is an object which holds references to
-// /dev/draw/n/^(data ctl), and allows you to send or
-// receive messages from it.
+// /dev/draw/n/data and the connection's ctl file, which is
+// /dev/draw/new as it was opened, and allows you to send or
+// receive messages from them.
 type DrawCtrler struct {
 	N    int
 	ctl  io.ReadWriteCloser
-	data io.ReadWriteCloser
+	data drawTransport
 
 	// the maxmum message size that can be written to
-	// /dev/draw/data.
+	// /dev/draw/data. reopen changes it with bufMu held, so anything
+	// that doesn't hold bufMu reads it with iounit.
 	iounitSize int
+	// noCompress disables the compressed 'Y' form of ReplaceSubimage,
+	// lookback is how far back it searches for matches if it's used,
+	// and maxBand is the most bytes that a 'Y' message can be. See
+	// DevdrawOptions.
+	noCompress bool
+	lookback   int
+	maxBand    int
 	// the next available ID to use when allocating
 	// an image
 	nextId uint32
+	// live is the set of image IDs that have been allocated and not
+	// freed yet, for LiveIDs and FreeAll, with how each of them was
+	// allocated, for reallocLive. idMu protects it and nextId, so that
+	// images can be allocated and freed from any goroutine.
+	live map[uint32]liveImage
+	idMu sync.Mutex
+
+	// CompressThreshold is the size in bytes that an image has to be
+	// bigger than for ReplaceSubimage to compress it, when /dev/draw is
+	// remote. Zero means the default of 256, below which the overhead of
+	// compressing is probably worse than the gain.
+	CompressThreshold int
+	// ForceCompress makes ReplaceSubimage compress every image bigger
+	// than CompressThreshold, even when /dev/draw is local.
+	ForceCompress bool
 
-	// A mutex to avoid race conditions with Draw/SetOp
+	// drawMu is held from setting the compositing operation until the
+	// message that uses it has been sent, so that messages from
+	// different goroutines can't be drawn with each other's operation.
+	// The operation set by an 'O' message is part of the connection's
+	// state on the server, and applies to every drawing message until the
+	// next 'O', so the pair has to be sent without another drawing
+	// message in between. SetOp acquires it, and setOpLocked and
+	// sendOpMessage must be called with it held.
 	drawMu sync.Mutex
+	// appMessages counts the calls to SendMessage and DrawBatch.Flush,
+	// whose messages are built by the application and may have drawn
+	// into any image that ImageID handed out. Protected by drawMu.
+	appMessages uint64
+
+	// cmdBuf is reused by sendMessage to build the messages that it
+	// writes, so that sending a message doesn't need an allocation.
+	// A message bigger than the iounit, which none that the driver
+	// builds are, gets a buffer of its own instead, so that it doesn't
+	// stay allocated afterwards.
+	//
+	// It has its own mutex because sendMessage is called both with and
+	// without drawMu held. That's safe because the buffer is only used
+	// inside writeMessage, from building a message until the write of
+	// it returns, and a Write mustn't keep the slice it's given; drawMu
+	// orders messages against each other, which doesn't involve the
+	// buffer.
+	cmdBuf []byte
+	bufMu  sync.Mutex
+	// err is the error from the first write to data that failed. Once
+	// it's set, nothing else is written. Protected by bufMu, for the
+	// same reason as cmdBuf.
+	err error
+	// counts and stats record what's been written, for Stats. Protected
+	// by bufMu.
+	counts [256]int
+	stats  DrawStats
+
+	// ctlMu is held while reading or writing ctl. Reading ctl describes
+	// the image whose ID was written to it last, so ReadCtl and
+	// QueryImage each have to write the ID and read the description
+	// without another goroutine using ctl in between. It also protects
+	// lastCtl, which is the message returned by LastCtl.
+	ctlMu   sync.Mutex
+	lastCtl *DrawCtlMsg
+
+	// droppedMouse and droppedKeyboard count the input records that the
+	// screen has dropped, for Stats. They have their own mutex so that
+	// the input goroutines don't wait for writes to data.
+	droppedMouse    int
+	droppedKeyboard int
+	droppedMu       sync.Mutex
+}
+
+// DrawStats counts what a DrawCtrler has written to /dev/draw, to help
+// find out why drawing is slow, such as over a slow 9P connection, and
+// the input that the screen drawing with it has dropped.
+type DrawStats struct {
+	// Messages is the number of messages that were sent of each type,
+	// by the message's command byte.
+	Messages map[byte]int
+	// Bytes is the total size of the messages.
+	Bytes int64
+	// UncompressedBytes is the size of the 'y' messages, and
+	// CompressedBytes is the size of the 'Y' messages, which both replace
+	// pixels of an image. CompressedPixels is the size of the pixels that
+	// the 'Y' messages held before they were compressed.
+	UncompressedBytes int64
+	CompressedBytes   int64
+	CompressedPixels  int64
+
+	// DroppedMouse and DroppedKeyboard are the number of records read
+	// from /dev/mouse and /dev/kbd that were dropped because they
+	// couldn't be parsed, which usually means that the device writes a
+	// format the driver doesn't know. Each one is also logged as a
+	// warning. They tell input that goes missing apart from input that
+	// never arrived.
+	DroppedMouse    int
+	DroppedKeyboard int
 }
 
 // A DrawCtlMsg represents the data that is returned from
@@ -48,23 +161,45 @@ type DrawCtlMsg struct {
 
 	DisplayImageId int
 	ChannelFormat  string
-	MysteryValue   string
-	DisplaySize    image.Rectangle
-	Clipping       image.Rectangle
+	// Repl is whether the image is replicated. It's the fourth of the
+	// 12 numbers, which draw(3) leaves out of its description of the
+	// message, but which devdraw writes from the image's repl flag. It's
+	// 0 or 1, and not a version or a size of any kind.
+	Repl bool
+	// MysteryValue is the replication flag as it was read, or empty if
+	// the implementation of /dev/draw didn't send one.
+	//
+	// Deprecated: use Repl.
+	MysteryValue string
+	DisplaySize  image.Rectangle
+	Clipping     image.Rectangle
 }
 
-const NewScreen = "/dev/draw/new"
+// NewScreen is the file which is opened to create a new connection to
+// /dev/draw, relative to DevRoot.
+const NewScreen = "draw/new"
 
 // NewDrawCtrler creates a new DrawCtrler to interact with
 // the /dev/draw filesystem. It returns a reference to
 // a DrawCtrler, and a DrawCtlMsg representing the data
 // that was returned from opening /dev/draw/new.
-func NewDrawCtrler() (*DrawCtrler, *DrawCtlMsg, error) {
-	fNew, err := os.Open(NewScreen)
+func NewDrawCtrler() (_ *DrawCtrler, _ *DrawCtlMsg, err error) {
+	// opening /dev/draw/new creates the connection, and the file that
+	// was opened is the connection's ctl file from then on, as it is
+	// for initdisplay in libdraw. /dev/draw/n/ctl can't be opened as
+	// well, since the server only allows one open ctl file for each
+	// connection.
+	fNew, err := openDevRetry(devPath(NewScreen), os.O_RDWR)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Could not open %s: %v\n", NewScreen, err)
+		return nil, nil, fmt.Errorf("Could not open %s: %v\n", devPath(NewScreen), err)
 	}
-	defer fNew.Close()
+	// the files stay open once the DrawCtrler is returned, but nothing
+	// else will close them if it isn't.
+	defer func() {
+		if err != nil {
+			fNew.Close()
+		}
+	}()
 
 	// id 1 reserved for the image represented by /dev/winname, so
 	// start allocating new IDs at 2.
@@ -72,7 +207,7 @@ func NewDrawCtrler() (*DrawCtrler, *DrawCtlMsg, error) {
 	ctlString := dc.readCtlString(fNew)
 	msg := parseCtlString(ctlString)
 	if msg == nil {
-		return dc, nil, fmt.Errorf("Could not parse ctl string from %s: %s\n", NewScreen, ctlString)
+		return nil, nil, fmt.Errorf("Could not parse ctl string from %s: %s\n", devPath(NewScreen), ctlString)
 	}
 
 	if msg.N < 1 {
@@ -80,81 +215,335 @@ func NewDrawCtrler() (*DrawCtrler, *DrawCtlMsg, error) {
 		return nil, nil, fmt.Errorf("draw index less than one: %d", msg.N)
 	}
 	dc.N = msg.N
+	dc.ctl = fNew
 	//      open the data channel for the connection we just created so
 	//      we can send messages to it.  We don't close it so that it
 	//      doesn't disappear from the /dev filesystem on us.  It needs
 	//      to be closed when the screen is cleaned up.
-	fn := fmt.Sprintf("/dev/draw/%d/data", msg.N)
-	fData, err := os.OpenFile(fn, os.O_RDWR, 0)
+	fn := devPath(fmt.Sprintf("draw/%d/data", msg.N))
+	fData, err := openDevRetry(fn, os.O_RDWR)
 	if err != nil {
-		return dc, msg, fmt.Errorf("Could not open %s: %v\n", fn, err)
+		return nil, nil, fmt.Errorf("Could not open %s: %v\n", fn, err)
 	}
+	defer func() {
+		if err != nil {
+			fData.Close()
+		}
+	}()
 	dc.data = fData
+	dc.lastCtl = msg
 
 	// read the iounit size from the /proc filesystem.
 	pid := os.Getpid()
-	if fdInfo, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/fd", pid)); err == nil {
-		lines := bytes.Split(fdInfo, []byte{'\n'})
-		// See man proc(3) for a description of the format of /proc/$pid/fd that's
-		// being parsed to find the iounit size
-		// the first line is just the current wd, so don't range over it
-		for _, line := range lines[1:] {
-			fInfo := bytes.Fields(line)
-			if len(fInfo) >= 10 && string(fInfo[9]) == fn {
-				// found /dev/draw/N/data in the list of open files, so get
-				// the iounit size of it.
-				i, err := strconv.Atoi(string(fInfo[7]))
-				if err != nil {
-					return nil, nil, fmt.Errorf("Invalid iounit size. Could not convert to integer.")
-				}
-				dc.iounitSize = i
-				break
+	fdInfo, err := readProc(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not determine iounit size: %v\n", err)
+	}
+	if dc.iounitSize, err = parseIOUnit(bytes.Split(fdInfo, []byte{'\n'}), fn); err != nil {
+		return nil, nil, err
+	}
+	return dc, msg, nil
+}
 
+// parseIOUnit returns the iounit of the open file path from the lines of
+// /proc/$pid/fd. As described in proc(3), the first line is the current
+// directory, and each of the others is an open file, such as:
+//
+//	3 rw M 4 (0000000000000001 0 00) 8192 0 /dev/draw/1/data
+//
+// Split on white space, the fields are the file descriptor, the open
+// mode, the device type and number, the qid's path, version and type (in
+// parentheses), the iounit, the offset, and the file name. So the iounit
+// is field 7 and the name is field 9, counting from 0.
+func parseIOUnit(lines [][]byte, path string) (int, error) {
+	if len(lines) > 0 {
+		lines = lines[1:]
+	}
+	for _, line := range lines {
+		fInfo := bytes.Fields(line)
+		if len(fInfo) >= 10 && string(fInfo[9]) == path {
+			// found /dev/draw/N/data in the list of open files, so get
+			// the iounit size of it.
+			i, err := strconv.Atoi(string(fInfo[7]))
+			if err != nil {
+				return 0, fmt.Errorf("Invalid iounit size. Could not convert to integer.")
 			}
-
-		}
-
-		if dc.iounitSize == 0 {
-			return nil, nil, fmt.Errorf("Could not parse iounit size.\n")
+			if i == 0 {
+				break
+			}
+			return i, nil
 		}
-	} else {
-		return nil, nil, fmt.Errorf("Could not determine iounit size: %v\n", err)
 	}
-	return dc, msg, nil
+	return 0, fmt.Errorf("Could not parse iounit size.\n")
+}
+
+// NewDrawCtrlerFromTransport returns a DrawCtrler which sends its messages
+// over t instead of opening /dev/draw, and never writes more than
+// iounitSize bytes at a time. It has no ctl channel, so ReadCtl and
+// QueryImage return an error.
+//
+// It's intended for tests, which can inspect the bytes that are written
+// to t without a Plan 9 kernel.
+func NewDrawCtrlerFromTransport(t drawTransport, iounitSize int) *DrawCtrler {
+	// as in NewDrawCtrler, image IDs start at 2.
+	return &DrawCtrler{data: t, iounitSize: iounitSize, nextId: 2}
 }
 
 // reads the output of /dev/draw/new or /dev/draw/n/ctl and returns
 // it without doing any parsing.  It should be passed along to
 // parseCtlString to create a *DrawCtlMsg
-func (d DrawCtrler) readCtlString(f io.Reader) string {
+func (d *DrawCtrler) readCtlString(f io.Reader) string {
 	val := make([]byte, 256)
-	n, err := f.Read(val)
+	// there are usually 12 11 character wide strings in a ctl message,
+	// each followed by a space, but a read can return less than all of
+	// them, so keep reading until they're all there. Not every draw
+	// implementation sends the same number, or the last space. devdraw
+	// fails a read after the whole message rather than returning EOF,
+	// so an error once something has been read ends the message too.
+	// parseCtlString checks that the fields make sense.
+	n := 0
+	for n < len(val) && !ctlComplete(val[:n]) {
+		m, err := f.Read(val[n:])
+		n += m
+		if err != nil && n > 0 {
+			break
+		}
+		if err != nil {
+			Log.Errorf("Error reading control string: %s", err)
+			return ""
+		}
+		if m == 0 {
+			break
+		}
+	}
+	return string(val[:n])
+}
+
+// ctlComplete reports whether b, the start of a ctl message, can't be
+// continued by another read: either it has all 12 fields, or it's a
+// shorter message that parses, and its last field is followed by white
+// space so that it isn't cut short.
+func ctlComplete(b []byte) bool {
+	fields := completeFields(b)
+	if fields >= 12 {
+		return true
+	}
+	return fields > 0 && fields == len(bytes.Fields(b)) && parseCtlString(string(b)) != nil
+}
+
+// ReadCtl reads and parses the current state of the connection from
+// /dev/draw/n/ctl. This can be used to poll for changes to the display
+// size. The result is also returned by later calls to LastCtl.
+func (d *DrawCtrler) ReadCtl() (*DrawCtlMsg, error) {
+	d.ctlMu.Lock()
+	defer d.ctlMu.Unlock()
+	// the server forgets which image to describe after every read of
+	// ctl, so it has to be told again that it's the display, which is
+	// image 0.
+	msg, err := d.queryLocked(0)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading control string: %s\n", err)
-		return ""
+		return nil, err
 	}
-	// there are 12 11 character wide strings in a ctl message, each followed
-	// by a space. The last one may or may not have a terminating space, depending
-	// on draw implementation, but it's irrelevant if it does.
-	if err != nil || n < 143 {
-		fmt.Fprintf(os.Stderr, "Incorrect number of bytes in ctl string: %d\n", n)
-		return ""
+	d.lastCtl = msg
+	return msg, nil
+}
+
+// LastCtl returns the most recently read state of the connection, either
+// from opening /dev/draw/new or from calling ReadCtl, or nil if there
+// isn't one. Its DisplaySize is the size of the whole display, not the
+// window. The result is a copy, which changing doesn't affect d.
+func (d *DrawCtrler) LastCtl() *DrawCtlMsg {
+	d.ctlMu.Lock()
+	defer d.ctlMu.Unlock()
+	if d.lastCtl == nil {
+		return nil
 	}
-	return string(val[:144])
+	msg := *d.lastCtl
+	return &msg
+}
+
+// QueryImage returns the channel format, bounds and clipping rectangle
+// of the image id, as reported by /dev/draw/n/ctl.
+//
+// draw(3) doesn't have a data message to query an image. Instead, writing
+// an image id to ctl makes the next read of ctl describe that image.
+// Unlike ReadCtl, this doesn't change what LastCtl returns.
+func (d *DrawCtrler) QueryImage(id uint32) (*DrawCtlMsg, error) {
+	d.ctlMu.Lock()
+	defer d.ctlMu.Unlock()
+	return d.queryLocked(id)
+}
+
+// queryLocked writes id to ctl and parses the description of the image
+// that's read back. It must be called with ctlMu held.
+func (d *DrawCtrler) queryLocked(id uint32) (*DrawCtlMsg, error) {
+	if d.ctl == nil {
+		return nil, errors.New("ctl channel is not open")
+	}
+	msg := make([]byte, 4)
+	binary.LittleEndian.PutUint32(msg, id)
+	if err := d.sendCtlMessage(msg); err != nil {
+		return nil, err
+	}
+	ctlString := d.readCtlString(d.ctl)
+	info := parseCtlString(ctlString)
+	if info == nil {
+		return nil, fmt.Errorf("Could not parse ctl string: %s", ctlString)
+	}
+	return info, nil
 }
 
 // sendMessage sends the command represented by cmd to the data channel,
 // with the raw arguments in val (n.b. They need to be in little endian
 // byte order and match the cmd arguments described in draw(3))
-func (d DrawCtrler) sendMessage(cmd byte, val []byte) error {
-	realCmd := append([]byte{cmd}, val...)
-	_, err := d.data.Write(realCmd)
-	return err
+func (d *DrawCtrler) sendMessage(cmd byte, val []byte) error {
+	return d.writeMessage(cmd, [][]byte{val})
+}
+
+// sendMessagev is like sendMessage, but the arguments are the parts
+// concatenated, such as a header and the pixels that follow it. They're
+// copied straight into the buffer that's written, so the caller doesn't
+// have to join them first.
+func (d *DrawCtrler) sendMessagev(cmd byte, parts ...[]byte) error {
+	return d.writeMessage(cmd, parts)
+}
+
+// SendMessage sends a message that this package doesn't have a method
+// for, the same as sendMessage, while holding drawMu so that it isn't
+// drawn with a compositing operation set for a different message. val
+// is the arguments after the command byte cmd, in the format described
+// in draw(3).
+//
+// Any image IDs must have been returned by AllocBuffer or one of the
+// other methods that allocate images, since the DrawCtrler assigns IDs
+// in sequence and doesn't know about any others.
+func (d *DrawCtrler) SendMessage(cmd byte, val []byte) error {
+	d.drawMu.Lock()
+	defer d.drawMu.Unlock()
+	d.appMessages++
+	return d.sendMessage(cmd, val)
+}
+
+// writeMessage does the work of sendMessagev. A write which fails because
+// the connection is gone is recorded in d.err, and stops anything else
+// from being sent. The server also rejects single messages, such as one
+// that frees an ID it doesn't know, but that leaves the connection as it
+// was, so the error is only returned.
+func (d *DrawCtrler) writeMessage(cmd byte, parts [][]byte) error {
+	d.bufMu.Lock()
+	defer d.bufMu.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	n := 1
+	for _, p := range parts {
+		n += len(p)
+	}
+	var realCmd []byte
+	if d.iounitSize > 0 && n > d.iounitSize {
+		realCmd = make([]byte, n)
+	} else {
+		if cap(d.cmdBuf) < n {
+			d.cmdBuf = make([]byte, n)
+		}
+		realCmd = d.cmdBuf[:n]
+	}
+	realCmd[0] = cmd
+	n = 1
+	for _, p := range parts {
+		n += copy(realCmd[n:], p)
+	}
+	if _, err := d.data.Write(realCmd); err != nil {
+		werr := fmt.Errorf("write %c message: %w", cmd, err)
+		if connLost(err) {
+			d.err = werr
+		}
+		return werr
+	}
+	d.count(realCmd)
+	return nil
+}
+
+// connLost reports whether err, from a write to /dev/draw/n/data, means
+// that the connection itself is gone, as opposed to the server rejecting
+// the message that was written.
+func connLost(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, os.ErrClosed) {
+		return true
+	}
+	// Plan 9 reports a lost connection with error strings such as
+	// "i/o on hungup channel" and "mount rpc error".
+	msg := err.Error()
+	for _, s := range []string{"hungup", "rpc error", "broken pipe", "closed"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// count adds the message msg, which has been written, to d's stats. It
+// must be called with bufMu held.
+func (d *DrawCtrler) count(msg []byte) {
+	d.counts[msg[0]]++
+	d.stats.Bytes += int64(len(msg))
+	switch msg[0] {
+	case 'y':
+		d.stats.UncompressedBytes += int64(len(msg))
+	case 'Y':
+		d.stats.CompressedBytes += int64(len(msg))
+		// the rectangle follows the image ID.
+		if len(msg) >= 21 {
+			dx := int32(binary.LittleEndian.Uint32(msg[13:])) - int32(binary.LittleEndian.Uint32(msg[5:]))
+			dy := int32(binary.LittleEndian.Uint32(msg[17:])) - int32(binary.LittleEndian.Uint32(msg[9:]))
+			d.stats.CompressedPixels += int64(dx) * int64(dy) * 4
+		}
+	}
 }
 
-// Sends a message to /dev/draw/n/ctl.
-// This isn't used, but might be in the future.
-func (d DrawCtrler) sendCtlMessage(val []byte) error {
+// Stats returns a snapshot of what d has written so far, and of the input
+// that's been dropped.
+func (d *DrawCtrler) Stats() DrawStats {
+	d.bufMu.Lock()
+	defer d.bufMu.Unlock()
+	st := d.stats
+	d.droppedMu.Lock()
+	st.DroppedMouse, st.DroppedKeyboard = d.droppedMouse, d.droppedKeyboard
+	d.droppedMu.Unlock()
+	st.Messages = make(map[byte]int)
+	for cmd, n := range d.counts {
+		if n > 0 {
+			st.Messages[byte(cmd)] = n
+		}
+	}
+	return st
+}
+
+// dropInput records that a record from the keyboard, if keyboard is
+// true, or else the mouse, was dropped.
+func (d *DrawCtrler) dropInput(keyboard bool) {
+	d.droppedMu.Lock()
+	defer d.droppedMu.Unlock()
+	if keyboard {
+		d.droppedKeyboard++
+	} else {
+		d.droppedMouse++
+	}
+}
+
+// Err returns the error that stopped d from sending messages to
+// /dev/draw, or nil if it's still working. Once a write has failed because
+// the connection was lost, every method that sends a message does
+// nothing, and those that return an error return this one. A message that
+// the server rejected doesn't stop anything else from being sent.
+func (d *DrawCtrler) Err() error {
+	d.bufMu.Lock()
+	defer d.bufMu.Unlock()
+	return d.err
+}
+
+// Sends a message to /dev/draw/n/ctl. It must be called with ctlMu held.
+func (d *DrawCtrler) sendCtlMessage(val []byte) error {
 	_, err := d.ctl.Write(val)
 	return err
 }
@@ -165,12 +554,17 @@ func (d *DrawCtrler) AllocScreen() (screenId, error) {
 	msg := make([]byte, 13)
 	for i := 0; i < 255; i++ {
 		binary.LittleEndian.PutUint32(msg[0:], uint32(i))
-		err := d.sendMessage('A', msg)
+		// the server rejects IDs that are already in use, which
+		// doesn't mean that anything is wrong.
+		err := d.writeMessage('A', [][]byte{msg})
 		if err == nil {
 			return screenId(i), nil
 		}
+		if d.Err() != nil {
+			return 0, d.Err()
+		}
 	}
-	return 0, NoScreen
+	return 0, fmt.Errorf("AllocScreen: no free screen ID after 255 attempts (0-254): %w", NoScreen)
 }
 
 // Frees the screen identified by id.
@@ -196,30 +590,89 @@ func (d *DrawCtrler) ReallocScreen(id screenId) error {
 	return d.sendMessage('A', msg)
 }
 
+// The refresh methods that can be passed to AllocBuffer, as described in
+// allocimage(2).
+const (
+	// RefBackup makes the server keep a backing store of the parts of
+	// the image that are obscured, and restore them itself.
+	RefBackup = 0
+	// RefNone makes the server discard obscured parts of the image.
+	RefNone = 1
+	// RefMesg makes the server notify the client when parts of the
+	// image need to be redrawn, which it reads with RefreshEvents.
+	RefMesg = 2
+)
+
+// chanABGR32 is the /dev/draw channel descriptor for images that have
+// the same layout as an image.RGBA (ie. a8b8g8r8 in little endian.)
+const chanABGR32 = 0x48281808
+
 // AllocBuffer will send a message to /dev/draw/N/data of the form:
 //    b id[4] screenid[4] refresh[1] chan[4] repl[1] r[4*r] clipr[4*4] color[4]
-// see draw(3) for details.
+// see draw(3) for details. refresh is one of RefBackup, RefNone or
+// RefMesg.
 //
-// For the purposes of the using this helper method, id and screenid are
-// automatically generated by the DrawDriver, and chan is always an RGBA
-// channel.
+// For the purposes of the using this helper method, id is automatically
+// generated by the DrawDriver, chan is always an RGBA channel, and
+// screenid is 0, so that the image is off screen. The driver's own
+// images are all off screen, and composited onto the Plan 9 window when
+// a window is published. An image doesn't need a screen to be drawn from
+// or into; giving it one would make it a window that the server shows
+// and layers by itself, which is what AllocScreenBuffer is for.
+//
+// color may be of any colour model. /dev/draw stores colours with
+// premultiplied alpha, the same as color.RGBA, so it's sent as returned
+// by its RGBA method; a color.NRGBA is converted by that, and mustn't be
+// converted to straight alpha first.
 //
 // Returns the ID that can be used to reference the allocated buffer
 func (d *DrawCtrler) AllocBuffer(refresh byte, repl bool, r, clipr image.Rectangle, color color.Color) uint32 {
+	// RGBA channel. This is the same format as image.RGBA.Pix,
+	// so that we can directly upload a buffer.
+	return d.allocImage(0, false, refresh, chanABGR32, repl, r, clipr, color)
+}
+
+// AllocScreenBuffer is like AllocBuffer, but allocates the image on the
+// screen sid (as returned by AllocScreen). As described in draw(3), that
+// makes the image a window on the screen, which is shown and layered by
+// the server, instead of an off screen image.
+func (d *DrawCtrler) AllocScreenBuffer(sid screenId, refresh byte, repl bool, r, clipr image.Rectangle, color color.Color) uint32 {
+	return d.allocImage(sid, true, refresh, chanABGR32, repl, r, clipr, color)
+}
+
+// liveImage is how an image that hasn't been freed yet was allocated.
+type liveImage struct {
+	// msg is the arguments of the 'b' message that allocated it, with
+	// the clipping changed by Reclip since.
+	msg []byte
+	// onScreen is set if it was allocated on a screen. The screen ID
+	// in msg doesn't tell, since AllocScreen may return 0.
+	onScreen bool
+	// owned is set by own, for an image that something else will free.
+	owned bool
+}
+
+// allocImage is like AllocScreenBuffer, but allocates an image with the
+// channel descriptor pix (as returned by parseChan) instead of RGBA. The
+// image is only put on the screen sid if onScreen is set; otherwise it's
+// off screen, and sid should be 0.
+func (d *DrawCtrler) allocImage(sid screenId, onScreen bool, refresh byte, pix uint32, repl bool, r, clipr image.Rectangle, color color.Color) uint32 {
+	// the rectangles are sent unsigned, so an inverted one would be
+	// enormous. An empty image is still allocated, since the caller
+	// needs an ID.
+	r, clipr = r.Canon(), clipr.Canon()
 	msg := make([]byte, 50)
 	// id is the next available ID.
+	d.idMu.Lock()
 	d.nextId += 1
 	newId := d.nextId
+	d.idMu.Unlock()
 	binary.LittleEndian.PutUint32(msg[0:], newId)
+	binary.LittleEndian.PutUint32(msg[4:], uint32(sid))
 	// refresh can just be passed along directly.
 	msg[8] = refresh
 
-	// RGBA channel. This is the same format as image.RGBA.Pix,
-	// so that we can directly upload a buffer.
-	msg[9] = 8   // r8
-	msg[10] = 24 // g8
-	msg[11] = 40 // b8
-	msg[12] = 72 // a8
+	binary.LittleEndian.PutUint32(msg[9:], pix)
 	// Convert repl from bool to a byte
 	if repl == true {
 		msg[13] = 1
@@ -238,7 +691,8 @@ func (d *DrawCtrler) AllocBuffer(refresh byte, repl bool, r, clipr image.Rectang
 	// RGBA colour to use by default for this buffer.
 	// color.RGBA() returns a uint16 (actually a uint32
 	// with only the lower 16 bits set), so shift it to
-	// convert it to a uint8.
+	// convert it to a uint8. The values are premultiplied
+	// by alpha, which is what draw(3) expects.
 
 	// Note that there's a bug in libmemdraw in the standard Plan 9
 	// distribution that the endianness is sometimes swapped, but
@@ -251,24 +705,238 @@ func (d *DrawCtrler) AllocBuffer(refresh byte, repl bool, r, clipr image.Rectang
 	msg[48] = byte(g >> 8)
 	msg[49] = byte(rd >> 8)
 
+	d.idMu.Lock()
+	if d.live == nil {
+		d.live = make(map[uint32]liveImage)
+	}
+	d.live[newId] = liveImage{msg: msg, onScreen: onScreen}
+	d.idMu.Unlock()
 	d.sendMessage('b', msg)
 	return newId
 }
 
 // FreeID will release the resources held by the imageID in this
 // /dev/draw interface.
+//
+// The server handles the messages written to /dev/draw/n/data in order,
+// and a 'v' only affects when the screen is updated, not when messages
+// are handled. So an image can be freed as soon as every message that
+// uses it has been sent, without waiting for a flush. Image IDs are never
+// reused, so a stale ID can't refer to a newer image either.
 func (d *DrawCtrler) FreeID(id uint32) {
+	d.idMu.Lock()
+	delete(d.live, id)
+	d.idMu.Unlock()
+
 	// just convert to little endian and send the id to 'f'
 	msg := make([]byte, 4)
 	binary.LittleEndian.PutUint32(msg, id)
 	d.sendMessage('f', msg)
 }
 
-// SetOp sets the compositing operation for the next draw to op.
+// LiveIDs returns the IDs of the images which have been allocated, and
+// not freed with FreeID yet, in increasing order. It's meant for finding
+// images that are leaked.
+func (d *DrawCtrler) LiveIDs() []uint32 {
+	d.idMu.Lock()
+	defer d.idMu.Unlock()
+	return d.liveIDsLocked()
+}
+
+// liveIDsLocked does the work of LiveIDs. It must be called with idMu
+// held.
+func (d *DrawCtrler) liveIDsLocked() []uint32 {
+	ids := make([]uint32, 0, len(d.live))
+	for id := range d.live {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// own records that the image id belongs to a window or texture, which
+// frees it itself, so that FreeAll leaves it alone.
+func (d *DrawCtrler) own(id uint32) {
+	d.idMu.Lock()
+	defer d.idMu.Unlock()
+	if img, ok := d.live[id]; ok {
+		img.owned = true
+		d.live[id] = img
+	}
+}
+
+// FreeAll frees every image that LiveIDs would return, except the ones
+// that belong to a window or texture, such as when tearing down the
+// screen. Those are freed when the window or texture is released, which
+// would fail if FreeAll had freed them already, so what's left is the
+// images that have been leaked. Anything else that still refers to one
+// of them can't be drawn with afterwards.
+func (d *DrawCtrler) FreeAll() {
+	var ids []uint32
+	d.idMu.Lock()
+	for _, id := range d.liveIDsLocked() {
+		if !d.live[id].owned {
+			ids = append(ids, id)
+			delete(d.live, id)
+		}
+	}
+	d.idMu.Unlock()
+
+	msg := make([]byte, 4)
+	for _, id := range ids {
+		binary.LittleEndian.PutUint32(msg, id)
+		d.sendMessage('f', msg)
+	}
+}
+
+// forgetID removes id from LiveIDs without freeing it, for an image that
+// was lost with the connection it was allocated on.
+func (d *DrawCtrler) forgetID(id uint32) {
+	d.idMu.Lock()
+	delete(d.live, id)
+	d.idMu.Unlock()
+}
+
+// reopen replaces d's connection to /dev/draw with a new one, such as
+// after the server was restarted and every write to the old connection
+// fails. The connection's state on the server is gone with it, so the
+// caller has to attach the window and allocate a screen again, and then
+// the images with reallocLive. opts is applied to the new connection as
+// by configure.
+func (d *DrawCtrler) reopen(opts DevdrawOptions) error {
+	nd, _, err := NewDrawCtrler()
+	if err != nil {
+		return err
+	}
+	nd.configure(opts)
+
+	d.drawMu.Lock()
+	defer d.drawMu.Unlock()
+	d.bufMu.Lock()
+	defer d.bufMu.Unlock()
+	d.ctlMu.Lock()
+	defer d.ctlMu.Unlock()
+	d.closeFiles()
+	d.N, d.data, d.ctl, d.iounitSize = nd.N, nd.data, nd.ctl, nd.iounitSize
+	d.lastCtl = nd.lastCtl
+	d.err = nil
+	return nil
+}
+
+// iounit returns iounitSize, which reopen can change while it's read.
+func (d *DrawCtrler) iounit() int {
+	d.bufMu.Lock()
+	defer d.bufMu.Unlock()
+	return d.iounitSize
+}
+
+// errClosed is the error from writing to a DrawCtrler after Close.
+var errClosed = errors.New("draw connection is closed")
+
+// Close closes the connection's data and ctl files, which makes the
+// server free everything that was allocated on it. Anything sent
+// afterwards fails with an error, and closing it again does nothing.
+func (d *DrawCtrler) Close() error {
+	d.drawMu.Lock()
+	defer d.drawMu.Unlock()
+	d.bufMu.Lock()
+	defer d.bufMu.Unlock()
+	d.ctlMu.Lock()
+	defer d.ctlMu.Unlock()
+	if d.err == errClosed {
+		return nil
+	}
+	d.err = errClosed
+	return d.closeFiles()
+}
+
+// closeFiles closes the data and ctl files, and returns the first error.
+// It must be called with drawMu, bufMu and ctlMu held.
+func (d *DrawCtrler) closeFiles() error {
+	var err error
+	if d.data != nil {
+		err = d.data.Close()
+	}
+	if d.ctl != nil {
+		if cerr := d.ctl.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// reallocLive allocates every image in LiveIDs again after reopen, with
+// the same ID and arguments that it was allocated with the first time,
+// except for the clipping set by Reclip since. The images that were on a
+// screen are put on sid, which is the one that AllocScreen returned on
+// the new connection. Whatever was drawn in them is lost, so they're
+// filled with the colour that they were allocated with, and it's up to
+// the caller to upload anything else.
+func (d *DrawCtrler) reallocLive(sid screenId) error {
+	for _, id := range d.LiveIDs() {
+		d.idMu.Lock()
+		img, ok := d.live[id]
+		if ok && img.onScreen {
+			img.msg = append([]byte(nil), img.msg...)
+			binary.LittleEndian.PutUint32(img.msg[4:], uint32(sid))
+			d.live[id] = img
+		}
+		d.idMu.Unlock()
+		if !ok {
+			continue
+		}
+		if err := d.sendMessage('b', img.msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush sends a 'v' message, which makes the server flush any changes to
+// the screen image to the display. It's harmless if there aren't any.
+func (d *DrawCtrler) Flush() error {
+	// a flush in the middle of another goroutine's draw would be
+	// harmless, but waiting for it keeps the draw in the same flush.
+	d.drawMu.Lock()
+	defer d.drawMu.Unlock()
+	return d.sendMessage('v', nil)
+}
+
+// Sync flushes the server like Flush, and then waits until the server
+// has processed every message that was sent before it, by reading back
+// a pixel of an image allocated for the purpose. A read can only be
+// answered once the messages before it have been, so after Sync returns,
+// reading back an image sees everything that was drawn into it.
+func (d *DrawCtrler) Sync() error {
+	if err := d.Flush(); err != nil {
+		return err
+	}
+	r := image.Rect(0, 0, 1, 1)
+	id := d.AllocBuffer(0, false, r, r, color.Transparent)
+	defer d.FreeID(id)
+	var pix [4]byte
+	if err := d.ReadSubimageInto(id, r, pix[:]); err != nil {
+		return fmt.Errorf("sync: %v", err)
+	}
+	return nil
+}
+
+// SetOp sets the compositing operation for the next draw to op. It stays
+// set on the server until the next 'O' message, which any of the drawing
+// methods may send.
 //
-// This isn't exposed, because it should only be called by Draw,
-// which needs to apply a mutex.
-func (d *DrawCtrler) setOp(op draw.Op) {
+// Draw and the other drawing methods set the operation themselves, so
+// this is only needed before sending drawing messages some other way.
+func (d *DrawCtrler) SetOp(op draw.Op) error {
+	d.drawMu.Lock()
+	defer d.drawMu.Unlock()
+	return d.setOpLocked(op)
+}
+
+// setOpLocked is like SetOp, but must be called with drawMu held, so that
+// no other goroutine can change the operation before the message which
+// it's for is sent.
+func (d *DrawCtrler) setOpLocked(op draw.Op) error {
 	// valid options according to draw(2):
 	//	Clear = 0
 	//	SinD  = 8
@@ -288,7 +956,16 @@ func (d *DrawCtrler) setOp(op draw.Op) {
 	default:
 		msg[0] = 11
 	}
-	d.sendMessage('O', msg)
+	return d.sendMessage('O', msg)
+}
+
+// sendOpMessage sends an 'O' message for op followed by the drawing
+// message cmd, which is drawn with it. It must be called with drawMu held.
+func (d *DrawCtrler) sendOpMessage(op draw.Op, cmd byte, val []byte) error {
+	if err := d.setOpLocked(op); err != nil {
+		return err
+	}
+	return d.sendMessage(cmd, val)
 }
 
 // Draw formats the parameters appropriate to send the message:
@@ -296,11 +973,28 @@ func (d *DrawCtrler) setOp(op draw.Op) {
 // to /dev/draw/n/data.
 // See draw(3) for details.
 func (d *DrawCtrler) Draw(dstid, srcid, maskid uint32, r image.Rectangle, srcp, maskp image.Point, op draw.Op) {
+	d.draw(dstid, srcid, maskid, r, srcp, maskp, op)
+}
+
+// DrawRect is like Draw, for the common case of a source which is in the
+// same coordinates as the destination, so that the rectangle dr of srcid
+// is drawn into the same rectangle of dstid. The mask is read from
+// image.ZP, which suits a replicated mask such as a solid one. Unlike
+// Draw, it returns the error from sending the message.
+func (d *DrawCtrler) DrawRect(dstid, srcid, maskid uint32, dr image.Rectangle, op draw.Op) error {
+	dr = dr.Canon()
+	return d.draw(dstid, srcid, maskid, dr, dr.Min, image.ZP, op)
+}
+
+// draw does the work of Draw and DrawRect.
+func (d *DrawCtrler) draw(dstid, srcid, maskid uint32, r image.Rectangle, srcp, maskp image.Point, op draw.Op) error {
+	// there's nothing to draw into an empty rectangle.
+	if r = r.Canon(); r.Empty() {
+		return nil
+	}
 	d.drawMu.Lock()
 	defer d.drawMu.Unlock()
 
-	d.setOp(op)
-
 	msg := make([]byte, 44)
 	binary.LittleEndian.PutUint32(msg[0:], dstid)
 	binary.LittleEndian.PutUint32(msg[4:], srcid)
@@ -313,12 +1007,181 @@ func (d *DrawCtrler) Draw(dstid, srcid, maskid uint32, r image.Rectangle, srcp,
 	binary.LittleEndian.PutUint32(msg[32:], uint32(srcp.Y))
 	binary.LittleEndian.PutUint32(msg[36:], uint32(maskp.X))
 	binary.LittleEndian.PutUint32(msg[40:], uint32(maskp.Y))
-	d.sendMessage('d', msg)
+	return d.sendOpMessage(op, 'd', msg)
+}
+
+// End styles for the ends of a line, as described in draw(2).
+const (
+	EndSquare = 0
+	EndDisc   = 1
+	EndArrow  = 2
+)
+
+// Line formats the parameters appropriate to send the message:
+//    L dstid[4] p0[2*4] p1[2*4] end0[4] end1[4] thick[4] srcid[4] sp[2*4]
+// to /dev/draw/n/data.
+// The line is 1+2*thick pixels wide. See draw(3) for details.
+func (d *DrawCtrler) Line(dstid uint32, p0, p1 image.Point, end0, end1, thick int, srcid uint32, sp image.Point, op draw.Op) {
+	d.drawMu.Lock()
+	defer d.drawMu.Unlock()
+
+	msg := make([]byte, 44)
+	binary.LittleEndian.PutUint32(msg[0:], dstid)
+	binary.LittleEndian.PutUint32(msg[4:], uint32(p0.X))
+	binary.LittleEndian.PutUint32(msg[8:], uint32(p0.Y))
+	binary.LittleEndian.PutUint32(msg[12:], uint32(p1.X))
+	binary.LittleEndian.PutUint32(msg[16:], uint32(p1.Y))
+	binary.LittleEndian.PutUint32(msg[20:], uint32(end0))
+	binary.LittleEndian.PutUint32(msg[24:], uint32(end1))
+	binary.LittleEndian.PutUint32(msg[28:], uint32(thick))
+	binary.LittleEndian.PutUint32(msg[32:], srcid)
+	binary.LittleEndian.PutUint32(msg[36:], uint32(sp.X))
+	binary.LittleEndian.PutUint32(msg[40:], uint32(sp.Y))
+	d.sendOpMessage(op, 'L', msg)
+}
+
+// Ellipse formats the parameters appropriate to send the message:
+//    e dstid[4] srcid[4] center[2*4] a[4] b[4] thick[4] sp[2*4] alpha[4] phi[4]
+// to /dev/draw/n/data.
+// If arc is set, only the arc starting at alpha degrees and spanning phi
+// degrees is drawn, otherwise alpha and phi are ignored. The outline is
+// 1+2*thick pixels wide. See draw(3) and ellipse(2) for details.
+func (d *DrawCtrler) Ellipse(dstid, srcid uint32, center image.Point, a, b, thick int, sp image.Point, arc bool, alpha, phi int, op draw.Op) {
+	d.drawMu.Lock()
+	defer d.drawMu.Unlock()
+
+	msg := make([]byte, 44)
+	binary.LittleEndian.PutUint32(msg[0:], dstid)
+	binary.LittleEndian.PutUint32(msg[4:], srcid)
+	binary.LittleEndian.PutUint32(msg[8:], uint32(center.X))
+	binary.LittleEndian.PutUint32(msg[12:], uint32(center.Y))
+	binary.LittleEndian.PutUint32(msg[16:], uint32(a))
+	binary.LittleEndian.PutUint32(msg[20:], uint32(b))
+	binary.LittleEndian.PutUint32(msg[24:], uint32(thick))
+	binary.LittleEndian.PutUint32(msg[28:], uint32(sp.X))
+	binary.LittleEndian.PutUint32(msg[32:], uint32(sp.Y))
+	// the high bit of alpha is what distinguishes an arc from a
+	// whole ellipse.
+	if arc {
+		binary.LittleEndian.PutUint32(msg[36:], uint32(alpha)|1<<31)
+		binary.LittleEndian.PutUint32(msg[40:], uint32(phi))
+	}
+	d.sendOpMessage(op, 'e', msg)
+}
+
+// InitFont sends the message:
+//    i id[4] n[4] ascent[1]
+// to /dev/draw/n/data, which makes the image id a font cache holding
+// n characters. See draw(3) for details.
+func (d *DrawCtrler) InitFont(id uint32, n int, ascent uint8) {
+	msg := make([]byte, 9)
+	binary.LittleEndian.PutUint32(msg[0:], id)
+	binary.LittleEndian.PutUint32(msg[4:], uint32(n))
+	msg[8] = ascent
+	d.sendMessage('i', msg)
+}
+
+// LoadChar sends the message:
+//    l cacheid[4] srcid[4] index[2] r[4*4] sp[2*4] left[1] width[1]
+// to /dev/draw/n/data, which copies r of srcid, starting at sp, into the
+// font cache cacheid and records it as character index.
+// See draw(3) for details.
+func (d *DrawCtrler) LoadChar(cacheid, srcid uint32, index int, r image.Rectangle, sp image.Point, left int8, width uint8) {
+	msg := make([]byte, 36)
+	binary.LittleEndian.PutUint32(msg[0:], cacheid)
+	binary.LittleEndian.PutUint32(msg[4:], srcid)
+	binary.LittleEndian.PutUint16(msg[8:], uint16(index))
+	binary.LittleEndian.PutUint32(msg[10:], uint32(r.Min.X))
+	binary.LittleEndian.PutUint32(msg[14:], uint32(r.Min.Y))
+	binary.LittleEndian.PutUint32(msg[18:], uint32(r.Max.X))
+	binary.LittleEndian.PutUint32(msg[22:], uint32(r.Max.Y))
+	binary.LittleEndian.PutUint32(msg[26:], uint32(sp.X))
+	binary.LittleEndian.PutUint32(msg[30:], uint32(sp.Y))
+	msg[34] = byte(left)
+	msg[35] = width
+	d.sendMessage('l', msg)
+}
+
+// String formats the parameters appropriate to send the message:
+//    s dstid[4] srcid[4] fontid[4] p[2*4] clipr[4*4] sp[2*4] ni[2] ni*(index[2])
+// to /dev/draw/n/data, which draws the characters at indices of the
+// font cache fontid in srcid, with the left end of their baseline at p.
+// The server finds the top from the ascent that the cache was
+// initialized with. sp is aligned with p. See draw(3) for details.
+func (d *DrawCtrler) String(dstid, srcid, fontid uint32, p image.Point, clipr image.Rectangle, sp image.Point, indices []uint16, op draw.Op) {
+	d.drawMu.Lock()
+	defer d.drawMu.Unlock()
+
+	msg := make([]byte, 46+2*len(indices))
+	binary.LittleEndian.PutUint32(msg[0:], dstid)
+	binary.LittleEndian.PutUint32(msg[4:], srcid)
+	binary.LittleEndian.PutUint32(msg[8:], fontid)
+	binary.LittleEndian.PutUint32(msg[12:], uint32(p.X))
+	binary.LittleEndian.PutUint32(msg[16:], uint32(p.Y))
+	binary.LittleEndian.PutUint32(msg[20:], uint32(clipr.Min.X))
+	binary.LittleEndian.PutUint32(msg[24:], uint32(clipr.Min.Y))
+	binary.LittleEndian.PutUint32(msg[28:], uint32(clipr.Max.X))
+	binary.LittleEndian.PutUint32(msg[32:], uint32(clipr.Max.Y))
+	binary.LittleEndian.PutUint32(msg[36:], uint32(sp.X))
+	binary.LittleEndian.PutUint32(msg[40:], uint32(sp.Y))
+	binary.LittleEndian.PutUint16(msg[44:], uint16(len(indices)))
+	for i, idx := range indices {
+		binary.LittleEndian.PutUint16(msg[46+2*i:], idx)
+	}
+	d.sendOpMessage(op, 's', msg)
+}
+
+// StringBg formats the parameters appropriate to send the message:
+//    x dstid[4] srcid[4] fontid[4] p[2*4] clipr[4*4] sp[2*4] ni[2] bgid[4] bgp[2*4] ni*(index[2])
+// to /dev/draw/n/data. It's like String, but first fills the area behind
+// each character with bgid, aligning bgp with p, so that text can be drawn
+// over whatever was there without clearing it first.
+// See draw(3) for details.
+func (d *DrawCtrler) StringBg(dstid, srcid, fontid uint32, p image.Point, clipr image.Rectangle, sp image.Point, bgid uint32, bgp image.Point, indices []uint16, op draw.Op) {
+	d.drawMu.Lock()
+	defer d.drawMu.Unlock()
+
+	msg := make([]byte, 58+2*len(indices))
+	binary.LittleEndian.PutUint32(msg[0:], dstid)
+	binary.LittleEndian.PutUint32(msg[4:], srcid)
+	binary.LittleEndian.PutUint32(msg[8:], fontid)
+	binary.LittleEndian.PutUint32(msg[12:], uint32(p.X))
+	binary.LittleEndian.PutUint32(msg[16:], uint32(p.Y))
+	binary.LittleEndian.PutUint32(msg[20:], uint32(clipr.Min.X))
+	binary.LittleEndian.PutUint32(msg[24:], uint32(clipr.Min.Y))
+	binary.LittleEndian.PutUint32(msg[28:], uint32(clipr.Max.X))
+	binary.LittleEndian.PutUint32(msg[32:], uint32(clipr.Max.Y))
+	binary.LittleEndian.PutUint32(msg[36:], uint32(sp.X))
+	binary.LittleEndian.PutUint32(msg[40:], uint32(sp.Y))
+	binary.LittleEndian.PutUint16(msg[44:], uint16(len(indices)))
+	binary.LittleEndian.PutUint32(msg[46:], bgid)
+	binary.LittleEndian.PutUint32(msg[50:], uint32(bgp.X))
+	binary.LittleEndian.PutUint32(msg[54:], uint32(bgp.Y))
+	for i, idx := range indices {
+		binary.LittleEndian.PutUint16(msg[58+2*i:], idx)
+	}
+	d.sendOpMessage(op, 'x', msg)
 }
 
 // Implements the compression format described in image(6) for use in
-// 'Y' messages if the /dev/draw driver isn't libmemdraw.
-func (d *DrawCtrler) compressedReplaceSubimage(dstid uint32, r image.Rectangle, pixels []byte) {
+// 'Y' messages if the /dev/draw driver isn't libmemdraw. Like
+// ReplaceSubimage, it returns an error and sends nothing if there are too
+// few pixels for r.
+func (d *DrawCtrler) compressedReplaceSubimage(dstid uint32, r image.Rectangle, pixels []byte) error {
+	r = r.Canon()
+	if n := r.Dx() * r.Dy() * 4; len(pixels) < n {
+		return fmt.Errorf("replace subimage: %d bytes of pixels for %v, want %d", len(pixels), r, n)
+	}
+	d.compressedReplaceRows(dstid, r, pixels, r.Dx()*4)
+	return nil
+}
+
+// compressedReplaceRows does the work of compressedReplaceSubimage for
+// pixels whose rows start stride bytes apart. The rows are compressed one
+// at a time into a buffer that's never more than one message, so the
+// memory used doesn't depend on the size of r. Rows which compression
+// would make bigger, such as noise, are sent uncompressed instead.
+func (d *DrawCtrler) compressedReplaceRows(dstid uint32, r image.Rectangle, pixels []byte, stride int) {
 	// "Pixels are encoding using a version of Lempel & Ziv's sliging window scheme LZ77."
 	// We don't care about the rest of image(6), because we're not using the image format,
 	// just the same LZ77 compression.
@@ -328,91 +1191,298 @@ func (d *DrawCtrler) compressedReplaceSubimage(dstid uint32, r image.Rectangle,
 	// the Y message before appending it if so.
 
 	blockYStart := 0
+	// rows which compression makes bigger are collected from rawYStart
+	// up to blockYStart, and sent uncompressed together by sendRaw.
+	rawYStart := 0
 	rSize := r.Size()
 
-	compressed := make([]byte, 0)
+	// limit is how much compressed data a message can hold after its
+	// 21 byte header.
+	limit := d.compressedBandSize()
+
+	// block is the message for /dev/draw/data that's being built. The
+	// header is filled in by sendBlock, and the compressed rows follow it.
+	block := make([]byte, 20, 20+limit)
+	// sendBlock sends the rows from blockYStart up to (but not including)
+	// end, which have already been compressed into block[20:n].
+	sendBlock := func(end, n int) {
+		if end == blockYStart {
+			return
+		}
+		encodeRect(block, dstid, image.Rect(r.Min.X, r.Min.Y+blockYStart, r.Max.X, r.Min.Y+end))
+		d.sendMessage('Y', block[:n])
+
+		// keep track of information for the next message
+		blockYStart = end
+		rawYStart = end
+	}
+
+	sendRaw := func() {
+		if rawYStart == blockYStart {
+			return
+		}
+		d.uncompressedReplaceRows(dstid, image.Rect(r.Min.X, r.Min.Y+rawYStart, r.Max.X, r.Min.Y+blockYStart), pixels[rawYStart*stride:], stride)
+		rawYStart = blockYStart
+	}
+
 	// use rSize instead of r.Min.Y to make indexing into pixels easier.
 	for i := 0; i < rSize.Y; i += 1 {
-
-		rowStart := i * 4 * rSize.X
+		rowStart := i * stride
 		linePixels := pixels[rowStart : rowStart+(rSize.X*4)]
-		compressedLine := compress(linePixels)
-		// Note that even though image(6) says the compression format should be less
-		// than 6000 to fit in a 9p unit, we're actually just using the lz77 compression
-		// described. We know the iounitSize, so use it as the cutoff.
-		if len(compressed)+len(compressedLine) >= d.iounitSize || i == rSize.Y-1 {
-			// construct the message for /dev/draw/data
-			msg := make([]byte, 20+len(compressed))
-			binary.LittleEndian.PutUint32(msg[0:], dstid)
-			binary.LittleEndian.PutUint32(msg[4:], uint32(r.Min.X))
-			binary.LittleEndian.PutUint32(msg[8:], uint32(r.Min.Y+blockYStart))
-			binary.LittleEndian.PutUint32(msg[12:], uint32(r.Max.X))
-			binary.LittleEndian.PutUint32(msg[16:], uint32(r.Min.Y+i))
-			copy(msg[20:], compressed)
-			d.sendMessage('Y', msg)
-
-			// keep track of information for the next message
-			blockYStart = i
-			compressed = compressedLine
-		} else {
-			compressed = append(compressed, compressedLine...)
+		start := len(block)
+		block = compressAppend(block, linePixels, d.lookbackSize())
+		lineLen := len(block) - start
+		if lineLen >= len(linePixels) && len(linePixels) <= limit {
+			// compression made this row bigger, so send what we have so
+			// far and add the row to the ones that are sent uncompressed.
+			sendBlock(i, start)
+			block = block[:20]
+			blockYStart = i + 1
+			continue
+		}
+		sendRaw()
+		if lineLen >= len(linePixels) || lineLen > limit {
+			// the row doesn't fit in a message by itself. Send what we
+			// have so far, and then the row on its own.
+			sendBlock(i, start)
+			block = d.replaceLongRow(dstid, image.Rect(r.Min.X, r.Min.Y+i, r.Max.X, r.Min.Y+i+1), linePixels, block)[:20]
+			blockYStart = i + 1
+			rawYStart = blockYStart
+			continue
 		}
+		// Row i isn't part of the block being sent, it starts the next one.
+		if len(block)-20 > limit {
+			sendBlock(i, start)
+			block = block[:20+copy(block[20:], block[start:])]
+		}
+	}
+	// send whatever is left over, which always includes the last row.
+	sendRaw()
+	sendBlock(rSize.Y, len(block))
+}
 
+// configure applies the parts of opts which affect how messages are
+// written to /dev/draw.
+func (d *DrawCtrler) configure(opts DevdrawOptions) {
+	if opts.IOUnitSize > 0 && opts.IOUnitSize < d.iounitSize {
+		d.iounitSize = opts.IOUnitSize
 	}
+	d.noCompress = opts.DisableCompression
+	d.lookback = opts.LookbackSize
+	d.maxBand = opts.MaxCompressedBand
+}
+
+// defaultCompressedBand is the default for DevdrawOptions.MaxCompressedBand.
+// image(6) says that a block of compressed data should be less than 6000
+// bytes to fit in a 9P message with its overhead, and some servers reject
+// 'Y' messages that fill the whole iounit.
+const defaultCompressedBand = 6000
+
+// compressedBandSize returns the most bytes of compressed data that a 'Y'
+// message can hold. It's small enough for the message, with its 21 byte
+// header, to fit in the iounit.
+func (d *DrawCtrler) compressedBandSize() int {
+	n := d.maxBand
+	if n <= 0 {
+		n = defaultCompressedBand
+	}
+	if max := d.iounit() - 21; n > max {
+		n = max
+	}
+	return n
+}
+
+// defaultCompressThreshold is the default for DrawCtrler.CompressThreshold.
+const defaultCompressThreshold = 256
+
+// useCompression reports whether an image of n bytes should be sent with
+// the compressed 'Y' form.
+func (d *DrawCtrler) useCompression(n int) bool {
+	if d.noCompress {
+		return false
+	}
+	// Don't bother with small images, because the overhead of the compression will
+	// probably be worse than the gain. 256 is entirely arbitrary.
+	threshold := d.CompressThreshold
+	if threshold <= 0 {
+		threshold = defaultCompressThreshold
+	}
+	if n <= threshold {
+		return false
+	}
+	// the in-memory /dev/draw driver has an iounit size of 65535. If it's less than
+	// that, it's probably because it's a remote implementation with some overhead
+	// somewhere.
+	return d.ForceCompress || d.iounit() < 65535
+}
+
+// lookbackSize returns how far back to search for matches when
+// compressing.
+func (d *DrawCtrler) lookbackSize() int {
+	switch {
+	case d.lookback <= 0:
+		return defaultLookback
+	case d.lookback > maxLookback:
+		return maxLookback
+	}
+	return d.lookback
+}
+
+// replaceLongRow is used by compressedReplaceSubimage for a row r which
+// can't be sent in a 'Y' message with other rows. If the row doesn't fit
+// in a band, it's split into strips which are compressed separately.
+// Anything which compression doesn't help is sent uncompressed. The
+// messages are built in buf, which is returned so that it can be reused.
+func (d *DrawCtrler) replaceLongRow(dstid uint32, r image.Rectangle, pixels, buf []byte) []byte {
+	limit := d.compressedBandSize()
+	if len(pixels) <= limit {
+		buf = append(buf[:20], pixels...)
+		encodeRect(buf, dstid, r)
+		d.sendMessage('y', buf)
+		return buf
+	}
+	// the worst case for compress is 1 extra byte for every 128, so
+	// strips of this many pixels always fit in a band when compressed
+	// or not.
+	cols := limit * 128 / 129 / 4
+	if cols < 1 {
+		Log.Errorf("replace subimage: compressed band size %d is too small for a pixel", d.compressedBandSize())
+		return buf
+	}
+	for x := r.Min.X; x < r.Max.X; x += cols {
+		end := x + cols
+		if end > r.Max.X {
+			end = r.Max.X
+		}
+		strip := pixels[(x-r.Min.X)*4 : (end-r.Min.X)*4]
+		cmd := byte('Y')
+		if buf = compressAppend(buf[:20], strip, d.lookbackSize()); len(buf)-20 >= len(strip) {
+			cmd = 'y'
+			buf = append(buf[:20], strip...)
+		}
+		encodeRect(buf, dstid, image.Rect(x, r.Min.Y, end, r.Max.Y))
+		d.sendMessage(cmd, buf)
+	}
+	return buf
+}
+
+// encodeRect writes id[4] r[4*4], which starts the 'y', 'Y' and 'r'
+// messages, into the first 20 bytes of msg.
+func encodeRect(msg []byte, id uint32, r image.Rectangle) {
+	binary.LittleEndian.PutUint32(msg[0:], id)
+	binary.LittleEndian.PutUint32(msg[4:], uint32(r.Min.X))
+	binary.LittleEndian.PutUint32(msg[8:], uint32(r.Min.Y))
+	binary.LittleEndian.PutUint32(msg[12:], uint32(r.Max.X))
+	binary.LittleEndian.PutUint32(msg[16:], uint32(r.Max.Y))
+}
+
+// replaceRect sends a single 'y' or 'Y' message (depending on cmd)
+// replacing r, which must be small enough to fit in one message, with
+// pixels.
+func (d *DrawCtrler) replaceRect(cmd byte, dstid uint32, r image.Rectangle, pixels []byte) {
+	var hdr [20]byte
+	encodeRect(hdr[:], dstid, r)
+	d.sendMessagev(cmd, hdr[:], pixels)
 }
 
 // ReplaceSubimage replaces the rectangle r with the pixel buffer
-// defined by pixels.
+// defined by pixels, which must be tightly packed RGBA: 4 bytes per
+// pixel, with each row straight after the one above it, like the Pix of
+// an *image.RGBA whose Stride is 4*r.Dx(). If pixels is too short for r,
+// nothing is sent and an error is returned.
 //
 // It sends /dev/draw/n/data the message:
 //	y id[4] r[4*4] buf[x*1]
-func (d *DrawCtrler) ReplaceSubimage(dstid uint32, r image.Rectangle, pixels []byte) {
+func (d *DrawCtrler) ReplaceSubimage(dstid uint32, r image.Rectangle, pixels []byte) error {
+	r = r.Canon()
+	if n := r.Dx() * r.Dy() * 4; len(pixels) < n {
+		return fmt.Errorf("replace subimage: %d bytes of pixels for %v, want %d", len(pixels), r, n)
+	}
+	d.replaceRows(dstid, r, pixels, r.Dx()*4)
+	return nil
+}
+
+// replaceRGBA replaces the rectangle r with the pixels of src, which must
+// be the same size. Unlike ReplaceSubimage, the rows of src don't need to
+// be contiguous, so a sub-image can be sent without copying it first.
+func (d *DrawCtrler) replaceRGBA(dstid uint32, r image.Rectangle, src *image.RGBA) {
+	d.replaceRows(dstid, r, src.Pix, src.Stride)
+}
+
+// replaceRows does the work of ReplaceSubimage for pixels whose rows start
+// stride bytes apart. No more than one message is built at a time.
+func (d *DrawCtrler) replaceRows(dstid uint32, r image.Rectangle, pixels []byte, stride int) {
+	if r.Empty() {
+		return
+	}
 	// 9p limits the reads and writes to the iounit size, which is read from /proc/$pid/fd
 	// at startup. So we need to split up the command into multiple 'y' commands of the
 	// maximum iounit size if it doesn't fit in 1 message.
-	if d.iounitSize < 65535 && len(pixels) > 256 {
-		// the in-memory /dev/draw driver has an iounit size of 65535. If it's less than
-		// that, it's probably because it's a remote implementation with some overhead
-		// somewhere.
-		// In that case, use the compresssed 'Y' form instead and skip this.
-		// Don't bother with small images, because the overhead of the compression will
-		// probably be worse than the gain. 256 is entirely arbitrary.
-		d.compressedReplaceSubimage(dstid, r, pixels)
+	if d.useCompression(r.Dx() * r.Dy() * 4) {
+		d.compressedReplaceRows(dstid, r, pixels, stride)
 		return
 	}
+	d.uncompressedReplaceRows(dstid, r, pixels, stride)
+}
+
+// uncompressedReplaceRows sends the pixels of r with 'y' messages, split
+// into as few messages as the iounit size allows.
+func (d *DrawCtrler) uncompressedReplaceRows(dstid uint32, r image.Rectangle, pixels []byte, stride int) {
 	rSize := r.Size()
-	if (rSize.X*rSize.Y*4 + 21) < d.iounitSize {
-		msg := make([]byte, 20+(rSize.X*rSize.Y*4))
-		binary.LittleEndian.PutUint32(msg[0:], dstid)
-		binary.LittleEndian.PutUint32(msg[4:], uint32(r.Min.X))
-		binary.LittleEndian.PutUint32(msg[8:], uint32(r.Min.Y))
-		binary.LittleEndian.PutUint32(msg[12:], uint32(r.Max.X))
-		binary.LittleEndian.PutUint32(msg[16:], uint32(r.Max.Y))
-
-		copy(msg[20:], pixels)
-		d.sendMessage('y', msg)
+	rowLen := rSize.X * 4
+	// sendRows sends rows y0 to y1 of r in one message. The rows are
+	// passed to sendMessagev as they are, so that they're only copied
+	// once, into the message that's written.
+	var hdr [20]byte
+	var parts [][]byte
+	sendRows := func(y0, y1 int) {
+		encodeRect(hdr[:], dstid, image.Rect(r.Min.X, y0, r.Max.X, y1))
+		parts = append(parts[:0], hdr[:])
+		for y := y0; y < y1; y++ {
+			rowStart := (y - r.Min.Y) * stride
+			parts = append(parts, pixels[rowStart:rowStart+rowLen])
+		}
+		d.sendMessagev('y', parts...)
+	}
+	iounit := d.iounit()
+	if (rSize.X*rSize.Y*4 + 21) < iounit {
+		sendRows(r.Min.Y, r.Max.Y)
 		return
 	}
 
-	lineSize := d.iounitSize / 4 / rSize.X
-	msg := make([]byte, 20+(rSize.X*lineSize*4))
-	binary.LittleEndian.PutUint32(msg[0:], dstid)
-	binary.LittleEndian.PutUint32(msg[4:], uint32(r.Min.X))
-	binary.LittleEndian.PutUint32(msg[12:], uint32(r.Max.X))
+	// the message has a 21 byte header, as well as the pixels.
+	lineSize := (iounit - 21) / 4 / rSize.X
+	if lineSize == 0 {
+		d.replaceColumns(dstid, r, pixels, stride)
+		return
+	}
 	for i := r.Min.Y; i < r.Max.Y; i += lineSize {
 		endline := i + lineSize
 		if endline > r.Max.Y {
 			endline = r.Max.Y
-			msg = make([]byte, 20+(rSize.X*(endline-i)*4))
-			binary.LittleEndian.PutUint32(msg[0:], dstid)
-			binary.LittleEndian.PutUint32(msg[4:], uint32(r.Min.X))
-			binary.LittleEndian.PutUint32(msg[12:], uint32(r.Max.X))
+		}
+		sendRows(i, endline)
+	}
+}
 
+// replaceColumns is used by ReplaceSubimage when a single row of r is too
+// wide to fit in one message, and sends each row in strips that do.
+func (d *DrawCtrler) replaceColumns(dstid uint32, r image.Rectangle, pixels []byte, stride int) {
+	iounit := d.iounit()
+	cols := (iounit - 21) / 4
+	if cols < 1 {
+		Log.Errorf("replace subimage: iounit size %d is too small for a pixel", iounit)
+		return
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := pixels[(y-r.Min.Y)*stride:]
+		for x := r.Min.X; x < r.Max.X; x += cols {
+			end := x + cols
+			if end > r.Max.X {
+				end = r.Max.X
+			}
+			d.replaceRect('y', dstid, image.Rect(x, y, end, y+1), row[(x-r.Min.X)*4:(end-r.Min.X)*4])
 		}
-		binary.LittleEndian.PutUint32(msg[8:], uint32(i))
-		binary.LittleEndian.PutUint32(msg[16:], uint32(endline))
-		copy(msg[20:], pixels[i*rSize.X*4:])
-		d.sendMessage('y', msg)
 	}
 }
 
@@ -424,24 +1494,40 @@ func (d *DrawCtrler) ReplaceSubimage(dstid uint32, r image.Rectangle, pixels []b
 //
 // and then reads the data from /dev/draw/n/data.
 func (d *DrawCtrler) ReadSubimage(src uint32, r image.Rectangle) []uint8 {
+	// some /dev/draw implementations return an error for a read of
+	// nothing, so don't ask.
+	if r = r.Canon(); r.Empty() {
+		return []byte{}
+	}
 	rSize := r.Size()
-	msg := make([]byte, 20)
 	pixels := make([]byte, (rSize.X * rSize.Y * 4))
+	if err := d.ReadSubimageInto(src, r, pixels); err != nil {
+		panic(err)
+	}
+	return pixels
+}
 
-	if (rSize.X * rSize.Y * 4) < d.iounitSize {
-		binary.LittleEndian.PutUint32(msg[0:], src)
-		binary.LittleEndian.PutUint32(msg[4:], uint32(r.Min.X))
-		binary.LittleEndian.PutUint32(msg[8:], uint32(r.Min.Y))
-		binary.LittleEndian.PutUint32(msg[12:], uint32(r.Max.X))
-		binary.LittleEndian.PutUint32(msg[16:], uint32(r.Max.Y))
-
-		d.sendMessage('r', msg)
+// ReadSubimageInto is like ReadSubimage, but reads the pixel data into
+// dst instead of allocating a new buffer, so that callers which read
+// often can reuse one. dst must be at least 4*r.Dx()*r.Dy() bytes.
+func (d *DrawCtrler) ReadSubimageInto(src uint32, r image.Rectangle, dst []byte) error {
+	if r = r.Canon(); r.Empty() {
+		return nil
+	}
+	rSize := r.Size()
+	size := rSize.X * rSize.Y * 4
+	if len(dst) < size {
+		return fmt.Errorf("read subimage: buffer is %d bytes, need %d", len(dst), size)
+	}
+	msg := make([]byte, 20)
 
-		_, err := d.data.Read(pixels)
-		if err != nil {
-			panic(err)
+	iounit := d.iounit()
+	if size < iounit {
+		encodeRect(msg, src, r)
+		if err := d.sendMessage('r', msg); err != nil {
+			return err
 		}
-		return pixels
+		return d.readData(dst[:size])
 	}
 	// This has the same limitation of the 'y' command.
 	// Trying to read more than iounit size will return 0 bytes
@@ -449,31 +1535,83 @@ func (d *DrawCtrler) ReadSubimage(src uint32, r image.Rectangle) []uint8 {
 	// So, again, split it up into multiple reads and reconstruct
 	// it.
 	// There's no compressed variant for 'r'.
-	binary.LittleEndian.PutUint32(msg[0:], src)
-	binary.LittleEndian.PutUint32(msg[4:], uint32(r.Min.X))
-	binary.LittleEndian.PutUint32(msg[12:], uint32(r.Max.X))
-	lineSize := d.iounitSize / 4 / rSize.X
+	lineSize := iounit / 4 / rSize.X
+	if lineSize == 0 {
+		return d.readColumns(src, r, dst)
+	}
 
 	for i := r.Min.Y; i < r.Max.Y; i += lineSize {
 		endline := i + lineSize
 		if endline > r.Max.Y {
 			endline = r.Max.Y
 		}
-		binary.LittleEndian.PutUint32(msg[8:], uint32(i))
-		binary.LittleEndian.PutUint32(msg[16:], uint32(endline))
+		encodeRect(msg, src, image.Rect(r.Min.X, i, r.Max.X, endline))
 		pixelsOffset := (i - r.Min.Y) * rSize.X * 4
-		d.sendMessage('r', msg)
-		_, err := d.data.Read(pixels[pixelsOffset:])
+		if err := d.sendMessage('r', msg); err != nil {
+			return err
+		}
+		if err := d.readData(dst[pixelsOffset : pixelsOffset+(endline-i)*rSize.X*4]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readColumns is used by ReadSubimageInto when a single row of r is too
+// wide to be read at once, and reads each row in strips that aren't.
+func (d *DrawCtrler) readColumns(src uint32, r image.Rectangle, dst []byte) error {
+	iounit := d.iounit()
+	cols := iounit / 4
+	if cols < 1 {
+		return fmt.Errorf("read subimage: iounit size %d is too small for a pixel", iounit)
+	}
+	msg := make([]byte, 20)
+	stride := r.Dx() * 4
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := dst[(y-r.Min.Y)*stride:]
+		for x := r.Min.X; x < r.Max.X; x += cols {
+			end := x + cols
+			if end > r.Max.X {
+				end = r.Max.X
+			}
+			encodeRect(msg, src, image.Rect(x, y, end, y+1))
+			if err := d.sendMessage('r', msg); err != nil {
+				return err
+			}
+			if err := d.readData(row[(x-r.Min.X)*4 : (end-r.Min.X)*4]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readData fills p with the reply to an 'r' message. devdraw returns
+// the whole reply at once, but a transport in between, such as 9P
+// imported over a network, may hand it back in smaller pieces.
+func (d *DrawCtrler) readData(p []byte) error {
+	for len(p) > 0 {
+		n, err := d.data.Read(p)
+		p = p[n:]
+		if len(p) == 0 {
+			return nil
+		}
+		if err == io.EOF || (err == nil && n == 0) {
+			return fmt.Errorf("read subimage: short read, %d bytes missing", len(p))
+		}
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
-	return pixels
+	return nil
 }
 
 // Resizes dstid to be bound by r and changes the repl bit to
 // repl. This is mostly used when a window is resized.
 func (d *DrawCtrler) Reclip(dstid uint32, repl bool, r image.Rectangle) {
+	// unlike the others, an empty clipping rectangle still means
+	// something, so it's sent.
+	r = r.Canon()
 	msg := make([]byte, 21)
 
 	binary.LittleEndian.PutUint32(msg[0:], dstid)
@@ -484,40 +1622,75 @@ func (d *DrawCtrler) Reclip(dstid uint32, repl bool, r image.Rectangle) {
 	binary.LittleEndian.PutUint32(msg[9:], uint32(r.Min.Y))
 	binary.LittleEndian.PutUint32(msg[13:], uint32(r.Max.X))
 	binary.LittleEndian.PutUint32(msg[17:], uint32(r.Max.Y))
-	d.sendMessage('c', msg)
 
+	// reallocLive has to allocate the image with its new clipping, so
+	// the stored 'b' message is replaced by an updated copy. It's not
+	// changed in place, since reallocLive may be sending it.
+	d.idMu.Lock()
+	if img, ok := d.live[dstid]; ok {
+		b := append([]byte(nil), img.msg...)
+		b[13] = msg[4]
+		copy(b[30:46], msg[5:21])
+		img.msg = b
+		d.live[dstid] = img
+	}
+	d.idMu.Unlock()
+	d.sendMessage('c', msg)
 }
 
-// parseCtlString parses the output of the format returned by /dev/draw/new.
-// It can also be used to parse a /dev/draw/n/ctl output, but isn't currently.
+// parseCtlString parses the output of /dev/draw/new or /dev/draw/n/ctl.
+// As described in draw(3), that's the client id, the image id, the channel
+// format, whether the image is replicated, and the image's rectangle and
+// clipping rectangle. Some implementations leave out the replication flag,
+// so 11 fields are accepted as well. It returns nil if drawString isn't in
+// either form.
 func parseCtlString(drawString string) *DrawCtlMsg {
 	pieces := strings.Fields(drawString)
-	if len(pieces) != 12 {
-		fmt.Fprintf(os.Stderr, "Invalid /dev/draw ctl string: %s\n", drawString)
+	var repl string
+	switch len(pieces) {
+	case 12:
+		repl = pieces[3]
+		pieces = append(pieces[:3:3], pieces[4:]...)
+	case 11:
+	default:
+		Log.Warnf("Invalid /dev/draw ctl string: %s", drawString)
 		return nil
 	}
-	return &DrawCtlMsg{
-		N:              strToInt(pieces[0]),
-		DisplayImageId: strToInt(pieces[1]),
+	// everything other than the channel format is a number.
+	var n [10]int
+	for i, j := 0, 0; i < len(pieces); i++ {
+		if i == 2 {
+			continue
+		}
+		v, err := strconv.Atoi(pieces[i])
+		if err != nil {
+			Log.Warnf("Invalid /dev/draw ctl string: %s", drawString)
+			return nil
+		}
+		n[j] = v
+		j++
+	}
+	msg := &DrawCtlMsg{
+		N:              n[0],
+		DisplayImageId: n[1],
 		ChannelFormat:  pieces[2],
-		// the man page says there are 12 strings returned by /dev/draw/new,
-		// and in fact there are, but I only count 11 described in the man page
-		// pieces[3] seems to be the location of the mystery value.
-		// It seems to be "0" when I just do a cat /dev/draw/new
-		MysteryValue: pieces[3],
-		DisplaySize: image.Rectangle{
-			Min: image.Point{strToInt(pieces[4]), strToInt(pieces[5])},
-			Max: image.Point{strToInt(pieces[6]), strToInt(pieces[7])},
-		},
-		Clipping: image.Rectangle{
-			Min: image.Point{strToInt(pieces[8]), strToInt(pieces[9])},
-			Max: image.Point{strToInt(pieces[10]), strToInt(pieces[11])},
-		},
-	}
-}
-
-// helper function for parseCtlstring that returns a single value instead of a multi-value
-// so that it can be used inline..
+		MysteryValue:   repl,
+		DisplaySize:    image.Rectangle{image.Pt(n[2], n[3]), image.Pt(n[4], n[5])},
+		Clipping:       image.Rectangle{image.Pt(n[6], n[7]), image.Pt(n[8], n[9])},
+	}
+	if repl != "" {
+		v, err := strconv.Atoi(repl)
+		if err != nil {
+			Log.Warnf("Invalid /dev/draw ctl string: %s", drawString)
+			return nil
+		}
+		msg.Repl = v != 0
+	}
+	return msg
+}
+
+// helper function for parsing the numbers in font files and /dev/wctl that
+// returns a single value instead of a multi-value so that it can be used inline..
 func strToInt(s string) int {
 	i, err := strconv.Atoi(strings.TrimSpace(s))
 	if err != nil {
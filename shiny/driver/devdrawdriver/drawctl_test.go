@@ -0,0 +1,1414 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+// fakeData stands in for /dev/draw/n/data. Every write is recorded as
+// a separate message, and reads are served from reads.
+type fakeData struct {
+	msgs  [][]byte
+	reads bytes.Buffer
+
+	// the driver closes some files from two goroutines, to interrupt
+	// blocking reads.
+	mu     sync.Mutex
+	closed bool
+}
+
+func (f *fakeData) Write(p []byte) (int, error) {
+	f.msgs = append(f.msgs, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (f *fakeData) Read(p []byte) (int, error) {
+	if f.reads.Len() == 0 {
+		return 0, io.EOF
+	}
+	return f.reads.Read(p)
+}
+
+func (f *fakeData) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// cmds returns the command byte of every message that was written.
+func (f *fakeData) cmds() string {
+	var s []byte
+	for _, m := range f.msgs {
+		s = append(s, m[0])
+	}
+	return string(s)
+}
+
+func newTestCtrler(iounitSize int) (*DrawCtrler, *fakeData) {
+	f := &fakeData{}
+	d := NewDrawCtrlerFromTransport(f, iounitSize)
+	d.N = 1
+	return d, f
+}
+
+// rawRect is like msgRect, but returns the rectangle as it was sent,
+// without making it canonical.
+func rawRect(msg []byte) image.Rectangle {
+	p := func(b []byte) int { return int(int32(binary.LittleEndian.Uint32(b))) }
+	return image.Rectangle{image.Pt(p(msg[0:]), p(msg[4:])), image.Pt(p(msg[8:]), p(msg[12:]))}
+}
+
+func msgRect(msg []byte) image.Rectangle {
+	return image.Rect(
+		int(int32(binary.LittleEndian.Uint32(msg[0:]))),
+		int(int32(binary.LittleEndian.Uint32(msg[4:]))),
+		int(int32(binary.LittleEndian.Uint32(msg[8:]))),
+		int(int32(binary.LittleEndian.Uint32(msg[12:]))),
+	)
+}
+
+// msgPoint decodes the point at the start of msg. Unlike msgRect, it can
+// be used for the source and mask points of a 'd' message, which aren't
+// a rectangle.
+func msgPoint(msg []byte) image.Point {
+	return image.Pt(
+		int(int32(binary.LittleEndian.Uint32(msg[0:]))),
+		int(int32(binary.LittleEndian.Uint32(msg[4:]))),
+	)
+}
+
+// decompress is the inverse of compress, as described in image(6).
+func decompress(t *testing.T, data []byte) []byte {
+	var pix []byte
+	for i := 0; i < len(data); {
+		c := data[i]
+		if c&0x80 != 0 {
+			n := int(c&0x7F) + 1
+			pix = append(pix, data[i+1:i+1+n]...)
+			i += 1 + n
+			continue
+		}
+		n := int(c>>2) + 3
+		off := (int(c&3)<<8 | int(data[i+1])) + 1
+		if off > len(pix) {
+			t.Fatalf("back reference %d before start of data (len %d)", off, len(pix))
+		}
+		for j := 0; j < n; j++ {
+			pix = append(pix, pix[len(pix)-off])
+		}
+		i += 2
+	}
+	return pix
+}
+
+// replay applies the 'y' and 'Y' messages in msgs to an image of size r,
+// and reports an error if any row is written more than once.
+func replay(t *testing.T, msgs [][]byte, r image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(r)
+	seen := make(map[int]bool)
+	for _, m := range msgs {
+		if m[0] != 'y' && m[0] != 'Y' {
+			continue
+		}
+		mr := msgRect(m[5:])
+		pix := m[21:]
+		if m[0] == 'Y' {
+			pix = decompress(t, pix)
+		}
+		if want := mr.Dx() * mr.Dy() * 4; len(pix) != want {
+			t.Fatalf("%c message for %v has %d bytes of pixels, want %d", m[0], mr, len(pix), want)
+		}
+		for y := mr.Min.Y; y < mr.Max.Y; y++ {
+			for x := mr.Min.X; x < mr.Max.X; x++ {
+				if seen[y*r.Dx()+x] {
+					t.Errorf("pixel (%d, %d) sent more than once", x, y)
+				}
+				seen[y*r.Dx()+x] = true
+			}
+			row := pix[(y-mr.Min.Y)*mr.Dx()*4:]
+			copy(img.Pix[img.PixOffset(mr.Min.X, y):], row[:mr.Dx()*4])
+		}
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if !seen[y*r.Dx()+x] {
+				t.Fatalf("pixel (%d, %d) never sent", x, y)
+			}
+		}
+	}
+	return img
+}
+
+func gradient(r image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			img.Pix[i+0] = uint8(x)
+			img.Pix[i+1] = uint8(y)
+			img.Pix[i+2] = uint8(x * y)
+			img.Pix[i+3] = 0xff
+		}
+	}
+	return img
+}
+
+// bufTransport is a drawTransport which writes everything into one
+// bytes.Buffer.
+type bufTransport struct {
+	bytes.Buffer
+}
+
+func (b *bufTransport) Close() error { return nil }
+
+// le returns vals in little endian order, as they appear in a message.
+func le(vals ...uint32) []byte {
+	var b []byte
+	for _, v := range vals {
+		b = append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	}
+	return b
+}
+
+func TestDrawCtrlerFromTransport(t *testing.T) {
+	var buf bufTransport
+	d := NewDrawCtrlerFromTransport(&buf, 65535)
+
+	r := image.Rect(0, 0, 2, 1)
+	id := d.AllocBuffer(RefNone, false, r, r, color.RGBA{0x10, 0x20, 0x30, 0xff})
+	d.ReplaceSubimage(id, r, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	d.FreeID(id)
+
+	var want []byte
+	want = append(want, 'b')
+	want = append(want, le(id, 0)...)
+	want = append(want, RefNone)
+	want = append(want, le(chanABGR32)...)
+	want = append(want, 0)
+	want = append(want, le(0, 0, 2, 1, 0, 0, 2, 1)...)
+	want = append(want, 0xff, 0x30, 0x20, 0x10)
+	want = append(want, 'y')
+	want = append(want, le(id, 0, 0, 2, 1)...)
+	want = append(want, 1, 2, 3, 4, 5, 6, 7, 8)
+	want = append(want, 'f')
+	want = append(want, le(id)...)
+	if got := buf.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("sent\n% x\nwant\n% x", got, want)
+	}
+
+	// there's no ctl channel.
+	if _, err := d.ReadCtl(); err == nil {
+		t.Errorf("ReadCtl succeeded without a ctl channel")
+	}
+}
+
+func TestReplaceSubimageShort(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		replace func(d *DrawCtrler, id uint32, r image.Rectangle, pixels []byte) error
+	}{
+		{"ReplaceSubimage", (*DrawCtrler).ReplaceSubimage},
+		{"compressedReplaceSubimage", (*DrawCtrler).compressedReplaceSubimage},
+	} {
+		d, f := newTestCtrler(65535)
+		r := image.Rect(0, 0, 4, 3)
+		// a byte short, as when the size of the rows was miscounted.
+		err := tc.replace(d, 1, r, make([]byte, 4*4*3-1))
+		if err == nil || !strings.Contains(err.Error(), "47 bytes") {
+			t.Errorf("%s: got error %v, want one about the 47 bytes", tc.name, err)
+		}
+		if len(f.msgs) != 0 {
+			t.Errorf("%s: sent %q for too few pixels, want nothing", tc.name, f.cmds())
+		}
+		if d.Err() != nil {
+			t.Errorf("%s: Err() = %v, want the connection to still be usable", tc.name, d.Err())
+		}
+		if err := tc.replace(d, 1, r, make([]byte, 4*4*3)); err != nil {
+			t.Errorf("%s: got error %v for the right number of pixels", tc.name, err)
+		}
+	}
+}
+
+func TestEncodeRect(t *testing.T) {
+	// id[4] r[4*4], little endian, as in draw(3).
+	msg := make([]byte, 24)
+	encodeRect(msg, 0x01020304, image.Rect(-1, 2, 0x300, 0x40000))
+	want := []byte{
+		4, 3, 2, 1,
+		0xff, 0xff, 0xff, 0xff,
+		2, 0, 0, 0,
+		0, 3, 0, 0,
+		0, 0, 4, 0,
+		0, 0, 0, 0,
+	}
+	if !bytes.Equal(msg, want) {
+		t.Errorf("got % x, want % x", msg, want)
+	}
+}
+
+func TestCompressedReplaceSubimage(t *testing.T) {
+	r := image.Rect(0, 0, 37, 23)
+	src := gradient(r)
+	for _, iounit := range []int{64, 200, 1000, 1 << 20} {
+		d, f := newTestCtrler(iounit)
+		d.compressedReplaceSubimage(3, r, src.Pix)
+		if len(f.msgs) == 0 {
+			t.Fatalf("iounit %d: no messages sent", iounit)
+		}
+		got := replay(t, f.msgs, r)
+		if !bytes.Equal(got.Pix, src.Pix) {
+			t.Errorf("iounit %d: uploaded pixels don't match the source", iounit)
+		}
+	}
+}
+
+func TestCompressedReplaceSubimageIncompressible(t *testing.T) {
+	r := image.Rect(0, 0, 37, 5)
+	src := image.NewRGBA(r)
+	rand.New(rand.NewSource(1)).Read(src.Pix)
+
+	d, f := newTestCtrler(1000)
+	d.compressedReplaceSubimage(3, r, src.Pix)
+	// the rows are sent together, as they would be without compression.
+	if got, want := f.cmds(), "y"; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	got := replay(t, f.msgs, r)
+	if !bytes.Equal(got.Pix, src.Pix) {
+		t.Errorf("uploaded pixels don't match the source")
+	}
+}
+
+func TestCompressedBandSize(t *testing.T) {
+	// rows that compress well, and rows that are still too big for a
+	// band when they're compressed.
+	stripes := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for y := 0; y < 200; y++ {
+		draw.Draw(stripes, image.Rect(0, y, 300, y+1), image.NewUniform(color.Gray{uint8(y)}), image.ZP, draw.Src)
+	}
+	wide := image.NewRGBA(image.Rect(0, 0, 3000, 3))
+	rand.New(rand.NewSource(1)).Read(wide.Pix)
+	draw.Draw(wide, image.Rect(2000, 0, 3000, 3), image.Black, image.ZP, draw.Src)
+	for _, src := range []*image.RGBA{stripes, wide} {
+		for _, tc := range []struct{ iounit, opt, want int }{
+			{1 << 16, 0, defaultCompressedBand},
+			{1 << 16, 500, 500},
+			// the whole message, with its 21 byte header, fits in
+			// the iounit.
+			{1 << 16, 1 << 20, 1<<16 - 21},
+			{1000, 0, 1000 - 21},
+		} {
+			d, f := newTestCtrler(tc.iounit)
+			d.configure(DevdrawOptions{MaxCompressedBand: tc.opt})
+			if got := d.compressedBandSize(); got != tc.want {
+				t.Errorf("iounit %d, band %d: compressedBandSize() = %d, want %d", tc.iounit, tc.opt, got, tc.want)
+			}
+			d.compressedReplaceSubimage(3, src.Rect, src.Pix)
+			if !strings.Contains(f.cmds(), "Y") {
+				t.Fatalf("band %d, %v: got messages %q, want some compressed", tc.opt, src.Rect, f.cmds())
+			}
+			for i, m := range f.msgs {
+				if m[0] == 'Y' && len(m)-21 > tc.want {
+					t.Errorf("band %d, %v: message %d has %d bytes of data, want at most %d", tc.opt, src.Rect, i, len(m)-21, tc.want)
+				}
+				if len(m) > tc.iounit {
+					t.Errorf("band %d, %v: message %d is %d bytes, more than the iounit", tc.opt, src.Rect, i, len(m))
+				}
+			}
+			if got := replay(t, f.msgs, src.Rect); !bytes.Equal(got.Pix, src.Pix) {
+				t.Errorf("band %d, %v: uploaded pixels don't match the source", tc.opt, src.Rect)
+			}
+		}
+	}
+}
+
+func TestReplaceSubimageNoise(t *testing.T) {
+	r := image.Rect(0, 0, 64, 64)
+	src := image.NewRGBA(r)
+	rand.New(rand.NewSource(1)).Read(src.Pix)
+	// rows 20 to 29 compress well, and split the noise in two.
+	for i := 20 * 64 * 4; i < 30*64*4; i++ {
+		src.Pix[i] = 0
+	}
+
+	d, f := newTestCtrler(8192)
+	d.ReplaceSubimage(3, r, src.Pix)
+	if got, want := f.cmds(), "yYyy"; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	n := 0
+	for _, m := range f.msgs {
+		if len(m) > d.iounitSize {
+			t.Errorf("sent a %d byte %c message, iounit is %d", len(m), m[0], d.iounitSize)
+		}
+		n += len(m)
+	}
+	// the noise costs nothing more than sending it uncompressed would.
+	if n > len(src.Pix)+4*21 {
+		t.Errorf("sent %d bytes for %d bytes of pixels", n, len(src.Pix))
+	}
+	if got := replay(t, f.msgs, r); !bytes.Equal(got.Pix, src.Pix) {
+		t.Errorf("uploaded pixels don't match the source")
+	}
+}
+
+// ctlString formats the fields of a ctl message the way /dev/draw does.
+func ctlString(fields ...interface{}) string {
+	var s string
+	for _, f := range fields {
+		s += fmt.Sprintf("%11v ", f)
+	}
+	return s
+}
+
+func TestParseCtlString(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		s    string
+		want *DrawCtlMsg
+	}{
+		{
+			// as formatted by Plan 9, 9front and drawterm, with a
+			// space after every field.
+			name: "12 fields",
+			s:    "          3           0    x8r8g8b8           0           0           0        1024         768           0           0        1024         768 ",
+			want: &DrawCtlMsg{N: 3, ChannelFormat: "x8r8g8b8", MysteryValue: "0",
+				DisplaySize: image.Rect(0, 0, 1024, 768), Clipping: image.Rect(0, 0, 1024, 768)},
+		},
+		{
+			name: "no trailing space",
+			s:    "          1          12    r8g8b8a8           1           0           0           1           1  -1073741823 -1073741823  1073741823  1073741823",
+			want: &DrawCtlMsg{N: 1, DisplayImageId: 12, ChannelFormat: "r8g8b8a8", Repl: true, MysteryValue: "1",
+				DisplaySize: image.Rect(0, 0, 1, 1), Clipping: image.Rect(-1073741823, -1073741823, 1073741823, 1073741823)},
+		},
+		{
+			name: "trailing newline",
+			s:    ctlString(2, 0, "k8", 0, 10, 20, 650, 500, 10, 20, 650, 500) + "\n",
+			want: &DrawCtlMsg{N: 2, ChannelFormat: "k8", MysteryValue: "0",
+				DisplaySize: image.Rect(10, 20, 650, 500), Clipping: image.Rect(10, 20, 650, 500)},
+		},
+		{
+			name: "no replication flag",
+			s:    ctlString(4, 0, "x8r8g8b8", 0, 0, 1920, 1080, 0, 0, 1920, 1080),
+			want: &DrawCtlMsg{N: 4, ChannelFormat: "x8r8g8b8",
+				DisplaySize: image.Rect(0, 0, 1920, 1080), Clipping: image.Rect(0, 0, 1920, 1080)},
+		},
+		{name: "empty", s: ""},
+		{name: "too few fields", s: ctlString(4, 0, "x8r8g8b8", 0, 0, 1920, 1080, 0, 0, 1920)},
+		{name: "not a number", s: ctlString(3, 0, "x8r8g8b8", 0, 0, 0, "wide", 768, 0, 0, 1024, 768)},
+		{name: "bad replication flag", s: ctlString(3, 0, "x8r8g8b8", "yes", 0, 0, 1024, 768, 0, 0, 1024, 768)},
+	} {
+		got := parseCtlString(tc.s)
+		if tc.want == nil {
+			if got != nil {
+				t.Errorf("%s: got %+v, want nil", tc.name, got)
+			}
+			continue
+		}
+		if got == nil || *got != *tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseIOUnit(t *testing.T) {
+	const data = "/dev/draw/3/data"
+	for _, tc := range []struct {
+		name string
+		fd   string
+		want int // 0 for an error
+	}{
+		{
+			name: "plan 9",
+			fd: "/usr/glenda\n" +
+				"  0 r  M    2 (0000000000000021     0 00)  8192        0 /dev/cons\n" +
+				"  3 rw i    0 (0000000000000001     0 00)  8192       44 /dev/draw/new\n" +
+				"  4 rw i    0 (0000000000030001     0 00)  8192        0 /dev/draw/3/data\n",
+			want: 8192,
+		},
+		{
+			name: "drawterm",
+			fd: "/\n" +
+				"  7 rw i    0 (0000000000030001     0 00) 65535        0 /dev/draw/3/data\n" +
+				"  8 rw i    0 (0000000000030002     0 00) 65535        0 /dev/draw/3/ctl\n",
+			want: 65535,
+		},
+		{
+			// the first line is the current directory, even if it looks
+			// like an open file.
+			name: "working directory",
+			fd:   "  4 rw i    0 (0000000000030001     0 00)  8192        0 /dev/draw/3/data\n",
+		},
+		{
+			name: "not open",
+			fd:   "/\n  0 r  M    2 (0000000000000021     0 00)  8192        0 /dev/cons\n",
+		},
+		{
+			name: "bad iounit",
+			fd:   "/\n  4 rw i    0 (0000000000030001     0 00)  big        0 /dev/draw/3/data\n",
+		},
+		{
+			name: "zero iounit",
+			fd:   "/\n  4 rw i    0 (0000000000030001     0 00)  0        0 /dev/draw/3/data\n",
+		},
+		{name: "empty", fd: ""},
+	} {
+		got, err := parseIOUnit(bytes.Split([]byte(tc.fd), []byte{'\n'}), data)
+		if tc.want == 0 {
+			if err == nil {
+				t.Errorf("%s: got iounit %d, want an error", tc.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %d, %v, want %d", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+// infoCtl stands in for the ctl file of a /dev/draw connection. As in
+// devdraw, writing an image ID to it makes the next read describe that
+// image, and reading it without writing an ID first fails.
+type infoCtl struct {
+	images map[uint32]string
+	id     int64
+	writes int
+}
+
+func newInfoCtl(images map[uint32]string) *infoCtl {
+	return &infoCtl{images: images, id: -1}
+}
+
+func (c *infoCtl) Write(p []byte) (int, error) {
+	if len(p) != 4 {
+		return 0, errors.New("bad ctl message")
+	}
+	c.writes++
+	c.id = int64(binary.LittleEndian.Uint32(p))
+	return len(p), nil
+}
+
+func (c *infoCtl) Read(p []byte) (int, error) {
+	s, ok := c.images[uint32(c.id)]
+	if c.id < 0 || !ok {
+		return 0, errors.New("unknown id for draw image")
+	}
+	c.id = -1
+	return copy(p, s), nil
+}
+
+func (c *infoCtl) Close() error {
+	return nil
+}
+
+func TestReadCtl(t *testing.T) {
+	useLogger(t)
+	d, _ := newTestCtrler(65535)
+	ctl := newInfoCtl(map[uint32]string{
+		0: ctlString(3, 0, "x8r8g8b8", 0, 0, 0, 1024, 768, 0, 0, 1024, 768),
+	})
+	d.ctl = ctl
+
+	for i := 0; i < 2; i++ {
+		msg, err := d.ReadCtl()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.N != 3 || msg.ChannelFormat != "x8r8g8b8" || msg.DisplaySize != image.Rect(0, 0, 1024, 768) {
+			t.Errorf("got %+v", msg)
+		}
+		if got := d.LastCtl(); got == nil || *got != *msg {
+			t.Errorf("LastCtl() = %+v, want %+v", got, msg)
+		}
+	}
+	if ctl.writes != 2 {
+		t.Errorf("wrote the display's id %d times, want once for each read", ctl.writes)
+	}
+
+	// LastCtl returns a copy.
+	d.LastCtl().DisplaySize = image.ZR
+	if got := d.LastCtl(); got.DisplaySize != image.Rect(0, 0, 1024, 768) {
+		t.Errorf("changing the result of LastCtl changed it to %+v", got)
+	}
+
+	last := d.LastCtl()
+	delete(ctl.images, 0)
+	if _, err := d.ReadCtl(); err == nil {
+		t.Errorf("expected an error when ctl can't be read")
+	}
+	if got := d.LastCtl(); *got != *last {
+		t.Errorf("LastCtl changed after a failed read")
+	}
+}
+
+func TestReadCtlAndQueryImage(t *testing.T) {
+	d, _ := newTestCtrler(65535)
+	display := ctlString(3, 0, "x8r8g8b8", 0, 0, 0, 1024, 768, 0, 0, 1024, 768)
+	image7 := ctlString(3, 7, "r8g8b8a8", 1, 0, 0, 1, 1, 0, 0, 50, 60)
+	d.ctl = newInfoCtl(map[uint32]string{0: display, 7: image7})
+
+	// each write of an id has to be followed by its own read, even when
+	// they're from different goroutines.
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := 0; i < 100; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			if msg, err := d.ReadCtl(); err != nil || msg.DisplayImageId != 0 {
+				errs <- fmt.Errorf("ReadCtl() = %+v, %v", msg, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if msg, err := d.QueryImage(7); err != nil || msg.DisplayImageId != 7 {
+				errs <- fmt.Errorf("QueryImage(7) = %+v, %v", msg, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			d.LastCtl()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestReadCtlString(t *testing.T) {
+	useLogger(t)
+	full := ctlString(3, 0, "x8r8g8b8", 0, 0, 0, 1024, 768, 0, 0, 1024, 768)
+	want := &DrawCtlMsg{N: 3, ChannelFormat: "x8r8g8b8", MysteryValue: "0",
+		DisplaySize: image.Rect(0, 0, 1024, 768), Clipping: image.Rect(0, 0, 1024, 768)}
+	wide := ""
+	for _, f := range []interface{}{3, 0, "x8r8g8b8", 0, 0, 0, 1024, 768, 0, 0, 1024, 768} {
+		wide += fmt.Sprintf("%12v ", f)
+	}
+	short := ctlString(3, 0, "x8r8g8b8", 0, 0, 1024, 768, 0, 0, 1024, 768)
+	for _, tc := range []struct {
+		name   string
+		chunks []string
+		want   *DrawCtlMsg
+	}{
+		{"one read", []string{full}, want},
+		{"short reads", []string{full[:5], full[5:40], full[40:90], full[90:]}, want},
+		{"split number", []string{full[:strings.Index(full, "1024")+2], full[strings.Index(full, "1024")+2:]}, want},
+		{"wide fields", []string{wide[:100], wide[100:]}, want},
+		{"no replication flag", []string{short[:50], short[50:]},
+			&DrawCtlMsg{N: 3, ChannelFormat: "x8r8g8b8",
+				DisplaySize: image.Rect(0, 0, 1024, 768), Clipping: image.Rect(0, 0, 1024, 768)}},
+		{"no last space", []string{strings.TrimSpace(full)}, want},
+	} {
+		// devdraw fails a read of ctl after the whole message has been
+		// read, instead of returning EOF, so try both.
+		for _, end := range []error{io.EOF, errors.New("short read")} {
+			var d DrawCtrler
+			s := d.readCtlString(io.MultiReader(&chunkReader{tc.chunks}, iotest.ErrReader(end)))
+			if got := parseCtlString(s); got == nil || *got != *tc.want {
+				t.Errorf("%s, then %v: read %q, parsed as %+v, want %+v", tc.name, end, s, got, tc.want)
+			}
+		}
+	}
+
+	// an error before anything has been read is still an error.
+	var d DrawCtrler
+	if s := d.readCtlString(iotest.ErrReader(errors.New("unknown id for draw image"))); s != "" {
+		t.Errorf("read %q from a failing reader", s)
+	}
+}
+
+func TestQueryImage(t *testing.T) {
+	useLogger(t)
+	d, _ := newTestCtrler(65535)
+	ctl := newInfoCtl(map[uint32]string{
+		7: ctlString(1, 7, "r8g8b8a8", 1, 0, 0, 1, 1, 0, 0, 50, 60),
+	})
+	d.ctl = ctl
+
+	msg, err := d.QueryImage(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctl.writes != 1 {
+		t.Errorf("wrote %d ids to ctl, want 1", ctl.writes)
+	}
+	if msg.DisplayImageId != 7 || msg.ChannelFormat != "r8g8b8a8" || !msg.Repl ||
+		msg.DisplaySize != image.Rect(0, 0, 1, 1) || msg.Clipping != image.Rect(0, 0, 50, 60) {
+		t.Errorf("got %+v", msg)
+	}
+	if d.LastCtl() != nil {
+		t.Errorf("LastCtl was updated by QueryImage")
+	}
+
+	if _, err := d.QueryImage(8); err == nil {
+		t.Errorf("expected an error querying an image that doesn't exist")
+	}
+}
+
+func TestSetOp(t *testing.T) {
+	d, f := newTestCtrler(65535)
+	for _, tc := range []struct {
+		op   draw.Op
+		want byte
+	}{
+		{draw.Src, 10},
+		{draw.Over, 11},
+	} {
+		f.msgs = nil
+		if err := d.SetOp(tc.op); err != nil {
+			t.Fatal(err)
+		}
+		if len(f.msgs) != 1 || !bytes.Equal(f.msgs[0], []byte{'O', tc.want}) {
+			t.Errorf("op %v: got messages %q, want O %d", tc.op, f.msgs, tc.want)
+		}
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	d := s.DrawCtrler()
+	id := d.AllocBuffer(0, false, image.Rect(0, 0, 10, 10), image.Rect(0, 0, 10, 10), color.White)
+	f.msgs = nil
+
+	// a message that DrawCtrler has no method for: a filled polygon,
+	// whose other arguments don't matter here.
+	msg := make([]byte, 30)
+	binary.LittleEndian.PutUint32(msg[0:], id)
+	if err := d.SendMessage('P', msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.msgs) != 1 || !bytes.Equal(f.msgs[0], append([]byte{'P'}, msg...)) {
+		t.Errorf("got messages %q, want the P message", f.msgs)
+	}
+}
+
+func TestSendMessagev(t *testing.T) {
+	d, f := newTestCtrler(65535)
+	if err := d.sendMessagev('y', []byte{1, 2}, nil, []byte{3}, []byte{4, 5, 6}); err != nil {
+		t.Fatal(err)
+	}
+	// a longer message after a shorter one, and the other way around,
+	// with the buffer that's reused between them.
+	d.sendMessagev('v')
+	d.sendMessagev('Y', make([]byte, 100), []byte{7})
+	d.sendMessagev('y', []byte{8})
+	want := [][]byte{{'y', 1, 2, 3, 4, 5, 6}, {'v'}, append(append([]byte{'Y'}, make([]byte, 100)...), 7), {'y', 8}}
+	if len(f.msgs) != len(want) {
+		t.Fatalf("got messages %q, want %q", f.msgs, want)
+	}
+	for i := range want {
+		if !bytes.Equal(f.msgs[i], want[i]) {
+			t.Errorf("message %d: got %q, want %q", i, f.msgs[i], want[i])
+		}
+	}
+	if got := d.Stats(); got.Bytes != 7+1+102+2 || got.Messages['y'] != 2 {
+		t.Errorf("got stats %+v, want 112 bytes with 2 y messages", got)
+	}
+}
+
+func TestSendMessageOversized(t *testing.T) {
+	d, f := newTestCtrler(100)
+	d.sendMessage('y', make([]byte, 50))
+	kept := cap(d.cmdBuf)
+	// a message bigger than the iounit is still sent as it is, but its
+	// buffer isn't kept.
+	d.sendMessage('Y', make([]byte, 1000))
+	if cap(d.cmdBuf) != kept {
+		t.Errorf("the buffer grew from %d to %d bytes for an oversized message", kept, cap(d.cmdBuf))
+	}
+	if len(f.msgs) != 2 || len(f.msgs[1]) != 1001 {
+		t.Errorf("got messages %q, want the oversized one sent whole", f.cmds())
+	}
+}
+
+func TestDrawRect(t *testing.T) {
+	d, f := newTestCtrler(65535)
+	dr := image.Rect(30, 40, 10, 20)
+	if err := d.DrawRect(1, 2, 3, dr, draw.Over); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.cmds(), "Od"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	m := f.msgs[1][1:]
+	// the source is read from the same rectangle, once it's canonical.
+	if r, sp, mp := msgRect(m[12:]), msgPoint(m[28:]), msgPoint(m[36:]); r != dr.Canon() || sp != r.Min || mp != image.ZP {
+		t.Errorf("drew %v from %v with mask at %v, want %v from %v with mask at (0,0)", r, sp, mp, dr.Canon(), dr.Canon().Min)
+	}
+
+	f.msgs = nil
+	if err := d.DrawRect(1, 2, 3, image.Rect(5, 5, 5, 10), draw.Over); err != nil || len(f.msgs) != 0 {
+		t.Errorf("got messages %q and error %v for an empty rectangle", f.cmds(), err)
+	}
+
+	d = NewDrawCtrlerFromTransport(&failingData{}, 65535)
+	if err := d.DrawRect(1, 2, 3, image.Rect(0, 0, 1, 1), draw.Src); err == nil {
+		t.Errorf("expected an error from a failed write")
+	}
+}
+
+func TestStringBg(t *testing.T) {
+	d, f := newTestCtrler(65535)
+	clipr := image.Rect(0, 0, 100, 50)
+	d.StringBg(1, 2, 3, image.Pt(10, 20), clipr, image.Pt(4, 5), 6, image.Pt(7, 8), []uint16{0x41, 0x142}, draw.Over)
+	if got, want := f.cmds(), "Ox"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	m := f.msgs[1][1:]
+	if len(m) != 58+2*2 {
+		t.Fatalf("message is %d bytes, want %d", len(m), 58+2*2)
+	}
+	for _, c := range []struct {
+		name string
+		off  int
+		want uint32
+	}{
+		{"dst", 0, 1},
+		{"src", 4, 2},
+		{"font", 8, 3},
+		{"bg", 46, 6},
+	} {
+		if got := binary.LittleEndian.Uint32(m[c.off:]); got != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, got, c.want)
+		}
+	}
+	if got, want := msgPoint(m[12:]), image.Pt(10, 20); got != want {
+		t.Errorf("p: got %v, want %v", got, want)
+	}
+	if got := msgRect(m[20:]); got != clipr {
+		t.Errorf("clipr: got %v, want %v", got, clipr)
+	}
+	if got, want := msgPoint(m[36:]), image.Pt(4, 5); got != want {
+		t.Errorf("sp: got %v, want %v", got, want)
+	}
+	if got, want := binary.LittleEndian.Uint16(m[44:]), uint16(2); got != want {
+		t.Errorf("ni: got %d, want %d", got, want)
+	}
+	if got, want := msgPoint(m[50:]), image.Pt(7, 8); got != want {
+		t.Errorf("bgp: got %v, want %v", got, want)
+	}
+	if got := []uint16{binary.LittleEndian.Uint16(m[58:]), binary.LittleEndian.Uint16(m[60:])}; got[0] != 0x41 || got[1] != 0x142 {
+		t.Errorf("indices: got %#x, want [0x41 0x142]", got)
+	}
+}
+
+func TestDrawOpInterleaved(t *testing.T) {
+	// the goroutines need to run at the same time for their messages to
+	// be interleaved, even with a single CPU.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	d, f := newTestCtrler(65535)
+	// each goroutine draws into its own image with its own operation,
+	// while another changes the operation on its own.
+	ops := map[uint32]draw.Op{1: draw.Src, 2: draw.Over}
+	var wg sync.WaitGroup
+	for dst, op := range ops {
+		wg.Add(1)
+		go func(dst uint32, op draw.Op) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				d.Draw(dst, 3, 3, image.Rect(0, 0, 1, 1), image.ZP, image.ZP, op)
+			}
+		}(dst, op)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			d.SetOp(draw.Over)
+		}
+	}()
+	wg.Wait()
+
+	want := map[draw.Op]byte{draw.Src: 10, draw.Over: 11}
+	draws := 0
+	for i, m := range f.msgs {
+		if m[0] != 'd' {
+			continue
+		}
+		draws++
+		dst := binary.LittleEndian.Uint32(m[1:])
+		if i == 0 {
+			t.Fatalf("'d' into %d was sent before any 'O'", dst)
+		}
+		if prev := f.msgs[i-1]; !bytes.Equal(prev, []byte{'O', want[ops[dst]]}) {
+			t.Fatalf("message %d: 'd' into %d follows %q, want O %d", i, dst, prev, want[ops[dst]])
+		}
+	}
+	if draws != 2000 {
+		t.Errorf("got %d draws, want 2000", draws)
+	}
+}
+
+func TestStats(t *testing.T) {
+	d, f := newTestCtrler(65535)
+	r := image.Rect(0, 0, 37, 23)
+	src := gradient(r)
+	d.AllocBuffer(0, false, r, r, color.Black)
+	d.ReplaceSubimage(2, r, src.Pix)
+	// a uniform image compresses well.
+	d.ForceCompress = true
+	d.ReplaceSubimage(2, r, make([]byte, len(src.Pix)))
+	d.Draw(1, 2, 2, r, image.ZP, image.ZP, draw.Src)
+	d.Flush()
+
+	st := d.Stats()
+	want := map[byte]int{'b': 1, 'y': 1, 'Y': 1, 'O': 1, 'd': 1, 'v': 1}
+	if fmt.Sprint(st.Messages) != fmt.Sprint(want) {
+		t.Errorf("got messages %v, want %v", st.Messages, want)
+	}
+	var total, y, bigY int64
+	for _, m := range f.msgs {
+		total += int64(len(m))
+		switch m[0] {
+		case 'y':
+			y += int64(len(m))
+		case 'Y':
+			bigY += int64(len(m))
+		}
+	}
+	if st.Bytes != total || st.UncompressedBytes != y || st.CompressedBytes != bigY {
+		t.Errorf("got %d bytes, %d in y and %d in Y, want %d, %d and %d",
+			st.Bytes, st.UncompressedBytes, st.CompressedBytes, total, y, bigY)
+	}
+	if want := int64(len(src.Pix)); st.CompressedPixels != want {
+		t.Errorf("got %d compressed pixel bytes, want %d", st.CompressedPixels, want)
+	}
+
+	// failed writes aren't counted.
+	d = &DrawCtrler{data: &failingData{}, iounitSize: 65535}
+	d.Flush()
+	if st := d.Stats(); st.Bytes != 0 || len(st.Messages) != 0 {
+		t.Errorf("got %+v after a failed write, want nothing", st)
+	}
+}
+
+type discardData struct{}
+
+func (discardData) Write(p []byte) (int, error) { return len(p), nil }
+func (discardData) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (discardData) Close() error                { return nil }
+
+func BenchmarkSendMessage(b *testing.B) {
+	d := &DrawCtrler{data: discardData{}, iounitSize: 65535}
+	msg := make([]byte, 44)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		d.sendMessage('d', msg)
+	}
+}
+
+func BenchmarkCompressedReplaceSubimage(b *testing.B) {
+	// a 4K frame: the compressed messages are built one at a time, so
+	// the bytes allocated per op stay around one iounit.
+	r := image.Rect(0, 0, 3840, 2160)
+	pix := gradient(r).Pix
+	d := &DrawCtrler{data: discardData{}, iounitSize: 8192}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(pix)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.compressedReplaceSubimage(1, r, pix)
+	}
+}
+
+// zeroData is like discardData, but reads are served with zeroes so
+// that reads of pixels succeed.
+type zeroData struct{ discardData }
+
+func (zeroData) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func BenchmarkReadSubimage(b *testing.B) {
+	r := image.Rect(0, 0, 1024, 768)
+	b.Run("alloc", func(b *testing.B) {
+		d := &DrawCtrler{data: zeroData{}, iounitSize: 65535}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			d.ReadSubimage(1, r)
+		}
+	})
+	b.Run("reuse", func(b *testing.B) {
+		d := &DrawCtrler{data: zeroData{}, iounitSize: 65535}
+		buf := make([]byte, r.Dx()*r.Dy()*4)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := d.ReadSubimageInto(1, r, buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestReadSubimageInto(t *testing.T) {
+	d, f := newTestCtrler(100)
+	r := image.Rect(0, 0, 5, 12)
+	want := gradient(r).Pix
+	f.reads.Write(want)
+
+	got := make([]byte, len(want))
+	if err := d.ReadSubimageInto(1, r, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read pixels don't match")
+	}
+	// 5 rows of 20 bytes fit in each read.
+	if got, want := f.cmds(), "rrr"; got != want {
+		t.Errorf("got messages %q, want %q", got, want)
+	}
+
+	if err := d.ReadSubimageInto(1, r, got[:10]); err == nil {
+		t.Errorf("expected an error reading into a short buffer")
+	}
+}
+
+// pieceData is a fakeData which returns at most n bytes from each Read,
+// like a transport that splits replies into small messages.
+type pieceData struct {
+	*fakeData
+	n int
+}
+
+func (p pieceData) Read(b []byte) (int, error) {
+	if len(b) > p.n {
+		b = b[:p.n]
+	}
+	return p.fakeData.Read(b)
+}
+
+func TestReadSubimageShortReads(t *testing.T) {
+	r := image.Rect(0, 0, 5, 12)
+	want := gradient(r).Pix
+	// the whole rectangle, bands of rows and strips of a row.
+	for _, iounit := range []int{1000, 100, 8} {
+		f := &fakeData{}
+		d := NewDrawCtrlerFromTransport(pieceData{f, 3}, iounit)
+		f.reads.Write(want)
+		got := make([]byte, len(want))
+		if err := d.ReadSubimageInto(1, r, got); err != nil {
+			t.Fatalf("iounit %d: %v", iounit, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("iounit %d: read pixels don't match", iounit)
+		}
+	}
+
+	// a reply that ends early is an error rather than a partial image.
+	d, f := newTestCtrler(1000)
+	f.reads.Write(want[:len(want)-1])
+	if err := d.ReadSubimageInto(1, r, make([]byte, len(want))); err == nil {
+		t.Errorf("expected an error for a short reply")
+	}
+}
+
+func TestAllocBufferColor(t *testing.T) {
+	for _, tc := range []struct {
+		c    color.Color
+		want [4]byte // a, b, g, r as they appear in the message
+	}{
+		{color.RGBA{0x40, 0, 0, 0x80}, [4]byte{0x80, 0, 0, 0x40}},
+		// straight alpha is premultiplied before it's sent.
+		{color.NRGBA{R: 128, G: 0, B: 0, A: 128}, [4]byte{0x80, 0, 0, 0x40}},
+		{color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0}, [4]byte{0, 0, 0, 0}},
+		{color.Gray{0x7f}, [4]byte{0xff, 0x7f, 0x7f, 0x7f}},
+	} {
+		d, f := newTestCtrler(65535)
+		d.AllocBuffer(0, false, image.Rect(0, 0, 1, 1), image.Rect(0, 0, 1, 1), tc.c)
+		var got [4]byte
+		copy(got[:], f.msgs[0][47:51])
+		if got != tc.want {
+			t.Errorf("%#v: sent colour % x, want % x", tc.c, got, tc.want)
+		}
+	}
+}
+
+func TestAllocScreenBuffer(t *testing.T) {
+	d, f := newTestCtrler(65535)
+	r := image.Rect(0, 0, 10, 10)
+	d.AllocBuffer(0, false, r, r, color.Black)
+	d.AllocScreenBuffer(5, 0, false, r, r, color.Black)
+	for i, want := range []uint32{0, 5} {
+		if got := binary.LittleEndian.Uint32(f.msgs[i][5:]); got != want {
+			t.Errorf("message %d: allocated on screen %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestLiveIDs(t *testing.T) {
+	d, f := newTestCtrler(65535)
+	r := image.Rect(0, 0, 10, 10)
+	var ids []uint32
+	for i := 0; i < 5; i++ {
+		ids = append(ids, d.AllocBuffer(0, false, r, r, color.Black))
+	}
+	d.FreeID(ids[1])
+	d.FreeID(ids[3])
+	want := []uint32{ids[0], ids[2], ids[4]}
+	if got := d.LiveIDs(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("LiveIDs() = %v, want %v", got, want)
+	}
+
+	f.msgs = nil
+	d.FreeAll()
+	if got := d.LiveIDs(); len(got) != 0 {
+		t.Errorf("LiveIDs() = %v after FreeAll, want none", got)
+	}
+	if got, want := f.cmds(), "fff"; got != want {
+		t.Fatalf("FreeAll sent %q, want %q", got, want)
+	}
+	for i, id := range want {
+		if got := binary.LittleEndian.Uint32(f.msgs[i][1:]); got != id {
+			t.Errorf("message %d: freed %d, want %d", i, got, id)
+		}
+	}
+	// nothing is freed twice.
+	f.msgs = nil
+	d.FreeAll()
+	if len(f.msgs) != 0 {
+		t.Errorf("second FreeAll sent %q, want nothing", f.cmds())
+	}
+}
+
+func TestFreeAllOwned(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	tex := newTextureImpl(s, image.Point{10, 10})
+	win, err := s.NewWindow(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := win.(*windowImpl)
+	leaked := s.ctl.AllocBuffer(0, false, image.Rect(0, 0, 1, 1), image.Rect(0, 0, 1, 1), color.Black)
+
+	// only the image that nothing owns is freed.
+	f.msgs = nil
+	s.ctl.FreeAll()
+	if got, want := f.cmds(), "f"; got != want {
+		t.Fatalf("FreeAll sent %q, want %q", got, want)
+	}
+	if got := binary.LittleEndian.Uint32(f.msgs[0][1:]); got != leaked {
+		t.Errorf("freed %d, want the leaked image %d", got, leaked)
+	}
+	// and the others are freed once, by their owners.
+	f.msgs = nil
+	tex.Release()
+	w.Release()
+	freed := make(map[uint32]int)
+	for _, m := range f.msgs {
+		if m[0] == 'f' {
+			freed[binary.LittleEndian.Uint32(m[1:])]++
+		}
+	}
+	for _, id := range []uint32{tex.imageId, w.imageId} {
+		if freed[id] != 1 {
+			t.Errorf("image %d was freed %d times on release, want once", id, freed[id])
+		}
+	}
+	if got := s.ctl.LiveIDs(); len(got) != 0 {
+		t.Errorf("LiveIDs() = %v, want none", got)
+	}
+}
+
+func TestReadSubimageEmpty(t *testing.T) {
+	d, f := newTestCtrler(100)
+	for _, r := range []image.Rectangle{image.ZR, image.Rect(3, 3, 3, 10), {image.Pt(5, 5), image.Pt(5, 2)}} {
+		if got := d.ReadSubimage(1, r); got == nil || len(got) != 0 {
+			t.Errorf("ReadSubimage(%v) = %v, want an empty slice", r, got)
+		}
+		if err := d.ReadSubimageInto(1, r, nil); err != nil {
+			t.Errorf("ReadSubimageInto(%v): %v", r, err)
+		}
+	}
+	if len(f.msgs) != 0 {
+		t.Errorf("sent messages %q, want none", f.cmds())
+	}
+}
+
+func TestNarrowIounit(t *testing.T) {
+	// a 60 pixel row is 240 bytes, which doesn't fit in one message.
+	r := image.Rect(0, 10, 60, 13)
+	src := gradient(r)
+	one := image.Rect(0, 10, 60, 11)
+	d, f := newTestCtrler(100)
+	d.ReplaceSubimage(3, one, src.Pix[:4*60])
+	for _, m := range f.msgs {
+		if len(m) > d.iounitSize {
+			t.Errorf("sent a %d byte message, iounit is %d", len(m), d.iounitSize)
+		}
+	}
+	if got := replay(t, f.msgs, one); !bytes.Equal(got.Pix, src.Pix[:4*60]) {
+		t.Errorf("uploaded pixels don't match the source")
+	}
+
+	f.msgs = nil
+	f.reads.Write(src.Pix)
+	got := make([]byte, len(src.Pix))
+	if err := d.ReadSubimageInto(3, r, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, src.Pix) {
+		t.Errorf("read pixels don't match")
+	}
+	// 25 pixels fit in each read, so each row takes 3.
+	if got, want := len(f.msgs), 9; got != want {
+		t.Errorf("sent %d reads, want %d", got, want)
+	}
+
+	d, f = newTestCtrler(3)
+	d.ReplaceSubimage(3, one, src.Pix[:4*60])
+	if len(f.msgs) != 0 {
+		t.Errorf("sent %d messages with an iounit too small for a pixel", len(f.msgs))
+	}
+	if err := d.ReadSubimageInto(3, one, got); err == nil {
+		t.Errorf("expected an error reading with an iounit too small for a pixel")
+	}
+}
+
+func TestColumnStrips(t *testing.T) {
+	// none of the rows fit in a message, and the rectangle isn't at the
+	// origin, so each strip has to be put at the right offset.
+	r := image.Rect(5, 10, 65, 14)
+	src := gradient(image.Rect(0, 0, 80, 20)).SubImage(r).(*image.RGBA)
+	want := image.NewRGBA(r)
+	draw.Draw(want, r, src, r.Min, draw.Src)
+
+	d, f := newTestCtrler(100)
+	d.replaceRGBA(3, r, src)
+	strips := image.ZR
+	for _, m := range f.msgs {
+		if len(m) > d.iounitSize {
+			t.Errorf("sent a %d byte message, iounit is %d", len(m), d.iounitSize)
+		}
+		mr := msgRect(m[5:])
+		if mr.Dy() != 1 || !mr.In(r) {
+			t.Errorf("sent strip %v, want one row of %v", mr, r)
+		}
+		strips = strips.Union(mr)
+	}
+	if strips != r {
+		t.Errorf("strips cover %v, want %v", strips, r)
+	}
+	if got := replay(t, f.msgs, r); !bytes.Equal(got.Pix, want.Pix) {
+		t.Errorf("uploaded pixels don't match the source")
+	}
+
+	// and reading them back puts them in the same place.
+	f.msgs = nil
+	f.reads.Write(want.Pix)
+	got := make([]byte, len(want.Pix))
+	if err := d.ReadSubimageInto(3, r, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Pix) {
+		t.Errorf("read pixels don't match")
+	}
+	for _, m := range f.msgs {
+		if mr := msgRect(m[5:]); mr.Dy() != 1 || !mr.In(r) {
+			t.Errorf("read strip %v, want one row of %v", mr, r)
+		}
+	}
+}
+
+func TestCompressedReplaceSubimageWideRow(t *testing.T) {
+	r := image.Rect(0, 0, 4096, 2)
+	src := gradient(r)
+	// make the second row incompressible.
+	rand.New(rand.NewSource(1)).Read(src.Pix[4*4096:])
+
+	d, f := newTestCtrler(1000)
+	if n := len(compress(src.Pix[:4*4096])); n <= d.iounitSize {
+		t.Fatalf("compressed row is only %d bytes", n)
+	}
+	d.compressedReplaceSubimage(3, r, src.Pix)
+	for _, m := range f.msgs {
+		if len(m) > d.iounitSize {
+			t.Errorf("sent a %d byte %c message, iounit is %d", len(m), m[0], d.iounitSize)
+		}
+	}
+	if got := replay(t, f.msgs, r); !bytes.Equal(got.Pix, src.Pix) {
+		t.Errorf("uploaded pixels don't match the source")
+	}
+}
+
+func TestReplaceRGBA(t *testing.T) {
+	src := gradient(image.Rect(0, 0, 64, 64))
+	sr := image.Rect(5, 7, 37, 40)
+	sub := src.SubImage(sr).(*image.RGBA)
+	want := image.NewRGBA(image.Rect(0, 0, sr.Dx(), sr.Dy()))
+	draw.Draw(want, want.Rect, sub, sr.Min, draw.Src)
+
+	for _, iounit := range []int{65535, 8192, 300} {
+		d, f := newTestCtrler(iounit)
+		d.replaceRGBA(3, want.Rect, sub)
+		if got := replay(t, f.msgs, want.Rect); !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("iounit %d: uploaded pixels don't match the sub-image", iounit)
+		}
+	}
+}
+
+func TestReplaceRGBAMemory(t *testing.T) {
+	r := image.Rect(0, 0, 2048, 2048)
+	src := gradient(r)
+	for _, iounit := range []int{65535, 8192} {
+		d := &DrawCtrler{data: discardData{}, iounitSize: iounit}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		d.replaceRGBA(1, r, src)
+		runtime.ReadMemStats(&after)
+		// the image is 16MB, uploading it should only need a few messages
+		// worth of memory.
+		if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+			t.Errorf("iounit %d: uploading a %d byte image allocated %d bytes", iounit, len(src.Pix), n)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	r := image.Rect(0, 0, 64, 64)
+	src := gradient(r)
+
+	d, f := newTestCtrler(8192)
+	d.configure(DevdrawOptions{IOUnitSize: 1000})
+	if d.iounitSize != 1000 {
+		t.Errorf("iounit is %d, want 1000", d.iounitSize)
+	}
+	d.ReplaceSubimage(3, r, src.Pix)
+	for _, m := range f.msgs {
+		if len(m) > 1000 {
+			t.Fatalf("sent a %d byte message, want at most 1000", len(m))
+		}
+	}
+	// the iounit can't be made bigger than the server's.
+	d.configure(DevdrawOptions{IOUnitSize: 65535})
+	if d.iounitSize != 1000 {
+		t.Errorf("iounit is %d, want 1000", d.iounitSize)
+	}
+
+	d, f = newTestCtrler(8192)
+	d.configure(DevdrawOptions{DisableCompression: true})
+	d.ReplaceSubimage(3, r, src.Pix)
+	if got := f.cmds(); strings.Contains(got, "Y") {
+		t.Errorf("got messages %q with compression disabled", got)
+	}
+	if got := replay(t, f.msgs, r); !bytes.Equal(got.Pix, src.Pix) {
+		t.Errorf("uploaded pixels don't match the source")
+	}
+
+	for _, tc := range []struct{ lookback, want int }{{0, 128}, {512, 512}, {5000, 1024}} {
+		d, f = newTestCtrler(8192)
+		d.configure(DevdrawOptions{LookbackSize: tc.lookback})
+		if got := d.lookbackSize(); got != tc.want {
+			t.Errorf("lookback %d: using %d, want %d", tc.lookback, got, tc.want)
+		}
+		d.ReplaceSubimage(3, r, src.Pix)
+		if got := replay(t, f.msgs, r); !bytes.Equal(got.Pix, src.Pix) {
+			t.Errorf("lookback %d: uploaded pixels don't match the source", tc.lookback)
+		}
+	}
+}
+
+func TestCompressionChoice(t *testing.T) {
+	// solid images, so that compressing them always helps.
+	solid := func(r image.Rectangle) *image.RGBA {
+		img := image.NewRGBA(r)
+		draw.Draw(img, r, image.NewUniform(color.RGBA{0x10, 0x20, 0x30, 0xff}), image.ZP, draw.Src)
+		return img
+	}
+	small := solid(image.Rect(0, 0, 64, 1)) // 256 bytes
+	large := solid(image.Rect(0, 0, 64, 4)) // 1024 bytes
+	for _, tc := range []struct {
+		iounit    int
+		threshold int
+		force     bool
+		img       *image.RGBA
+		want      byte
+	}{
+		{65535, 0, false, large, 'y'},
+		{8192, 0, false, large, 'Y'},
+		{8192, 0, false, small, 'y'},
+		{8192, 100, false, small, 'Y'},
+		{8192, 2000, false, large, 'y'},
+		{65535, 0, true, large, 'Y'},
+		{65535, 0, true, small, 'y'},
+		{65535, 100, true, small, 'Y'},
+	} {
+		d, f := newTestCtrler(tc.iounit)
+		d.CompressThreshold = tc.threshold
+		d.ForceCompress = tc.force
+		d.ReplaceSubimage(3, tc.img.Rect, tc.img.Pix)
+		if got := f.msgs[0][0]; got != tc.want {
+			t.Errorf("iounit %d, threshold %d, force %v, %d bytes: sent %q, want %q",
+				tc.iounit, tc.threshold, tc.force, len(tc.img.Pix), got, tc.want)
+		}
+		if got := replay(t, f.msgs, tc.img.Rect); !bytes.Equal(got.Pix, tc.img.Pix) {
+			t.Errorf("uploaded pixels don't match the source")
+		}
+	}
+
+	// disabling compression overrides forcing it.
+	d, f := newTestCtrler(8192)
+	d.ForceCompress = true
+	d.configure(DevdrawOptions{DisableCompression: true})
+	d.ReplaceSubimage(3, large.Rect, large.Pix)
+	if got := f.cmds(); got != "y" {
+		t.Errorf("got messages %q with compression disabled, want %q", got, "y")
+	}
+}
+
+func TestInvertedRectangles(t *testing.T) {
+	inverted := image.Rectangle{image.Pt(10, 20), image.Pt(2, 4)}
+	want := inverted.Canon()
+
+	d, f := newTestCtrler(65535)
+	d.AllocBuffer(0, false, inverted, inverted, color.Black)
+	d.Draw(1, 2, 2, inverted, image.ZP, image.ZP, draw.Src)
+	d.ReplaceSubimage(1, inverted, make([]byte, want.Dx()*want.Dy()*4))
+	d.Reclip(1, false, inverted)
+	if got := f.cmds(); got != "bOdyc" {
+		t.Fatalf("got messages %q, want %q", got, "bOdyc")
+	}
+	for _, r := range []struct {
+		msg int
+		off int
+	}{{0, 15}, {0, 31}, {2, 13}, {3, 5}, {4, 6}} {
+		if got := rawRect(f.msgs[r.msg][r.off:]); got != want {
+			t.Errorf("%q message: got rectangle %v, want %v", f.msgs[r.msg][0], got, want)
+		}
+	}
+	f.reads.Write(make([]byte, want.Dx()*want.Dy()*4))
+	if got := d.ReadSubimage(1, inverted); len(got) != want.Dx()*want.Dy()*4 {
+		t.Errorf("read %d bytes, want %d", len(got), want.Dx()*want.Dy()*4)
+	}
+
+	// nothing is sent for empty rectangles.
+	d, f = newTestCtrler(65535)
+	for _, r := range []image.Rectangle{image.ZR, image.Rect(5, 5, 5, 50), {image.Pt(5, 5), image.Pt(50, 5)}} {
+		d.Draw(1, 2, 2, r, image.ZP, image.ZP, draw.Src)
+		d.ReplaceSubimage(1, r, nil)
+	}
+	if len(f.msgs) != 0 {
+		t.Errorf("sent messages %q for empty rectangles, want none", f.cmds())
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"github.com/niconan/shiny-plan9/shiny/driver/internal/drawer"
+	"github.com/niconan/shiny-plan9/shiny/screen"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// The methods in this file implement screen.Drawer for any /dev/draw
+// image, so that both windows and textures can be drawn into. The 'd'
+// message works the same way whatever the destination is.
+
+// Do an affine transformation on sr using src2dst.
+func affineTransform(src2dst f64.Aff3, sr image.Rectangle) image.Rectangle {
+	// helper function to do the calculations of src2dst..
+	mapPoint := func(p image.Point) image.Point {
+		xf, yf := float64(p.X), float64(p.Y)
+		return image.Point{
+			X: int(xf*src2dst[0] + yf*src2dst[1] + src2dst[2]),
+			Y: int(xf*src2dst[3] + yf*src2dst[4] + src2dst[5]),
+		}
+	}
+
+	// map the top left corner, and assume it's both the min and the max
+	topLeft := mapPoint(sr.Min)
+	min, max := topLeft, topLeft
+	updateMinMax := func(p image.Point) {
+		if p.X < min.X {
+			min.X = p.X
+		}
+		if p.Y < min.Y {
+			min.Y = p.Y
+		}
+		if p.X > max.X {
+			max.X = p.X
+		}
+		if p.Y > max.Y {
+			max.Y = p.Y
+		}
+	}
+
+	// map the top right corner, and change the min or max as necessary
+	p := mapPoint(image.Point{sr.Max.X, sr.Min.Y})
+	updateMinMax(p)
+	// bottom left
+	p = mapPoint(image.Point{sr.Min.X, sr.Max.Y})
+	updateMinMax(p)
+	// bottom right
+	p = mapPoint(image.Point{sr.Max.X, sr.Max.Y})
+	updateMinMax(p)
+
+	return image.Rectangle{min, max}
+}
+
+// translationEpsilon is how far the scale and rotation parts of a
+// transformation can be from the identity for isTranslation to still
+// treat it as a translation. Across a texture 100000 pixels wide, that's
+// an error of a tenth of a pixel.
+const translationEpsilon = 1e-6
+
+// isTranslation reports whether src2dst only translates, allowing for
+// floating point rounding errors such as a scale of 1.0000001.
+func isTranslation(src2dst f64.Aff3) bool {
+	near := func(a, b float64) bool {
+		return math.Abs(a-b) <= translationEpsilon
+	}
+	return near(src2dst[0], 1) && near(src2dst[1], 0) &&
+		near(src2dst[3], 0) && near(src2dst[4], 1)
+}
+
+// translation returns where isTranslation's src2dst moves the origin to.
+// A translation within translationEpsilon of a whole pixel is rounded to
+// it, so that 9.9999999 doesn't end up a pixel short.
+func translation(src2dst f64.Aff3) image.Point {
+	pixel := func(f float64) int {
+		if r := math.Round(f); math.Abs(f-r) <= translationEpsilon {
+			return int(r)
+		}
+		return int(f)
+	}
+	return image.Point{pixel(src2dst[2]), pixel(src2dst[5])}
+}
+
+func (u *uploadImpl) Draw(src2dst f64.Aff3, src screen.Texture, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
+	// There's no direct way to do an affine transformation in /dev/draw,
+	// so this does the following steps:
+	//
+	// 1. Read the pixel data of the rectangle sr from texture.
+	// 2. Transform into dst space using src2dst
+	// 3. Create a new imageId of the transformed texture
+	// 4. Upload the transformed data to the new ImageId
+	// 5. Draw.
+
+	u.markDirty(affineTransform(src2dst, sr))
+
+	// step 0: Check if there's no rotation, in which case we don't need to bother with
+	// 	the expensive network traffic or CPU matrix multiplication.
+	//  We can just draw the already uploaded texture at the translated location.
+	if isTranslation(src2dst) {
+		srcT := src.(*textureImpl)
+		// src2dst maps sr itself, not a rectangle at the origin.
+		newRectangle := sr.Add(translation(src2dst))
+		u.drawTexture(srcT.imageId, newRectangle, sr.Min, op)
+		return
+
+	}
+
+	// step 0b: /dev/draw can't scale an image, but a scale without any
+	// rotation or shear can still be done by the server when replicating
+	// the source is enough, such as stretching a single row or column,
+	// or when it's shrunk by a whole number (see Scale). Anything else
+	// has to go through the pixels.
+	if src2dst[1] == 0 && src2dst[3] == 0 && src2dst[0] > 0 && src2dst[4] > 0 {
+		dr := affineTransform(src2dst, sr)
+		if _, ok := src.(*textureImpl); ok && serverScalable(dr.Size(), sr.Size()) {
+			u.Scale(dr, src, sr, op, opts)
+			return
+		}
+	}
+
+	// step 1: read the subimage data
+	t := src.(*textureImpl)
+	// the pixels are only needed until they've been transformed, so
+	// read them into a buffer that's reused for every Draw.
+	if n := sr.Dx() * sr.Dy() * 4; cap(u.scratch) < n {
+		u.scratch = make([]byte, n)
+	} else {
+		u.scratch = u.scratch[:n]
+	}
+	// if the texture has only been uploaded to, the client still has
+	// its pixels, which saves a round trip to the server.
+	if !t.readLocal(sr, u.scratch) {
+		if err := u.ctl.ReadSubimageInto(t.imageId, sr, u.scratch); err != nil {
+			Log.Errorf("draw: read texture: %v", err)
+			return
+		}
+	}
+	// convert it to an image.RGBA to make life easier.
+	srcImage := &image.RGBA{Pix: u.scratch, Stride: 4 * sr.Dx(), Rect: sr}
+
+	// step 2: transform it into dst space
+	// 2a. Calculate the size of the translated buffer by multiplying
+	// the transformation through on sr.Min and sr.Max.
+	newRectangle := affineTransform(src2dst, sr)
+
+	// 2b. Do the transformation itself. Create a new RGBA image to
+	// use temporarily to make this easier.
+	transformedImage := image.NewRGBA(newRectangle)
+	xdraw.NearestNeighbor.Transform(transformedImage, src2dst, srcImage, sr, xdraw.Op(op), nil)
+
+	// 3. Create a new imageId of the transformed texture
+	newOriginRectangle := image.Rectangle{image.ZP, newRectangle.Size()}
+	imageId := u.ctl.AllocBuffer(0, false, newOriginRectangle, newOriginRectangle, color.RGBA{0, 0, 0, 0})
+	// the image is only used by this Draw and there's no way to reference it, so we might as
+	// well free it now instead of waiting until Release() is called. This is safe because the
+	// 'f' is written after the 'd' that uses it, and /dev/draw handles messages in the order
+	// they're written (see FreeID.)
+	defer u.ctl.FreeID(imageId)
+
+	// 4. Upload the transformed data to the new ImageId
+	if err := u.ctl.ReplaceSubimage(imageId, newOriginRectangle, transformedImage.Pix); err != nil {
+		Log.Errorf("draw: upload transformed texture: %v", err)
+		return
+	}
+
+	// 5. Draw.
+	u.drawTexture(imageId, newRectangle, image.ZP, op)
+}
+
+// Copy draws sr of src at dp with a single /dev/draw message, since a copy
+// never needs the pixels to be transformed on the client.
+func (u *uploadImpl) Copy(dp image.Point, src screen.Texture, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
+	t, ok := src.(*textureImpl)
+	if !ok {
+		drawer.Copy(u, dp, src, sr, op, opts)
+		return
+	}
+	dr := image.Rectangle{dp, dp.Add(sr.Size())}
+	u.markDirty(dr)
+	u.drawTexture(t.imageId, dr, sr.Min, op)
+}
+
+// drawTexture draws the image srcID into dr with sp at dr.Min. The
+// image's pixels are premultiplied, so its alpha is already part of
+// them, and the mask is solid: the server multiplies the source by the
+// mask's alpha, so using the image as its own mask would apply the alpha
+// twice. Only op decides whether it's blended with what's already there
+// or replaces it.
+func (u *uploadImpl) drawTexture(srcID uint32, dr image.Rectangle, sp image.Point, op draw.Op) {
+	u.ctl.Draw(u.imageId, srcID, u.s.solidMask(), dr, sp, image.ZP, op)
+}
+
+// Scale draws the texture server side when the scaling can be expressed
+// as a replicated /dev/draw image, or as a shrink by a whole number, and
+// falls back to drawer.Scale (which reads the pixels back and scales them
+// on the CPU) otherwise.
+//
+// /dev/draw has no notion of scaling, but a replicated image tiles itself
+// across whatever it's drawn into, so any axis of sr that is either
+// unscaled or a single pixel wide can be stretched by the server. A
+// shrink is done by drawing every k'th column and row on its own, which
+// is a message for each of them but never needs the pixels.
+func (u *uploadImpl) Scale(dr image.Rectangle, src screen.Texture, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
+	t, ok := src.(*textureImpl)
+	if !ok || !serverScalable(dr.Size(), sr.Size()) {
+		drawer.Scale(u, dr, src, sr, op, opts)
+		return
+	}
+	u.markDirty(dr)
+	if dr.Size() == sr.Size() {
+		u.drawTexture(t.imageId, dr, sr.Min, op)
+		return
+	}
+	if k, ok := downscaleFactor(dr.Size(), sr.Size()); ok {
+		u.downscale(dr, t.imageId, sr, k, op)
+		return
+	}
+
+	// copy sr into a replicated image which is clipped to the size of
+	// the destination, then let the server tile it into dr.
+	tileR := image.Rectangle{image.ZP, sr.Size()}
+	clipR := image.Rectangle{image.ZP, dr.Size()}
+	replID := u.ctl.AllocBuffer(0, true, tileR, clipR, color.RGBA{0, 0, 0, 0})
+	defer u.ctl.FreeID(replID)
+	// the copy needs to be exact, so use a solid mask.
+	maskID := u.s.solidMask()
+
+	u.ctl.Draw(replID, t.imageId, maskID, tileR, sr.Min, image.ZP, draw.Src)
+	u.drawTexture(replID, dr, image.ZP, op)
+}
+
+// downscale draws sr of the image srcID into dr, which is k times smaller
+// on each axis, by picking the pixel in the middle of each k by k block
+// like drawer.Scale's nearest neighbour does. The columns are picked into
+// an image as tall as sr first, and then the rows from that into dr, so
+// that every pixel of dr is drawn once with op.
+func (u *uploadImpl) downscale(dr image.Rectangle, srcID uint32, sr image.Rectangle, k image.Point, op draw.Op) {
+	maskID := u.s.solidMask()
+	sp := sr.Min
+	if k.X > 1 {
+		colsR := image.Rect(0, 0, dr.Dx(), sr.Dy())
+		colsID := u.ctl.AllocBuffer(0, false, colsR, colsR, color.RGBA{0, 0, 0, 0})
+		defer u.ctl.FreeID(colsID)
+		for x := 0; x < dr.Dx(); x++ {
+			u.ctl.Draw(colsID, srcID, maskID, image.Rect(x, 0, x+1, sr.Dy()), image.Pt(sr.Min.X+x*k.X+k.X/2, sr.Min.Y), image.ZP, draw.Src)
+		}
+		srcID, sp = colsID, image.ZP
+	}
+	if k.Y == 1 {
+		u.ctl.Draw(u.imageId, srcID, maskID, dr, sp, image.ZP, op)
+		return
+	}
+	for y := 0; y < dr.Dy(); y++ {
+		u.ctl.Draw(u.imageId, srcID, maskID, image.Rect(dr.Min.X, dr.Min.Y+y, dr.Max.X, dr.Min.Y+y+1), image.Pt(sp.X, sp.Y+y*k.Y+k.Y/2), image.ZP, op)
+	}
+}
+
+// serverScalable reports whether a source of size ssz can be scaled to
+// dsz by the /dev/draw server, without reading its pixels back.
+func serverScalable(dsz, ssz image.Point) bool {
+	_, ok := downscaleFactor(dsz, ssz)
+	return ok || replScalable(dsz, ssz)
+}
+
+// downscaleFactor returns how many times bigger ssz is than dsz on each
+// axis, if they're both whole numbers.
+func downscaleFactor(dsz, ssz image.Point) (image.Point, bool) {
+	if dsz.X <= 0 || dsz.Y <= 0 || ssz.X < dsz.X || ssz.Y < dsz.Y || ssz.X%dsz.X != 0 || ssz.Y%dsz.Y != 0 {
+		return image.ZP, false
+	}
+	return image.Point{ssz.X / dsz.X, ssz.Y / dsz.Y}, true
+}
+
+// replScalable reports whether a source of size ssz can be scaled to dsz
+// by replicating it on the /dev/draw server.
+func replScalable(dsz, ssz image.Point) bool {
+	if ssz.X <= 0 || ssz.Y <= 0 {
+		return false
+	}
+	return (dsz.X == ssz.X || ssz.X == 1) && (dsz.Y == ssz.Y || ssz.Y == 1)
+}
+
+// DrawUniform fills the area that sr is transformed to with src. The
+// colour's alpha is already part of the colour that's drawn, so the mask is
+// solid: using the colour as its own mask would apply the alpha twice with
+// draw.Over, and make draw.Src blend instead of replacing.
+func (u *uploadImpl) DrawUniform(src2dst f64.Aff3, src color.Color, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
+	u.markDirty(affineTransform(src2dst, sr))
+	// check of we can skip the affine transformation to speed things up.
+	if isTranslation(src2dst) {
+		newRectangle := sr.Add(translation(src2dst))
+		colorID := u.ctl.AllocBuffer(0, true, newRectangle, sr, src)
+		defer u.ctl.FreeID(colorID)
+		u.ctl.Draw(u.imageId, colorID, u.s.solidMask(), newRectangle, sr.Min, image.ZP, op)
+		return
+
+	}
+
+	// the colour is drawn from the origin, so as in Fill, it's clipped
+	// to the size of the area it covers rather than to sr, which may not
+	// include the origin at all.
+	newRectangle := affineTransform(src2dst, sr)
+	colorID := u.ctl.AllocBuffer(0, true, image.Rect(0, 0, 1, 1), image.Rectangle{image.ZP, newRectangle.Size()}, src)
+	defer u.ctl.FreeID(colorID)
+	u.ctl.Draw(u.imageId, colorID, u.s.solidMask(), newRectangle, image.ZP, image.ZP, op)
+}
@@ -0,0 +1,174 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"testing"
+
+	"golang.org/x/mobile/event/key"
+	"golang.org/x/mobile/event/mouse"
+)
+
+// errReader returns err from every Read.
+type errReader struct{ err error }
+
+func (r errReader) Read(p []byte) (int, error) { return 0, r.err }
+
+func TestDeviceErrors(t *testing.T) {
+	useLogger(t)
+	errc := make(chan error, 1)
+	s := &screenImpl{opts: DevdrawOptions{Errors: errc}}
+
+	hungup := errors.New("i/o on hungup channel")
+	readMouseEvents(errReader{hungup}, make(chan *mouse.Event), s, nil)
+	select {
+	case err := <-errc:
+		if !strings.Contains(err.Error(), hungup.Error()) {
+			t.Errorf("got error %v, want one about %v", err, hungup)
+		}
+	default:
+		t.Errorf("no error was sent when /dev/mouse failed")
+	}
+
+	// the driver doesn't block when the application isn't keeping up.
+	s.fail(hungup)
+	s.fail(hungup)
+	if len(errc) != 1 {
+		t.Errorf("got %d errors queued, want 1", len(errc))
+	}
+}
+
+func TestKeyboardError(t *testing.T) {
+	useLogger(t)
+	useFS(t, &fakeFS{files: map[string]string{
+		"/dev/consctl": "",
+		"/dev/cons":    "ab",
+	}})
+	errc := make(chan error, 1)
+	s := &screenImpl{opts: DevdrawOptions{Errors: errc}}
+
+	notifier := make(chan *key.Event, 10)
+	keyboardEventHandler(notifier, s, nil)
+	if len(notifier) != 2 {
+		t.Errorf("got %d key events, want 2", len(notifier))
+	}
+	select {
+	case err := <-errc:
+		if !strings.Contains(err.Error(), "EOF") {
+			t.Errorf("got error %v, want EOF", err)
+		}
+	default:
+		t.Errorf("no error was sent when /dev/cons was closed")
+	}
+}
+
+func TestMouseStartError(t *testing.T) {
+	useLogger(t)
+	useFS(t, &fakeFS{})
+	startErr := make(chan error, 1)
+	mouseEventHandler(make(chan *mouse.Event), &screenImpl{}, nil, startErr)
+	if err := <-startErr; err == nil || !strings.Contains(err.Error(), "/dev/mouse") {
+		t.Errorf("got start error %v, want one about /dev/mouse", err)
+	}
+
+	useFS(t, &fakeFS{files: map[string]string{"/dev/mouse": ""}})
+	mouseEventHandler(make(chan *mouse.Event), &screenImpl{}, nil, startErr)
+	if err := <-startErr; err != nil {
+		t.Errorf("got start error %v after /dev/mouse was opened", err)
+	}
+}
+
+// failingData is a /dev/draw/n/data whose writes fail after the first
+// ok of them succeed, with err if it's set, or else as though the
+// connection was lost.
+type failingData struct {
+	ok     int
+	writes int
+	err    error
+}
+
+func (f *failingData) Write(p []byte) (int, error) {
+	f.writes++
+	if f.writes > f.ok {
+		if f.err != nil {
+			return 0, f.err
+		}
+		return 0, errors.New("i/o on hungup channel")
+	}
+	return len(p), nil
+}
+
+func (f *failingData) Read(p []byte) (int, error) { return 0, errors.New("unexpected read") }
+func (f *failingData) Close() error               { return nil }
+
+func TestDrawCtrlerWriteError(t *testing.T) {
+	f := &failingData{ok: 1}
+	d := &DrawCtrler{data: f, iounitSize: 65535}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Err(); err != nil {
+		t.Fatalf("Err() = %v before anything failed", err)
+	}
+	err := d.Flush()
+	if err == nil || !strings.Contains(err.Error(), "hungup") {
+		t.Fatalf("got error %v, want the write error", err)
+	}
+	if d.Err() != err {
+		t.Errorf("Err() = %v, want %v", d.Err(), err)
+	}
+
+	// nothing else touches the file.
+	d.AllocBuffer(0, false, image.Rect(0, 0, 1, 1), image.Rect(0, 0, 1, 1), color.Black)
+	d.Draw(1, 2, 2, image.Rect(0, 0, 1, 1), image.ZP, image.ZP, draw.Src)
+	if err := d.SetOp(draw.Src); err != d.Err() {
+		t.Errorf("SetOp: got %v, want %v", err, d.Err())
+	}
+	if err := d.ReadSubimageInto(1, image.Rect(0, 0, 1, 1), make([]byte, 4)); err != d.Err() {
+		t.Errorf("ReadSubimageInto: got %v, want %v", err, d.Err())
+	}
+	if _, err := d.AllocScreen(); err != d.Err() {
+		t.Errorf("AllocScreen: got %v, want %v", err, d.Err())
+	}
+	if f.writes != 2 {
+		t.Errorf("wrote %d messages, want 2", f.writes)
+	}
+}
+
+func TestAllocScreenInUse(t *testing.T) {
+	// the first screen IDs are taken, which isn't a fatal error.
+	f := &failingData{err: errors.New("screen id in use")}
+	d := &DrawCtrler{data: f, iounitSize: 65535}
+	_, err := d.AllocScreen()
+	if !errors.Is(err, NoScreen) || !strings.Contains(err.Error(), "255") {
+		t.Errorf("got %v, want NoScreen after 255 attempts", err)
+	}
+	if err := d.Err(); err != nil {
+		t.Errorf("Err() = %v after the screen IDs were rejected", err)
+	}
+}
+
+func TestDrawCtrlerRejectedMessage(t *testing.T) {
+	// the server rejects a message without the connection being lost,
+	// such as freeing an ID that it doesn't know.
+	f := &failingData{err: errors.New("unknown id for draw image")}
+	d := &DrawCtrler{data: f, iounitSize: 65535}
+	d.FreeID(42)
+	if err := d.Err(); err != nil {
+		t.Fatalf("Err() = %v after a rejected message", err)
+	}
+	f.err, f.ok = nil, f.writes+1
+	if err := d.Flush(); err != nil {
+		t.Errorf("Flush after a rejected message: %v", err)
+	}
+	if f.writes != 2 {
+		t.Errorf("wrote %d messages, want 2", f.writes)
+	}
+}
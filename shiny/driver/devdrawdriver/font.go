@@ -0,0 +1,336 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maxStringChars is the most characters that are sent in a single 's'
+// message, so that it comfortably fits in an iounit.
+const maxStringChars = 100
+
+// font is a Plan 9 font, as described in font(6). Its subfonts are loaded
+// into /dev/draw the first time one of their characters is drawn.
+type font struct {
+	height, ascent int
+	ranges         []fontRange
+}
+
+// fontRange is the range of runes in a font that are drawn with one
+// subfont.
+type fontRange struct {
+	min, max rune
+	// the index of min in the subfont.
+	offset int
+	// the absolute path of the subfont file.
+	file string
+
+	sub *subfont
+	// the error from loading sub, so that it's only reported once.
+	err error
+}
+
+// subfont is a subfont which has been loaded into a /dev/draw font cache.
+type subfont struct {
+	cacheID uint32
+	ascent  int
+	chars   []fontChar
+}
+
+// fontChar describes one character of a subfont, as in font(6).
+type fontChar struct {
+	x           int
+	top, bottom int
+	left        int8
+	width       uint8
+}
+
+// parseFont parses the contents of the font file named name.
+func parseFont(name string, data []byte) (*font, error) {
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("%s: missing height and ascent", name)
+	}
+	height, err1 := strconv.Atoi(fields[0])
+	ascent, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("%s: invalid height and ascent", name)
+	}
+	f := &font{height: height, ascent: ascent}
+	for fields = fields[2:]; len(fields) > 0; {
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s: incomplete subfont range", name)
+		}
+		min, err1 := strconv.ParseInt(fields[0], 0, 32)
+		max, err2 := strconv.ParseInt(fields[1], 0, 32)
+		if err1 != nil || err2 != nil || max < min {
+			return nil, fmt.Errorf("%s: invalid subfont range %s %s", name, fields[0], fields[1])
+		}
+		fields = fields[2:]
+		// the offset is optional, and the file name never starts with
+		// a number.
+		var offset int64
+		if n, err := strconv.ParseInt(fields[0], 0, 32); err == nil {
+			offset = n
+			fields = fields[1:]
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("%s: missing subfont file", name)
+			}
+		}
+		file := fields[0]
+		fields = fields[1:]
+		if !path.IsAbs(file) {
+			file = path.Join(path.Dir(name), file)
+		}
+		f.ranges = append(f.ranges, fontRange{
+			min:    rune(min),
+			max:    rune(max),
+			offset: int(offset),
+			file:   file,
+		})
+	}
+	return f, nil
+}
+
+// parseChan parses a channel descriptor such as "k1" or "r8g8b8a8" (or
+// the log2 of the depth of a grey image, from the old image format) as
+// described in image(6). It returns the descriptor in the form that's
+// sent to /dev/draw, and the number of bits per pixel.
+func parseChan(s string) (uint32, int, error) {
+	if ld, err := strconv.Atoi(s); err == nil {
+		if ld < 0 || ld > 3 {
+			return 0, 0, fmt.Errorf("invalid depth %s", s)
+		}
+		s = fmt.Sprintf("k%d", 1<<uint(ld))
+	}
+	var pix uint32
+	depth := 0
+	for i := 0; i < len(s); i += 2 {
+		t := strings.IndexByte("rgbkamx", s[i])
+		if t < 0 || i+1 >= len(s) || s[i+1] < '1' || s[i+1] > '8' {
+			return 0, 0, fmt.Errorf("invalid channel descriptor %s", s)
+		}
+		n := int(s[i+1] - '0')
+		pix = pix<<8 | uint32(t)<<4 | uint32(n)
+		depth += n
+	}
+	if depth == 0 || depth > 32 || 8%depth != 0 && depth%8 != 0 {
+		return 0, 0, fmt.Errorf("invalid channel descriptor %s", s)
+	}
+	return pix, depth, nil
+}
+
+// bytesPerLine returns the number of bytes in each row of an image
+// with bounds r and the given depth, as described in image(6).
+func bytesPerLine(r image.Rectangle, depth int) int {
+	return (r.Max.X*depth+7)/8 - r.Min.X*depth/8
+}
+
+// loadImage parses the image in data, which is in the format described
+// in image(6), and uploads it to a new /dev/draw image. It returns the
+// image, its channel descriptor and bounds, and whatever follows the
+// image in data.
+func (d *DrawCtrler) loadImage(data []byte) (id uint32, pix uint32, r image.Rectangle, rest []byte, err error) {
+	compressed := bytes.HasPrefix(data, []byte("compressed\n"))
+	if compressed {
+		data = data[len("compressed\n"):]
+	}
+	if len(data) < 5*12 {
+		return 0, 0, r, nil, fmt.Errorf("short image header")
+	}
+	fields := strings.Fields(string(data[:5*12]))
+	data = data[5*12:]
+	if len(fields) != 5 {
+		return 0, 0, r, nil, fmt.Errorf("invalid image header")
+	}
+	pix, depth, err := parseChan(fields[0])
+	if err != nil {
+		return 0, 0, r, nil, err
+	}
+	r = image.Rect(strToInt(fields[1]), strToInt(fields[2]), strToInt(fields[3]), strToInt(fields[4]))
+	if r.Empty() {
+		return 0, 0, r, nil, fmt.Errorf("empty image %v", r)
+	}
+	bpl := bytesPerLine(r, depth)
+
+	id = d.allocImage(0, false, 0, pix, false, r, r, color.Transparent)
+	defer func() {
+		if err != nil {
+			d.FreeID(id)
+		}
+	}()
+
+	if compressed {
+		// the data is already in the form that 'Y' expects, split into
+		// blocks of rows that each fit in a message.
+		for y := r.Min.Y; y < r.Max.Y; {
+			if len(data) < 2*12 {
+				return 0, 0, r, nil, fmt.Errorf("short compressed block header")
+			}
+			maxy := strToInt(strings.TrimSpace(string(data[:12])))
+			n := strToInt(strings.TrimSpace(string(data[12:24])))
+			data = data[24:]
+			if maxy <= y || maxy > r.Max.Y || n < 0 || n > len(data) {
+				return 0, 0, r, nil, fmt.Errorf("invalid compressed block")
+			}
+			d.replaceRect('Y', id, image.Rect(r.Min.X, y, r.Max.X, maxy), data[:n])
+			data = data[n:]
+			y = maxy
+		}
+		return id, pix, r, data, nil
+	}
+
+	if len(data) < bpl*r.Dy() {
+		return 0, 0, r, nil, fmt.Errorf("short image data")
+	}
+	rows := (d.iounit() - 21) / bpl
+	if rows < 1 {
+		rows = 1
+	}
+	for y := r.Min.Y; y < r.Max.Y; y += rows {
+		end := y + rows
+		if end > r.Max.Y {
+			end = r.Max.Y
+		}
+		d.replaceRect('y', id, image.Rect(r.Min.X, y, r.Max.X, end), data[:(end-y)*bpl])
+		data = data[(end-y)*bpl:]
+	}
+	return id, pix, r, data, nil
+}
+
+// loadSubfont loads the subfont in data, which is in the format
+// described in font(6), into a new /dev/draw font cache.
+func (d *DrawCtrler) loadSubfont(data []byte) (*subfont, error) {
+	srcID, pix, r, data, err := d.loadImage(data)
+	if err != nil {
+		return nil, err
+	}
+	// the characters are copied into the cache, so the image they
+	// came from isn't needed afterwards.
+	defer d.FreeID(srcID)
+
+	if len(data) < 3*12 {
+		return nil, fmt.Errorf("short subfont header")
+	}
+	n := strToInt(strings.TrimSpace(string(data[:12])))
+	ascent := strToInt(strings.TrimSpace(string(data[24:36])))
+	data = data[3*12:]
+	if n <= 0 || n > 0xFFFF || len(data) < 6*(n+1) {
+		return nil, fmt.Errorf("invalid subfont header")
+	}
+	sub := &subfont{ascent: ascent, chars: make([]fontChar, n+1)}
+	for i := range sub.chars {
+		c := data[6*i:]
+		sub.chars[i] = fontChar{
+			x:      int(c[0]) | int(c[1])<<8,
+			top:    int(c[2]),
+			bottom: int(c[3]),
+			left:   int8(c[4]),
+			width:  c[5],
+		}
+	}
+
+	sub.cacheID = d.allocImage(0, false, 0, pix, false, r, r, color.Transparent)
+	d.InitFont(sub.cacheID, n, uint8(ascent))
+	for i, c := range sub.chars[:n] {
+		cr := image.Rect(c.x, c.top, sub.chars[i+1].x, c.bottom).Intersect(r)
+		d.LoadChar(sub.cacheID, srcID, i, cr, cr.Min, c.left, c.width)
+	}
+	return sub, nil
+}
+
+// loadFont returns the font in the file name, reading it the first
+// time that it's used.
+func (s *screenImpl) loadFont(name string) (*font, error) {
+	s.fontsMu.Lock()
+	defer s.fontsMu.Unlock()
+	if f, ok := s.fonts[name]; ok {
+		return f, nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parseFont(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if s.fonts == nil {
+		s.fonts = make(map[string]*font)
+	}
+	s.fonts[name] = f
+	return f, nil
+}
+
+// fontChar returns the subfont of f which contains r, and the index of r
+// in it, loading the subfont if necessary. ok is false if f has no
+// character for r.
+func (s *screenImpl) fontChar(f *font, r rune) (sub *subfont, index int, ok bool) {
+	s.fontsMu.Lock()
+	defer s.fontsMu.Unlock()
+	for i := range f.ranges {
+		fr := &f.ranges[i]
+		if r < fr.min || r > fr.max {
+			continue
+		}
+		if fr.sub == nil && fr.err == nil {
+			data, err := ioutil.ReadFile(fr.file)
+			if err == nil {
+				fr.sub, err = s.ctl.loadSubfont(data)
+			}
+			if err != nil {
+				fr.err = fmt.Errorf("%s: %v", fr.file, err)
+				Log.Errorf("load subfont: %v", fr.err)
+			}
+		}
+		if fr.sub == nil {
+			return nil, 0, false
+		}
+		index = int(r-fr.min) + fr.offset
+		if index < 0 || index >= len(fr.sub.chars)-1 {
+			return nil, 0, false
+		}
+		return fr.sub, index, true
+	}
+	return nil, 0, false
+}
+
+// releaseFonts frees the font caches of every subfont that was loaded.
+func (s *screenImpl) releaseFonts() {
+	s.fontsMu.Lock()
+	defer s.fontsMu.Unlock()
+	for _, f := range s.fonts {
+		for _, fr := range f.ranges {
+			if fr.sub != nil {
+				s.ctl.FreeID(fr.sub.cacheID)
+			}
+		}
+	}
+	s.fonts = nil
+}
+
+// forgetFonts is like releaseFonts, but for after the connection that the
+// font caches were loaded on was lost, when there's nothing to free. The
+// fonts are loaded again the next time that they're used.
+func (s *screenImpl) forgetFonts() {
+	s.fontsMu.Lock()
+	defer s.fontsMu.Unlock()
+	for _, f := range s.fonts {
+		for _, fr := range f.ranges {
+			if fr.sub != nil {
+				s.ctl.forgetID(fr.sub.cacheID)
+			}
+		}
+	}
+	s.fonts = nil
+}
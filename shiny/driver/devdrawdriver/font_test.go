@@ -0,0 +1,158 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestFont writes a font with the characters 'A' to 'C' to dir, and
+// returns the name of the font file. The subfont is an uncompressed k1
+// image where character i is i+4 pixels wide.
+func writeTestFont(t *testing.T, dir string) string {
+	const n, height, ascent = 3, 10, 8
+	var chars []fontChar
+	x := 0
+	for i := 0; i < n; i++ {
+		chars = append(chars, fontChar{x: x, top: 0, bottom: height, left: 0, width: uint8(i + 4)})
+		x += i + 4
+	}
+	chars = append(chars, fontChar{x: x})
+	r := image.Rect(0, 0, x, height)
+
+	sub := []byte(fmt.Sprintf("%11s %11d %11d %11d %11d ", "k1", r.Min.X, r.Min.Y, r.Max.X, r.Max.Y))
+	sub = append(sub, make([]byte, bytesPerLine(r, 1)*r.Dy())...)
+	sub = append(sub, fmt.Sprintf("%11d %11d %11d ", n, height, ascent)...)
+	for _, c := range chars {
+		sub = append(sub, byte(c.x), byte(c.x>>8), byte(c.top), byte(c.bottom), byte(c.left), c.width)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "abc.subfont"), sub, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(dir, "abc.font")
+	font := fmt.Sprintf("%d %d\n0x41 0x43 abc.subfont\n", height, ascent)
+	if err := ioutil.WriteFile(name, []byte(font), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestParseFont(t *testing.T) {
+	f, err := parseFont("/lib/font/bit/test/x.font", []byte("13 10\n0x0000 0x007F ascii.9\n0x0100 0x017F 2 /abs/latin\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.height != 13 || f.ascent != 10 || len(f.ranges) != 2 {
+		t.Fatalf("got %+v", f)
+	}
+	if r := f.ranges[0]; r.min != 0 || r.max != 0x7F || r.offset != 0 || r.file != "/lib/font/bit/test/ascii.9" {
+		t.Errorf("range 0: got %+v", r)
+	}
+	if r := f.ranges[1]; r.min != 0x100 || r.max != 0x17F || r.offset != 2 || r.file != "/abs/latin" {
+		t.Errorf("range 1: got %+v", r)
+	}
+}
+
+func TestParseChan(t *testing.T) {
+	for _, tc := range []struct {
+		s     string
+		pix   uint32
+		depth int
+	}{
+		{"k1", 0x31, 1},
+		{"0", 0x31, 1},
+		{"3", 0x38, 8},
+		{"a8b8g8r8", chanABGR32, 32},
+	} {
+		pix, depth, err := parseChan(tc.s)
+		if err != nil || pix != tc.pix || depth != tc.depth {
+			t.Errorf("parseChan(%q) = %#x, %d, %v, want %#x, %d", tc.s, pix, depth, err, tc.pix, tc.depth)
+		}
+	}
+}
+
+func TestWindowDrawString(t *testing.T) {
+	fontName := writeTestFont(t, t.TempDir())
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w := newWindowImpl(s, image.ZP)
+	f.msgs = nil
+
+	// the first string loads the subfont into a font cache, after the
+	// colour has been allocated.
+	w.DrawString(image.Pt(10, 20), "ABZAC", fontName, color.Black)
+	if got, want := f.cmds(), "bbybilllfOsf"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	srcID := binary.LittleEndian.Uint32(f.msgs[1][1:])
+	cacheID := binary.LittleEndian.Uint32(f.msgs[3][1:])
+	if got := binary.LittleEndian.Uint32(f.msgs[8][1:]); got != srcID {
+		t.Errorf("freed %d after loading the subfont, want the subfont image %d", got, srcID)
+	}
+	// character 1 is 5 pixels wide, starting after the 4 pixels of
+	// character 0.
+	l := f.msgs[6][1:]
+	if idx, r := binary.LittleEndian.Uint16(l[8:]), msgRect(l[10:]); idx != 1 || r != image.Rect(4, 0, 9, 10) || l[35] != 5 {
+		t.Errorf("loaded character %d from %v with width %d, want 1 from (4,0)-(9,10) with width 5", idx, r, l[35])
+	}
+
+	checkString := func(msg []byte) {
+		t.Helper()
+		str := msg[1:]
+		if got := binary.LittleEndian.Uint32(str[8:]); got != cacheID {
+			t.Errorf("font: got %d, want the cache %d", got, cacheID)
+		}
+		// the point is on the baseline, the font's ascent below the
+		// top of the string.
+		if got := image.Pt(int(binary.LittleEndian.Uint32(str[12:])), int(binary.LittleEndian.Uint32(str[16:]))); got != image.Pt(10, 28) {
+			t.Errorf("point: got %v, want (10,28)", got)
+		}
+		n := int(binary.LittleEndian.Uint16(str[44:]))
+		var indices []uint16
+		for i := 0; i < n; i++ {
+			indices = append(indices, binary.LittleEndian.Uint16(str[46+2*i:]))
+		}
+		if fmt.Sprint(indices) != "[0 1 0 2]" {
+			t.Errorf("indices: got %v, want [0 1 0 2]", indices)
+		}
+	}
+	checkString(f.msgs[10])
+
+	// the second one uses the cache that's already loaded.
+	f.msgs = nil
+	w.DrawString(image.Pt(10, 20), "ABAC", fontName, color.Black)
+	if got, want := f.cmds(), "bOsf"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	checkString(f.msgs[2])
+
+	// a string that starts off the left of the window is lined up with
+	// the colour at p, and the server clips the colour even though it's
+	// replicated, so it has to cover the window from there.
+	f.msgs = nil
+	p := image.Pt(-150, 20)
+	w.DrawString(p, "ABAC", fontName, color.Black)
+	if got, want := f.cmds(), "bOsf"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	baseline := msgPoint(f.msgs[2][13:])
+	need := image.Rect(0, 0, 100, 100).Sub(baseline).Add(msgPoint(f.msgs[2][37:]))
+	if clipr := msgRect(f.msgs[0][31:]); !need.In(clipr) {
+		t.Errorf("the colour is clipped to %v, which doesn't cover the string's source %v", clipr, need)
+	}
+
+	// and the cache is freed with the screen.
+	f.msgs = nil
+	s.releaseFonts()
+	if got := f.cmds(); got != "f" || binary.LittleEndian.Uint32(f.msgs[0][1:]) != cacheID {
+		t.Errorf("got messages %q when releasing fonts, want the cache to be freed", got)
+	}
+}
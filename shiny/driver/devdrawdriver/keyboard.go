@@ -6,20 +6,34 @@ package devdrawdriver
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"golang.org/x/mobile/event/key"
+	"io"
 	"os"
+	"strings"
 )
 
 var currentModifiers key.Modifiers
 
-// keyboardEventHandler writes rawon to /dev/consctl, and then continuously
-// reads runes from /dev/cons and converts them to key.Event messages, which
-// it passes along the notifier channel.
-func keyboardEventHandler(notifier chan *key.Event) {
-	ctl, err := os.OpenFile("/dev/consctl", os.O_WRONLY, 0644)
+// keyboardEventHandler reads the keyboard and converts what it reads to
+// key.Event messages, which it passes along the notifier channel. It
+// returns when done is closed, or the keyboard can't be read.
+//
+// If /dev/kbd exists (as it does on 9front) it's used, since it reports
+// both presses and releases. Otherwise it writes rawon to /dev/consctl,
+// and then continuously reads runes from /dev/cons.
+func keyboardEventHandler(notifier chan *key.Event, s *screenImpl, done <-chan struct{}) {
+	if kbd, err := openDev("kbd", os.O_RDONLY); err == nil {
+		defer kbd.Close()
+		defer closeOnDone(kbd, done)()
+		readKbdEvents(kbd, notifier, s, done)
+		return
+	}
+
+	ctl, err := openDev("consctl", os.O_WRONLY)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error converting keyboard input to raw mode. Could not open /dev/consctl.\n")
+		s.fail(fmt.Errorf("Error converting keyboard input to raw mode. Could not open /dev/consctl: %v", err))
 		return
 	}
 	// Closing /dev/consctl will cause the keyboard to stop being in raw mode. So defer the close instead of
@@ -28,36 +42,280 @@ func keyboardEventHandler(notifier chan *key.Event) {
 	rawon := []byte("rawon")
 	n, err := ctl.Write(rawon)
 	if err != nil || n != 5 {
-		fmt.Fprintf(os.Stderr, "Error converting keyboard into raw mode. Could not write rawon..\n")
+		s.fail(fmt.Errorf("Error converting keyboard into raw mode. Could not write rawon: %v", err))
 		return
 	}
 
-	cons, err := os.Open("/dev/cons")
+	cons, err := openDev("cons", os.O_RDONLY)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not open keyboard driver.\n")
+		s.fail(fmt.Errorf("Could not open keyboard driver: %v", err))
 		return
-
 	}
+	defer cons.Close()
+	defer closeOnDone(cons, done)()
 	// *os.File doesn't implement ReadRune, and /dev/cons will return one rune at
 	// a time in raw mode, so convert the file Reader to a bufio.Reader so that
 	// it implements the ReadRune() interface.
 	keyReader := bufio.NewReader(cons)
 	for {
 		r, _, err := keyReader.ReadRune()
+		select {
+		case <-done:
+			return
+		default:
+		}
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading key from console.\n")
-			continue
+			s.fail(fmt.Errorf("Error reading key from console: %v", err))
+			return
 		}
 		var code key.Code
 		code, currentModifiers = RuneToCode(r)
-		notifier <- &key.Event{
-			Rune:      r,
+		select {
+		case notifier <- &key.Event{
+			Rune:      keyRune(r),
 			Code:      code,
 			Modifiers: currentModifiers,
 			Direction: key.DirPress,
+		}:
+		case <-done:
+			return
+		}
+
+	}
+}
+
+// The runes that /dev/kbd uses for the modifier keys, from 9front's
+// keyboard.h.
+const (
+	kbdAlt   = '\uf015'
+	kbdShift = '\uf016'
+	kbdCtl   = '\uf017'
+)
+
+// readKbdEvents does the work of keyboardEventHandler for the already
+// opened /dev/kbd file r. It returns when r is closed or done is closed.
+//
+// Each read from /dev/kbd returns one or more NUL terminated messages,
+// which start with a letter giving their type:
+//
+//	k runes	a key was pressed, and runes are the keys that are now down
+//	K runes	a key was released, and runes are the keys that are still down
+//	c runes	runes were typed
+//
+// The keys in 'k' and 'K' messages are the runes that they produce without
+// any modifiers. They're sent as presses and releases with the rune that
+// the key types with the modifiers that are down, as kbdRune works it
+// out, like the /dev/cons path does. Typing a key also sends its rune in
+// a 'c' message, which is dropped, so only the runes that no key was
+// pressed for, such as ones made with compose, are sent from 'c' messages,
+// with a Direction of key.DirNone. 'r' and 'R' messages, which have the
+// raw scan codes, are ignored.
+func readKbdEvents(r io.Reader, notifier chan *key.Event, s *screenImpl, done <-chan struct{}) {
+	send := func(e *key.Event) {
+		select {
+		case notifier <- e:
+		case <-done:
+		}
+	}
+
+	buf := make([]byte, 256)
+	// the keys that were down after the last 'k' or 'K' message, and the
+	// runes that their presses were sent with.
+	var down []rune
+	pressed := make(map[rune]rune)
+	// the runes that keys were pressed for, which their 'c' messages
+	// type again.
+	var typed []rune
+	var mods key.Modifiers
+	for {
+		n, err := r.Read(buf)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			s.fail(fmt.Errorf("Error reading from the keyboard: %v", err))
+			return
+		}
+		for _, msg := range bytes.Split(buf[:n], []byte{0}) {
+			if len(msg) == 0 {
+				continue
+			}
+			runes := []rune(string(msg[1:]))
+			switch msg[0] {
+			case 'k':
+				for _, r := range runes {
+					if containsRune(down, r) {
+						continue
+					}
+					mods |= kbdModifier(r)
+					kr := kbdRune(r, mods)
+					pressed[r] = kr
+					if kbdModifier(r) == 0 {
+						if kr == -1 {
+							// the special keys type their own rune.
+							typed = append(typed, r)
+						} else {
+							typed = append(typed, kr)
+						}
+						// a 'c' message that never comes, such as
+						// for a key that's part of a compose
+						// sequence, isn't waited for forever.
+						if len(typed) > maxTyped {
+							typed = typed[1:]
+						}
+					}
+					send(&key.Event{Rune: kr, Code: kbdCode(r), Modifiers: mods, Direction: key.DirPress})
+				}
+				down = runes
+			case 'K':
+				for _, r := range down {
+					if containsRune(runes, r) {
+						continue
+					}
+					mods &^= kbdModifier(r)
+					kr, ok := pressed[r]
+					if !ok {
+						kr = kbdRune(r, mods)
+					}
+					delete(pressed, r)
+					send(&key.Event{Rune: kr, Code: kbdCode(r), Modifiers: mods, Direction: key.DirRelease})
+				}
+				down = runes
+			case 'c':
+				for _, r := range runes {
+					if i := indexRune(typed, r); i >= 0 {
+						typed = append(typed[:i], typed[i+1:]...)
+						continue
+					}
+					code, _ := RuneToCode(r)
+					send(&key.Event{Rune: keyRune(r), Code: code, Modifiers: mods, Direction: key.DirNone})
+				}
+			case 'r', 'R':
+			default:
+				Log.Warnf("Unhandled keyboard event: %q", msg)
+				s.ctl.dropInput(true)
+			}
+		}
+	}
+}
+
+// maxTyped is how many runes readKbdEvents keeps waiting for 'c' messages
+// for.
+const maxTyped = 16
+
+// kbdRune returns the rune that the key r from /dev/kbd types with the
+// modifiers mods, assuming a standard US keyboard layout as RuneToCode
+// does. It's -1 for the modifiers and the special keys, which don't type
+// anything.
+func kbdRune(r rune, mods key.Modifiers) rune {
+	if kbdModifier(r) != 0 {
+		return -1
+	}
+	r = keyRune(r)
+	switch {
+	case r == -1:
+	case mods&key.ModControl != 0 && r >= 'a' && r <= 'z':
+		r = r - 'a' + 1
+	case mods&key.ModShift != 0 && r >= 'a' && r <= 'z':
+		r = r - 'a' + 'A'
+	case mods&key.ModShift != 0:
+		if i := strings.IndexRune(unshifted, r); i >= 0 {
+			r = rune(shifted[i])
+		}
+	}
+	return r
+}
+
+// unshifted and shifted are the runes that the keys which aren't letters
+// type without and with shift on a US keyboard.
+const (
+	unshifted = "`1234567890-=[]\\;',./"
+	shifted   = "~!@#$%^&*()_+{}|:\"<>?"
+)
+
+func indexRune(runes []rune, r rune) int {
+	for i, c := range runes {
+		if c == r {
+			return i
 		}
+	}
+	return -1
+}
 
+func containsRune(runes []rune, r rune) bool {
+	return indexRune(runes, r) >= 0
+}
+
+// kbdModifier returns the modifier that the key r from /dev/kbd is, if
+// any.
+func kbdModifier(r rune) key.Modifiers {
+	switch r {
+	case kbdShift:
+		return key.ModShift
+	case kbdCtl:
+		return key.ModControl
+	case kbdAlt:
+		return key.ModAlt
 	}
+	return 0
+}
+
+// kbdCode returns the code of the key r from /dev/kbd.
+func kbdCode(r rune) key.Code {
+	switch r {
+	case kbdShift:
+		return key.CodeLeftShift
+	case kbdCtl:
+		return key.CodeLeftControl
+	case kbdAlt:
+		return key.CodeLeftAlt
+	}
+	code, _ := RuneToCode(r)
+	return code
+}
+
+// specialKeys maps the runes that Plan 9 uses for keys which don't type
+// anything, from keyboard.h, to their codes. Most of them are in the
+// private use area starting at KF, 0xF000.
+var specialKeys = map[rune]key.Code{
+	'\uf001': key.CodeF1,
+	'\uf002': key.CodeF2,
+	'\uf003': key.CodeF3,
+	'\uf004': key.CodeF4,
+	'\uf005': key.CodeF5,
+	'\uf006': key.CodeF6,
+	'\uf007': key.CodeF7,
+	'\uf008': key.CodeF8,
+	'\uf009': key.CodeF9,
+	'\uf00a': key.CodeF10,
+	'\uf00b': key.CodeF11,
+	'\uf00c': key.CodeF12,
+	'\uf00d': key.CodeHome,
+	'\uf00e': key.CodeUpArrow,
+	'\uf00f': key.CodePageUp,
+	'\uf011': key.CodeLeftArrow,
+	'\uf012': key.CodeRightArrow,
+	'\uf013': key.CodePageDown,
+	'\uf014': key.CodeInsert,
+	'\uf018': key.CodeEnd,
+	// Kdown is 0x80. Kview is 0xF800, which is the same key, and some
+	// keyboards send it for the down arrow instead.
+	'\u0080': key.CodeDownArrow,
+	'\uf800': key.CodeDownArrow,
+}
+
+// keyRune returns the Rune of a key.Event for the rune r that was typed,
+// which is -1 for the special keys, since they don't type anything.
+func keyRune(r rune) rune {
+	if _, ok := specialKeys[r]; ok {
+		return -1
+	}
+	return r
 }
 
 // RuneToCode takes a unicode rune that came off of /dev/cons, and guesses
@@ -67,15 +325,16 @@ func keyboardEventHandler(notifier chan *key.Event) {
 //
 // 9front has /dev/kbd which tells more information about the keypresses instead
 // of the runes generated by the key press, but /dev/cons is the only thing
-// that can be assumed to be present on every Plan 9 instance, so even if
-// support is implemented for /dev/kbd this needs to remain here as a fallback.
+// that can be assumed to be present on every Plan 9 instance, so this remains
+// as a fallback for when /dev/kbd isn't there.
 //
 // This only supports the shift and control modifiers, because alt is used
 // as the compose key at a lower level of the OS before passing the rune along
 // /dev/cons
 func RuneToCode(r rune) (key.Code, key.Modifiers) {
-	// TODO: Look into using /dev/kbd on 9front when available.
-
+	if code, ok := specialKeys[r]; ok {
+		return code, 0
+	}
 	// first handle ones that can easily be calculated from the
 	// ASCII ordering.
 	if r >= 'a' && r <= 'z' {
@@ -223,58 +482,10 @@ func RuneToCode(r rune) (key.Code, key.Modifiers) {
 		return key.CodeSlash, 0
 	case '?':
 		return key.CodeSlash, key.ModShift
-	// Aptly named unicode codepoints.
-	case '\uf001':
-		return key.CodeF1, 0
-	case '\uf002':
-		return key.CodeF2, 0
-	case '\uf003':
-		return key.CodeF3, 0
-	case '\uf004':
-		return key.CodeF4, 0
-	case '\uf005':
-		return key.CodeF5, 0
-	case '\uf006':
-		return key.CodeF6, 0
-	case '\uf007':
-		return key.CodeF7, 0
-	case '\uf008':
-		return key.CodeF8, 0
-	case '\uf009':
-		return key.CodeF9, 0
-	case '\uf00a':
-		return key.CodeF10, 0
-	case '\uf00b':
-		return key.CodeF11, 0
-	case '\uf00c':
-		return key.CodeF12, 0
-
-	// Magic unicode characters that came from
-	// pushing keys on my keyboard and seeing what
-	// came out.
-	case '\uf012':
-		return key.CodeRightArrow, 0
-	case '\uf011':
-		return key.CodeLeftArrow, 0
-	case '\uf00e':
-		return key.CodeUpArrow, 0
-	case '\uf800':
-		return key.CodeDownArrow, 0
-
-	case '\uf014':
-		return key.CodeInsert, 0
 	case '\u007f':
 		return key.CodeDeleteForward, 0
-	case '\uf00f':
-		return key.CodePageUp, 0
-	case '\uf013':
-		return key.CodePageDown, 0
-	case '\uf00d':
-		return key.CodeHome, 0
-	case '\uf018':
-		return key.CodeEnd, 0
 	default:
-		fmt.Fprintf(os.Stderr, "Unknown unicode character %d %c %s, %u unsupported by /dev/draw driver.\n", r, r, r, r)
+		Log.Warnf("Unknown unicode character %d %c (%U) unsupported by /dev/draw driver.", r, r, r)
 		return key.CodeUnknown, 0
 	}
 }
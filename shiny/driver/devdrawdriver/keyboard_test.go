@@ -0,0 +1,161 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"testing"
+
+	"golang.org/x/mobile/event/key"
+)
+
+func TestKbdEvents(t *testing.T) {
+	l := useLogger(t)
+	notifier := make(chan *key.Event, 100)
+	readKbdEvents(&chunkReader{[]string{
+		"k\uf016\x00",
+		// a read can have more than one message.
+		"k\uf016a\x00cA\x00",
+		"r\x1e\x00",
+		"K\uf016\x00",
+		"K\x00",
+	}}, notifier, &screenImpl{}, nil)
+	close(notifier)
+
+	// the press and release carry the rune that was typed, and its 'c'
+	// message isn't sent again.
+	want := []key.Event{
+		{Rune: -1, Code: key.CodeLeftShift, Modifiers: key.ModShift, Direction: key.DirPress},
+		{Rune: 'A', Code: key.CodeA, Modifiers: key.ModShift, Direction: key.DirPress},
+		{Rune: 'A', Code: key.CodeA, Modifiers: key.ModShift, Direction: key.DirRelease},
+		{Rune: -1, Code: key.CodeLeftShift, Modifiers: 0, Direction: key.DirRelease},
+	}
+	var got []key.Event
+	for e := range notifier {
+		got = append(got, *e)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if len(l.warnings) != 0 {
+		t.Errorf("logged warnings %q", l.warnings)
+	}
+}
+
+func TestKbdRunes(t *testing.T) {
+	useLogger(t)
+	notifier := make(chan *key.Event, 100)
+	readKbdEvents(&chunkReader{[]string{
+		// shift-1, with the 'c' message for it in the next read.
+		"k\uf016\x00k\uf0161\x00", "c!\x00K\uf016\x00K\x00",
+		// control-V.
+		"k\uf017\x00k\uf017v\x00c\x16\x00K\uf017\x00K\x00",
+		// the up arrow types a rune that isn't sent.
+		"k\uf00e\x00c\uf00e\x00K\x00",
+		// é is composed from keys that don't type anything themselves.
+		"k\uf015\x00K\x00ke\x00K\x00k'\x00K\x00c\u00e9\x00",
+	}}, notifier, &screenImpl{}, nil)
+	close(notifier)
+
+	var got []key.Event
+	for e := range notifier {
+		if e.Direction != key.DirRelease {
+			got = append(got, *e)
+		}
+	}
+	want := []key.Event{
+		{Rune: -1, Code: key.CodeLeftShift, Modifiers: key.ModShift, Direction: key.DirPress},
+		{Rune: '!', Code: key.Code1, Modifiers: key.ModShift, Direction: key.DirPress},
+		{Rune: -1, Code: key.CodeLeftControl, Modifiers: key.ModControl, Direction: key.DirPress},
+		{Rune: '\x16', Code: key.CodeV, Modifiers: key.ModControl, Direction: key.DirPress},
+		{Rune: -1, Code: key.CodeUpArrow, Direction: key.DirPress},
+		{Rune: -1, Code: key.CodeLeftAlt, Modifiers: key.ModAlt, Direction: key.DirPress},
+		{Rune: 'e', Code: key.CodeE, Direction: key.DirPress},
+		{Rune: '\'', Code: key.CodeApostrophe, Direction: key.DirPress},
+		{Rune: 'é', Code: key.CodeUnknown, Direction: key.DirNone},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestKeyboardUsesKbd(t *testing.T) {
+	useLogger(t)
+	fs := &fakeFS{files: map[string]string{
+		"/dev/kbd":     "ka\x00ca\x00K\x00",
+		"/dev/consctl": "",
+		"/dev/cons":    "ab",
+	}}
+	useFS(t, fs)
+	notifier := make(chan *key.Event, 10)
+	keyboardEventHandler(notifier, &screenImpl{}, nil)
+	if len(notifier) != 2 {
+		t.Errorf("got %d key events, want 2", len(notifier))
+	}
+	for _, name := range fs.opened {
+		if name != "/dev/kbd" {
+			t.Errorf("opened %s as well as /dev/kbd", name)
+		}
+	}
+}
+
+func TestSpecialKeys(t *testing.T) {
+	l := useLogger(t)
+	for r, want := range map[rune]key.Code{
+		'\uf001': key.CodeF1,
+		'\uf00c': key.CodeF12,
+		'\uf00e': key.CodeUpArrow,
+		'\u0080': key.CodeDownArrow,
+		'\uf011': key.CodeLeftArrow,
+		'\uf012': key.CodeRightArrow,
+		'\uf018': key.CodeEnd,
+	} {
+		if got, mods := RuneToCode(r); got != want || mods != 0 {
+			t.Errorf("RuneToCode(%U) = %v, %v, want %v", r, got, mods, want)
+		}
+	}
+
+	// typing a special key doesn't type a rune.
+	notifier := make(chan *key.Event, 10)
+	readKbdEvents(&chunkReader{[]string{"c\uf00e\x00ca\x00"}}, notifier, &screenImpl{}, nil)
+	close(notifier)
+	var got []key.Event
+	for e := range notifier {
+		got = append(got, *e)
+	}
+	want := []key.Event{
+		{Rune: -1, Code: key.CodeUpArrow, Direction: key.DirNone},
+		{Rune: 'a', Code: key.CodeA, Direction: key.DirNone},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got events %+v, want %+v", got, want)
+	}
+	if len(l.warnings) != 0 {
+		t.Errorf("logged warnings %q", l.warnings)
+	}
+}
+
+func TestKbdDropped(t *testing.T) {
+	useLogger(t)
+	s := &screenImpl{ctl: &DrawCtrler{}}
+	notifier := make(chan *key.Event, 100)
+	readKbdEvents(&chunkReader{[]string{"ca\x00x\x00", "R\x1e\x00?\x00cb\x00"}}, notifier, s, nil)
+	close(notifier)
+	if n := len(notifier); n != 2 {
+		t.Errorf("got %d events, want 2", n)
+	}
+	if got := s.ctl.Stats().DroppedKeyboard; got != 2 {
+		t.Errorf("got DroppedKeyboard %d, want 2", got)
+	}
+}
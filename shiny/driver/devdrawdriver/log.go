@@ -0,0 +1,40 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"log"
+)
+
+// A Logger receives the diagnostics of the driver. Warnings are for
+// unexpected or malformed data from the devices, which are otherwise
+// ignored, and errors are for failures of the devices themselves.
+type Logger interface {
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Log is where the driver's diagnostics are sent. By default they are
+// discarded. It should be set before calling Main.
+var Log Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+// StdLogger is a Logger which prints to a *log.Logger, prefixing every
+// message with its level.
+type StdLogger struct {
+	*log.Logger
+}
+
+func (l StdLogger) Warnf(format string, args ...interface{}) {
+	l.Printf("warning: "+format, args...)
+}
+
+func (l StdLogger) Errorf(format string, args ...interface{}) {
+	l.Printf("error: "+format, args...)
+}
@@ -0,0 +1,52 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingLogger is a Logger which remembers everything it's sent.
+type recordingLogger struct {
+	mu       sync.Mutex
+	warnings []string
+	errors   []string
+}
+
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.mu.Lock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.mu.Lock()
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
+
+// useLogger sends the driver's diagnostics to a new recordingLogger
+// until the test finishes.
+func useLogger(t *testing.T) *recordingLogger {
+	l := &recordingLogger{}
+	old := Log
+	Log = l
+	t.Cleanup(func() { Log = old })
+	return l
+}
+
+func TestLogMalformedMouse(t *testing.T) {
+	l := useLogger(t)
+	readMouse(t, &screenImpl{ctl: &DrawCtrler{}}, "m        abc           0           0           0 ")
+	if len(l.warnings) != 1 || !strings.Contains(l.warnings[0], "X coordinate") {
+		t.Errorf("got warnings %q, want one about the X coordinate", l.warnings)
+	}
+	if len(l.errors) != 0 {
+		t.Errorf("got errors %q, want none", l.errors)
+	}
+}
@@ -4,32 +4,42 @@
 
 package devdrawdriver
 
-// Gets index and size of the largest prefix of pix[idx] which occurs
+import "encoding/binary"
+
+// maxLookback is the farthest back that a match can be encoded in the
+// compressed format, and defaultLookback is how far compress searches.
+const (
+	maxLookback     = 1024
+	defaultLookback = 128
+)
+
+// Gets the absolute index and size of the largest prefix of pix[idx] which occurs
 // before it in pix. If it doesn't find a prefix of at least size 3,
 // it will claim it couldn't find any, and if it finds one of size 34,
 // it will claim that's the largest that it found since that's the range
 // that fits in a compressed image.
 //
-// It will search at most 128 bytes back (32 pixels) which should be enough
-// to cover the common case of a pixel repeating itself in a fill colour, without
-// adding too much CPU overhead in a degenerate case.
+// It will search less than lookback bytes back. The default of 128 bytes (32
+// pixels) should be enough to cover the common case of a pixel repeating itself
+// in a fill colour, without adding too much CPU overhead in a degenerate case.
+// The optimum value is a function of bandwidth and CPU: from trial and error on
+// a Raspberry Pi 2 over a wifi connection (probably close to the worst case
+// scenerio), looking back the full 1024 bytes is slower than not using
+// compression, while 128 provides some gains. More powerful CPU servers will get
+// more from looking farther.
 //
 // If it doesn't find anything, it will return 0, 0 indicating that bytes should just be
 // encoded directly.
-func getLargestPrefix(pix []byte, idx int) (uint16, uint8) {
-	// BUG(driusan): This length that it searches back should probably be a tuneable parameter
-	// since the optimum value is going to be a function of bandwidth and CPU, but from trial
-	// and error on a Raspberry Pi 2 over a wifi connection (probably close to the worst case
-	// scenerio), looking back the full 1024 bytes is slower than not using compression, while
-	// 128 provides some gains. More powerful CPU servers will still get gains from this, just
-	// not as much as if they looked back farther.
-	var candidateIdx uint16
+func getLargestPrefix(pix []byte, idx, lookback int) (int, uint8) {
+	if idx+34 >= len(pix) {
+		return 0, 0
+	}
+	var candidateIdx int
 	var candidateSize uint8
-	for i := int(idx - 34); i >= 0 && (idx-i < 128); i-- {
-		if pix[i] == pix[idx] {
-			if idx+34 >= len(pix) {
-				break
-			}
+	for i := idx - 34; i >= 0 && (idx-i < lookback); i-- {
+		// anything shorter than 3 bytes isn't a match, so don't
+		// bother comparing the rest unless the first 3 are the same.
+		if pix[i] == pix[idx] && pix[i+1] == pix[idx+1] && pix[i+2] == pix[idx+2] {
 			for j, val := range pix[idx : idx+34] {
 				if i+j >= len(pix) {
 					break
@@ -37,7 +47,7 @@ func getLargestPrefix(pix []byte, idx int) (uint16, uint8) {
 				if val == pix[i+j] {
 					if j > int(candidateSize) {
 						candidateSize = uint8(j)
-						candidateIdx = uint16(i)
+						candidateIdx = i
 					}
 				} else {
 					break
@@ -57,51 +67,119 @@ func getLargestPrefix(pix []byte, idx int) (uint16, uint8) {
 
 // Compresses pix using the variant of LZ77 compression described in image(6)
 func compress(pix []byte) []byte {
-	val := make([]byte, 0)
+	// In the worst case nothing matches and every 128 bytes of pix
+	// needs a 1 byte header, so allocate enough for that up front.
+	return compressAppend(make([]byte, 0, len(pix)+(len(pix)+127)/128), pix, defaultLookback)
+}
+
+// compressChannelSplit is like compress, but compresses each of the four
+// channels of the RGBA pixels in pix separately, one after another, in
+// the hope that a channel on its own repeats more than the interleaved
+// pixels do. len(pix) must be a multiple of 4.
+//
+// image(6) decompresses straight into the interleaved pixels of the
+// image, so what this returns can't be sent in a 'Y' message. It's kept
+// so that BenchmarkCompressPhoto can compare the two.
+func compressChannelSplit(pix []byte) []byte {
+	n := len(pix) / 4
+	planes := make([]byte, len(pix))
+	for i := 0; i < n; i++ {
+		for c := 0; c < 4; c++ {
+			planes[c*n+i] = pix[4*i+c]
+		}
+	}
+	val := make([]byte, 0, len(pix)+4*((n+127)/128))
+	for c := 0; c < 4; c++ {
+		val = compressAppend(val, planes[c*n:(c+1)*n], defaultLookback)
+	}
+	return val
+}
+
+// compressAppend is like compress, but appends the compressed data to val
+// and returns the extended slice, so that callers can reuse a buffer. It
+// searches for matches less than lookback bytes back, which must be at
+// most maxLookback.
+func compressAppend(val, pix []byte, lookback int) []byte {
+	// lit is the start of the bytes which didn't match anything and
+	// haven't been written yet.
+	lit := 0
+	// last is 1 + the most recent position at which each 4 byte
+	// sequence (by its hash) starts, out of the positions before seen.
+	// Those are only added once getLargestPrefix could match them.
+	// Looking for a match at every byte would be too slow otherwise, so
+	// getLargestPrefix is only used when the bytes at that position
+	// are the same as at i, and close enough to be used.
+	var last [1 << hashBits]int32
+	seen := 0
 	for i := 0; i < len(pix); {
-		if idx, size := getLargestPrefix(pix, i); size > 2 {
-			// "If the high-order bit is zero, the next 5 bits encode the
-			//  length of a substring copied from previous pixels. Values
-			//  from 0 to 31 encode lengths from 3 to 34. The bottom
-			//  two bits of the first byte and the 8 bits of the next byte
-			//  encode an offset backward from the current position in the
-			//  pixel data at which the copy is to be found. Values from
-			//  0 to 1023 encode offsets from 1 to 1024."
-			var encoding [2]byte
+		for ; seen <= i-34; seen++ {
+			last[hash4(pix[seen:])] = int32(seen + 1)
+		}
+		var idx int
+		var size uint8
+		if i+3 < len(pix) {
+			if p := int(last[hash4(pix[i:])]) - 1; p >= 0 && i-p < lookback &&
+				binary.LittleEndian.Uint32(pix[p:]) == binary.LittleEndian.Uint32(pix[i:]) {
+				idx, size = getLargestPrefix(pix, i, lookback)
+			}
+		}
+		if size <= 2 {
+			// Rather than giving up on the next 128 bytes, look for a
+			// match again at the next one, so that a match right after
+			// something that doesn't repeat (such as the edge of
+			// the foreground on a plain background) isn't missed.
+			i++
+			if i-lit == 128 {
+				val = appendLiteral(val, pix[lit:i])
+				lit = i
+			}
+			continue
+		}
+		val = appendLiteral(val, pix[lit:i])
+
+		// "If the high-order bit is zero, the next 5 bits encode the
+		//  length of a substring copied from previous pixels. Values
+		//  from 0 to 31 encode lengths from 3 to 34. The bottom
+		//  two bits of the first byte and the 8 bits of the next byte
+		//  encode an offset backward from the current position in the
+		//  pixel data at which the copy is to be found. Values from
+		//  0 to 1023 encode offsets from 1 to 1024."
+		var encoding [2]byte
 
-			// encode the length
-			encoding[0] = (size - 3) << 2
+		// encode the length
+		encoding[0] = (size - 3) << 2
 
-			// encode the offset
-			encodedOffset := uint16(i-int(idx)) - 1
-			encoding[0] |= byte((encodedOffset & 0x0300) >> 8)
-			encoding[1] = byte(encodedOffset & 0x00FF)
-			val = append(val, encoding[:]...)
+		// encode the offset
+		encodedOffset := uint16(i-idx) - 1
+		encoding[0] |= byte((encodedOffset & 0x0300) >> 8)
+		encoding[1] = byte(encodedOffset & 0x00FF)
+		val = append(val, encoding[:]...)
 
-			i += int(size)
-		} else {
-			// "In a code whose first byte has the high-order bit set, the rest
-			//  of the byte encodes the length of a byte encoded
-			// directly. Values from 0 to 127 encode lengths from 1 to 128
-			// bytes. Subsequent bytes are the literal pixel data."
-			//
-			// If there were no matches, we just add as much data
-			// as we can in order to give the next bit pixel a better
-			// chance of finding something to match against without wasting
-			// much CPU time.
-			if left := len(pix) - i; left >= 128 {
-				val = append(val, 0xFF)
-				val = append(val, pix[i:i+128]...)
+		i += int(size)
+		lit = i
+	}
+	return appendLiteral(val, pix[lit:])
+}
 
-				i += 128
-			} else {
-				val = append(val, (0x80 | byte(left-1)))
-				val = append(val, pix[i:i+left]...)
+// hashBits is the number of bits of the hashes returned by hash4.
+const hashBits = 12
 
-				i += left
-			}
-		}
+// hash4 hashes the first 4 bytes of b, which is the shortest match that
+// getLargestPrefix returns.
+func hash4(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b) * 2654435761 >> (32 - hashBits)
+}
 
+// appendLiteral appends the code for lit, which must be at most 128 bytes,
+// to val and returns the extended slice.
+func appendLiteral(val, lit []byte) []byte {
+	if len(lit) == 0 {
+		return val
 	}
-	return val
+	// "In a code whose first byte has the high-order bit set, the rest
+	//  of the byte encodes the length of a byte encoded
+	// directly. Values from 0 to 127 encode lengths from 1 to 128
+	// bytes. Subsequent bytes are the literal pixel data."
+	val = append(val, 0x80|byte(len(lit)-1))
+	return append(val, lit...)
 }
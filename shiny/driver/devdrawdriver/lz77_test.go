@@ -0,0 +1,128 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"bytes"
+	"image"
+	"math/rand"
+	"testing"
+)
+
+func BenchmarkCompress(b *testing.B) {
+	// one row of a 1920 pixel wide frame.
+	line := gradient(image.Rect(0, 0, 1920, 1)).Pix
+	b.ReportAllocs()
+	b.SetBytes(int64(len(line)))
+	for i := 0; i < b.N; i++ {
+		compress(line)
+	}
+}
+
+// photo returns the pixels of a w by h image that varies smoothly with a
+// little noise, the way a photograph does, unlike gradient.
+func photo(w, h int) []byte {
+	r := rand.New(rand.NewSource(1))
+	pix := make([]byte, 4*w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := 4 * (y*w + x)
+			pix[i] = uint8((x+y)/8 + r.Intn(4))
+			pix[i+1] = uint8(x/4 + r.Intn(4))
+			pix[i+2] = uint8(y/4 + r.Intn(4))
+			pix[i+3] = 0xff
+		}
+	}
+	return pix
+}
+
+func BenchmarkCompressPhoto(b *testing.B) {
+	pix := photo(640, 4)
+	for _, bc := range []struct {
+		name     string
+		compress func([]byte) []byte
+	}{
+		{"interleaved", compress},
+		{"channels", compressChannelSplit},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(pix)))
+			var c []byte
+			for i := 0; i < b.N; i++ {
+				c = bc.compress(pix)
+			}
+			b.ReportMetric(float64(len(c))/float64(len(pix)), "ratio")
+		})
+	}
+}
+
+func TestCompressChannelSplit(t *testing.T) {
+	pix := photo(100, 3)
+	// the channels are compressed one after another, so decompressing
+	// gives each of them in turn.
+	got := decompress(t, compressChannelSplit(pix))
+	n := len(pix) / 4
+	if len(got) != len(pix) {
+		t.Fatalf("decompressed to %d bytes, want %d", len(got), len(pix))
+	}
+	for i := 0; i < n; i++ {
+		for c := 0; c < 4; c++ {
+			if got[c*n+i] != pix[4*i+c] {
+				t.Fatalf("channel %d of pixel %d: got %d, want %d", c, i, got[c*n+i], pix[4*i+c])
+			}
+		}
+	}
+}
+
+func TestCompressLarge(t *testing.T) {
+	// more than 65535 bytes, so that matches are found at indexes which
+	// don't fit in a uint16.
+	pix := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 10000)
+	idx := 70000
+	if got, size := getLargestPrefix(pix, idx, defaultLookback); size < 3 || got < idx-128 || got >= idx {
+		t.Errorf("getLargestPrefix(pix, %d) = %d, %d, want a match just before %d", idx, got, size, idx)
+	}
+	if got := decompress(t, compress(pix)); !bytes.Equal(got, pix) {
+		t.Errorf("decompressed data doesn't match the original")
+	}
+}
+
+func TestCompressAfterLiteral(t *testing.T) {
+	// something that doesn't repeat, followed by a plain background.
+	pix := make([]byte, 20)
+	rand.New(rand.NewSource(1)).Read(pix)
+	pix = append(pix, bytes.Repeat([]byte{10, 20, 30, 255}, 100)...)
+
+	c := compress(pix)
+	if got := decompress(t, c); !bytes.Equal(got, pix) {
+		t.Fatalf("decompressed data doesn't match the original")
+	}
+	// the background is matched as soon as there's enough of it before
+	// to match against, instead of after 128 bytes of literals.
+	if c[0] != 0x80|(20+36-1) {
+		t.Errorf("first code is %#x, want %d bytes of literals", c[0], 20+36)
+	}
+	// (the last 34 bytes are never matched.)
+	if len(c) > 120 {
+		t.Errorf("compressed %d bytes to %d", len(pix), len(c))
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 50; n++ {
+		// runs of random bytes and repeated pixels.
+		var pix []byte
+		for len(pix) < 2000 {
+			run := make([]byte, r.Intn(200))
+			r.Read(run)
+			pix = append(pix, run...)
+			pix = append(pix, bytes.Repeat(run[:len(run)%8], r.Intn(20))...)
+		}
+		if got := decompress(t, compress(pix)); !bytes.Equal(got, pix) {
+			t.Fatalf("decompressed data doesn't match the original %x", pix)
+		}
+	}
+}
@@ -5,10 +5,13 @@
 package devdrawdriver
 
 import (
+	"context"
+	"fmt"
+	"github.com/niconan/shiny-plan9/shiny/driver/internal/errscreen"
 	"github.com/niconan/shiny-plan9/shiny/screen"
 	"golang.org/x/mobile/event/key"
 	"golang.org/x/mobile/event/mouse"
-	"log"
+	"image"
 )
 
 // Main spawns 2 goroutines to make blocking reads from /dev
@@ -16,50 +19,149 @@ import (
 // Window events such as resize and move come in over the mouse
 // channel.
 func Main(f func(s screen.Screen)) {
+	MainContext(context.Background(), f)
+}
+
+// MainContext is like Main, but also returns when ctx is cancelled.
+// When that happens, the active window is sent a lifecycle.StageDead
+// event and the screen is released, even if f hasn't returned.
+func MainContext(ctx context.Context, f func(s screen.Screen)) {
+	mainWithOptions(ctx, f, DefaultOptions)
+}
+
+// MainWithOptions is like Main, but configures the driver with opts.
+// Fields that are left zero aren't all the same as Main's: a zero
+// BorderWidth draws over rio's border, for example. Unless that's what's
+// wanted, start from a copy of DefaultOptions and change it:
+//
+//	opts := devdrawdriver.DefaultOptions
+//	opts.Reconnect = true
+//	devdrawdriver.MainWithOptions(f, opts)
+func MainWithOptions(f func(s screen.Screen), opts DevdrawOptions) {
+	mainWithOptions(context.Background(), f, opts)
+}
+
+func mainWithOptions(ctx context.Context, f func(s screen.Screen), opts DevdrawOptions) {
 	mouseEvent := make(chan *mouse.Event)
 	keyboardEvent := make(chan *key.Event)
-	doneChan := make(chan bool)
 
-	s, err := newScreenImpl()
+	s, err := newScreenImpl(opts)
 	if err != nil {
-		log.Fatalf("new screen: %v\n", err)
+		f(errscreen.Stub(fmt.Errorf("new screen: %v", err)))
+		return
 	}
 	// read the current window size that will be drawn into from
 	// /dev/wctl
-	windowSize, err := readWctl()
+	windowSize, border, err := s.readFrame()
 	if err != nil {
-		log.Fatalf("read current window size: %v\n", err)
+		s.release()
+		f(errscreen.Stub(fmt.Errorf("read current window size: %v", err)))
+		return
+	}
+
+	s.windowsMu.Lock()
+	s.windowFrame, s.border = windowSize, border
+	s.windowsMu.Unlock()
+	if opts.Fullscreen {
+		if err := s.setFullscreen(true); err != nil {
+			Log.Errorf("%v", err)
+		}
 	}
 
-	s.windowFrame = windowSize
+	// the device goroutines are stopped by cancelling ctx when this
+	// returns.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// the screen stops them itself when it's released, before it frees
+	// anything.
+	s.stopDevices = cancel
+	// without the mouse, the application would run but never get any
+	// mouse events, so it's given a screen that only returns the error
+	// instead, like the other drivers do when they can't start. What
+	// was allocated on the server is freed first.
+	startErr := make(chan error, 1)
+	go mouseEventHandler(mouseEvent, s, ctx.Done(), startErr)
+	if err := <-startErr; err != nil {
+		s.release()
+		f(errscreen.Stub(err))
+		return
+	}
+	go keyboardEventHandler(keyboardEvent, s, ctx.Done())
+	go wctlEventHandler(s, ctx.Done())
+	s.eventLoop(ctx, f, mouseEvent, keyboardEvent)
+}
 
+// eventLoop runs f in a new goroutine and dispatches the events
+// from the device goroutines to the active window until either f
+// returns or ctx is cancelled. The screen is released before it
+// returns.
+func (s *screenImpl) eventLoop(ctx context.Context, f func(s screen.Screen), mouseEvent chan *mouse.Event, keyboardEvent chan *key.Event) {
+	// buffered so that the goroutine doesn't leak if ctx was cancelled
+	// before f returned.
+	doneChan := make(chan bool, 1)
 	go func() {
 		// run the callback with the screen implementation, then send
 		// a notification to break out of the infinite loop when it
 		// exits
 		f(s)
 		doneChan <- true
-		s.release()
 	}()
+	defer s.release()
 
-	go mouseEventHandler(mouseEvent, s)
-	go keyboardEventHandler(keyboardEvent)
+	threshold := s.opts.DragThreshold
+	if threshold == 0 {
+		threshold = defaultDragThreshold
+	}
+	var drag dragTracker
 	for {
 		select {
 		case mEv := <-mouseEvent:
-			if s.w != nil {
-				// translate the mouse event from the screen coordinate system to the window
-				// coordinate system
-				mEv.X -= float32(s.windowFrame.Min.X)
-				mEv.Y -= float32(s.windowFrame.Min.Y)
-				s.w.Deque.Send(*mEv)
+			// translate the mouse event from the screen coordinate system to the Plan 9
+			// window's coordinate system. mouseTarget then translates it to the
+			// coordinate system of the window that it's for.
+			frame := s.frame()
+			mEv.X -= float32(frame.Min.X)
+			mEv.Y -= float32(frame.Min.Y)
+			if s.opts.SoftwareCursor {
+				s.moveCursor(image.Point{int(mEv.X), int(mEv.Y)})
+			}
+			if w, buttons := s.mouseTarget(mEv); w != nil {
+				if s.opts.CoalesceMotion && isMotion(*mEv) {
+					w.Deque.SendCoalesced(*mEv, isMotion)
+				} else {
+					w.Deque.Send(*mEv)
+				}
+				if s.opts.ButtonChords && mEv.Direction != mouse.DirNone {
+					w.Deque.Send(ChordEvent{X: mEv.X, Y: mEv.Y, Buttons: buttons})
+				}
+				if s.opts.DragGestures {
+					if d, ok := drag.update(*mEv, buttons, threshold); ok {
+						w.Deque.Send(d)
+					}
+				}
 			}
 		case kEv := <-keyboardEvent:
-			if s.w != nil {
-				s.w.Deque.Send(*kEv)
+			if w := s.focused(); w != nil {
+				if s.isPasteKey(kEv) {
+					// the key's release is dropped along with
+					// its press.
+					if kEv.Direction != key.DirRelease {
+						paste(w)
+					}
+				} else {
+					w.Deque.Send(*kEv)
+				}
 			}
 		case <-doneChan:
 			return
+		case <-ctx.Done():
+			s.windowsMu.Lock()
+			for _, w := range s.windows {
+				w.lifecycler.SetDead(true)
+				w.lifecycler.SendEvent(w, nil)
+			}
+			s.windowsMu.Unlock()
+			return
 		}
 	}
 }
@@ -0,0 +1,565 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/niconan/shiny-plan9/shiny/driver/devdrawdriver/devdrawsim"
+	"github.com/niconan/shiny-plan9/shiny/screen"
+	"golang.org/x/mobile/event/key"
+	"golang.org/x/mobile/event/lifecycle"
+	"golang.org/x/mobile/event/mouse"
+	"golang.org/x/mobile/event/size"
+)
+
+func TestMain(m *testing.M) {
+	// the tests never open the real devices, even on Plan 9. The ones
+	// that need particular files replace devfs with a fake of their own.
+	devfs = devdrawsim.New(image.Rect(0, 0, 1024, 768), image.Rect(100, 100, 304, 254))
+	os.Exit(m.Run())
+}
+
+func TestEventLoopCancel(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	ctx, cancel := context.WithCancel(context.Background())
+
+	windows := make(chan screen.Window)
+	block := make(chan struct{})
+	defer close(block)
+	app := func(s screen.Screen) {
+		w, _ := s.NewWindow(nil)
+		windows <- w
+		// never return on our own.
+		<-block
+	}
+
+	returned := make(chan struct{})
+	go func() {
+		s.eventLoop(ctx, app, make(chan *mouse.Event), make(chan *key.Event))
+		close(returned)
+	}()
+	w := <-windows
+	f.msgs = nil
+	cancel()
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("eventLoop did not return after the context was cancelled")
+	}
+	if got := f.cmds(); got != "fF" {
+		t.Errorf("got messages %q after cancelling, want the window and screen to be freed", got)
+	}
+
+	var last lifecycle.Event
+	for {
+		e := w.NextEvent()
+		if l, ok := e.(lifecycle.Event); ok {
+			last = l
+			if l.To == lifecycle.StageDead {
+				break
+			}
+		}
+	}
+	if last.From != lifecycle.StageVisible {
+		t.Errorf("got lifecycle event %v, want a transition from visible to dead", last)
+	}
+}
+
+// nextInput returns the next mouse or key event sent to w, skipping over
+// the lifecycle, size and paint events.
+func nextInput(w screen.Window) interface{} {
+	for {
+		switch e := w.NextEvent().(type) {
+		case mouse.Event, key.Event:
+			return e
+		}
+	}
+}
+
+func TestEventRouting(t *testing.T) {
+	s, _ := newTestScreen(65535, image.Rect(100, 100, 300, 300))
+	mouseEvent := make(chan *mouse.Event)
+	keyboardEvent := make(chan *key.Event)
+
+	windows := make(chan screen.Window)
+	block := make(chan struct{})
+	defer close(block)
+	app := func(s screen.Screen) {
+		// bottom covers the whole Plan 9 window, top only the top left
+		// corner of it.
+		bottom, _ := s.NewWindow(nil)
+		top, _ := s.NewWindow(&screen.NewWindowOptions{Width: 50, Height: 50})
+		windows <- bottom
+		windows <- top
+		<-block
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.eventLoop(ctx, app, mouseEvent, keyboardEvent)
+	bottom, top := <-windows, <-windows
+
+	// the most recently created window has the focus.
+	keyboardEvent <- &key.Event{Rune: 'a'}
+	if e := nextInput(top).(key.Event); e.Rune != 'a' {
+		t.Errorf("top window got %v, want 'a'", e)
+	}
+
+	// mouse events go to the window under the pointer, in window
+	// coordinates.
+	mouseEvent <- &mouse.Event{X: 110, Y: 120}
+	if e := nextInput(top).(mouse.Event); e.X != 10 || e.Y != 20 {
+		t.Errorf("top window got %+v, want a move to (10, 20)", e)
+	}
+	mouseEvent <- &mouse.Event{X: 250, Y: 250}
+	if e := nextInput(bottom).(mouse.Event); e.X != 150 || e.Y != 150 {
+		t.Errorf("bottom window got %+v, want a move to (150, 150)", e)
+	}
+
+	// pressing a button over the bottom window focuses it, and it keeps
+	// getting mouse events until the button is released.
+	mouseEvent <- &mouse.Event{X: 250, Y: 250, Button: mouse.ButtonLeft, Direction: mouse.DirPress}
+	nextInput(bottom)
+	mouseEvent <- &mouse.Event{X: 110, Y: 110, Button: mouse.ButtonLeft, Direction: mouse.DirRelease}
+	if e := nextInput(bottom).(mouse.Event); e.Direction != mouse.DirRelease {
+		t.Errorf("bottom window got %+v, want the release", e)
+	}
+	keyboardEvent <- &key.Event{Rune: 'b'}
+	if e := nextInput(bottom).(key.Event); e.Rune != 'b' {
+		t.Errorf("bottom window got %v, want 'b'", e)
+	}
+}
+
+func TestEventRoutingWindowChurn(t *testing.T) {
+	// the race detector needs the goroutines to actually run at the
+	// same time.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	mouseEvent := make(chan *mouse.Event)
+	keyboardEvent := make(chan *key.Event)
+
+	done := make(chan struct{})
+	app := func(s screen.Screen) {
+		defer close(done)
+		// the windows are created and released by the application
+		// while the events are being routed to them.
+		for i := 0; i < 200; i++ {
+			w, _ := s.NewWindow(&screen.NewWindowOptions{Width: 10 + i%50, Height: 10 + i%50})
+			w.Release()
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	returned := make(chan struct{})
+	go func() {
+		s.eventLoop(ctx, app, mouseEvent, keyboardEvent)
+		close(returned)
+	}()
+
+	for i := 0; ; i++ {
+		select {
+		case mouseEvent <- &mouse.Event{X: float32(i % 100), Y: 5, Button: mouse.ButtonLeft, Direction: mouse.Direction(1 + i%2)}:
+		case keyboardEvent <- &key.Event{Rune: 'a'}:
+		case <-done:
+			select {
+			case <-returned:
+			case <-time.After(5 * time.Second):
+				t.Fatal("eventLoop did not return after the application did")
+			}
+			return
+		}
+	}
+}
+
+func TestButtonChords(t *testing.T) {
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	s.opts.ButtonChords = true
+	mouseEvent := make(chan *mouse.Event)
+
+	windows := make(chan screen.Window)
+	block := make(chan struct{})
+	defer close(block)
+	app := func(s screen.Screen) {
+		w, _ := s.NewWindow(nil)
+		windows <- w
+		<-block
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.eventLoop(ctx, app, mouseEvent, make(chan *key.Event))
+	w := <-windows
+
+	// hold left, then press middle with it, then release both at once.
+	evs := readMouse(t, s,
+		mouseMsg(10, 10, MouseButtonLeft),
+		mouseMsg(10, 10, MouseButtonLeft|MouseButtonMiddle),
+		mouseMsg(20, 10, 0),
+	)
+	go func() {
+		for i := range evs {
+			mouseEvent <- &evs[i]
+		}
+	}()
+	want := []ButtonMask{
+		MouseButtonLeft,
+		MouseButtonLeft | MouseButtonMiddle,
+		MouseButtonMiddle,
+		0,
+	}
+	for i, buttons := range want {
+		var c ChordEvent
+		for ok := false; !ok; {
+			c, ok = w.NextEvent().(ChordEvent)
+		}
+		if c.Buttons != buttons {
+			t.Errorf("chord %d: got buttons %v, want %v", i, c.Buttons, buttons)
+		}
+	}
+}
+
+func TestCoalesceMotion(t *testing.T) {
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	s.opts.CoalesceMotion = true
+	mouseEvent := make(chan *mouse.Event)
+
+	windows := make(chan screen.Window)
+	block := make(chan struct{})
+	defer close(block)
+	app := func(s screen.Screen) {
+		w, _ := s.NewWindow(nil)
+		windows <- w
+		<-block
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.eventLoop(ctx, app, mouseEvent, make(chan *key.Event))
+	w := <-windows
+
+	// the window doesn't read anything until the mouse has stopped.
+	evs := readMouse(t, s,
+		mouseMsg(10, 10, 0),
+		mouseMsg(11, 11, 0),
+		mouseMsg(12, 12, 0),
+		mouseMsg(12, 12, MouseButtonLeft),
+		mouseMsg(20, 20, MouseButtonLeft),
+		mouseMsg(21, 21, MouseButtonLeft),
+		mouseMsg(21, 21, 0),
+	)
+	for i := range evs {
+		mouseEvent <- &evs[i]
+	}
+	// only the last of each run of moves is left, and presses and
+	// releases are never dropped.
+	want := []mouse.Event{
+		{X: 12, Y: 12},
+		{X: 12, Y: 12, Button: mouse.ButtonLeft, Direction: mouse.DirPress},
+		{X: 21, Y: 21},
+		{X: 21, Y: 21, Button: mouse.ButtonLeft, Direction: mouse.DirRelease},
+	}
+	for i, e := range want {
+		if got := nextInput(w).(mouse.Event); got != e {
+			t.Errorf("event %d: got %+v, want %+v", i, got, e)
+		}
+	}
+}
+
+func TestDragGestures(t *testing.T) {
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	s.opts.DragGestures = true
+	mouseEvent := make(chan *mouse.Event)
+
+	windows := make(chan screen.Window)
+	block := make(chan struct{})
+	defer close(block)
+	app := func(s screen.Screen) {
+		w, _ := s.NewWindow(nil)
+		windows <- w
+		<-block
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.eventLoop(ctx, app, mouseEvent, make(chan *key.Event))
+	w := <-windows
+
+	evs := readMouse(t, s,
+		// a click, which jitters by less than the threshold.
+		mouseMsg(10, 10, MouseButtonLeft),
+		mouseMsg(12, 9, MouseButtonLeft),
+		mouseMsg(13, 11, 0),
+		// a drag, which only starts once it's gone far enough.
+		mouseMsg(50, 50, MouseButtonLeft),
+		mouseMsg(53, 50, MouseButtonLeft),
+		mouseMsg(60, 50, MouseButtonLeft),
+		mouseMsg(70, 55, MouseButtonLeft),
+		mouseMsg(70, 55, 0),
+		// moving without a button isn't a drag.
+		mouseMsg(90, 90, 0),
+	)
+	go func() {
+		for i := range evs {
+			mouseEvent <- &evs[i]
+		}
+		w.Send("marker")
+	}()
+	var drags []DragEvent
+	for e := w.NextEvent(); e != "marker"; e = w.NextEvent() {
+		if d, ok := e.(DragEvent); ok {
+			drags = append(drags, d)
+		}
+	}
+	want := []DragEvent{
+		{X: 60, Y: 50, StartX: 50, StartY: 50, Buttons: MouseButtonLeft},
+		{X: 70, Y: 55, StartX: 50, StartY: 50, Buttons: MouseButtonLeft},
+	}
+	if len(drags) != len(want) {
+		t.Fatalf("got drags %+v, want %+v", drags, want)
+	}
+	for i := range want {
+		if drags[i] != want[i] {
+			t.Errorf("drag %d: got %+v, want %+v", i, drags[i], want[i])
+		}
+	}
+}
+
+// pipeFS is a fakeFS which serves some of its files from pipes, so that
+// a test can decide when the driver reads from them.
+type pipeFS struct {
+	*fakeFS
+	pipes map[string]*io.PipeReader
+	// wctlRead, if it isn't nil, is closed once the wctl goroutine has
+	// read all of /dev/wctl. It doesn't use devfs or Log after that, so
+	// the test can put them back without racing with it.
+	wctlRead chan struct{}
+}
+
+// pipeFile is a file which is read from a pipe.
+type pipeFile struct{ *io.PipeReader }
+
+func (pipeFile) Write(p []byte) (int, error) { return 0, errors.New("read only") }
+
+// eofFile is a file which closes eof when a read reaches its end.
+type eofFile struct {
+	io.ReadWriteCloser
+	eof  chan struct{}
+	once sync.Once
+}
+
+func (f *eofFile) Read(p []byte) (int, error) {
+	n, err := f.ReadWriteCloser.Read(p)
+	if err == io.EOF {
+		f.once.Do(func() { close(f.eof) })
+	}
+	return n, err
+}
+
+func (f *pipeFS) OpenFile(name string, flag int) (io.ReadWriteCloser, error) {
+	if p, ok := f.pipes[name]; ok {
+		return pipeFile{p}, nil
+	}
+	file, err := f.fakeFS.OpenFile(name, flag)
+	// the wctl goroutine is the only one which opens it read only.
+	if err == nil && name == "/dev/wctl" && flag == os.O_RDONLY && f.wctlRead != nil {
+		file = &eofFile{ReadWriteCloser: file, eof: f.wctlRead}
+	}
+	return file, err
+}
+
+// TestMainDevices runs the driver from start to finish on the files that
+// a Plan 9 window system serves, from opening /dev/draw to freeing the
+// screen when the application returns.
+func TestMainDevices(t *testing.T) {
+	useLogger(t)
+	fs := drawFS()
+	fs.files["/dev/winname"] = "window.7"
+	fs.files["/dev/wctl"] = "        100         100         304         254 current visible"
+	fs.files["/dev/consctl"] = ""
+	mouseR, mouseW := io.Pipe()
+	consR, consW := io.Pipe()
+	wctlRead := make(chan struct{})
+	useFS(t, &pipeFS{fakeFS: fs, pipes: map[string]*io.PipeReader{
+		"/dev/mouse": mouseR,
+		"/dev/cons":  consR,
+	}, wctlRead: wctlRead})
+
+	ready := make(chan struct{})
+	go func() {
+		<-ready
+		mouseW.Write([]byte(mouseMsg(114, 124, 0)))
+	}()
+	app := func(s screen.Screen) {
+		w, err := s.NewWindow(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer w.Release()
+		close(ready)
+
+		// the window is inside rio's border.
+		if e := nextInput(w).(mouse.Event); e.X != 10 || e.Y != 20 {
+			t.Errorf("got %+v, want a move to (10, 20)", e)
+		}
+		// the mouse and keyboard are read by different goroutines, so
+		// the key is only typed once the move has arrived.
+		consW.Write([]byte("a"))
+		if e := nextInput(w).(key.Event); e.Rune != 'a' {
+			t.Errorf("got %v, want 'a'", e)
+		}
+
+		b, err := s.NewBuffer(image.Point{4, 3})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer b.Release()
+		for i := range b.RGBA().Pix {
+			b.RGBA().Pix[i] = uint8(i)
+		}
+		w.Upload(image.ZP, b, b.Bounds())
+		w.Publish()
+		// the wctl goroutine isn't waited for when this returns, so
+		// it has to be finished with the fake devices first.
+		<-wctlRead
+	}
+	mainWithOptions(context.Background(), app, DefaultOptions)
+
+	data := fs.data["/dev/draw/3/data"]
+	// attach the window, allocate a screen and the window's image,
+	// upload, composite and free everything.
+	want := "nAbyOdvfF"
+	if got := data.cmds(); !matchCmds(got, want) {
+		t.Errorf("got messages %q, want them to include %q in order", got, want)
+	}
+	if got := replay(t, data.msgs, image.Rect(0, 0, 4, 3)); !bytes.Equal(got.Pix, []byte(func() string {
+		pix := make([]byte, 4*3*4)
+		for i := range pix {
+			pix[i] = uint8(i)
+		}
+		return string(pix)
+	}())) {
+		t.Errorf("uploaded % x", got.Pix)
+	}
+}
+
+// matchCmds reports whether the commands in want appear in got in the
+// same order, with anything else in between.
+func matchCmds(got, want string) bool {
+	for i := 0; i < len(got) && want != ""; i++ {
+		if got[i] == want[0] {
+			want = want[1:]
+		}
+	}
+	return want == ""
+}
+
+func TestMainMouseFails(t *testing.T) {
+	useLogger(t)
+	fs := drawFS()
+	fs.files["/dev/winname"] = "window.7"
+	fs.files["/dev/wctl"] = "        100         100         304         254 current visible"
+	// there's no /dev/mouse.
+	useFS(t, fs)
+
+	called := false
+	mainWithOptions(context.Background(), func(s screen.Screen) {
+		called = true
+		if _, err := s.NewWindow(nil); err == nil {
+			t.Error("NewWindow succeeded, want the mouse's error")
+		}
+	}, DefaultOptions)
+	if !called {
+		t.Fatal("f wasn't called")
+	}
+
+	// the screen was freed and the connection closed before f was called.
+	data := fs.data["/dev/draw/3/data"]
+	if got, want := data.cmds(), "nAF"; !matchCmds(got, want) {
+		t.Errorf("got messages %q, want them to include %q in order", got, want)
+	}
+	if !data.closed {
+		t.Error("the draw data file is still open")
+	}
+}
+
+// TestMainSim runs the driver on devdrawsim, which checks the messages
+// that it sends to /dev/draw as devdraw does, and draws them.
+func TestMainSim(t *testing.T) {
+	useLogger(t)
+	sim := devdrawsim.New(image.Rect(0, 0, 400, 300), image.Rect(100, 100, 304, 254))
+	useFS(t, sim)
+
+	red := color.RGBA{0xFF, 0, 0, 0xFF}
+	app := func(s screen.Screen) {
+		w, err := s.NewWindow(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer w.Release()
+
+		// the window is inside rio's border.
+		sim.Mouse(image.Pt(114, 124), 0)
+		if e := nextInput(w).(mouse.Event); e.X != 10 || e.Y != 20 {
+			t.Errorf("got %+v, want a move to (10, 20)", e)
+		}
+		sim.Type("a")
+		if e := nextInput(w).(key.Event); e.Rune != 'a' || e.Direction != key.DirPress {
+			t.Errorf("got %v, want 'a' to be pressed", e)
+		}
+
+		b, err := s.NewBuffer(image.Point{4, 3})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer b.Release()
+		for i := range b.RGBA().Pix {
+			b.RGBA().Pix[i] = 0xFF
+		}
+		b.RGBA().SetRGBA(1, 1, red)
+		w.Upload(image.Pt(10, 20), b, b.Bounds())
+		w.Publish()
+		if got := sim.Screen().RGBAAt(104+11, 104+21); got != red {
+			t.Errorf("published pixel is %v, want %v", got, red)
+		}
+
+		// rio sends the resize through /dev/mouse, and the window is
+		// the size of the new one inside its border.
+		sim.Resize(image.Rect(50, 60, 354, 264))
+		for {
+			e := w.NextEvent()
+			if sz, ok := e.(size.Event); ok {
+				if sz.WidthPx == 296 && sz.HeightPx == 196 {
+					break
+				}
+			}
+		}
+		w.Fill(image.Rect(0, 0, 1, 1), red, draw.Src)
+		w.Publish()
+		if got := sim.Screen().RGBAAt(54, 64); got != red {
+			t.Errorf("pixel at the resized window's origin is %v, want %v", got, red)
+		}
+	}
+	mainWithOptions(context.Background(), app, DefaultOptions)
+
+	for _, err := range sim.Errors() {
+		t.Errorf("/dev/draw rejected a message: %v", err)
+	}
+	if n := sim.Conns(); n != 0 {
+		t.Errorf("%d connections to /dev/draw are still open", n)
+	}
+}
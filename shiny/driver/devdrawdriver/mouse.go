@@ -6,14 +6,12 @@ package devdrawdriver
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"strconv"
 	"strings"
 
 	"golang.org/x/mobile/event/mouse"
-	"golang.org/x/mobile/event/paint"
-	"golang.org/x/mobile/event/size"
 )
 
 // ButtonMask represents the Plan9 button masks as read from /dev/mouse.
@@ -29,75 +27,295 @@ const (
 	MouseButtonRight  = ButtonMask(4)
 	MouseScrollUp     = ButtonMask(8)
 	MouseScrollDown   = ButtonMask(16)
+	// the side buttons that some mice have.
+	MouseButton4 = ButtonMask(32)
+	MouseButton5 = ButtonMask(64)
 )
 
+// The buttons of the mouse.Events sent for MouseButton4 and MouseButton5.
+// The mouse package only has the three main buttons, so these are the
+// next physical buttons after mouse.ButtonRight.
+const (
+	ButtonBack    = mouse.Button(4)
+	ButtonForward = mouse.Button(5)
+)
+
+// buttonMask returns the bit of b in a ButtonMask.
+func buttonMask(b mouse.Button) ButtonMask {
+	switch b {
+	case mouse.ButtonLeft:
+		return MouseButtonLeft
+	case mouse.ButtonMiddle:
+		return MouseButtonMiddle
+	case mouse.ButtonRight:
+		return MouseButtonRight
+	case mouse.ButtonWheelUp:
+		return MouseScrollUp
+	case mouse.ButtonWheelDown:
+		return MouseScrollDown
+	case ButtonBack:
+		return MouseButton4
+	case ButtonForward:
+		return MouseButton5
+	}
+	return 0
+}
+
+// ChordEvent is sent to a window after each mouse.Event that presses or
+// releases a button, if DevdrawOptions.ButtonChords is set. Buttons is
+// every button that's held down after the event, so that the window can
+// recognise chords such as acme's 1-2 and 1-3 without tracking the
+// buttons itself. X and Y are the same as in the mouse.Event.
+type ChordEvent struct {
+	X, Y    float32
+	Buttons ButtonMask
+}
+
+// DragEvent is sent to a window after each mouse.Event that moves the
+// pointer while a button is held down, once the pointer has moved more than
+// DevdrawOptions.DragThreshold pixels from where the button was pressed,
+// if DevdrawOptions.DragGestures is set. A press and release without any
+// DragEvent in between is a click, even if the pointer jittered a little.
+// X and Y are the same as in the mouse.Event, and StartX and StartY are
+// where the button was pressed, in the same coordinates.
+type DragEvent struct {
+	X, Y           float32
+	StartX, StartY float32
+	Buttons        ButtonMask
+}
+
+// defaultDragThreshold is the DragThreshold that's used if it's zero.
+const defaultDragThreshold = 4
+
+// dragTracker follows the mouse events sent to a window, to recognise
+// when a button is held down and the pointer moves far enough for it to
+// be a drag.
+type dragTracker struct {
+	// whether a drag has started since the first button was pressed at
+	// startX, startY.
+	dragging       bool
+	startX, startY float32
+}
+
+// update records e, which was sent to a window when buttons were held
+// down after it, and returns the DragEvent to send after it, if it's part
+// of a drag. threshold is the distance that the pointer has to move
+// before it's a drag.
+func (d *dragTracker) update(e mouse.Event, buttons ButtonMask, threshold int) (DragEvent, bool) {
+	// the scroll wheel doesn't drag anything.
+	buttons &^= MouseScrollUp | MouseScrollDown
+	switch e.Direction {
+	case mouse.DirPress:
+		if buttons == buttonMask(e.Button) {
+			d.dragging = false
+			d.startX, d.startY = e.X, e.Y
+		}
+	case mouse.DirRelease:
+		if buttons == 0 {
+			d.dragging = false
+		}
+	case mouse.DirNone:
+		if buttons == 0 {
+			return DragEvent{}, false
+		}
+		if !d.dragging {
+			dx, dy := e.X-d.startX, e.Y-d.startY
+			t := float32(threshold)
+			d.dragging = dx*dx+dy*dy > t*t
+		}
+		if d.dragging {
+			return DragEvent{X: e.X, Y: e.Y, StartX: d.startX, StartY: d.startY, Buttons: buttons}, true
+		}
+	}
+	return DragEvent{}, false
+}
+
+const (
+	// scrollAccelInterval is the time in milliseconds between notches of
+	// the scroll wheel below which ScrollAcceleration speeds scrolling
+	// up, and maxScrollAcceleration is the most that it's sped up by.
+	scrollAccelInterval   = 100
+	maxScrollAcceleration = 4
+)
+
+// scrollTracker follows the notches of the scroll wheel, to work out how
+// many steps each of them is sent as.
+type scrollTracker struct {
+	// the direction and time of the last notch, if seen is set.
+	seen bool
+	dir  ButtonMask
+	msec int
+}
+
+// steps returns the number of steps for a notch in the direction dir,
+// which is MouseScrollUp or MouseScrollDown, at the time msec from
+// /dev/mouse. The acceleration is inversely proportional to the time
+// since the last notch, so a notch half of scrollAccelInterval after the
+// one before is 2 steps, and it's bounded by maxScrollAcceleration. If
+// hasTime is false, the message had no time, and there's no
+// acceleration.
+func (t *scrollTracker) steps(dir ButtonMask, msec int, hasTime bool, opts DevdrawOptions) int {
+	n := opts.ScrollMultiplier
+	if n < 1 {
+		n = 1
+	}
+	if !opts.ScrollAcceleration || !hasTime {
+		t.seen = false
+		return n
+	}
+	accel := 1
+	// the time goes backwards when it wraps around.
+	if dt := msec - t.msec; t.seen && t.dir == dir && dt >= 0 && dt < scrollAccelInterval {
+		accel = maxScrollAcceleration
+		if dt > 0 && scrollAccelInterval/dt < accel {
+			accel = scrollAccelInterval / dt
+		}
+	}
+	t.seen, t.dir, t.msec = true, dir, msec
+	return n * accel
+}
+
+// isMotion reports whether e is a mouse.Event which only moves the pointer,
+// for DevdrawOptions.CoalesceMotion.
+func isMotion(e interface{}) bool {
+	m, ok := e.(mouse.Event)
+	return ok && m.Direction == mouse.DirNone && m.Button == mouse.ButtonNone
+}
+
 // mouseEventHandler runs in a go routine to continuously make (blocking)
 // reads from /dev/mouse and converts them to mouse.Event messages which
 // are passed along the notifier channel to be added to the shiny event
-// queue.
-func mouseEventHandler(notifier chan *mouse.Event, s *screenImpl) {
-	mouseEvent, err := os.Open("/dev/mouse")
+// queue. It returns when done is closed.
+//
+// Once /dev/mouse has been opened, nil is sent on startErr, or the error
+// if it can't be, in which case it returns straight away.
+func mouseEventHandler(notifier chan *mouse.Event, s *screenImpl, done <-chan struct{}, startErr chan<- error) {
+	mouseEvent, err := openDev("mouse", os.O_RDONLY)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not open mouse driver.\n")
+		startErr <- fmt.Errorf("open mouse: %v", err)
 		return
 	}
+	startErr <- nil
 	defer mouseEvent.Close()
+	defer closeOnDone(mouseEvent, done)()
+
+	readMouseEvents(mouseEvent, notifier, s, done)
+}
 
-	mouseMessage := make([]byte, 100)
+// readMouseEvents does the work of mouseEventHandler for the already
+// opened /dev/mouse file r. Every read from r is expected to return a
+// single message. It returns when r is closed or done is closed.
+//
+// The messages that are handled are:
+//
+//	m x[12] y[12] buttons[12] msec[12]
+//	t nsec[12] m x[12] y[12] buttons[12] msec[12]
+//	r ...
+//
+// where the 't' record is sent by newer 9front kernels, and is an 'm'
+// record with a nanosecond timestamp in front of it. The timestamp isn't
+// used, so it's stripped and the rest is handled as an 'm' record. The
+// widths are what rio uses, but any fields separated by white space are
+// accepted.
+func readMouseEvents(r io.Reader, notifier chan *mouse.Event, s *screenImpl, done <-chan struct{}) {
+	send := func(e *mouse.Event) {
+		select {
+		case notifier <- e:
+		case <-done:
+		}
+	}
+
+	// rio's records are at most 62 bytes, and this leaves room for
+	// implementations with wider fields.
+	buf := make([]byte, 256)
 	// used to determine if it's an up or a down direction
 	var prevmask ButtonMask
+	var scroll scrollTracker
 	for {
-		_, err := mouseEvent.Read(mouseMessage)
+		n, err := r.Read(buf)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if err == io.EOF {
+			return
+		}
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unexpected data from the mouse.\n")
+			s.fail(fmt.Errorf("Error reading from the mouse: %v", err))
+			return
+		}
+		if n == 0 {
+			Log.Errorf("Unexpected data from the mouse.")
+			s.ctl.dropInput(false)
 			continue
 
 		}
-		switch mouseMessage[0] {
-		case 'r':
-			// Reread the window size the same way that happens on startup.
-			// This is more reliable than the 'r' message, the format of which
-			// isn't documented.
-			windowSize, err := readWctl()
-			if err != nil {
-				log.Printf("read current window size: %v\n", err)
+		mouseMessage := buf[:n]
+		if mouseMessage[0] == 't' {
+			m, ok := stripMouseTimestamp(mouseMessage)
+			if !ok {
+				Log.Warnf("Unhandled mouse event: %s", mouseMessage)
+				s.ctl.dropInput(false)
 				continue
 			}
-
-			s.windowFrame = windowSize
-			repositionWindow(s, s.windowFrame)
-			if s.w != nil {
-				sz := s.windowFrame.Size()
-				// tell the window it's current size before doing anything.
-				s.w.Deque.Send(size.Event{WidthPx: sz.X, HeightPx: sz.Y})
-				// and after it knows the size, tell the program using it to paint.
-				s.w.Deque.Send(paint.Event{})
-			}
+			mouseMessage = m
+		}
+		switch mouseMessage[0] {
+		case 'r':
+			// dragging the window's corner sends one of these for every
+			// step, so wait until they stop before doing anything.
+			s.scheduleResize()
 		case 'm':
-			if mouseMessage[12] != ' ' {
-				fmt.Fprintf(os.Stderr, "Unhandled data from /dev/mouse: %s\n", mouseMessage)
+			// the message is 'm' followed by x, y, buttons and msec.
+			// rio pads each of them to 11 characters and a space, but
+			// other implementations of /dev/mouse don't, so they're
+			// split on white space rather than read from where rio
+			// puts them. A message that was cut short is missing msec.
+			fields := strings.Fields(string(mouseMessage[1:]))
+			if len(fields) < 4 {
+				Log.Warnf("short message from /dev/mouse (%d bytes): %q", len(mouseMessage), mouseMessage)
+				s.ctl.dropInput(false)
+				continue
 			}
 
 			// /dev/mouse prints an ASCII integer number, but x/mobile/event/mouse.Event
 			// expects a float32, so we just parse it as a float32.
-			x, err := strconv.ParseFloat(strings.TrimSpace(string(mouseMessage[1:12])), 32)
+			x, err := strconv.ParseFloat(fields[0], 32)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Unexpected data from the mouse. Could not parse X coordinate.\n")
+				Log.Warnf("Unexpected data from the mouse. Could not parse X coordinate.")
+				s.ctl.dropInput(false)
 				continue
 			}
-			y, err := strconv.ParseFloat(strings.TrimSpace(string(mouseMessage[13:24])), 32)
+			y, err := strconv.ParseFloat(fields[1], 32)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Unexpected data from the mouse. Could not parse Y coordinate.\n")
+				Log.Warnf("Unexpected data from the mouse. Could not parse Y coordinate.")
+				s.ctl.dropInput(false)
 				continue
 			}
 
-			btnMaskInt, err := strconv.Atoi(strings.TrimSpace(string(mouseMessage[25:36])))
+			btnMaskInt, err := strconv.Atoi(fields[2])
 			buttons := ButtonMask(btnMaskInt)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Unexpected data from the mouse. Could not parse button mask.\n")
+				Log.Warnf("Unexpected data from the mouse. Could not parse button mask.")
+				s.ctl.dropInput(false)
 				continue
 			}
 
+			// the time isn't needed for anything else, so a message
+			// with a time that can't be parsed is still handled.
+			msec, err := strconv.Atoi(fields[3])
+			hasTime := err == nil
+			// sends the extra steps of a notch of the scroll wheel,
+			// before the press that's sent for every notch.
+			scrollSteps := func(dir ButtonMask, button mouse.Button) {
+				for i := scroll.steps(dir, msec, hasTime, s.opts); i > 1; i-- {
+					for _, d := range []mouse.Direction{mouse.DirPress, mouse.DirRelease} {
+						send(&mouse.Event{X: float32(x), Y: float32(y), Button: button, Direction: d})
+					}
+				}
+			}
+
 			// Convert the Plan9 button mask to a event.Mouse button.
 			// It would be nice if this could be a switch statement, but multiple
 			// cases would potentially need to match (ie when a user clicks two
@@ -109,121 +327,186 @@ func mouseEventHandler(notifier chan *mouse.Event, s *screenImpl) {
 
 			// Left click
 			if (buttons&MouseButtonLeft) != 0 && (prevmask&MouseButtonLeft) == 0 {
-				notifier <- &mouse.Event{
+				send(&mouse.Event{
 					X:         float32(x),
 					Y:         float32(y),
 					Button:    mouse.ButtonLeft,
 					Direction: mouse.DirPress,
-				}
+				})
 				sentEvt = true
 			}
 			// Left release
 			if (buttons&MouseButtonLeft) == 0 && (prevmask&MouseButtonLeft) != 0 {
-				notifier <- &mouse.Event{
+				send(&mouse.Event{
 					X:         float32(x),
 					Y:         float32(y),
 					Button:    mouse.ButtonLeft,
 					Direction: mouse.DirRelease,
-				}
+				})
 				sentEvt = true
 			}
 
 			// Middle click
 			if (buttons&MouseButtonMiddle) != 0 && (prevmask&MouseButtonMiddle) == 0 {
-				notifier <- &mouse.Event{
+				send(&mouse.Event{
 					X:         float32(x),
 					Y:         float32(y),
 					Button:    mouse.ButtonMiddle,
 					Direction: mouse.DirPress,
-				}
+				})
 				sentEvt = true
 			}
 			// Middle release
 			if (buttons&MouseButtonMiddle) == 0 && (prevmask&MouseButtonMiddle) != 0 {
-				notifier <- &mouse.Event{
+				send(&mouse.Event{
 					X:         float32(x),
 					Y:         float32(y),
 					Button:    mouse.ButtonMiddle,
 					Direction: mouse.DirRelease,
-				}
+				})
 				sentEvt = true
 			}
 
 			// Right click
 			if (buttons&MouseButtonRight) != 0 && (prevmask&MouseButtonRight) == 0 {
-				notifier <- &mouse.Event{
+				send(&mouse.Event{
 					X:         float32(x),
 					Y:         float32(y),
 					Button:    mouse.ButtonRight,
 					Direction: mouse.DirPress,
-				}
+				})
 				sentEvt = true
 			}
 			// Right release
 			if (buttons&MouseButtonRight) == 0 && (prevmask&MouseButtonRight) != 0 {
-				notifier <- &mouse.Event{
+				send(&mouse.Event{
 					X:         float32(x),
 					Y:         float32(y),
 					Button:    mouse.ButtonRight,
 					Direction: mouse.DirRelease,
-				}
+				})
 				sentEvt = true
 			}
 
 			// WheelUp start
 			if (buttons&MouseScrollUp) != 0 && (prevmask&MouseScrollUp) == 0 {
-				notifier <- &mouse.Event{
+				scrollSteps(MouseScrollUp, mouse.ButtonWheelUp)
+				send(&mouse.Event{
 					X:         float32(x),
 					Y:         float32(y),
 					Button:    mouse.ButtonWheelUp,
 					Direction: mouse.DirPress,
-				}
+				})
 				sentEvt = true
 			}
 			// WheelUp end
 			if (buttons&MouseScrollUp) == 0 && (prevmask&MouseScrollUp) != 0 {
-				notifier <- &mouse.Event{
+				send(&mouse.Event{
 					X:         float32(x),
 					Y:         float32(y),
 					Button:    mouse.ButtonWheelUp,
 					Direction: mouse.DirRelease,
-				}
+				})
 				sentEvt = true
 			}
 			// WheelDown start
 			if (buttons&MouseScrollDown) != 0 && (prevmask&MouseScrollDown) == 0 {
-				notifier <- &mouse.Event{
+				scrollSteps(MouseScrollDown, mouse.ButtonWheelDown)
+				send(&mouse.Event{
 					X:         float32(x),
 					Y:         float32(y),
 					Button:    mouse.ButtonWheelDown,
 					Direction: mouse.DirPress,
-				}
+				})
 				sentEvt = true
 			}
 			// WheelDown end
 			if (buttons&MouseScrollDown) == 0 && (prevmask&MouseScrollDown) != 0 {
-				notifier <- &mouse.Event{
+				send(&mouse.Event{
 					X:         float32(x),
 					Y:         float32(y),
 					Button:    mouse.ButtonWheelDown,
 					Direction: mouse.DirRelease,
-				}
+				})
+				sentEvt = true
+			}
+
+			// Back click
+			if (buttons&MouseButton4) != 0 && (prevmask&MouseButton4) == 0 {
+				send(&mouse.Event{
+					X:         float32(x),
+					Y:         float32(y),
+					Button:    ButtonBack,
+					Direction: mouse.DirPress,
+				})
+				sentEvt = true
+			}
+			// Back release
+			if (buttons&MouseButton4) == 0 && (prevmask&MouseButton4) != 0 {
+				send(&mouse.Event{
+					X:         float32(x),
+					Y:         float32(y),
+					Button:    ButtonBack,
+					Direction: mouse.DirRelease,
+				})
+				sentEvt = true
+			}
+
+			// Forward click
+			if (buttons&MouseButton5) != 0 && (prevmask&MouseButton5) == 0 {
+				send(&mouse.Event{
+					X:         float32(x),
+					Y:         float32(y),
+					Button:    ButtonForward,
+					Direction: mouse.DirPress,
+				})
+				sentEvt = true
+			}
+			// Forward release
+			if (buttons&MouseButton5) == 0 && (prevmask&MouseButton5) != 0 {
+				send(&mouse.Event{
+					X:         float32(x),
+					Y:         float32(y),
+					Button:    ButtonForward,
+					Direction: mouse.DirRelease,
+				})
 				sentEvt = true
 			}
 
 			// Default. The mouse moved without any buttons changing state.
 			if sentEvt == false {
-				notifier <- &mouse.Event{
+				send(&mouse.Event{
 					X:         float32(x),
 					Y:         float32(y),
 					Button:    mouse.ButtonNone,
 					Direction: mouse.DirNone,
-				}
+				})
 			}
 
 			prevmask = buttons
 		default:
-			fmt.Fprintf(os.Stderr, "Unhandled mouse event: %s\n", mouseMessage)
+			Log.Warnf("Unhandled mouse event: %s", mouseMessage)
+			s.ctl.dropInput(false)
 		}
 	}
 }
+
+// stripMouseTimestamp returns the 'm' record that follows the timestamp
+// of the 't' record msg, and whether there was one.
+func stripMouseTimestamp(msg []byte) ([]byte, bool) {
+	i := 1
+	// the timestamp is right aligned and padded with spaces.
+	for i < len(msg) && msg[i] == ' ' {
+		i++
+	}
+	for i < len(msg) && msg[i] >= '0' && msg[i] <= '9' {
+		i++
+	}
+	for i < len(msg) && msg[i] == ' ' {
+		i++
+	}
+	if i >= len(msg) || msg[i] != 'm' {
+		return nil, false
+	}
+	return msg[i:], true
+}
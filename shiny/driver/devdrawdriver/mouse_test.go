@@ -0,0 +1,372 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/mobile/event/mouse"
+	"golang.org/x/mobile/event/paint"
+	"golang.org/x/mobile/event/size"
+)
+
+// chunkReader returns one of its chunks per Read, the same way that
+// /dev/mouse returns one message per read.
+type chunkReader struct {
+	chunks []string
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.chunks[0])
+	c.chunks = c.chunks[1:]
+	return n, nil
+}
+
+// mouseMsg formats an 'm' message the way /dev/mouse does.
+func mouseMsg(x, y int, buttons ButtonMask) string {
+	return fmt.Sprintf("m%11d %11d %11d %11d ", x, y, int(buttons), 0)
+}
+
+// readMouse runs readMouseEvents over msgs, and returns the events that
+// were sent.
+func readMouse(t *testing.T, s *screenImpl, msgs ...string) []mouse.Event {
+	notifier := make(chan *mouse.Event, 100)
+	readMouseEvents(&chunkReader{msgs}, notifier, s, nil)
+	close(notifier)
+
+	var evs []mouse.Event
+	for e := range notifier {
+		evs = append(evs, *e)
+	}
+	return evs
+}
+
+func TestMouseShortMessage(t *testing.T) {
+	full := mouseMsg(10, 20, MouseButtonLeft)
+	l := useLogger(t)
+	evs := readMouse(t, &screenImpl{ctl: &DrawCtrler{}}, "m", full[:12], full[:36], full)
+	if got := len(l.warnings); got != 3 {
+		t.Errorf("logged %d warnings, want 3: %q", got, l.warnings)
+	}
+	if len(evs) != 1 {
+		t.Fatalf("got %d events, want 1: %v", len(evs), evs)
+	}
+	if e := evs[0]; e.X != 10 || e.Y != 20 || e.Button != mouse.ButtonLeft || e.Direction != mouse.DirPress {
+		t.Errorf("got event %+v, want a left press at (10, 20)", e)
+	}
+}
+
+func TestMouseDropped(t *testing.T) {
+	useLogger(t)
+	s := &screenImpl{ctl: &DrawCtrler{}}
+	evs := readMouse(t, s,
+		mouseMsg(10, 20, 0),
+		"m",
+		"m          x           20           0           0 ",
+		"m         10            y           0           0 ",
+		"m         10           20           b           0 ",
+		"tgarbage",
+		"q",
+		// a message with a time that can't be parsed is still used.
+		"m         10           20           0           ? ",
+		mouseMsg(30, 40, 0),
+	)
+	if len(evs) != 3 {
+		t.Errorf("got %d events, want 3: %v", len(evs), evs)
+	}
+	if got := s.ctl.Stats().DroppedMouse; got != 6 {
+		t.Errorf("got DroppedMouse %d, want 6", got)
+	}
+}
+
+func TestMouseTimestamp(t *testing.T) {
+	l := useLogger(t)
+	evs := readMouse(t, &screenImpl{ctl: &DrawCtrler{}},
+		fmt.Sprintf("t%11d ", int64(1234567890))+mouseMsg(10, 20, MouseButtonLeft),
+		fmt.Sprintf("t%11d ", int64(1234567891))+mouseMsg(30, 40, 0),
+		"t 12345 x",
+	)
+	if got := len(l.warnings); got != 1 {
+		t.Errorf("logged %d warnings, want 1: %q", got, l.warnings)
+	}
+	if len(evs) != 2 {
+		t.Fatalf("got %d events, want 2: %v", len(evs), evs)
+	}
+	if e := evs[0]; e.X != 10 || e.Y != 20 || e.Button != mouse.ButtonLeft || e.Direction != mouse.DirPress {
+		t.Errorf("got event %+v, want a left press at (10, 20)", e)
+	}
+	if e := evs[1]; e.X != 30 || e.Y != 40 || e.Button != mouse.ButtonLeft || e.Direction != mouse.DirRelease {
+		t.Errorf("got event %+v, want a left release at (30, 40)", e)
+	}
+}
+
+func TestMouseSideButtons(t *testing.T) {
+	useLogger(t)
+	evs := readMouse(t, &screenImpl{ctl: &DrawCtrler{}},
+		mouseMsg(1, 1, MouseButton4),
+		mouseMsg(1, 1, MouseButton4|MouseButton5),
+		mouseMsg(1, 1, 0),
+	)
+	want := []struct {
+		b mouse.Button
+		d mouse.Direction
+	}{
+		{ButtonBack, mouse.DirPress},
+		{ButtonForward, mouse.DirPress},
+		{ButtonBack, mouse.DirRelease},
+		{ButtonForward, mouse.DirRelease},
+	}
+	if len(evs) != len(want) {
+		t.Fatalf("got %d events, want %d: %v", len(evs), len(want), evs)
+	}
+	for i, w := range want {
+		if evs[i].Button != w.b || evs[i].Direction != w.d {
+			t.Errorf("event %d: got %v %v, want %v %v", i, evs[i].Button, evs[i].Direction, w.b, w.d)
+		}
+	}
+	if buttonMask(ButtonForward) != MouseButton5 {
+		t.Errorf("buttonMask(ButtonForward) = %d, want %d", buttonMask(ButtonForward), MouseButton5)
+	}
+}
+
+func TestResizeDebounce(t *testing.T) {
+	defer func(old time.Duration) { resizeDebounce = old }(resizeDebounce)
+	resizeDebounce = 20 * time.Millisecond
+	useFS(t, &fakeFS{files: map[string]string{
+		"/dev/wctl":    "          0           0         200         150 current visible",
+		"/dev/winname": "window.1",
+	}})
+
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w, _ := s.NewWindow(nil)
+	// dragging the corner of the window sends a burst of resizes.
+	readMouse(t, s, "r", "r", "r", "r", "r")
+
+	// skip the size that the window was created with.
+	w.Send("marker")
+	for e := w.NextEvent(); e != "marker"; e = w.NextEvent() {
+	}
+	var sz size.Event
+	for ok := false; !ok; {
+		sz, ok = w.NextEvent().(size.Event)
+	}
+	if sz.WidthPx != 200 || sz.HeightPx != 150 {
+		t.Errorf("got %+v, want the window to be resized to 200x150", sz)
+	}
+	// and nothing else happens once it's settled.
+	time.Sleep(3 * resizeDebounce)
+	w.Send("marker")
+	for e := w.NextEvent(); e != "marker"; e = w.NextEvent() {
+		if e, ok := e.(size.Event); ok {
+			t.Errorf("got %+v after the resize settled, want nothing", e)
+		}
+	}
+	reallocs := 0
+	for _, m := range f.msgs {
+		if m[0] == 'F' {
+			reallocs++
+		}
+	}
+	if reallocs != 1 {
+		t.Errorf("reallocated the screen %d times, want once", reallocs)
+	}
+}
+
+func TestLiveResize(t *testing.T) {
+	defer func(old time.Duration) { resizeDebounce = old }(resizeDebounce)
+	resizeDebounce = 20 * time.Millisecond
+	useFS(t, &fakeFS{files: map[string]string{
+		"/dev/wctl":    "          0           0         200         150 current visible",
+		"/dev/winname": "window.1",
+	}})
+
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	s.opts.LiveResize = true
+	w, _ := s.NewWindow(nil)
+	w.Send("marker")
+	for e := w.NextEvent(); e != "marker"; e = w.NextEvent() {
+	}
+	readMouse(t, s, "r", "r", "r")
+	time.Sleep(3 * resizeDebounce)
+
+	// every step of the resize is sent, and then the settled size with
+	// a paint.
+	w.Send("marker")
+	var sizes, paints int
+	for e := w.NextEvent(); e != "marker"; e = w.NextEvent() {
+		switch e := e.(type) {
+		case size.Event:
+			sizes++
+			if e.WidthPx != 200 || e.HeightPx != 150 {
+				t.Errorf("got %+v, want the window to be resized to 200x150", e)
+			}
+		case paint.Event:
+			paints++
+		}
+	}
+	if sizes != 4 || paints != 1 {
+		t.Errorf("got %d size events and %d paints, want 4 and 1", sizes, paints)
+	}
+	// the images are still only reallocated once.
+	reallocs := 0
+	for _, m := range f.msgs {
+		if m[0] == 'F' {
+			reallocs++
+		}
+	}
+	if reallocs != 1 {
+		t.Errorf("reallocated the screen %d times, want once", reallocs)
+	}
+}
+
+func TestResizeEmptyFrame(t *testing.T) {
+	defer func(old time.Duration) { resizeDebounce = old }(resizeDebounce)
+	resizeDebounce = time.Millisecond
+	logs := useLogger(t)
+	useFS(t, &fakeFS{files: map[string]string{
+		"/dev/wctl":    "         10          10          10          10 current visible",
+		"/dev/winname": "window.1",
+	}})
+
+	// the resize arrives before the screen knows the window's size.
+	s, f := newTestScreen(65535, image.ZR)
+	w, _ := s.NewWindow(nil)
+	id := w.(*windowImpl).imageId
+	f.msgs = nil
+	readMouse(t, s, "r")
+	time.Sleep(10 * resizeDebounce)
+
+	if len(f.msgs) != 0 {
+		t.Errorf("sent %q for an empty window, want nothing", f.cmds())
+	}
+	if got := w.(*windowImpl).imageId; got != id {
+		t.Errorf("window image changed from %d to %d", id, got)
+	}
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	if len(logs.warnings) != 1 || !strings.Contains(logs.warnings[0], "empty") {
+		t.Errorf("got warnings %q, want one about the empty window", logs.warnings)
+	}
+}
+
+func TestWindowMove(t *testing.T) {
+	useFS(t, &fakeFS{files: map[string]string{
+		"/dev/wctl":    "         50          60         150         160 current visible",
+		"/dev/winname": "window.2",
+	}})
+
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	win, _ := s.NewWindow(nil)
+	w := win.(*windowImpl)
+	id := w.imageId
+	w.Publish()
+	w.Send("marker")
+	for e := w.NextEvent(); e != "marker"; e = w.NextEvent() {
+	}
+	f.msgs = nil
+
+	// the window is the same size, so the images are kept and only
+	// composited at the new position.
+	s.applyResize()
+	if got, want := f.cmds(), "FAnOdv"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	if w.imageId != id {
+		t.Errorf("window image changed from %d to %d", id, w.imageId)
+	}
+	if got, want := msgRect(f.msgs[4][13:]), image.Rect(50, 60, 150, 160); got != want {
+		t.Errorf("composited at %v, want %v", got, want)
+	}
+	// and nothing needs to be repainted.
+	w.Send("marker")
+	for e := w.NextEvent(); e != "marker"; e = w.NextEvent() {
+		t.Errorf("got %#v after a move, want nothing", e)
+	}
+}
+
+func TestScrollSteps(t *testing.T) {
+	// a notch of the wheel is the button pressed and released, at msec,
+	// and it's followed by a move to tell it from the next.
+	notch := func(b ButtonMask, msec int) []string {
+		return []string{
+			fmt.Sprintf("m%11d %11d %11d %11d ", 10, 20, int(b), msec),
+			fmt.Sprintf("m%11d %11d %11d %11d ", 10, 20, 0, msec+1),
+			fmt.Sprintf("m%11d %11d %11d %11d ", 11, 20, 0, msec+2),
+		}
+	}
+	var msgs []string
+	for _, n := range []struct {
+		b    ButtonMask
+		msec int
+	}{
+		{MouseScrollDown, 1000},
+		{MouseScrollDown, 1050}, // 50ms later
+		{MouseScrollDown, 1060}, // 10ms later, which is capped
+		{MouseScrollUp, 1070},   // the other way
+		{MouseScrollUp, 2000},   // after a pause
+	} {
+		msgs = append(msgs, notch(n.b, n.msec)...)
+	}
+	for _, tc := range []struct {
+		opts DevdrawOptions
+		want []int
+	}{
+		{DevdrawOptions{}, []int{1, 1, 1, 1, 1}},
+		{DevdrawOptions{ScrollMultiplier: 3}, []int{3, 3, 3, 3, 3}},
+		{DevdrawOptions{ScrollAcceleration: true}, []int{1, 2, 4, 1, 1}},
+		{DevdrawOptions{ScrollMultiplier: 2, ScrollAcceleration: true}, []int{2, 4, 8, 2, 2}},
+	} {
+		evs := readMouse(t, &screenImpl{ctl: &DrawCtrler{}, opts: tc.opts}, msgs...)
+		var got []int
+		n := 0
+		for _, e := range evs {
+			switch e.Direction {
+			case mouse.DirPress:
+				n++
+			case mouse.DirNone:
+				got = append(got, n)
+				n = 0
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%+v: got steps %v, want %v", tc.opts, got, tc.want)
+		}
+	}
+}
+
+func TestMouseFieldWidths(t *testing.T) {
+	l := useLogger(t)
+	evs := readMouse(t, &screenImpl{ctl: &DrawCtrler{}},
+		// rio's fixed width fields.
+		mouseMsg(10, 20, MouseButtonLeft),
+		// no padding at all.
+		"m30 40 0 1234",
+		// wider fields than rio's, and a negative coordinate off the
+		// left of the display.
+		fmt.Sprintf("m%20d %20d %20d %20d\n", -5, 123456, int(MouseButtonRight), 5678),
+		// a tab between the fields, and more of them than are needed.
+		"m\t50\t60\t0\t9999\textra",
+	)
+	if len(l.warnings) != 0 {
+		t.Errorf("logged warnings %q", l.warnings)
+	}
+	want := []mouse.Event{
+		{X: 10, Y: 20, Button: mouse.ButtonLeft, Direction: mouse.DirPress},
+		{X: 30, Y: 40, Button: mouse.ButtonLeft, Direction: mouse.DirRelease},
+		{X: -5, Y: 123456, Button: mouse.ButtonRight, Direction: mouse.DirPress},
+		{X: 50, Y: 60, Button: mouse.ButtonRight, Direction: mouse.DirRelease},
+	}
+	if fmt.Sprint(evs) != fmt.Sprint(want) {
+		t.Errorf("got events %v, want %v", evs, want)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import "image/color"
+
+// DevdrawOptions configures the driver.
+type DevdrawOptions struct {
+	// WindowRefresh is the refresh method that the /dev/draw images
+	// backing windows are allocated with. RefBackup, the default, makes
+	// the server keep a copy of obscured parts of the window at the cost
+	// of server memory. RefNone saves that memory, but the application
+	// has to repaint anything that was obscured.
+	WindowRefresh byte
+
+	// BorderWidth is the width of the border that the window system
+	// draws around the window, which is excluded from the area that's
+	// drawn into. It's 4 for rio, and 0 for borderless windows such as
+	// under acme or in headless sessions. A window that's exactly the
+	// size of the display, as on a bare framebuffer, is taken to have
+	// no border whatever it's set to. Zero is taken as is, so it's 4
+	// only in DefaultOptions.
+	BorderWidth int
+
+	// BackgroundColor is the colour that windows are filled with when
+	// they're created, before the application paints them. If it's nil,
+	// windows start out white.
+	BackgroundColor color.Color
+
+	// Errors, if not nil, is sent the errors which stop the driver
+	// from reading one of its devices, such as /dev/mouse or /dev/cons
+	// going away, so that the application can react to them. The driver
+	// never blocks sending to it, so it should be buffered. Errors which
+	// don't fit are only logged.
+	Errors chan<- error
+
+	// Reconnect makes the driver open a new connection to /dev/draw
+	// when writing to the current one fails, such as after the server
+	// was restarted, instead of leaving the windows frozen. The failure
+	// is noticed the next time a window is published. See
+	// ReconnectEvent.
+	Reconnect bool
+
+	// ButtonChords makes the driver send a ChordEvent with every button
+	// that's held down after each mouse button press or release, in
+	// addition to the mouse.Event.
+	ButtonChords bool
+
+	// DragGestures makes the driver send a DragEvent after each
+	// mouse.Event that's part of a drag, which is when the pointer moves
+	// more than DragThreshold pixels from where a button was pressed
+	// before it's released. Zero means the default of 4.
+	DragGestures  bool
+	DragThreshold int
+
+	// CoalesceMotion makes a mouse.Event that only moves the pointer
+	// replace the one before it, if that only moved the pointer as well
+	// and the window hasn't received it yet, so that a window which is
+	// slow to handle events isn't flooded by a fast moving mouse.
+	CoalesceMotion bool
+
+	// ScrollMultiplier is the number of steps that each notch of the
+	// scroll wheel is sent as, each one a press and release of
+	// mouse.ButtonWheelUp or mouse.ButtonWheelDown. Zero means the
+	// default of 1. ScrollAcceleration multiplies it by up to 4 more when
+	// notches in the same direction come in quick succession, as timed by
+	// /dev/mouse, so that scrolling fast covers more distance.
+	ScrollMultiplier   int
+	ScrollAcceleration bool
+
+	// SoftwareCursor makes the driver draw the mouse pointer itself,
+	// over the windows, for displays which have no /dev/cursor and so
+	// no pointer of their own. The windows are composited again each
+	// time the pointer moves, so it should be left off when there's a
+	// hardware cursor.
+	SoftwareCursor bool
+
+	// DisableCompression makes the driver always upload images
+	// uncompressed. Compression is normally used when /dev/draw is
+	// remote (its iounit is less than 65535), but on a fast network
+	// with a slow CPU it can cost more time than it saves.
+	DisableCompression bool
+
+	// LookbackSize is how many bytes back compression searches for a
+	// repeat of the data being compressed. Searching farther finds more
+	// matches at the cost of CPU. Zero means the default of 128, and it's
+	// at most 1024, which is the farthest that image(6) can encode.
+	LookbackSize int
+
+	// MaxCompressedBand is the most bytes of compressed pixels that a
+	// message can hold, not counting its header. Zero means the default
+	// of 6000, which image(6) recommends to leave room for the server's
+	// overhead. It's lowered if the message wouldn't fit in the iounit.
+	MaxCompressedBand int
+
+	// LiveResize makes the driver send a size.Event for every step of a
+	// resize, such as while the corner of the Plan 9 window is being
+	// dragged, and not only for the size that it settles at. The
+	// windows' images are still only reallocated once it has settled,
+	// and only then followed by a paint.Event, so until then anything
+	// drawn outside their old size is lost.
+	LiveResize bool
+
+	// Fullscreen makes the Plan 9 window cover the whole display when
+	// the driver starts. See FullscreenWindow.
+	Fullscreen bool
+
+	// PasteRune, if not zero, is the rune typed by a key that pastes the
+	// snarf buffer, such as '\x16' for control-V. Instead of a key.Event,
+	// the focused window is sent a PasteEvent with the snarf buffer's
+	// contents. Applications which handle the key themselves should
+	// leave it unset.
+	PasteRune rune
+
+	// IOUnitSize, if not zero, limits the size of the messages written
+	// to /dev/draw. It can only make them smaller than the iounit that
+	// was negotiated with the server.
+	IOUnitSize int
+}
+
+// DefaultOptions is the configuration used by Main, and the one to start
+// from for MainWithOptions.
+var DefaultOptions = DevdrawOptions{
+	WindowRefresh: RefBackup,
+	BorderWidth:   4,
+}
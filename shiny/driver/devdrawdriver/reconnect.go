@@ -0,0 +1,96 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"fmt"
+
+	"golang.org/x/mobile/event/paint"
+)
+
+// ReconnectEvent is sent to every window after the driver has replaced
+// a connection to /dev/draw that stopped working, if
+// DevdrawOptions.Reconnect is set. The windows and textures are
+// allocated again with the same sizes. A texture that has only been
+// filled by Upload gets its pixels back, but what was drawn in the
+// windows, and in textures that were drawn into on the server, is lost,
+// so the application has to draw those again before it handles the
+// paint.Event that follows.
+type ReconnectEvent struct{}
+
+// checkConn reconnects to /dev/draw if writing to the current connection
+// failed and DevdrawOptions.Reconnect is set. A connection is only
+// replaced once for each failure, so if reconnecting fails, the screen
+// stays broken and the error is reported through fail. A connection
+// that was closed by release isn't replaced, since the screen is gone.
+func (s *screenImpl) checkConn() {
+	if !s.opts.Reconnect {
+		return
+	}
+	lost := s.ctl.Err()
+	if lost == nil || lost == errClosed {
+		return
+	}
+	s.windowsMu.Lock()
+	if lost == s.lostErr {
+		s.windowsMu.Unlock()
+		return
+	}
+	s.lostErr = lost
+	s.windowsMu.Unlock()
+
+	Log.Warnf("reconnecting to /dev/draw after %v", lost)
+	if err := s.reconnect(); err != nil {
+		s.fail(fmt.Errorf("reconnect after %v: %v", lost, err))
+	}
+}
+
+// reconnect replaces the screen's connection to /dev/draw, and rebuilds
+// what the server had for it on the new one: the attachment of image ID
+// 0 to the Plan 9 window, the screen, and every image that hasn't been
+// freed, with the IDs that the windows and textures already refer to.
+// The textures whose pixels are kept locally are uploaded again. Fonts
+// are loaded again when they're next used.
+func (s *screenImpl) reconnect() error {
+	if err := s.ctl.reopen(s.opts); err != nil {
+		return err
+	}
+	winname, err := attachWindow(s.ctl)
+	if err != nil {
+		return err
+	}
+	sid, err := s.ctl.AllocScreen()
+	if err != nil {
+		return err
+	}
+	s.forgetFonts()
+	if err := s.ctl.reallocLive(sid); err != nil {
+		return err
+	}
+
+	s.windowsMu.Lock()
+	s.screenId = sid
+	s.winname = winname
+	s.stale = true
+	// the cursor's image is allocated again like the others, but it's
+	// drawn by the driver rather than the application.
+	if s.cursorId != 0 {
+		s.ctl.replaceRGBA(s.cursorId, cursorRect, cursorImage())
+	}
+	windows := append([]*windowImpl(nil), s.windows...)
+	textures := make([]*textureImpl, 0, len(s.textures))
+	for t := range s.textures {
+		textures = append(textures, t)
+	}
+	s.windowsMu.Unlock()
+	for _, t := range textures {
+		t.restoreLocal()
+	}
+	for _, w := range windows {
+		w.Deque.Send(ReconnectEvent{})
+		w.Deque.Send(paint.Event{External: true})
+	}
+	return nil
+}
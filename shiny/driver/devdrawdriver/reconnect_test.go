@@ -0,0 +1,232 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"testing"
+
+	"golang.org/x/mobile/event/paint"
+)
+
+func TestReconnect(t *testing.T) {
+	useLogger(t)
+	fs := drawFS()
+	fs.files["/dev/winname"] = "window.2"
+	useFS(t, fs)
+	errc := make(chan error, 1)
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	s.opts = DevdrawOptions{Reconnect: true, Errors: errc}
+	win, _ := s.NewWindow(nil)
+	w := win.(*windowImpl)
+	tex := newTextureImpl(s, image.Point{10, 10})
+	freed := newTextureImpl(s, image.Point{10, 10})
+	freed.Release()
+	buf, _ := s.NewBuffer(image.Point{10, 10})
+	defer buf.Release()
+	for i := range buf.RGBA().Pix {
+		buf.RGBA().Pix[i] = uint8(i)
+	}
+	tex.Upload(image.ZP, buf, buf.Bounds())
+
+	// the server goes away.
+	s.ctl.data = &failingData{}
+	w.Fill(image.Rect(0, 0, 10, 10), color.Black, draw.Src)
+	w.Publish()
+
+	data := fs.data["/dev/draw/3/data"]
+	if data == nil {
+		t.Fatalf("didn't reconnect after the connection failed")
+	}
+	// the window is attached, the images that are still in use, which
+	// include the solid mask that the fill allocated, are allocated
+	// again with the same IDs, and the texture's pixels are uploaded
+	// again.
+	if got, want := data.cmds(), "nAbbby"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	if got := string(data.msgs[0][6:]); got != "window.2" {
+		t.Errorf("attached %q, want window.2", got)
+	}
+	for i, id := range []uint32{w.imageId, tex.imageId, s.solidMask()} {
+		if got := binary.LittleEndian.Uint32(data.msgs[2+i][1:]); got != id {
+			t.Errorf("image %d: allocated %d, want %d", i, got, id)
+		}
+	}
+	if got := renderImages(data.msgs, image.NewRGBA(image.Rect(0, 0, 100, 100)))[tex.imageId]; !bytes.Equal(got.Pix, buf.RGBA().Pix) {
+		t.Errorf("the texture has % x after reconnecting, want what was uploaded", got.Pix)
+	}
+	if s.ctl.Err() != nil {
+		t.Errorf("Err() = %v after reconnecting", s.ctl.Err())
+	}
+
+	// the application is asked to repaint everything.
+	for _, ok := w.NextEvent().(ReconnectEvent); !ok; _, ok = w.NextEvent().(ReconnectEvent) {
+	}
+	if e := w.NextEvent(); e != (paint.Event{External: true}) {
+		t.Errorf("got %#v, want an external paint.Event", e)
+	}
+	// and the windows are composited again, even before they're drawn
+	// into.
+	data.msgs = nil
+	w.Publish()
+	if got, want := data.cmds(), "Odv"; got != want {
+		t.Errorf("got messages %q after reconnecting, want %q", got, want)
+	}
+	select {
+	case err := <-errc:
+		t.Errorf("got error %v from a successful reconnect", err)
+	default:
+	}
+}
+
+func TestReconnectAfterRelease(t *testing.T) {
+	useLogger(t)
+	fs := drawFS()
+	useFS(t, fs)
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	s.opts = DevdrawOptions{Reconnect: true}
+	win, _ := s.NewWindow(nil)
+
+	// a window that's published after the screen has been released
+	// doesn't bring the screen back on a new connection.
+	s.release()
+	win.Publish()
+	if len(fs.flags) != 0 {
+		t.Errorf("opened %v after the screen was released", fs.flags)
+	}
+}
+
+func TestReconnectCursor(t *testing.T) {
+	useLogger(t)
+	fs := drawFS()
+	fs.files["/dev/winname"] = "window.2"
+	useFS(t, fs)
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	s.opts = DevdrawOptions{Reconnect: true, SoftwareCursor: true}
+	win, _ := s.NewWindow(nil)
+	s.moveCursor(image.Pt(10, 10))
+
+	s.ctl.data = &failingData{}
+	win.Fill(image.Rect(0, 0, 10, 10), color.Black, draw.Src)
+	win.Publish()
+	data := fs.data["/dev/draw/3/data"]
+	if data == nil {
+		t.Fatalf("didn't reconnect after the connection failed")
+	}
+	// the arrow is uploaded again into the cursor's new image.
+	for _, m := range data.msgs {
+		if m[0] == 'y' && binary.LittleEndian.Uint32(m[1:]) == s.cursorId {
+			return
+		}
+	}
+	t.Errorf("got messages %q, want the cursor %d uploaded", data.cmds(), s.cursorId)
+}
+
+func TestReconnectFails(t *testing.T) {
+	useLogger(t)
+	fs := &flakyFS{fakeFS: drawFS(), err: os.ErrPermission, fails: map[string]int{
+		"/dev/draw/new": 1,
+	}}
+	useFS(t, fs)
+	errc := make(chan error, 1)
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	s.opts = DevdrawOptions{Reconnect: true, Errors: errc}
+	win, _ := s.NewWindow(nil)
+
+	s.ctl.data = &failingData{}
+	win.Fill(image.Rect(0, 0, 10, 10), color.Black, draw.Src)
+	win.Publish()
+	select {
+	case <-errc:
+	default:
+		t.Errorf("no error was sent when reconnecting failed")
+	}
+	// it isn't tried again for the same failure.
+	opened := len(fs.opened)
+	win.Publish()
+	if len(fs.opened) != opened {
+		t.Errorf("opened %v after reconnecting already failed", fs.opened[opened:])
+	}
+}
+
+func TestReconnectInfo(t *testing.T) {
+	useLogger(t)
+	useFS(t, drawFS())
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	// Info can be called while the connection is being replaced, which
+	// the race detector catches if it doesn't take the lock.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := s.ctl.reopen(DevdrawOptions{}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			// it's the new connection's, from /proc/N/fd.
+			if got := s.Info().IOUnitSize; got != 8192 {
+				t.Errorf("IOUnitSize = %d after reconnecting, want 8192", got)
+			}
+			return
+		default:
+			s.Info()
+		}
+	}
+}
+
+func TestReallocLive(t *testing.T) {
+	d, f := newTestCtrler(65535)
+	r := image.Rect(0, 0, 20, 20)
+	off := d.AllocBuffer(0, false, r, r, color.Black)
+	on := d.AllocScreenBuffer(3, 0, false, r, r, color.Black)
+	// AllocScreen can return 0, which is a screen like any other.
+	onZero := d.AllocScreenBuffer(0, 0, false, r, r, color.Black)
+	d.Reclip(off, true, image.Rect(5, 5, 10, 10))
+	f.msgs = nil
+
+	// the screen was allocated with a different ID on the new
+	// connection, and the reclip isn't undone.
+	if err := d.reallocLive(7); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.cmds(), "bbb"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	for i, want := range []struct {
+		id    uint32
+		sid   uint32
+		repl  byte
+		clipr image.Rectangle
+	}{
+		{off, 0, 1, image.Rect(5, 5, 10, 10)},
+		{on, 7, 0, r},
+		{onZero, 7, 0, r},
+	} {
+		m := f.msgs[i]
+		if got := binary.LittleEndian.Uint32(m[1:]); got != want.id {
+			t.Errorf("message %d: allocated %d, want %d", i, got, want.id)
+		}
+		if got := binary.LittleEndian.Uint32(m[5:]); got != want.sid {
+			t.Errorf("image %d: screen %d, want %d", want.id, got, want.sid)
+		}
+		if m[14] != want.repl {
+			t.Errorf("image %d: repl %d, want %d", want.id, m[14], want.repl)
+		}
+		if got := msgRect(m[31:]); got != want.clipr {
+			t.Errorf("image %d: clipr %v, want %v", want.id, got, want.clipr)
+		}
+	}
+}
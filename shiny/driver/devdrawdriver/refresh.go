@@ -0,0 +1,87 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"os"
+)
+
+// A RefreshEvent reports that R of the image ID, which was allocated
+// with RefMesg, has been uncovered and has to be redrawn by the client.
+type RefreshEvent struct {
+	ID uint32
+	R  image.Rectangle
+}
+
+// refreshRecordSize is the size of each record in /dev/draw/n/refresh:
+// the image ID and the rectangle, as little endian 32 bit integers.
+const refreshRecordSize = 5 * 4
+
+// RefreshEvents opens /dev/draw/n/refresh, and returns a channel that
+// the events read from it are sent on. The server only sends them for
+// images on a screen that were allocated with RefMesg, since it restores
+// or discards the other images itself.
+//
+// Reads of the refresh file block until something needs to be redrawn,
+// so the events are read by a goroutine. It closes the channel when done
+// is closed or the file can't be read any more.
+func (d *DrawCtrler) RefreshEvents(done <-chan struct{}) (<-chan RefreshEvent, error) {
+	f, err := openDev(fmt.Sprintf("draw/%d/refresh", d.N), os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	c := make(chan RefreshEvent)
+	go func() {
+		defer close(c)
+		defer f.Close()
+		defer closeOnDone(f, done)()
+		readRefreshEvents(f, c, done)
+	}()
+	return c, nil
+}
+
+// readRefreshEvents does the work of RefreshEvents for the already open
+// refresh file r. A read can return any number of whole records.
+func readRefreshEvents(r io.Reader, c chan<- RefreshEvent, done <-chan struct{}) {
+	buf := make([]byte, 32*refreshRecordSize)
+	for {
+		n, err := r.Read(buf)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if n%refreshRecordSize != 0 {
+			Log.Warnf("short record in /dev/draw refresh file (%d bytes)", n)
+		}
+		for p := buf[:n]; len(p) >= refreshRecordSize; p = p[refreshRecordSize:] {
+			e := RefreshEvent{
+				ID: binary.LittleEndian.Uint32(p),
+				R: image.Rect(
+					int(int32(binary.LittleEndian.Uint32(p[4:]))),
+					int(int32(binary.LittleEndian.Uint32(p[8:]))),
+					int(int32(binary.LittleEndian.Uint32(p[12:]))),
+					int(int32(binary.LittleEndian.Uint32(p[16:]))),
+				),
+			}
+			select {
+			case c <- e:
+			case <-done:
+				return
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			Log.Errorf("read /dev/draw refresh file: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+func TestRefreshEvents(t *testing.T) {
+	useLogger(t)
+	want := []RefreshEvent{
+		{5, image.Rect(0, 0, 10, 20)},
+		{7, image.Rect(-5, 3, 100, 40)},
+	}
+	var records []byte
+	for _, e := range want {
+		for _, v := range []int{int(e.ID), e.R.Min.X, e.R.Min.Y, e.R.Max.X, e.R.Max.Y} {
+			records = binary.LittleEndian.AppendUint32(records, uint32(v))
+		}
+	}
+	fs := &fakeFS{files: map[string]string{"/dev/draw/1/refresh": string(records)}}
+	useFS(t, fs)
+	d, _ := newTestCtrler(65535)
+
+	c, err := d.RefreshEvents(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []RefreshEvent
+	for e := range c {
+		got = append(got, e)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got events %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+	if !fs.data["/dev/draw/1/refresh"].closed {
+		t.Errorf("the refresh file was left open")
+	}
+
+	useFS(t, &fakeFS{})
+	if _, err := d.RefreshEvents(nil); err == nil {
+		t.Errorf("expected an error without a refresh file")
+	}
+}
@@ -5,145 +5,915 @@
 package devdrawdriver
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/niconan/shiny-plan9/shiny/screen"
+	"golang.org/x/mobile/event/mouse"
+	"golang.org/x/mobile/event/size"
 	"image"
-	//"sigint.ca/plan9/draw"
 	"image/color"
+	//"sigint.ca/plan9/draw"
 	"image/draw"
 	"io/ioutil"
+	"os"
+	"sync"
+	"time"
 )
 
 type screenId uint32
 
 type screenImpl struct {
-	// the active shiny window
+	// the focused shiny window, which receives keyboard events.
 	w *windowImpl
+	// the window that receives mouse events while a button that was
+	// pressed over it is held down, regardless of where the pointer is.
+	grab *windowImpl
+	// the buttons that are held down, according to the mouse events that
+	// have been routed by mouseTarget.
+	buttons ButtonMask
+	// whether the Plan 9 window is the current window in the window
+	// system, which means that the focused shiny window has the focus.
+	current bool
 
 	screenId screenId
 
+	opts DevdrawOptions
+
 	// the reference to /dev/draw/N/data to send
 	// messages to
 	ctl *DrawCtrler
 
 	// the dimensions of the Plan 9 window that we're overlaying our
-	// shiny window onto.
+	// shiny window onto, and the width of the border that was removed
+	// from each side of it.
 	windowFrame image.Rectangle
+	border      int
 
 	// list of existing window image IDs that have been allocated, so we know
-	// what to free at the end.
+	// what to free at the end. The windows are composited in this order,
+	// so the most recently created window is on top.
 	windows []*windowImpl
+	// the last state of the Plan 9 window reported by setCurrent, which
+	// becomes current when focusTimer fires.
+	wantCurrent bool
+	focusTimer  *time.Timer
+	// resizeTimer calls applyResize once the Plan 9 window has stopped
+	// being resized.
+	resizeTimer *time.Timer
+	// released is set by release, after which the timers aren't started
+	// again, and do nothing if they had already fired.
+	released bool
+	// stale is set when the windows have to be composited again even if
+	// none of them has been drawn into, because a window was removed or
+	// they were moved.
+	stale bool
+	// appMessages is ctl.appMessages when the windows were last
+	// composited. The application's own messages may have drawn into a
+	// window whose ImageID it was given, so the windows are composited
+	// again after any of them. Protected by ctl.drawMu.
+	appMessages uint64
+	// fullscreen is whether setFullscreen made the Plan 9 window cover
+	// the display, and savedFrame is where the Plan 9 window was before,
+	// including its border.
+	fullscreen bool
+	savedFrame image.Rectangle
+	// winname is the name of the Plan 9 window's image that image ID 0
+	// is attached to.
+	winname string
+	// painted is closed after the first frame has been flushed. It's
+	// made by whichever of FirstPaint and paintedLocked needs it first.
+	painted chan struct{}
+	// lostErr is the write error that the last reconnect was for, so that
+	// a connection which couldn't be replaced isn't tried again on every
+	// publish.
+	lostErr error
+	// cursorId is the image of the software cursor, which is allocated
+	// by moveCursor if DevdrawOptions.SoftwareCursor is set, and
+	// cursorPos is where the pointer is in the Plan 9 window.
+	// cursorDrawn is where the cursor was last drawn on image 0, which
+	// is painted over before it's drawn anywhere else.
+	cursorId    uint32
+	cursorPos   image.Point
+	cursorDrawn image.Rectangle
+	// textures that haven't been released yet, so that they can be
+	// released along with the screen.
+	textures map[*textureImpl]bool
+	// solidMaskId is the image that solidMask returns, which it
+	// allocates the first time that it's called.
+	solidMaskOnce sync.Once
+	solidMaskId   uint32
+	// stopDevices, if not nil, stops the goroutines reading the devices,
+	// which mainWithOptions started.
+	stopDevices func()
+	// paintDelay is how long NewWindow waits before kicking a new
+	// window, or zero for initialPaintDelay. Tests set it so that the
+	// kick doesn't arrive in the middle of what they're checking.
+	paintDelay time.Duration
+	// protects windows, w, grab, buttons, current, wantCurrent,
+	// focusTimer, resizeTimer, released, stale, fullscreen, savedFrame, winname,
+	// painted, lostErr, textures, cursorId, cursorPos, cursorDrawn, screenId,
+	// windowFrame and border once the screen is running
+	windowsMu sync.Mutex
+
+	// fonts that have been loaded by DrawString, by file name. DrawString
+	// holds windowsMu while it loads them, so fontsMu comes after it.
+	fonts   map[string]*font
+	fontsMu sync.Mutex
 }
 
+// NewBuffer returns a buffer of the given size, which must be positive
+// in both dimensions, like the size of a texture.
 func (s *screenImpl) NewBuffer(size image.Point) (retBuf screen.Buffer, retErr error) {
+	// an empty buffer can never be uploaded, so it's better to say so
+	// here than to have nothing show up later.
+	if size.X <= 0 || size.Y <= 0 {
+		return nil, fmt.Errorf("new buffer: invalid size %v", size)
+	}
 	img := image.NewRGBA(image.Rectangle{image.ZP, size})
 	return &bufferImpl{img}, nil
-
 }
 
 func (s *screenImpl) NewTexture(size image.Point) (screen.Texture, error) {
+	// the size is sent to /dev/draw unsigned, so a negative one would
+	// become an enormous image.
+	if size.X <= 0 || size.Y <= 0 {
+		return nil, fmt.Errorf("new texture: invalid size %v", size)
+	}
 	return newTextureImpl(s, size), nil
 }
 
+// NewWindow creates a new window on top of the existing ones, and gives
+// it the keyboard focus. All windows have their top left corner at the top
+// left of the Plan 9 window. If opts doesn't specify a size, the window
+// covers the whole Plan 9 window and is resized along with it. It's
+// filled with DevdrawOptions.BackgroundColor until the first paint.
 func (s *screenImpl) NewWindow(opts *screen.NewWindowOptions) (screen.Window, error) {
-	w := newWindowImpl(s)
+	var size image.Point
+	if opts != nil {
+		size = image.Point{opts.Width, opts.Height}
+	}
+	w := newWindowImpl(s, size)
+	s.windowsMu.Lock()
 	s.w = w
 	s.windows = append(s.windows, w)
+	s.sendLifecyclesLocked()
+	s.windowsMu.Unlock()
+	delay := s.paintDelay
+	if delay == 0 {
+		delay = initialPaintDelay
+	}
+	time.AfterFunc(delay, func() { s.kickWindow(w) })
 	return w, nil
 }
 
+// initialPaintDelay is how long after a window is created that it's sent
+// its size and a paint event again, unless the Plan 9 window has been
+// resized since. Some rio configurations never send the resize that
+// applications wait for before drawing, so this makes sure that they
+// start.
+const initialPaintDelay = 250 * time.Millisecond
+
+// kickWindow re-sends w its size and a paint event if it's still on the
+// screen and hasn't been resized since it was created.
+func (s *screenImpl) kickWindow(w *windowImpl) {
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	if w.resized {
+		return
+	}
+	for _, win := range s.windows {
+		if win == w {
+			w.sendSize()
+			return
+		}
+	}
+}
+
+// focusDebounce is how long the Plan 9 window has to stay current (or not
+// current) before the lifecycle stages of the shiny windows are changed, so
+// that the window flapping between the two, such as during a drag, doesn't
+// send a flurry of events.
+var focusDebounce = 50 * time.Millisecond
+
+// setCurrent records whether the Plan 9 window is the current window, and
+// updates the lifecycle stage of the shiny windows accordingly once it's
+// stayed that way for focusDebounce.
+func (s *screenImpl) setCurrent(current bool) {
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	if s.released {
+		return
+	}
+	s.wantCurrent = current
+	if s.focusTimer == nil {
+		s.focusTimer = time.AfterFunc(focusDebounce, s.applyCurrent)
+		return
+	}
+	s.focusTimer.Reset(focusDebounce)
+}
+
+// applyCurrent is called by focusTimer to update the lifecycle stages of
+// the windows after the last call to setCurrent.
+func (s *screenImpl) applyCurrent() {
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	if s.released {
+		return
+	}
+	s.current = s.wantCurrent
+	s.sendLifecyclesLocked()
+}
+
+// resizeDebounce is how long the Plan 9 window has to go without being
+// resized before the windows are moved and reallocated to fit it, so that
+// a drag which resizes it many times only reallocates them once.
+var resizeDebounce = 50 * time.Millisecond
+
+// scheduleResize makes applyResize run once the Plan 9 window has stopped
+// being resized for resizeDebounce. With DevdrawOptions.LiveResize, the
+// windows are told each size along the way as well.
+func (s *screenImpl) scheduleResize() {
+	if s.opts.LiveResize {
+		s.sendLiveSize()
+	}
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	if s.released {
+		return
+	}
+	if s.resizeTimer == nil {
+		s.resizeTimer = time.AfterFunc(resizeDebounce, s.applyResize)
+		return
+	}
+	s.resizeTimer.Reset(resizeDebounce)
+}
+
+// sendLiveSize sends the windows that fill the Plan 9 window a size.Event
+// with its current size, without reallocating their images, for a resize
+// that's still in progress. If the size can't be read, or is empty, the
+// event is skipped, and applyResize reports it once the resize settles.
+func (s *screenImpl) sendLiveSize() {
+	r, _, err := s.readFrame()
+	if err != nil || r.Empty() {
+		return
+	}
+	sz := r.Size()
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	for _, w := range s.windows {
+		if w.fillFrame {
+			w.Deque.Send(size.Event{WidthPx: sz.X, HeightPx: sz.Y})
+		}
+	}
+}
+
+// applyResize fits the windows to the current size of the Plan 9 window,
+// and tells them their size and to paint.
+func (s *screenImpl) applyResize() {
+	s.windowsMu.Lock()
+	released := s.released
+	s.windowsMu.Unlock()
+	if released {
+		return
+	}
+	// Reread the window size the same way that happens on startup.
+	// This is more reliable than the 'r' message, the format of which
+	// isn't documented.
+	windowSize, border, err := s.readFrame()
+	if err != nil {
+		Log.Errorf("read current window size: %v", err)
+		return
+	}
+	// a resize can arrive before the Plan 9 window has a size, and
+	// there's nothing that can be drawn into an empty one. The windows
+	// are left as they are, and fitted to the next real size.
+	if windowSize.Empty() {
+		Log.Warnf("ignoring resize to an empty window %v", windowSize)
+		return
+	}
+
+	s.windowsMu.Lock()
+	moved := windowSize.Size() == s.windowFrame.Size()
+	s.windowFrame, s.border = windowSize, border
+	s.windowsMu.Unlock()
+	if moved {
+		// the Plan 9 window was only moved, so the images still fit
+		// and nothing has to be repainted. They only have to be
+		// composited at the new position.
+		moveWindow(s)
+		redrawWindow(s, windowSize)
+		return
+	}
+	repositionWindow(s, windowSize)
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	for _, w := range s.windows {
+		w.resized = true
+		w.sendSize()
+	}
+}
+
+// frame returns the rectangle of the Plan 9 window that the windows are
+// drawn in, which applyResize changes from the resize timer's goroutine.
+func (s *screenImpl) frame() image.Rectangle {
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	return s.windowFrame
+}
+
+// readFrame reads the rectangle of the Plan 9 window from /dev/wctl,
+// and removes opts.BorderWidth from each side of it. A window which is
+// exactly the size of the display is taken to have no border, since
+// that's how the display looks to a program that has it all, such as
+// under a compositor or on a bare framebuffer. That isn't done once
+// setFullscreen has made the window cover the display, because rio's
+// border is still drawn inside it then.
+func (s *screenImpl) readFrame() (image.Rectangle, int, error) {
+	r, err := readWctl(0)
+	if err != nil {
+		return image.ZR, 0, err
+	}
+	s.windowsMu.Lock()
+	fullscreen := s.fullscreen
+	s.windowsMu.Unlock()
+	border := s.opts.BorderWidth
+	if msg := s.ctl.LastCtl(); msg != nil && r == msg.DisplaySize && !fullscreen {
+		border = 0
+	}
+	b := image.Pt(border, border)
+	return image.Rectangle{r.Min.Add(b), r.Max.Sub(b)}, border, nil
+}
+
+// setFullscreen makes the Plan 9 window cover the whole display, or puts
+// it back where it was before. Once rio has done it, it sends a resize
+// through /dev/mouse, which resizes the windows as usual.
+//
+// rio draws its border inside the window, so the window is made bigger
+// than the display by the border to hide it. rio may refuse a window which
+// doesn't fit on the display, in which case the window covers the display
+// with its border showing, like a maximized window.
+func (s *screenImpl) setFullscreen(on bool) error {
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	if on == s.fullscreen {
+		return nil
+	}
+	if !on {
+		if err := resizeWctl(s.savedFrame); err != nil {
+			return fmt.Errorf("restore window: %v", err)
+		}
+		s.fullscreen = false
+		return nil
+	}
+
+	msg := s.ctl.LastCtl()
+	if msg == nil {
+		return errors.New("fullscreen: unknown display size")
+	}
+	display := msg.DisplaySize
+	border := s.opts.BorderWidth
+	err := resizeWctl(display.Inset(-border))
+	if err != nil && border > 0 {
+		err = resizeWctl(display)
+	}
+	if err != nil {
+		return fmt.Errorf("fullscreen: %v", err)
+	}
+	s.savedFrame = s.windowFrame.Inset(-s.border)
+	s.fullscreen = true
+	return nil
+}
+
+// sendLifecyclesLocked sends a lifecycle event to every window whose stage
+// has changed. The focused window is in StageFocused while the Plan 9
+// window is current, and the others are in StageVisible.
+//
+// It must be called with windowsMu held.
+func (s *screenImpl) sendLifecyclesLocked() {
+	for _, w := range s.windows {
+		w.lifecycler.SetFocused(s.current && w == s.w)
+		w.lifecycler.SendEvent(w, nil)
+	}
+}
+
+// focused returns the window that has the keyboard focus.
+func (s *screenImpl) focused() *windowImpl {
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	return s.w
+}
+
+// mouseTarget returns the window which should receive e, whose coordinates
+// are relative to the Plan 9 window and are changed to be relative to the
+// window, and the buttons that are held down after it. The window is the
+// topmost one under the pointer, unless a button was pressed over another
+// window and hasn't been released yet. Pressing a button also gives that
+// window the focus.
+func (s *screenImpl) mouseTarget(e *mouse.Event) (*windowImpl, ButtonMask) {
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	w := s.grab
+	if w == nil {
+		p := image.Point{int(e.X), int(e.Y)}
+		for i := len(s.windows) - 1; i >= 0; i-- {
+			if p.In(s.windows[i].rect) {
+				w = s.windows[i]
+				break
+			}
+		}
+	}
+	switch e.Direction {
+	case mouse.DirPress:
+		s.buttons |= buttonMask(e.Button)
+		s.grab = w
+		if w != nil && w != s.w {
+			s.w = w
+			s.sendLifecyclesLocked()
+		}
+	case mouse.DirRelease:
+		s.buttons &^= buttonMask(e.Button)
+		// the window keeps the mouse until every button of a chord has
+		// been released.
+		if s.buttons == 0 {
+			s.grab = nil
+		}
+	}
+	// the window's rectangle changes when the Plan 9 window is resized,
+	// so it's only read with windowsMu held.
+	if w != nil {
+		e.X -= float32(w.rect.Min.X)
+		e.Y -= float32(w.rect.Min.Y)
+	}
+	return w, s.buttons
+}
+
+// removeWindow removes w from the list of windows that are composited
+// onto the Plan 9 window. If w had the focus, it goes to the topmost
+// window that's left. It reports whether w was in the list.
+func (s *screenImpl) removeWindow(w *windowImpl) bool {
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	if s.grab == w {
+		s.grab = nil
+	}
+	for i, win := range s.windows {
+		if win == w {
+			s.windows = append(s.windows[:i], s.windows[i+1:]...)
+			s.stale = true
+			if s.w == w {
+				s.w = nil
+				if n := len(s.windows); n > 0 {
+					s.w = s.windows[n-1]
+				}
+				s.sendLifecyclesLocked()
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// fail reports err, which stopped the driver from reading one of its
+// devices, to the log and to the application's Errors channel.
+func (s *screenImpl) fail(err error) {
+	Log.Errorf("%v", err)
+	if s.opts.Errors == nil {
+		return
+	}
+	select {
+	case s.opts.Errors <- err:
+	default:
+	}
+}
+
+// release tears the screen down: it stops the device goroutines, frees
+// everything that the screen owns on the /dev/draw server, which is the
+// images of any windows and textures that haven't been released yet,
+// the font caches and the screen itself, and then closes the connection.
+// The images are freed first, so that the server isn't left holding them
+// if closing the connection doesn't free them.
 func (s *screenImpl) release() {
 	if s == nil || s.ctl == nil {
 		return
 	}
-	s.ctl.FreeScreen(s.screenId)
+	if s.stopDevices != nil {
+		s.stopDevices()
+	}
+	s.windowsMu.Lock()
+	// a timer that fires anyway does nothing, and neither is started
+	// again.
+	s.released = true
+	if s.focusTimer != nil {
+		s.focusTimer.Stop()
+	}
+	if s.resizeTimer != nil {
+		s.resizeTimer.Stop()
+	}
+	windows := append([]*windowImpl(nil), s.windows...)
+	textures := make([]*textureImpl, 0, len(s.textures))
+	for t := range s.textures {
+		textures = append(textures, t)
+	}
+	sid := s.screenId
+	cursorId := s.cursorId
+	s.cursorId = 0
+	s.windowsMu.Unlock()
+	for _, w := range windows {
+		w.Release()
+	}
+	if cursorId != 0 {
+		s.ctl.FreeID(cursorId)
+	}
+	for _, t := range textures {
+		t.Release()
+	}
+	// a draw that's still allocating the mask is waited for, and none
+	// is allocated afterwards.
+	s.solidMaskOnce.Do(func() {})
+	if s.solidMaskId != 0 {
+		s.ctl.FreeID(s.solidMaskId)
+	}
+	s.releaseFonts()
+	s.ctl.FreeScreen(sid)
+	if err := s.ctl.Close(); err != nil {
+		Log.Errorf("close draw connection: %v", err)
+	}
+}
+
+// solidMask returns an opaque replicated image that covers the whole
+// plane, for use as the mask of any draw that should use the source as
+// it is, like libdraw's display->opaque. It's shared by every image on
+// the screen, and freed when the screen is released.
+func (s *screenImpl) solidMask() uint32 {
+	s.solidMaskOnce.Do(func() {
+		s.solidMaskId = s.ctl.AllocBuffer(0, true, image.Rect(0, 0, 1, 1), replClipr, color.Black)
+		s.ctl.own(s.solidMaskId)
+	})
+	return s.solidMaskId
+}
+
+// addTexture records that t is to be released along with the screen.
+func (s *screenImpl) addTexture(t *textureImpl) {
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	if s.textures == nil {
+		s.textures = make(map[*textureImpl]bool)
+	}
+	s.textures[t] = true
+}
+
+// removeTexture is the counterpart of removeWindow for textures. It
+// reports whether t was still to be released.
+func (s *screenImpl) removeTexture(t *textureImpl) bool {
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	if !s.textures[t] {
+		return false
+	}
+	delete(s.textures, t)
+	return true
 }
 
-func newScreenImpl() (*screenImpl, error) {
+func newScreenImpl(opts DevdrawOptions) (*screenImpl, error) {
+	useWsys()
 	ctrl, _, err := NewDrawCtrler()
 	if err != nil {
 		return nil, fmt.Errorf("new controller: %v", err)
 	}
+	ctrl.configure(opts)
 
 	// makes image ID 0 refer to the same image as /dev/winname on this process.
-	ctrl.sendMessage('n', reAttachWindow())
+	winname, err := attachWindow(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
 
 	sId, err := ctrl.AllocScreen()
 	if err != nil {
+		ctrl.Close()
 		return nil, err
 	}
 
 	return &screenImpl{
+		opts:     opts,
 		ctl:      ctrl,
 		windows:  make([]*windowImpl, 0),
 		screenId: sId,
+		winname:  winname,
 	}, nil
 }
 
 // moves the current shiny windows to be overlaid on the current plan9 window
 // frame.
 func repositionWindow(s *screenImpl, r image.Rectangle) {
-	// reattach the window after a resize event. We always attach id 0
-	// to the current window.
-	// BUG(driusan): This reallocs everything on every resize event, but
-	// it only needs to be triggered when the size of the new window is
+	// BUG(driusan): This reallocs everything whenever the window's size
+	// changes, but it only needs to be triggered when the size of the new window is
 	// bigger than the size of the original window.
-	s.ctl.ReallocScreen(s.screenId)
-	s.ctl.sendMessage('n', reAttachWindow())
-
-	args := make([]byte, 20)
-	// 0-3 = windowId
-	// 4-7 = internal X. Always 0.
-	// 8-11 = internal Y. Always 0.
-	// 12-15 = top corner X on screen. The same as the windowFrame
-	// 16-19 = top corner Y. The same as the windowFrame.
-	binary.LittleEndian.PutUint32(args[12:], uint32(r.Min.X))
-	binary.LittleEndian.PutUint32(args[16:], uint32(r.Min.Y))
-	for i, win := range s.windows {
+	reattachScreen(s)
+
+	// The windows' images are off screen, so there's no 'o' message to
+	// move them, as there would be for windows on a /dev/draw screen.
+	// They always have their origin at image.ZP, and redrawWindow
+	// composites them at r.Min.
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	s.stale = true
+	for _, win := range s.windows {
+		if !win.fillFrame {
+			continue
+		}
 		s.ctl.FreeID(uint32(win.imageId))
 		sz := image.Rectangle{image.ZP, r.Size()}
-		s.windows[i].imageId = (s.ctl.AllocBuffer(0, false, sz, sz, color.RGBA{0, 0, 0, 0}))
+		// /dev/draw has no way to change the colour that an image
+		// was allocated with, but the image is new anyway, so the
+		// area that the window grew by shows the background instead
+		// of whatever the Plan 9 window had there.
+		win.imageId = s.ctl.AllocBuffer(s.opts.WindowRefresh, false, sz, sz, s.background())
+		s.ctl.own(win.imageId)
+		win.rect = sz
+		s.ctl.drawMu.Lock()
+		win.clipr = sz
+		s.ctl.drawMu.Unlock()
+	}
+}
 
-		if win.imageId == s.w.imageId {
-			s.w.imageId = s.windows[i].imageId
-		}
+// moveWindow marks the shiny windows to be composited again after the Plan 9
+// window was moved without being resized. Their images are kept as they
+// are, along with what has been drawn in them.
+func moveWindow(s *screenImpl) {
+	reattachScreen(s)
+	s.windowsMu.Lock()
+	s.stale = true
+	s.windowsMu.Unlock()
+}
+
+// reattachScreen reattaches image ID 0 to the current Plan 9 window, which
+// rio replaces whenever it's moved or resized.
+func reattachScreen(s *screenImpl) {
+	s.windowsMu.Lock()
+	sid := s.screenId
+	s.windowsMu.Unlock()
+	s.ctl.ReallocScreen(sid)
+	if attach, err := reAttachWindow(); err != nil {
+		Log.Errorf("reattach window: %v", err)
+	} else {
+		s.ctl.sendMessage('n', attach)
+		s.windowsMu.Lock()
+		s.winname = string(attach[5:])
+		s.windowsMu.Unlock()
+	}
+}
+
+// winnameChanged reports whether /dev/winname names a different image to
+// the one that image ID 0 is attached to. rio replaces the window's image
+// when it's resized, but also for other reasons, such as when the window
+// is hidden and shown again, and then the windows have to be attached to
+// the new one. If /dev/winname can't be read, it's left for the next
+// resize to find out.
+func (s *screenImpl) winnameChanged() bool {
+	attach, err := reAttachWindow()
+	if err != nil {
+		return false
 	}
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	return string(attach[5:]) != s.winname
 }
 
 // Redraw the shiny windows on top of the active Plan9 window that we're
-// attached to
+// attached to. Nothing is sent if none of the windows have been drawn
+// into since the last time, since the Plan 9 window would look the same.
 func redrawWindow(s *screenImpl, r image.Rectangle) {
 	args := make([]byte, 44)
 
-	// the rectangle clipping rectangle
-	binary.LittleEndian.PutUint32(args[12:], uint32(r.Min.X))
-	binary.LittleEndian.PutUint32(args[16:], uint32(r.Min.Y))
-	binary.LittleEndian.PutUint32(args[20:], uint32(r.Max.X))
-	binary.LittleEndian.PutUint32(args[24:], uint32(r.Max.Y))
 	// source point and mask point are both always 0.
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
 	s.ctl.drawMu.Lock()
 	defer s.ctl.drawMu.Unlock()
+	dirty := s.stale || s.appMessages != s.ctl.appMessages
+	s.appMessages = s.ctl.appMessages
+	for _, win := range s.windows {
+		dirty = dirty || win.dirty
+		win.dirty = false
+	}
+	if !dirty {
+		return
+	}
+	s.stale = false
+	// flush the buffer, even if compositing stops part of the way
+	// through, so that the display isn't left with some of it.
+	drawn := false
+	defer func() {
+		if err := s.ctl.sendMessage('v', nil); err == nil && drawn {
+			s.paintedLocked()
+		}
+	}()
+	composite := func(dr image.Rectangle, src, mask uint32, op draw.Op) error {
+		binary.LittleEndian.PutUint32(args[12:], uint32(dr.Min.X))
+		binary.LittleEndian.PutUint32(args[16:], uint32(dr.Min.Y))
+		binary.LittleEndian.PutUint32(args[20:], uint32(dr.Max.X))
+		binary.LittleEndian.PutUint32(args[24:], uint32(dr.Max.Y))
+		binary.LittleEndian.PutUint32(args[4:], src)
+		binary.LittleEndian.PutUint32(args[8:], mask)
+		return s.ctl.sendOpMessage(op, 'd', args)
+	}
+
+	// a translucent window is blended with what's under it, which is
+	// still the last frame, with the window already blended into it.
+	// So the area under them starts again from the background, as does
+	// the cursor from the last frame, since it may be somewhere that no
+	// window covers, or where a window is transparent.
+	var under image.Rectangle
+	for _, win := range s.windows {
+		if win.opacityMask != 0 {
+			under = under.Union(win.rect.Add(r.Min).Intersect(r))
+		}
+	}
+	oldCursor := s.cursorDrawn.Intersect(r)
+	s.cursorDrawn = image.ZR
+	if !under.Empty() || !oldCursor.Empty() {
+		bgID := s.ctl.AllocBuffer(0, true, image.Rect(0, 0, 1, 1), replClipr, s.background())
+		defer s.ctl.FreeID(bgID)
+		for _, dr := range []image.Rectangle{under, oldCursor} {
+			if dr.Empty() {
+				continue
+			}
+			if err := composite(dr, bgID, bgID, draw.Src); err != nil {
+				Log.Errorf("composite background: %v", err)
+				return
+			}
+		}
+	}
+
 	for _, win := range s.windows {
-		// redraw each window id
-		binary.LittleEndian.PutUint32(args[4:], uint32(win.imageId))
+		// redraw each window id, clipped to the Plan 9 window.
+		dr := win.rect.Add(r.Min).Intersect(r)
+		if dr.Empty() {
+			continue
+		}
 		// use the window itself as a mask, so that it's opaque.
 		// (or at least uses it's own alpha channel)
-		binary.LittleEndian.PutUint32(args[8:], uint32(win.imageId))
-		s.ctl.setOp(draw.Src)
-		s.ctl.sendMessage('d', args)
+		mask, op := win.imageId, draw.Src
+		if win.opacityMask != 0 {
+			// or blend it with what's under it, for SetOpacity.
+			mask, op = win.opacityMask, draw.Over
+		}
+		if err := composite(dr, win.imageId, mask, op); err != nil {
+			Log.Errorf("composite window: %v", err)
+			return
+		}
+		drawn = true
+	}
+	if err := s.drawCursorLocked(r); err != nil {
+		Log.Errorf("draw cursor: %v", err)
 	}
-	// flush the buffer
-	s.ctl.sendMessage('v', nil)
 }
 
-func reAttachWindow() []byte {
-	winname, err := ioutil.ReadFile("/dev/winname")
+// PaintScreen tells when the application has actually been shown, for
+// callers that need to know, such as to tell a supervisor that it's up:
+//
+//	<-s.(devdrawdriver.PaintScreen).FirstPaint()
+type PaintScreen interface {
+	FirstPaint() <-chan struct{}
+}
+
+// FirstPaint returns a channel which is closed once a window has been
+// composited onto the Plan 9 window and flushed for the first time.
+// Unlike a lifecycle event, that means a frame was sent to /dev/draw.
+func (s *screenImpl) FirstPaint() <-chan struct{} {
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+	if s.painted == nil {
+		s.painted = make(chan struct{})
+	}
+	return s.painted
+}
+
+// CtrlerScreen gives access to the connection to /dev/draw that the
+// screen draws with, for messages that screen.Screen can't send:
+//
+//	d := s.(devdrawdriver.CtrlerScreen).DrawCtrler()
+//	d.SendMessage('L', msg)
+type CtrlerScreen interface {
+	DrawCtrler() *DrawCtrler
+}
+
+// DrawCtrler returns the connection to /dev/draw that s draws with.
+func (s *screenImpl) DrawCtrler() *DrawCtrler {
+	return s.ctl
+}
+
+// ScreenInfo describes the /dev/draw connection that a screen draws with,
+// as reported by the server when the connection was opened, or by the
+// last DrawCtrler.ReadCtl.
+type ScreenInfo struct {
+	// ChannelFormat is the pixel format of the display, such as
+	// "x8r8g8b8", as described in image(6).
+	ChannelFormat string
+	// DisplaySize is the rectangle of the whole display, and Clipping is
+	// its clipping rectangle.
+	DisplaySize image.Rectangle
+	Clipping    image.Rectangle
+	// IOUnitSize is the largest message that's written to /dev/draw,
+	// after DevdrawOptions.IOUnitSize is applied. Unless it's disabled,
+	// compression is used when it's less than 65535, because /dev/draw
+	// is probably remote then.
+	IOUnitSize int
+}
+
+// InfoScreen describes the display, for callers that adapt to it, such
+// as by choosing a pixel format:
+//
+//	info := s.(devdrawdriver.InfoScreen).Info()
+type InfoScreen interface {
+	Info() ScreenInfo
+}
+
+// Info returns a description of the /dev/draw connection that s draws
+// with.
+func (s *screenImpl) Info() ScreenInfo {
+	info := ScreenInfo{IOUnitSize: s.ctl.iounit()}
+	if msg := s.ctl.LastCtl(); msg != nil {
+		info.ChannelFormat = msg.ChannelFormat
+		info.DisplaySize = msg.DisplaySize
+		info.Clipping = msg.Clipping
+	}
+	return info
+}
+
+// paintedLocked closes the channel returned by FirstPaint, if it hasn't
+// been already. It must be called with windowsMu held.
+func (s *screenImpl) paintedLocked() {
+	if s.painted == nil {
+		s.painted = make(chan struct{})
+	}
+	select {
+	case <-s.painted:
+	default:
+		close(s.painted)
+	}
+}
+
+// attachRetries is how many times attachWindow sends the 'n' message
+// before it gives up on /dev/winname settling.
+const attachRetries = 3
+
+// attachWindow attaches image ID 0 of d to the window named by
+// /dev/winname, and returns the name. /dev/winname names the window of
+// whichever process reads it, so if it names a different one after the
+// image was attached, such as because the process was moved to another
+// window in between, the new one is attached instead. If it still hasn't
+// settled after attachRetries attempts, the last one is kept, and left
+// for winnameChanged to notice.
+func attachWindow(d *DrawCtrler) (string, error) {
+	attach, err := reAttachWindow()
+	if err != nil {
+		return "", fmt.Errorf("attach window: %v", err)
+	}
+	for i := 0; ; i++ {
+		if err := d.sendMessage('n', attach); err != nil {
+			return "", fmt.Errorf("attach window %q: %v", attach[5:], err)
+		}
+		// if it can't be read again, what was attached is as good
+		// as it gets.
+		again, err := reAttachWindow()
+		if err != nil || bytes.Equal(again, attach) {
+			return string(attach[5:]), nil
+		}
+		if i+1 == attachRetries {
+			Log.Warnf("window name changed from %q to %q while attaching it", attach[5:], again[5:])
+			return string(attach[5:]), nil
+		}
+		attach = again
+	}
+}
+
+// reAttachWindow returns the arguments for an 'n' message which attaches
+// image ID 0 to the window named by /dev/winname.
+func reAttachWindow() ([]byte, error) {
+	f, err := openDev("winname", os.O_RDONLY)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	defer f.Close()
+	winname, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	// rio doesn't end the name with a newline, but other window systems
+	// or a file bound over /dev/winname may, and it isn't part of the
+	// image's name.
+	winname = bytes.TrimRight(winname, " \t\r\n")
+	// the length of the name is sent in a single byte.
+	if len(winname) > 255 {
+		return nil, fmt.Errorf("window name %.20q... is %d bytes long, the most is 255", winname, len(winname))
 	}
 	buf := make([]byte, 4+1+len(winname))
 	buf[4] = byte(len(winname))
 	copy(buf[5:], winname)
-	return buf
+	return buf, nil
 }
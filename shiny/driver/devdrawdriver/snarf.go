@@ -0,0 +1,77 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/mobile/event/key"
+)
+
+// SnarfScreen reads and replaces Plan 9's clipboard, the snarf buffer:
+//
+//	text, err := s.(devdrawdriver.SnarfScreen).Snarf()
+//	err = s.(devdrawdriver.SnarfScreen).SetSnarf("hello")
+type SnarfScreen interface {
+	Snarf() (string, error)
+	SetSnarf(text string) error
+}
+
+// PasteEvent is sent to the focused window instead of the key.Event for
+// DevdrawOptions.PasteRune, if it's set. Text is what was in the snarf
+// buffer, so that applications which don't read it themselves can still
+// be pasted into.
+type PasteEvent struct {
+	Text string
+}
+
+// Snarf returns the contents of the snarf buffer, /dev/snarf.
+func (s *screenImpl) Snarf() (string, error) {
+	return readSnarf()
+}
+
+// SetSnarf replaces the contents of the snarf buffer with text.
+func (s *screenImpl) SetSnarf(text string) error {
+	f, err := openDev("snarf", os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("set snarf: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(text)); err != nil {
+		return fmt.Errorf("set snarf: %v", err)
+	}
+	return nil
+}
+
+func readSnarf() (string, error) {
+	f, err := openDev("snarf", os.O_RDONLY)
+	if err != nil {
+		return "", fmt.Errorf("snarf: %v", err)
+	}
+	defer f.Close()
+	text, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", fmt.Errorf("snarf: %v", err)
+	}
+	return string(text), nil
+}
+
+// isPasteKey reports whether e is a press or release of the key that was
+// configured with DevdrawOptions.PasteRune.
+func (s *screenImpl) isPasteKey(e *key.Event) bool {
+	return s.opts.PasteRune != 0 && e.Rune == s.opts.PasteRune
+}
+
+// paste sends the contents of the snarf buffer to w as a PasteEvent.
+func paste(w *windowImpl) {
+	text, err := readSnarf()
+	if err != nil {
+		Log.Errorf("paste: %v", err)
+		return
+	}
+	w.Deque.Send(PasteEvent{Text: text})
+}
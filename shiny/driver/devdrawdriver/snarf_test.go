@@ -0,0 +1,83 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"context"
+	"image"
+	"testing"
+
+	"github.com/niconan/shiny-plan9/shiny/screen"
+	"golang.org/x/mobile/event/key"
+	"golang.org/x/mobile/event/mouse"
+)
+
+func TestSnarf(t *testing.T) {
+	fs := &fakeFS{files: map[string]string{"/dev/snarf": "snarfed ☺"}}
+	useFS(t, fs)
+	var s SnarfScreen = &screenImpl{}
+
+	text, err := s.Snarf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "snarfed ☺" {
+		t.Errorf("Snarf() = %q, want %q", text, "snarfed ☺")
+	}
+
+	if err := s.SetSnarf("hello"); err != nil {
+		t.Fatal(err)
+	}
+	d := fs.data["/dev/snarf"]
+	if len(d.msgs) != 1 || string(d.msgs[0]) != "hello" || !d.closed {
+		t.Errorf("wrote %q to /dev/snarf, want one write of %q", d.msgs, "hello")
+	}
+
+	useFS(t, &fakeFS{})
+	if _, err := s.Snarf(); err == nil {
+		t.Errorf("Snarf() succeeded without /dev/snarf")
+	}
+}
+
+func TestPasteKey(t *testing.T) {
+	useFS(t, &fakeFS{files: map[string]string{"/dev/snarf": "pasted"}})
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	s.opts.PasteRune = '\x16'
+	keyboardEvent := make(chan *key.Event)
+
+	windows := make(chan screen.Window)
+	block := make(chan struct{})
+	defer close(block)
+	app := func(s screen.Screen) {
+		w, _ := s.NewWindow(nil)
+		windows <- w
+		<-block
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.eventLoop(ctx, app, make(chan *mouse.Event), keyboardEvent)
+	w := <-windows
+
+	keyboardEvent <- &key.Event{Rune: 'a', Direction: key.DirPress}
+	keyboardEvent <- &key.Event{Rune: '\x16', Code: key.CodeV, Modifiers: key.ModControl, Direction: key.DirPress}
+	keyboardEvent <- &key.Event{Rune: '\x16', Code: key.CodeV, Modifiers: key.ModControl, Direction: key.DirRelease}
+	keyboardEvent <- &key.Event{Rune: 'b', Direction: key.DirPress}
+
+	// the paste key itself isn't sent, and only pastes once.
+	want := []interface{}{
+		key.Event{Rune: 'a', Direction: key.DirPress},
+		PasteEvent{Text: "pasted"},
+		key.Event{Rune: 'b', Direction: key.DirPress},
+	}
+	for i := 0; i < len(want); {
+		switch e := w.NextEvent(); e.(type) {
+		case key.Event, PasteEvent:
+			if e != want[i] {
+				t.Errorf("event %d: got %v, want %v", i, e, want[i])
+			}
+			i++
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"sync"
+
+	"github.com/niconan/shiny-plan9/shiny/screen"
+)
+
+// A TestRecorder records the messages that a screen created by
+// NewTestScreen sends to /dev/draw/n/data.
+type TestRecorder struct {
+	mu   sync.Mutex
+	msgs [][]byte
+}
+
+// Messages returns a copy of every message that was sent since the
+// screen was created or Reset was last called. The first byte of each
+// message is the command, as described in draw(3).
+func (r *TestRecorder) Messages() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msgs := make([][]byte, len(r.msgs))
+	for i, m := range r.msgs {
+		msgs[i] = append([]byte(nil), m...)
+	}
+	return msgs
+}
+
+// Commands returns the command byte of every message that was sent
+// since the screen was created or Reset was last called.
+func (r *TestRecorder) Commands() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cmds := make([]byte, len(r.msgs))
+	for i, m := range r.msgs {
+		cmds[i] = m[0]
+	}
+	return string(cmds)
+}
+
+// Reset forgets the messages that have been recorded so far.
+func (r *TestRecorder) Reset() {
+	r.mu.Lock()
+	r.msgs = nil
+	r.mu.Unlock()
+}
+
+func (r *TestRecorder) record(p []byte) {
+	r.mu.Lock()
+	r.msgs = append(r.msgs, append([]byte(nil), p...))
+	r.mu.Unlock()
+}
+
+// recorderConn is an in memory /dev/draw/n/data which records everything
+// that's written to it. Nothing can be read back from it.
+type recorderConn struct {
+	r *TestRecorder
+}
+
+func (c recorderConn) Write(p []byte) (int, error) {
+	c.r.record(p)
+	return len(p), nil
+}
+
+func (c recorderConn) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c recorderConn) Close() error {
+	return nil
+}
+
+// ctlConn is an in memory /dev/draw/n/ctl which returns the same ctl
+// message on every read.
+type ctlConn struct {
+	msg string
+}
+
+func (c ctlConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c ctlConn) Read(p []byte) (int, error) {
+	return copy(p, c.msg), nil
+}
+
+func (c ctlConn) Close() error {
+	return nil
+}
+
+// NewTestScreen returns a screen which doesn't need a Plan 9 kernel.
+// Instead of /dev/draw, it sends its messages to the returned
+// TestRecorder. It behaves as if it was overlaid on a Plan 9 window
+// covering frame, on a display of the same size.
+//
+// It's intended for testing programs that use the driver, by making
+// assertions on the messages that they send.
+func NewTestScreen(frame image.Rectangle) (screen.Screen, *TestRecorder) {
+	r := &TestRecorder{}
+	msg := fmt.Sprintf("%11d %11d %11s %11d %11d %11d %11d %11d %11d %11d %11d %11d ",
+		1, 0, "r8g8b8a8", 0,
+		frame.Min.X, frame.Min.Y, frame.Max.X, frame.Max.Y,
+		frame.Min.X, frame.Min.Y, frame.Max.X, frame.Max.Y)
+	ctl := NewDrawCtrlerFromTransport(recorderConn{r}, 65535)
+	ctl.N = 1
+	ctl.ctl = ctlConn{msg}
+	ctl.lastCtl = parseCtlString(msg)
+	return &screenImpl{
+		opts:        DefaultOptions,
+		ctl:         ctl,
+		windowFrame: frame,
+	}, r
+}
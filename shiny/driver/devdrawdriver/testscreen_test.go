@@ -0,0 +1,54 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver_test
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/niconan/shiny-plan9/shiny/driver/devdrawdriver"
+)
+
+func TestNewTestScreen(t *testing.T) {
+	s, rec := devdrawdriver.NewTestScreen(image.Rect(0, 0, 640, 480))
+	w, err := s.NewWindow(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rec.Commands(), "b"; got != want {
+		t.Errorf("NewWindow: got messages %q, want %q", got, want)
+	}
+	rec.Reset()
+
+	// allocate a colour and the screen's solid mask, draw them, and
+	// free the colour.
+	w.Fill(image.Rect(10, 10, 20, 20), color.RGBA{0xff, 0, 0, 0xff}, draw.Src)
+	if got, want := rec.Commands(), "bbOdf"; got != want {
+		t.Errorf("Fill: got messages %q, want %q", got, want)
+	}
+	rec.Reset()
+
+	// composite the window and flush.
+	w.Publish()
+	if got, want := rec.Commands(), "Odv"; got != want {
+		t.Errorf("Publish: got messages %q, want %q", got, want)
+	}
+}
+
+func TestScreenInfo(t *testing.T) {
+	s, _ := devdrawdriver.NewTestScreen(image.Rect(0, 0, 640, 480))
+	got := s.(devdrawdriver.InfoScreen).Info()
+	want := devdrawdriver.ScreenInfo{
+		ChannelFormat: "r8g8b8a8",
+		DisplaySize:   image.Rect(0, 0, 640, 480),
+		Clipping:      image.Rect(0, 0, 640, 480),
+		IOUnitSize:    65535,
+	}
+	if got != want {
+		t.Errorf("Info() = %+v, want %+v", got, want)
+	}
+}
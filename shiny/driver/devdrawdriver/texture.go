@@ -4,17 +4,32 @@
 package devdrawdriver
 
 import (
+	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
+
+	"github.com/niconan/shiny-plan9/shiny/screen"
 )
 
 type textureId uint32
 
+// textureImpl is a texture stored in a /dev/draw image.
+//
+// The /dev/draw image of a texture always has its origin at image.ZP,
+// so texture coordinates (such as the sr passed to Draw, Copy and
+// Scale) can be used as /dev/draw source points without translation,
+// and Bounds is the rectangle of the image on the server.
 type textureImpl struct {
 	*uploadImpl
+	s    *screenImpl
 	size image.Point
 }
 
+// Bounds returns the rectangle that the texture's image was allocated
+// with, which is always rooted at image.ZP and the size passed to
+// NewTexture. What the server will draw of it, if the image has been
+// reclipped, is given by ClipRect.
 func (t *textureImpl) Bounds() image.Rectangle {
 	if t == nil {
 		return image.ZR
@@ -28,10 +43,92 @@ func (t *textureImpl) Size() image.Point {
 	return t.size
 }
 func newTextureImpl(s *screenImpl, size image.Point) *textureImpl {
-	uploader := newUploadImpl(s, image.Rectangle{image.ZP, size}, color.RGBA{0, 0, 0, 0})
+	// Bounds depends on the image being allocated at the origin.
+	uploader := newUploadImpl(s, image.Rectangle{image.ZP, size}, RefBackup, color.RGBA{0, 0, 0, 0})
+	// the image starts out transparent, the same as a new image.RGBA.
+	uploader.local = image.NewRGBA(image.Rectangle{image.ZP, size})
 	t := &textureImpl{
 		uploadImpl: uploader,
+		s:          s,
 		size:       size,
 	}
+	s.addTexture(t)
 	return t
 }
+
+// Release frees the texture's image. The screen releases any textures
+// that are left when it's released, so releasing one afterwards does
+// nothing.
+func (t *textureImpl) Release() {
+	if !t.s.removeTexture(t) {
+		return
+	}
+	t.uploadImpl.Release()
+}
+
+// DrawImage gives the /dev/draw image that holds the pixels of a window
+// or texture, so that it can be drawn into or from with draw(3) messages
+// that shiny has no equivalent for, such as strings in a font loaded by
+// the application:
+//
+//	img := w.(devdrawdriver.DrawImage)
+//	d := img.DrawController()
+//	d.SendMessage('s', msg) // msg names img.ImageID() as the destination
+//
+// The image stays owned by the window or texture, and is freed when it's
+// released, so it mustn't be freed by the caller. Since the driver can't
+// tell what messages sent with SendMessage or a DrawBatch draw into, the
+// windows are composited again on the next Publish after any of them,
+// and a texture reads its pixels back from the server once its ID has
+// been asked for. A window's image is
+// reallocated when it's resized, so its ID should be asked for again
+// after each size.Event.
+//
+// ClipRect gives the image's clipping rectangle, which the server clips
+// everything drawn into or from it to.
+type DrawImage interface {
+	ImageID() uint32
+	DrawController() *DrawCtrler
+	ClipRect() image.Rectangle
+}
+
+// ImageID returns the ID of the /dev/draw image that holds the pixels of
+// t. Since the caller may draw into it at any time afterwards, the local
+// copy of the pixels that Draw would otherwise transform is dropped for
+// good.
+func (t *textureImpl) ImageID() uint32 {
+	t.markDirty(image.Rectangle{image.ZP, t.size})
+	return t.imageId
+}
+
+// DrawController returns the connection to /dev/draw that t's image was
+// allocated on.
+func (t *textureImpl) DrawController() *DrawCtrler {
+	return t.ctl
+}
+
+// NewTextureFromImage returns a new texture of s holding the pixels of img,
+// such as an image decoded from a PNG or JPEG file. img can be any
+// image.Image, which is converted by drawing it with image/draw unless it's
+// an *image.RGBA. The top left of img's bounds is at the origin of the
+// texture.
+func NewTextureFromImage(s screen.Screen, img image.Image) (screen.Texture, error) {
+	r := img.Bounds()
+	t, err := s.NewTexture(r.Size())
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := t.(ImageUploader); ok {
+		u.UploadImage(image.ZP, img, r)
+		return t, nil
+	}
+	buf, err := s.NewBuffer(r.Size())
+	if err != nil {
+		t.Release()
+		return nil, fmt.Errorf("new texture from image: %v", err)
+	}
+	defer buf.Release()
+	draw.Draw(buf.RGBA(), buf.Bounds(), img, r.Min, draw.Src)
+	t.Upload(image.ZP, buf, buf.Bounds())
+	return t, nil
+}
@@ -0,0 +1,770 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/niconan/shiny-plan9/shiny/screen"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+func TestTextureDraw(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	src := newTextureImpl(s, image.Point{20, 20})
+	var dst screen.Drawer = newTextureImpl(s, image.Point{20, 20})
+	f.msgs = nil
+
+	dst.Copy(image.Point{2, 3}, src, image.Rect(0, 0, 10, 10), draw.Src, nil)
+	// draw.Src replaces what's there, so the mask is solid. It's
+	// allocated the first time that it's needed, and kept.
+	if got, want := f.cmds(), "bOd"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	dstID := dst.(*textureImpl).imageId
+	maskID := s.solidMask()
+	if dstID > 0xff || src.imageId > 0xff || maskID > 0xff {
+		t.Fatalf("image IDs %d, %d and %d don't fit in a byte", dstID, src.imageId, maskID)
+	}
+	// d dstid[4] srcid[4] maskid[4] dstr[4*4] srcp[2*4] maskp[2*4], all
+	// little endian, as in draw(3).
+	want := []byte{
+		'd',
+		byte(dstID), 0, 0, 0,
+		byte(src.imageId), 0, 0, 0,
+		byte(maskID), 0, 0, 0,
+		2, 0, 0, 0, 3, 0, 0, 0, 12, 0, 0, 0, 13, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+	}
+	if got := f.msgs[2]; !bytes.Equal(got, want) {
+		t.Errorf("got message % x, want % x", got, want)
+	}
+
+	// reading the texture back asks the server for the destination
+	// image's pixels.
+	f.msgs = nil
+	pix := bytes.Repeat([]byte{0xff}, 10*10*4)
+	f.reads.Write(pix)
+	got := s.ctl.ReadSubimage(dstID, image.Rect(2, 3, 12, 13))
+	if cmds := f.cmds(); cmds != "r" || binary.LittleEndian.Uint32(f.msgs[0][1:]) != dstID {
+		t.Errorf("got messages %q, want an 'r' of the texture %d", cmds, dstID)
+	}
+	if !bytes.Equal(got, pix) {
+		t.Errorf("read back pixels don't match")
+	}
+}
+
+func TestTextureBounds(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	f.msgs = nil
+	tex := newTextureImpl(s, image.Point{30, 20})
+	if got, want := tex.Bounds(), image.Rect(0, 0, 30, 20); got != want {
+		t.Errorf("Bounds: got %v, want %v", got, want)
+	}
+	// the /dev/draw image has the same rectangle.
+	if got := msgRect(f.msgs[0][15:]); got != tex.Bounds() {
+		t.Errorf("allocated %v, want %v", got, tex.Bounds())
+	}
+
+	// drawing part of it uses the same point in the texture as in
+	// sr, through a solid mask from the origin.
+	w := newWindowImpl(s, image.ZP)
+	f.msgs = nil
+	sr := image.Rect(5, 6, 15, 16)
+	w.Draw(f64.Aff3{1, 0, 40, 0, 1, 50}, tex, sr, draw.Over, nil)
+	if got, want := f.cmds(), "bOd"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	d := f.msgs[2][1:]
+	if got, want := msgRect(d[12:]), image.Rect(45, 56, 55, 66); got != want {
+		t.Errorf("dst rectangle: got %v, want %v", got, want)
+	}
+	srcp, maskp := msgPoint(d[28:]), msgPoint(d[36:])
+	if srcp != sr.Min || maskp != image.ZP {
+		t.Errorf("src and mask points: got %v, %v, want %v, %v", srcp, maskp, sr.Min, image.ZP)
+	}
+}
+
+func TestTextureReclip(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	tex := newTextureImpl(s, image.Point{30, 20})
+	f.msgs = nil
+
+	tex.reclip(image.Rect(5, 5, 10, 50))
+	if got, want := f.cmds(), "c"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	// the bounds stay rooted at the origin, with the size that the
+	// texture was created with, and the clip is kept separately.
+	if got, want := tex.Bounds(), image.Rect(0, 0, 30, 20); got != want {
+		t.Errorf("Bounds: got %v, want %v", got, want)
+	}
+	if got, want := tex.Size(), image.Pt(30, 20); got != want {
+		t.Errorf("Size: got %v, want %v", got, want)
+	}
+	if got, want := tex.ClipRect(), image.Rect(5, 5, 10, 50); got != want {
+		t.Errorf("ClipRect: got %v, want %v", got, want)
+	}
+
+	tex.reclip(image.Rect(0, 0, 30, 20))
+	if got, want := tex.ClipRect(), image.Rect(0, 0, 30, 20); got != want {
+		t.Errorf("ClipRect after reclipping to the image: got %v, want %v", got, want)
+	}
+}
+
+func TestTextureFreeResource(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	tex := newTextureImpl(s, image.Point{10, 10})
+	a := s.ctl.AllocBuffer(0, false, tex.Bounds(), tex.Bounds(), color.Black)
+	b := s.ctl.AllocBuffer(0, false, tex.Bounds(), tex.Bounds(), color.Black)
+	s.ctl.drawMu.Lock()
+	tex.addResource(a)
+	tex.addResource(b)
+
+	f.msgs = nil
+	tex.freeResource(a)
+	s.ctl.drawMu.Unlock()
+	tex.Release()
+	var freed []uint32
+	for _, m := range f.msgs {
+		if m[0] == 'f' {
+			freed = append(freed, binary.LittleEndian.Uint32(m[1:]))
+		}
+	}
+	if want := []uint32{a, b, tex.imageId}; fmt.Sprint(freed) != fmt.Sprint(want) {
+		t.Errorf("freed %v, want %v", freed, want)
+	}
+}
+
+func TestTextureReleaseTwice(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	tex := newTextureImpl(s, image.Point{10, 10})
+	a := s.ctl.AllocBuffer(0, false, tex.Bounds(), tex.Bounds(), color.Black)
+	s.ctl.drawMu.Lock()
+	tex.addResource(a)
+	s.ctl.drawMu.Unlock()
+
+	f.msgs = nil
+	tex.Release()
+	tex.Release()
+	freed := make(map[uint32]int)
+	for _, m := range f.msgs {
+		if m[0] == 'f' {
+			freed[binary.LittleEndian.Uint32(m[1:])]++
+		}
+	}
+	for _, id := range []uint32{a, tex.imageId} {
+		if freed[id] != 1 {
+			t.Errorf("freed %d %d times, want once", id, freed[id])
+		}
+	}
+	if len(freed) != 2 {
+		t.Errorf("freed %v, want only %d and %d", freed, a, tex.imageId)
+	}
+}
+
+func TestUploadReleaseConcurrently(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	tex := newTextureImpl(s, image.Point{10, 10})
+	a := s.ctl.AllocBuffer(0, false, tex.Bounds(), tex.Bounds(), color.Black)
+	s.ctl.drawMu.Lock()
+	tex.addResource(a)
+	s.ctl.drawMu.Unlock()
+	f.msgs = nil
+
+	// the screen releases the image while the application does,
+	// bypassing the screen's list of textures.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tex.uploadImpl.Release()
+		}()
+	}
+	wg.Wait()
+	if got, want := f.cmds(), "ff"; got != want {
+		t.Errorf("got messages %q, want %q", got, want)
+	}
+}
+
+func TestTextureDrawScale(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w := newWindowImpl(s, image.ZP)
+	tex := newTextureImpl(s, image.Point{10, 10})
+	// the texture was drawn into by the server, so its pixels have to
+	// be read back.
+	tex.Fill(tex.Bounds(), color.Black, draw.Src)
+	f.msgs = nil
+
+	// stretching a single column is done by the server.
+	w.Draw(f64.Aff3{20, 0, 5, 0, 1, 7}, tex, image.Rect(3, 0, 4, 10), draw.Over, nil)
+	if got, want := f.cmds(), "bOdOdf"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	d := f.msgs[4][1:]
+	if got, want := msgRect(d[12:]), image.Rect(65, 7, 85, 17); got != want {
+		t.Errorf("dst rectangle: got %v, want %v", got, want)
+	}
+
+	// but anything else needs the pixels.
+	f.msgs = nil
+	f.reads.Write(make([]byte, 10*10*4))
+	w.Draw(f64.Aff3{2, 0, 5, 0, 2, 7}, tex, tex.Bounds(), draw.Over, nil)
+	if got := f.cmds(); got[0] != 'r' {
+		t.Errorf("got messages %q, want the pixels to be read", got)
+	}
+}
+
+func TestDrawNearIdentity(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w := newWindowImpl(s, image.ZP)
+	tex := newTextureImpl(s, image.Point{10, 10})
+	// the texture was drawn into by the server, so its pixels have to
+	// be read back.
+	tex.Fill(tex.Bounds(), color.Black, draw.Src)
+	f.msgs = nil
+
+	// a translation with floating point noise is still drawn by the
+	// server, at the whole pixel it's meant to be.
+	src2dst := f64.Aff3{1 + 1e-9, 1e-9, 5 - 1e-9, -1e-9, 1 - 1e-9, 7}
+	w.Draw(src2dst, tex, tex.Bounds(), draw.Over, nil)
+	if got, want := f.cmds(), "Od"; got != want {
+		t.Fatalf("Draw: got messages %q, want %q", got, want)
+	}
+	if got, want := msgRect(f.msgs[1][13:]), image.Rect(5, 7, 15, 17); got != want {
+		t.Errorf("Draw: dst rectangle: got %v, want %v", got, want)
+	}
+
+	f.msgs = nil
+	w.DrawUniform(src2dst, color.Black, image.Rect(0, 0, 10, 10), draw.Over, nil)
+	if got, want := f.cmds(), "bOdf"; got != want {
+		t.Fatalf("DrawUniform: got messages %q, want %q", got, want)
+	}
+	if got, want := msgRect(f.msgs[2][13:]), image.Rect(5, 7, 15, 17); got != want {
+		t.Errorf("DrawUniform: dst rectangle: got %v, want %v", got, want)
+	}
+
+	// but a rotation that's visible over the texture isn't ignored.
+	f.msgs = nil
+	f.reads.Write(make([]byte, 10*10*4))
+	w.Draw(f64.Aff3{1, 1e-3, 5, -1e-3, 1, 7}, tex, tex.Bounds(), draw.Over, nil)
+	if got := f.cmds(); got[0] != 'r' {
+		t.Errorf("got messages %q, want the pixels to be read", got)
+	}
+}
+
+func TestNewTextureSize(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	for _, sz := range []image.Point{{0, 0}, {10, 0}, {0, 10}, {-1, 10}, {10, -5}} {
+		if tex, err := s.NewTexture(sz); err == nil {
+			t.Errorf("NewTexture(%v) = %v, want an error", sz, tex)
+		}
+	}
+	if len(f.msgs) != 0 {
+		t.Errorf("sent messages %q for invalid textures, want none", f.cmds())
+	}
+	if _, err := s.NewTexture(image.Point{1, 1}); err != nil {
+		t.Errorf("NewTexture(1, 1): %v", err)
+	}
+}
+
+func TestNewBufferSize(t *testing.T) {
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	for _, sz := range []image.Point{{0, 0}, {10, 0}, {0, 10}, {-1, 10}, {10, -5}} {
+		b, err := s.NewBuffer(sz)
+		if err == nil {
+			t.Errorf("NewBuffer(%v) = %v, want an error", sz, b)
+		} else if !strings.Contains(err.Error(), "invalid size") {
+			t.Errorf("NewBuffer(%v): got error %v, want one about the size", sz, err)
+		}
+	}
+	if _, err := s.NewBuffer(image.Point{1, 1}); err != nil {
+		t.Errorf("NewBuffer(1, 1): %v", err)
+	}
+}
+
+func TestBufferStride(t *testing.T) {
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	b, err := s.NewBuffer(image.Point{7, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.(StridedBuffer).Stride(), b.RGBA().Stride; got != want {
+		t.Errorf("Stride() = %d, want %d", got, want)
+	}
+}
+
+func TestBufferCopyFrom(t *testing.T) {
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	b, err := s.NewBuffer(image.Point{4, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a gray image that's smaller than the buffer, and not at the origin.
+	src := image.NewGray(image.Rect(10, 20, 13, 22))
+	src.SetGray(10, 20, color.Gray{0x80})
+	if err := b.(CopyBuffer).CopyFrom(src); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.RGBA().RGBAAt(0, 0), (color.RGBA{0x80, 0x80, 0x80, 0xff}); got != want {
+		t.Errorf("pixel (0, 0) = %v, want %v", got, want)
+	}
+	if got, want := b.RGBA().RGBAAt(1, 0), (color.RGBA{0, 0, 0, 0xff}); got != want {
+		t.Errorf("pixel (1, 0) = %v, want %v", got, want)
+	}
+	if got := b.RGBA().RGBAAt(3, 2); got != (color.RGBA{}) {
+		t.Errorf("pixel (3, 2) = %v outside of src, want it unchanged", got)
+	}
+
+	b.Release()
+	if err := b.(CopyBuffer).CopyFrom(src); err == nil {
+		t.Errorf("CopyFrom succeeded after Release")
+	}
+}
+
+func TestNewTextureFromImage(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+
+	// a paletted image, which isn't at the origin.
+	r := image.Rect(10, 20, 14, 23)
+	pal := color.Palette{color.RGBA{0, 0, 0, 0xff}, color.RGBA{0x10, 0x20, 0x30, 0xff}}
+	img := image.NewPaletted(r, pal)
+	img.SetColorIndex(11, 21, 1)
+	want := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	draw.Draw(want, want.Rect, img, r.Min, draw.Src)
+
+	tex, err := NewTextureFromImage(s, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tex.Bounds(); got != want.Rect {
+		t.Errorf("got bounds %v, want %v", got, want.Rect)
+	}
+	if got := f.cmds(); got != "by" {
+		t.Fatalf("got messages %q, want an allocation and an upload", got)
+	}
+	if got := replay(t, f.msgs[1:], want.Rect); !bytes.Equal(got.Pix, want.Pix) {
+		t.Errorf("uploaded %x, want %x", got.Pix, want.Pix)
+	}
+
+	if _, err := NewTextureFromImage(s, image.NewRGBA(image.Rect(5, 5, 5, 10))); err == nil {
+		t.Errorf("expected an error for an empty image")
+	}
+}
+
+func TestUploadImage(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	tex := newTextureImpl(s, image.Point{8, 6})
+
+	// images which aren't at the origin, with translucent pixels that
+	// an *image.NRGBA has to be converted for.
+	r := image.Rect(10, 20, 16, 24)
+	rgba := image.NewRGBA(r)
+	nrgba := image.NewNRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := color.NRGBA{uint8(x * 10), uint8(y * 5), 0x40, 0x80}
+			rgba.Set(x, y, c)
+			nrgba.Set(x, y, c)
+		}
+	}
+	for _, img := range []image.Image{rgba, nrgba} {
+		for _, tc := range []struct {
+			dp image.Point
+			sr image.Rectangle
+			// where the pixels from sp should end up.
+			dr image.Rectangle
+			sp image.Point
+		}{
+			{image.Pt(1, 2), image.Rect(11, 21, 15, 23), image.Rect(1, 2, 5, 4), image.Pt(11, 21)},
+			// only the part inside the image is uploaded, at the same
+			// place.
+			{image.Pt(0, 0), image.Rect(8, 18, 14, 22), image.Rect(2, 2, 6, 4), image.Pt(10, 20)},
+		} {
+			f.msgs = nil
+			tex.UploadImage(tc.dp, img, tc.sr)
+			if got := f.cmds(); got != "y" {
+				t.Fatalf("%T: got messages %q, want one upload", img, got)
+			}
+			want := image.NewRGBA(tc.dr)
+			draw.Draw(want, tc.dr, img, tc.sp, draw.Src)
+			if got := replay(t, f.msgs, tc.dr); !bytes.Equal(got.Pix, want.Pix) {
+				t.Errorf("%T: uploaded %v of it at %v as %x, want %x", img, tc.sr, tc.dp, got.Pix, want.Pix)
+			}
+		}
+	}
+}
+
+func TestUploadStraightAlpha(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	tex := newTextureImpl(s, image.Point{2, 1})
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{0xff, 0x80, 0x00, 0x80})
+	img.SetNRGBA(1, 0, color.NRGBA{0x40, 0xff, 0x20, 0x00})
+	f.msgs = nil
+
+	tex.UploadImage(image.ZP, img, img.Bounds())
+	// the colours are multiplied by alpha, as /dev/draw expects, and a
+	// transparent pixel has no colour left.
+	want := []byte{0x80, 0x40, 0x00, 0x80, 0, 0, 0, 0}
+	if got := replay(t, f.msgs, img.Bounds()); !bytes.Equal(got.Pix, want) {
+		t.Errorf("uploaded % x, want % x", got.Pix, want)
+	}
+}
+
+func TestUploadReleasedBuffer(t *testing.T) {
+	l := useLogger(t)
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	tex := newTextureImpl(s, image.Point{4, 4})
+	buf, _ := s.NewBuffer(image.Point{4, 4})
+	buf.Release()
+	f.msgs = nil
+
+	tex.Upload(image.ZP, buf, image.Rect(0, 0, 4, 4))
+	if len(f.msgs) != 0 {
+		t.Errorf("got messages %q for a released buffer", f.cmds())
+	}
+	if len(l.errors) != 1 || !strings.Contains(l.errors[0], "released") {
+		t.Errorf("got errors %q, want one about the released buffer", l.errors)
+	}
+}
+
+func TestTextureDrawRotatedSubimage(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	src := newTextureImpl(s, image.Point{10, 10})
+	// the texture was drawn into by the server, so its pixels have to
+	// be read back.
+	src.Fill(src.Bounds(), color.Black, draw.Src)
+	dst := newTextureImpl(s, image.Point{20, 20})
+	full := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			full.SetRGBA(x, y, color.RGBA{uint8(x * 20), uint8(y * 20), 0, 0xff})
+		}
+	}
+	// a quarter turn of part of the texture that isn't at its origin.
+	sr := image.Rect(4, 2, 7, 4)
+	src2dst := f64.Aff3{0, -1, 10, 1, 0, 0}
+	f.msgs = nil
+	// the pixels of sr are read back from the server.
+	for y := sr.Min.Y; y < sr.Max.Y; y++ {
+		f.reads.Write(full.Pix[full.PixOffset(sr.Min.X, y):full.PixOffset(sr.Max.X, y)])
+	}
+	dst.Draw(src2dst, src, sr, draw.Src, nil)
+
+	want := image.NewRGBA(image.Rect(6, 4, 8, 7))
+	xdraw.NearestNeighbor.Transform(want, src2dst, full, sr, xdraw.Src, nil)
+	var upload [][]byte
+	for _, m := range f.msgs {
+		if m[0] == 'y' {
+			upload = append(upload, m)
+		}
+	}
+	got := replay(t, upload, image.Rect(0, 0, 2, 3))
+	if !bytes.Equal(got.Pix, want.Pix) {
+		t.Errorf("uploaded %x, want %x", got.Pix, want.Pix)
+	}
+	// the result is drawn where sr is transformed to.
+	drawn := false
+	for _, m := range f.msgs {
+		if m[0] == 'd' && binary.LittleEndian.Uint32(m[1:]) == dst.imageId {
+			drawn = true
+			if r := msgRect(m[13:]); r != want.Rect {
+				t.Errorf("drew into %v, want %v", r, want.Rect)
+			}
+		}
+	}
+	if !drawn {
+		t.Errorf("got messages %q, want a 'd' into the texture", f.cmds())
+	}
+	// and the transformed image is freed after it's been drawn.
+	if got, want := f.cmds()[len(f.msgs)-1], byte('f'); got != want {
+		t.Errorf("got messages %q, want them to end with %c", f.cmds(), want)
+	}
+	if ids := s.ctl.LiveIDs(); len(ids) != 3 {
+		t.Errorf("live images %v after Draw, want only the two textures and the solid mask", ids)
+	}
+}
+
+func TestTextureDrawLocalCopy(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	src := newTextureImpl(s, image.Point{10, 10})
+	dst := newTextureImpl(s, image.Point{20, 20})
+	b, _ := s.NewBuffer(image.Point{10, 10})
+	full := b.RGBA()
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			full.SetRGBA(x, y, color.RGBA{uint8(x * 20), uint8(y * 20), 0, 0xff})
+		}
+	}
+	// the texture has only been uploaded to, half from a buffer and half
+	// from an image.
+	src.Upload(image.ZP, b, image.Rect(0, 0, 10, 5))
+	src.UploadImage(image.Pt(0, 5), full, image.Rect(0, 5, 10, 10))
+	sr := image.Rect(4, 2, 7, 8)
+	src2dst := f64.Aff3{0, -1, 10, 1, 0, 0}
+	f.msgs = nil
+	dst.Draw(src2dst, src, sr, draw.Src, nil)
+
+	// so its pixels are transformed without being read back.
+	if got, want := f.cmds(), "bybOdf"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	want := image.NewRGBA(affineTransform(src2dst, sr))
+	xdraw.NearestNeighbor.Transform(want, src2dst, full, sr, xdraw.Src, nil)
+	if got := replay(t, f.msgs[1:2], image.Rectangle{image.ZP, want.Rect.Size()}); !bytes.Equal(got.Pix, want.Pix) {
+		t.Errorf("uploaded %x, want %x", got.Pix, want.Pix)
+	}
+
+	// once the server has drawn into it, only the server has its pixels.
+	src.Fill(image.Rect(0, 0, 1, 1), color.White, draw.Src)
+	f.msgs = nil
+	f.reads.Write(make([]byte, sr.Dx()*sr.Dy()*4))
+	dst.Draw(src2dst, src, sr, draw.Src, nil)
+	if got := f.cmds(); got[0] != 'r' {
+		t.Errorf("got messages %q after a Fill, want the pixels to be read", got)
+	}
+}
+
+func TestTextureFillOffset(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	tex := newTextureImpl(s, image.Point{20, 20})
+	dr := image.Rect(5, 7, 12, 15)
+	f.msgs = nil
+	tex.Fill(dr, color.White, draw.Src)
+
+	// the source and mask are read from sp and mp, not from dr, so their
+	// clipping rectangles are rooted at the origin. The server draws the
+	// part of dr where each of them, moved to dr, overlaps.
+	clips := make(map[uint32]image.Rectangle)
+	var d []byte
+	for _, m := range f.msgs {
+		switch m[0] {
+		case 'b':
+			clips[binary.LittleEndian.Uint32(m[1:])] = msgRect(m[31:])
+		case 'd':
+			d = m
+		}
+	}
+	if d == nil {
+		t.Fatalf("got messages %q, want a draw", f.cmds())
+	}
+	if got := msgRect(d[13:]); got != dr {
+		t.Errorf("drew into %v, want %v", got, dr)
+	}
+	drawn := dr.Intersect(tex.Bounds())
+	for i, off := range []int{5, 9} {
+		id := binary.LittleEndian.Uint32(d[off:])
+		p := msgPoint(d[29+8*i:])
+		drawn = drawn.Intersect(clips[id].Add(dr.Min.Sub(p)))
+	}
+	if drawn != dr {
+		t.Errorf("the fill covers %v, want exactly %v", drawn, dr)
+	}
+}
+
+func TestDamage(t *testing.T) {
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	src := newTextureImpl(s, image.Point{10, 10})
+	dst := newTextureImpl(s, image.Point{40, 40})
+	b, _ := s.NewBuffer(image.Point{10, 10})
+	src.Upload(image.ZP, b, b.Bounds())
+	var r DamageReporter = dst
+	if got := r.Damage(); got != image.ZR {
+		t.Errorf("new texture: got damage %v, want none", got)
+	}
+
+	rotate := f64.Aff3{0, -1, 10, 1, 0, 0}
+	for _, tc := range []struct {
+		name string
+		op   func()
+		want image.Rectangle
+	}{
+		{"Upload", func() { dst.Upload(image.Pt(5, 6), b, image.Rect(2, 3, 6, 10)) }, image.Rect(5, 6, 9, 13)},
+		{"Fill", func() { dst.Fill(image.Rect(1, 2, 3, 4), color.White, draw.Src) }, image.Rect(1, 2, 3, 4)},
+		{"Fill clipped", func() { dst.Fill(image.Rect(30, 30, 50, 50), color.White, draw.Src) }, image.Rect(30, 30, 40, 40)},
+		{"Draw", func() { dst.Draw(f64.Aff3{1, 0, 20, 0, 1, 10}, src, image.Rect(2, 2, 6, 4), draw.Src, nil) }, image.Rect(22, 12, 26, 14)},
+		{"Draw rotated", func() { dst.Draw(rotate, src, image.Rect(4, 2, 7, 8), draw.Src, nil) }, affineTransform(rotate, image.Rect(4, 2, 7, 8))},
+	} {
+		tc.op()
+		if got := r.Damage(); got != tc.want {
+			t.Errorf("%s: got damage %v, want %v", tc.name, got, tc.want)
+		}
+		if got := r.Damage(); got != image.ZR {
+			t.Errorf("%s: got damage %v the second time, want none", tc.name, got)
+		}
+	}
+
+	// damage accumulates until it's asked for.
+	dst.Fill(image.Rect(0, 0, 2, 2), color.White, draw.Src)
+	dst.Fill(image.Rect(10, 10, 12, 12), color.White, draw.Src)
+	if got, want := r.Damage(), image.Rect(0, 0, 12, 12); got != want {
+		t.Errorf("two fills: got damage %v, want %v", got, want)
+	}
+}
+
+func TestTextureScaleRepl(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w := newWindowImpl(s, image.ZP)
+	tex := newTextureImpl(s, image.Point{10, 10})
+	// the pixels are only on the server, so none of this can be done
+	// on the CPU without reading them back.
+	tex.Fill(tex.Bounds(), color.Black, draw.Src)
+	f.msgs = nil
+
+	// a single row is stretched down dr by a replicated copy of it.
+	dr := image.Rect(20, 30, 30, 70)
+	w.Scale(dr, tex, image.Rect(0, 4, 10, 5), draw.Over, nil)
+	if got, want := f.cmds(), "bOdOdf"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	b := f.msgs[0]
+	if b[14] != 1 {
+		t.Errorf("the row's copy isn't replicated")
+	}
+	if got, want := msgRect(b[15:]), image.Rect(0, 0, 10, 1); got != want {
+		t.Errorf("copy's rectangle: got %v, want %v", got, want)
+	}
+	if got, want := msgRect(b[31:]), image.Rect(0, 0, 10, 40); got != want {
+		t.Errorf("copy's clipr: got %v, want %v", got, want)
+	}
+	d := f.msgs[4][1:]
+	if got, want := msgRect(d[12:]), dr; got != want {
+		t.Errorf("dst rectangle: got %v, want %v", got, want)
+	}
+
+	// an unscaled draw is a single 'd' from the texture.
+	f.msgs = nil
+	w.Scale(dr, tex, image.Rect(0, 0, 10, 40), draw.Over, nil)
+	if got, want := f.cmds(), "Od"; got != want {
+		t.Errorf("unscaled: got messages %q, want %q", got, want)
+	}
+
+	// halving it draws every other column into a copy, and then every
+	// other row of that.
+	f.msgs = nil
+	w.Scale(image.Rect(0, 0, 5, 5), tex, tex.Bounds(), draw.Over, nil)
+	if got, want := f.cmds(), "b"+strings.Repeat("Od", 10)+"f"; got != want {
+		t.Errorf("halved: got messages %q, want %q", got, want)
+	}
+
+	// anything else that shrinks it reads the pixels back.
+	f.msgs = nil
+	f.reads.Write(make([]byte, 10*10*4))
+	w.Scale(image.Rect(0, 0, 4, 4), tex, tex.Bounds(), draw.Over, nil)
+	if got := f.cmds(); got == "" || got[0] != 'r' {
+		t.Errorf("downscale: got messages %q, want the pixels to be read", got)
+	}
+}
+
+func TestTextureScalePixels(t *testing.T) {
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	// each 2x2 block of the texture is a different half transparent
+	// colour, so that halving it picks one colour from each block.
+	colors := [2][2]color.RGBA{
+		{{0x80, 0, 0, 0x80}, {0, 0x80, 0, 0x80}},
+		{{0x40, 0x40, 0, 0x80}, {0, 0, 0, 0x80}},
+	}
+	over := func(c color.RGBA) color.RGBA {
+		return color.RGBA{c.R, c.G, c.B + 0x7f, 0xff}
+	}
+	for _, tc := range []struct {
+		name   string
+		dr, sr image.Rectangle
+		op     draw.Op
+		// want is the colour at dr.Min.Add(p) for each point p.
+		want map[image.Point]color.RGBA
+	}{
+		{
+			// a row is stretched on the server, by replicating it.
+			name: "replicated, over", dr: image.Rect(10, 10, 14, 20), sr: image.Rect(0, 1, 4, 2), op: draw.Over,
+			want: map[image.Point]color.RGBA{
+				{0, 0}: over(colors[0][0]), {3, 9}: over(colors[0][1]),
+			},
+		},
+		{
+			name: "replicated, src", dr: image.Rect(10, 10, 14, 20), sr: image.Rect(0, 1, 4, 2), op: draw.Src,
+			want: map[image.Point]color.RGBA{
+				{0, 0}: colors[0][0], {3, 9}: colors[0][1],
+			},
+		},
+		{
+			// halving it picks every other column and row on the
+			// server.
+			name: "halved, over", dr: image.Rect(20, 20, 22, 22), sr: image.Rect(0, 0, 4, 4), op: draw.Over,
+			want: map[image.Point]color.RGBA{
+				{0, 0}: over(colors[0][0]), {1, 0}: over(colors[0][1]),
+				{0, 1}: over(colors[1][0]), {1, 1}: over(colors[1][1]),
+			},
+		},
+		{
+			name: "halved, src", dr: image.Rect(20, 20, 22, 22), sr: image.Rect(0, 0, 4, 4), op: draw.Src,
+			want: map[image.Point]color.RGBA{
+				{0, 0}: colors[0][0], {1, 0}: colors[0][1],
+				{0, 1}: colors[1][0], {1, 1}: colors[1][1],
+			},
+		},
+		{
+			// only the columns are picked.
+			name: "halved across", dr: image.Rect(20, 20, 22, 24), sr: image.Rect(0, 0, 4, 4), op: draw.Over,
+			want: map[image.Point]color.RGBA{
+				{0, 0}: over(colors[0][0]), {1, 1}: over(colors[0][1]),
+				{0, 2}: over(colors[1][0]), {1, 3}: over(colors[1][1]),
+			},
+		},
+		{
+			// only the rows are picked.
+			name: "halved down", dr: image.Rect(20, 20, 24, 22), sr: image.Rect(0, 0, 4, 4), op: draw.Src,
+			want: map[image.Point]color.RGBA{
+				{1, 0}: colors[0][0], {2, 0}: colors[0][1],
+				{0, 1}: colors[1][0], {3, 1}: colors[1][1],
+			},
+		},
+		{
+			// a quarter of the texture on each axis is the middle
+			// pixel of each block of 4.
+			name: "quartered", dr: image.Rect(20, 20, 21, 21), sr: image.Rect(0, 0, 4, 4), op: draw.Src,
+			want: map[image.Point]color.RGBA{
+				{0, 0}: colors[1][1],
+			},
+		},
+	} {
+		s, f := newTestScreen(65535, image.Rect(0, 0, 40, 40))
+		s.opts.BackgroundColor = blue
+		w := newWindowImpl(s, image.ZP)
+		tex := newTextureImpl(s, image.Point{4, 4})
+		buf, _ := s.NewBuffer(image.Point{4, 4})
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 4; x++ {
+				buf.RGBA().SetRGBA(x, y, colors[y/2][x/2])
+			}
+		}
+		tex.Upload(image.ZP, buf, buf.Bounds())
+
+		w.Scale(tc.dr, tex, tc.sr, tc.op, nil)
+		img := renderImages(f.msgs, image.NewRGBA(image.Rect(0, 0, 40, 40)))[w.imageId]
+		for p, want := range tc.want {
+			p = tc.dr.Min.Add(p)
+			if got := img.RGBAAt(p.X, p.Y); got != want {
+				t.Errorf("%s: got %v at %v, want %v", tc.name, got, p, want)
+			}
+		}
+		// nothing outside dr is drawn.
+		if got := img.RGBAAt(tc.dr.Max.X, tc.dr.Max.Y); got != blue {
+			t.Errorf("%s: got %v at %v outside %v, want the background", tc.name, got, tc.dr.Max, tc.dr)
+		}
+	}
+}
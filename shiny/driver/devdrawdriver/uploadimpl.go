@@ -17,23 +17,184 @@ import (
 type uploadImpl struct {
 	// writer to /dev/draw/n/data
 	ctl *DrawCtrler
+	// the screen that the image belongs to, for its solid mask.
+	s *screenImpl
 	// the imageId that represents this image in /dev/draw.
 	imageId uint32
 	// resources that were allocated which need to be
-	// freed upon release.
+	// freed upon release. Anything in it that's no longer
+	// needed before then must be freed with freeResource,
+	// so that Release doesn't free it a second time.
+	// Protected by ctl.drawMu.
 	resources []uint32
+	// scratch space for reading pixels back from /dev/draw, which
+	// is reused by Draw between calls.
+	scratch []byte
+	// released is set by Release, so that the IDs aren't freed a second
+	// time, which /dev/draw rejects as an unknown image. Protected by
+	// ctl.drawMu, since the screen releases what the application
+	// hasn't when it's released, which can be while the application is
+	// releasing the same image.
+	released bool
+	// dirty is set when the image is drawn into, and cleared when a
+	// window is composited onto the screen. Protected by ctl.drawMu.
+	dirty bool
+	// clipr is the clipping rectangle of the image on the server, as it
+	// was allocated or last changed by reclip. Protected by ctl.drawMu.
+	clipr image.Rectangle
+	// local is a copy of a texture's pixels, which is kept up to date
+	// by Upload and UploadImage so that Draw can transform them without
+	// reading them back from the server. It's nil for windows, and once
+	// the texture has been drawn into in any other way, since only the
+	// server knows the result. Protected by ctl.drawMu.
+	local *image.RGBA
+	// damage is the smallest rectangle containing everything that's
+	// been drawn into the image since the last call to Damage.
+	// Protected by ctl.drawMu.
+	damage image.Rectangle
 }
 
+// reclip changes the clipping rectangle of u's image to r, and keeps
+// track of it so that ClipRect matches the server.
+func (u *uploadImpl) reclip(r image.Rectangle) {
+	u.ctl.Reclip(u.imageId, false, r)
+	u.ctl.drawMu.Lock()
+	u.clipr = r.Canon()
+	u.ctl.drawMu.Unlock()
+}
+
+// ClipRect returns the clipping rectangle of u's image, in the image's
+// coordinates. It's the whole image unless it has been reclipped, such as
+// a window's image after the Plan 9 window shrinks.
+func (u *uploadImpl) ClipRect() image.Rectangle {
+	u.ctl.drawMu.Lock()
+	defer u.ctl.drawMu.Unlock()
+	return u.clipr
+}
+
+// markDirty records that the rectangle r of u is about to be drawn into
+// by the server, which makes any local copy of its pixels out of date.
+func (u *uploadImpl) markDirty(r image.Rectangle) {
+	u.ctl.drawMu.Lock()
+	u.dirty = true
+	u.local = nil
+	u.addDamageLocked(r)
+	u.ctl.drawMu.Unlock()
+}
+
+// markUploaded is like markDirty, but for when the rectangle dr is about
+// to be replaced by the pixels of src, which are copied into the local
+// copy if there is one.
+func (u *uploadImpl) markUploaded(dr image.Rectangle, src *image.RGBA) {
+	u.ctl.drawMu.Lock()
+	defer u.ctl.drawMu.Unlock()
+	u.dirty = true
+	u.addDamageLocked(dr)
+	if u.local != nil {
+		draw.Draw(u.local, dr, src, src.Rect.Min, draw.Src)
+	}
+}
+
+// addDamageLocked adds the part of r that's inside the image's clipping
+// rectangle, which is all that the server can draw, to u.damage. It must
+// be called with ctl.drawMu held.
+func (u *uploadImpl) addDamageLocked(r image.Rectangle) {
+	u.damage = u.damage.Union(r.Canon().Intersect(u.clipr))
+}
+
+// DamageReporter tells what Upload, Fill, Draw and the other drawing
+// methods of a window or texture have touched, in the image's
+// coordinates, for callers that keep track of what needs repainting
+// themselves:
+//
+//	r := w.(devdrawdriver.DamageReporter).Damage()
+type DamageReporter interface {
+	Damage() image.Rectangle
+}
+
+// Damage returns the smallest rectangle containing everything that has
+// been drawn into the image since the last call, or since it was created,
+// and starts again from nothing. For methods whose result isn't known
+// until the server has drawn it, such as DrawString, it's the whole image.
+func (u *uploadImpl) Damage() image.Rectangle {
+	u.ctl.drawMu.Lock()
+	defer u.ctl.drawMu.Unlock()
+	r := u.damage
+	u.damage = image.ZR
+	return r
+}
+
+// restoreLocal uploads the local copy of u's pixels into its image, if
+// there is one and u hasn't been released, such as after the image was
+// allocated again on a new connection.
+func (u *uploadImpl) restoreLocal() {
+	u.ctl.drawMu.Lock()
+	defer u.ctl.drawMu.Unlock()
+	if u.released || u.local == nil {
+		return
+	}
+	u.ctl.replaceRGBA(u.imageId, u.local.Rect, u.local)
+}
+
+// readLocal copies the pixels of the rectangle r from the local copy into
+// dst, tightly packed like ReadSubimageInto. It returns false if there's no
+// local copy, or r isn't inside it.
+func (u *uploadImpl) readLocal(r image.Rectangle, dst []byte) bool {
+	u.ctl.drawMu.Lock()
+	defer u.ctl.drawMu.Unlock()
+	if u.local == nil || !r.In(u.local.Rect) {
+		return false
+	}
+	n := 4 * r.Dx()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := u.local.PixOffset(r.Min.X, y)
+		copy(dst[(y-r.Min.Y)*n:], u.local.Pix[i:i+n])
+	}
+	return true
+}
+
+// addResource records that id should be freed when u is released. It
+// must be called with ctl.drawMu held.
+func (u *uploadImpl) addResource(id uint32) {
+	u.ctl.own(id)
+	u.resources = append(u.resources, id)
+}
+
+// freeResource frees id now, and removes it from the resources that are
+// freed when u is released. It must be called with ctl.drawMu held.
+func (u *uploadImpl) freeResource(id uint32) {
+	for i, r := range u.resources {
+		if r == id {
+			u.resources = append(u.resources[:i], u.resources[i+1:]...)
+			break
+		}
+	}
+	u.ctl.FreeID(id)
+}
+
+// Release frees the image and any resources that were allocated for it.
+// It's safe to call more than once, only the first call does anything.
 func (u *uploadImpl) Release() {
+	u.ctl.drawMu.Lock()
+	defer u.ctl.drawMu.Unlock()
+	if u.released {
+		return
+	}
+	u.released = true
 	for _, id := range u.resources {
 		u.ctl.FreeID(id)
 	}
+	u.resources = nil
 	u.ctl.FreeID(u.imageId)
 }
 
+// Upload can't return an error, since its signature is fixed by
+// screen.Uploader, so a buffer that has already been released is logged as
+// an error instead of being silently ignored.
 func (u *uploadImpl) Upload(dp image.Point, src screen.Buffer, sr image.Rectangle) {
 	img := src.RGBA()
 	if img == nil {
+		Log.Errorf("upload: buffer has been released")
 		return
 	}
 	// get an image.RGBA referencing sr of Buffer.
@@ -44,30 +205,76 @@ func (u *uploadImpl) Upload(dp image.Point, src screen.Buffer, sr image.Rectangl
 		Min: dp,
 		Max: dp.Add(sr.Size()),
 	}
-	u.ctl.ReplaceSubimage(u.imageId, dr, subimage.Pix)
+	u.markUploaded(dr, subimage)
+	u.ctl.replaceRGBA(u.imageId, dr, subimage)
+}
+
+// ImageUploader uploads an image that the caller already has, such as
+// one that was just decoded, into a window or texture without copying it
+// into a screen.Buffer first:
+//
+//	w.(devdrawdriver.ImageUploader).UploadImage(dp, img, img.Bounds())
+type ImageUploader interface {
+	UploadImage(dp image.Point, img image.Image, sr image.Rectangle)
+}
+
+// UploadImage is like Upload, but takes any image. An *image.RGBA is sent
+// as it is, and anything else is converted to one first by premultipliedRGBA.
+// Only the part of sr which is inside img's bounds is uploaded.
+func (u *uploadImpl) UploadImage(dp image.Point, img image.Image, sr image.Rectangle) {
+	clipped := sr.Intersect(img.Bounds())
+	if clipped.Empty() {
+		return
+	}
+	dp = dp.Add(clipped.Min.Sub(sr.Min))
+	sr = clipped
+
+	rgba := premultipliedRGBA(img, sr)
+	dr := image.Rectangle{dp, dp.Add(sr.Size())}
+	u.markUploaded(dr, rgba)
+	u.ctl.replaceRGBA(u.imageId, dr, rgba)
+}
+
+// premultipliedRGBA returns the part r of img as an *image.RGBA, which
+// has the alpha premultiplied pixels that /dev/draw expects. Images with
+// straight alpha, such as an *image.NRGBA decoded from a PNG, would be
+// composited wrongly if their pixels were sent as they are, so they're
+// converted through their colour model. An *image.RGBA is already
+// premultiplied, and isn't copied.
+func premultipliedRGBA(img image.Image, r image.Rectangle) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba.SubImage(r).(*image.RGBA)
+	}
+	rgba := image.NewRGBA(r)
+	draw.Draw(rgba, r, img, r.Min, draw.Src)
+	return rgba
 }
 
 func (u *uploadImpl) Fill(dr image.Rectangle, src color.Color, op draw.Op) {
+	u.markDirty(dr)
 	// create a new buffer with the appropriate colour and the appropriate
-	// size.
+	// size. It's read from image.ZP, which the server lines up with
+	// dr.Min, so its clipping rectangle is rooted there and not at dr.
 	rect := image.Rectangle{image.ZP, dr.Size()}
 	fillID := u.ctl.AllocBuffer(0, true, image.Rectangle{image.Point{0, 0}, image.Point{1, 1}}, rect, src)
-	// we need a mask with the same shape, but a solid alpha channel.
-	maskID := u.ctl.AllocBuffer(0, true, image.Rectangle{image.ZP, image.Point{1, 1}}, rect, color.Black)
-	defer u.ctl.FreeID(maskID)
 	defer u.ctl.FreeID(fillID)
 
-	// then draw it on top of this image.
-	u.ctl.Draw(uint32(u.imageId), fillID, maskID, dr, image.ZP, image.ZP, op)
+	// then draw it on top of this image, through a solid mask.
+	u.ctl.Draw(uint32(u.imageId), fillID, u.s.solidMask(), dr, image.ZP, image.ZP, op)
 }
 
-func newUploadImpl(s *screenImpl, size image.Rectangle, c color.Color) *uploadImpl {
+func newUploadImpl(s *screenImpl, size image.Rectangle, refresh byte, c color.Color) *uploadImpl {
 	// allocate a /dev/draw image id to represent this image.
-	imageId := s.ctl.AllocBuffer(0, false, size, size, c)
+	imageId := s.ctl.AllocBuffer(refresh, false, size, size, c)
+	s.ctl.own(imageId)
 
 	return &uploadImpl{
 		ctl:       s.ctl,
+		s:         s,
 		imageId:   imageId,
 		resources: make([]uint32, 0),
+		// the image hasn't been shown yet.
+		dirty: true,
+		clipr: size,
 	}
 }
@@ -7,7 +7,9 @@ package devdrawdriver
 import (
 	"fmt"
 	"image"
+	"io"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -15,22 +17,147 @@ import (
 // size. This is done once on startup to figure out the frame
 // that will be used for drawing into, and after every resize
 // event that comes from /dev/mouse to establish the new viewport.
-func readWctl() (image.Rectangle, error) {
-	ctl, err := os.OpenFile("/dev/wctl", os.O_RDWR, 0644)
+//
+// border is the width of the window system's border around the window,
+// which is excluded from the returned rectangle.
+func readWctl(border int) (image.Rectangle, error) {
+	ctl, err := openDev("wctl", os.O_RDWR)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting current window status.\n")
+		Log.Errorf("Error getting current window status.")
 		return image.ZR, err
 	}
 	defer ctl.Close()
-	value := make([]byte, 1024) // 1024 should be enough..
-	_, err = ctl.Read(value)
-	if err != nil {
-		return image.ZR, err
+	return parseWctl(ctl, border)
+}
+
+// wctlFieldWidth is the width of each number in the state read from
+// /dev/wctl, which rio writes as %11d followed by a space.
+const wctlFieldWidth = 12
+
+// parseWctl does the work of readWctl for the already open /dev/wctl in r.
+// 9P doesn't guarantee that the state is returned by a single read, so
+// it reads until it has the 4 numbers of the window's rectangle. It
+// doesn't read any further, since a read of /dev/wctl after the state
+// blocks until the state changes.
+func parseWctl(r io.Reader, border int) (image.Rectangle, error) {
+	value := make([]byte, 0, 1024) // 1024 should be enough..
+	for len(value) < 4*wctlFieldWidth {
+		n, err := r.Read(value[len(value):cap(value)])
+		value = value[:len(value)+n]
+		if err == io.EOF || (n == 0 && err == nil) {
+			break
+		}
+		if err != nil {
+			return image.ZR, err
+		}
+	}
+	if len(value) < 4*wctlFieldWidth {
+		return image.ZR, fmt.Errorf("invalid window size in /dev/wctl: %q", value)
+	}
+	// each number has to take up its whole field, since one that was cut
+	// short can still look like a number. The numbers can be negative,
+	// since a window can be partly off the display.
+	var c [4]int
+	for i := range c {
+		field := value[i*wctlFieldWidth : (i+1)*wctlFieldWidth]
+		if field[wctlFieldWidth-1] != ' ' {
+			return image.ZR, fmt.Errorf("invalid window size in /dev/wctl: %q", value)
+		}
+		var err error
+		if c[i], err = strconv.Atoi(strings.TrimSpace(string(field))); err != nil {
+			return image.ZR, fmt.Errorf("invalid window size in /dev/wctl: %q", value)
+		}
 	}
-	sizes := strings.Fields(string(value))
-	// remove 4 pixels from each side to take rio's borders into consideration.
+	if c[2] < c[0] || c[3] < c[1] {
+		return image.ZR, fmt.Errorf("invalid window size in /dev/wctl: %q", value)
+	}
+	// remove the border from each side.
 	return image.Rectangle{
-		Min: image.Point{strToInt(sizes[0]) + 4, strToInt(sizes[1]) + 4},
-		Max: image.Point{strToInt(sizes[2]) - 4, strToInt(sizes[3]) - 4},
+		Min: image.Point{c[0] + border, c[1] + border},
+		Max: image.Point{c[2] - border, c[3] - border},
 	}, nil
 }
+
+// completeFields returns the number of fields in b which are followed by
+// white space, so that they can't be continued by the next read.
+func completeFields(b []byte) int {
+	n := 0
+	inField := false
+	for _, c := range b {
+		switch c {
+		case ' ', '\t', '\n':
+			if inField {
+				n++
+			}
+			inField = false
+		default:
+			inField = true
+		}
+	}
+	return n
+}
+
+// resizeWctl asks the window system to move the Plan 9 window to r,
+// including its border, by writing a resize command to /dev/wctl as
+// described in rio(4).
+func resizeWctl(r image.Rectangle) error {
+	ctl, err := openDev("wctl", os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer ctl.Close()
+	_, err = fmt.Fprintf(ctl, "resize -r %d %d %d %d", r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+	return err
+}
+
+// wctlEventHandler runs in a go routine to make blocking reads from
+// /dev/wctl, which returns a new message every time the state of the
+// Plan 9 window changes, and updates the focus of the shiny windows when
+// the Plan 9 window becomes or stops being the current window. The
+// windows are also reattached if the window's image has been replaced. It
+// returns when done is closed.
+func wctlEventHandler(s *screenImpl, done <-chan struct{}) {
+	ctl, err := openDev("wctl", os.O_RDONLY)
+	if err != nil {
+		s.fail(fmt.Errorf("Could not open /dev/wctl for window events: %v", err))
+		return
+	}
+	defer ctl.Close()
+	defer closeOnDone(ctl, done)()
+
+	readWctlEvents(ctl, s, done)
+}
+
+// readWctlEvents does the work of wctlEventHandler for the already
+// opened /dev/wctl file r. It returns when r is closed or done is
+// closed.
+func readWctlEvents(r io.Reader, s *screenImpl, done <-chan struct{}) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := r.Read(buf)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if err != nil {
+			if err != io.EOF {
+				s.fail(fmt.Errorf("Error reading window events: %v", err))
+			}
+			return
+		}
+		// the message is the window's rectangle, followed by "current" or
+		// "notcurrent" and "visible" or "hidden".
+		fields := strings.Fields(string(buf[:n]))
+		if len(fields) < 5 {
+			Log.Warnf("Unexpected data from /dev/wctl: %s", buf[:n])
+			continue
+		}
+		s.setCurrent(fields[4] == "current")
+		// reattaching is done along with resizing, since rio usually
+		// replaces the image because the window was resized.
+		if s.winnameChanged() {
+			s.scheduleResize()
+		}
+	}
+}
@@ -0,0 +1,379 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/niconan/shiny-plan9/shiny/screen"
+	"golang.org/x/mobile/event/lifecycle"
+	"golang.org/x/mobile/event/size"
+)
+
+func TestReadWctlBorder(t *testing.T) {
+	useFS(t, &fakeFS{files: map[string]string{
+		"/dev/wctl": "         10          20         640         480 current visible",
+	}})
+	for _, tc := range []struct {
+		border int
+		want   image.Rectangle
+	}{
+		{4, image.Rect(14, 24, 636, 476)},
+		{0, image.Rect(10, 20, 640, 480)},
+	} {
+		got, err := readWctl(tc.border)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("border %d: got %v, want %v", tc.border, got, tc.want)
+		}
+	}
+}
+
+func TestReadWctlOffscreen(t *testing.T) {
+	// rio reports the rectangle of a window that's partly off the display
+	// as it is, negative numbers and all.
+	useFS(t, &fakeFS{files: map[string]string{
+		"/dev/wctl": "        -20          -5         600         400 current visible",
+	}})
+	got, err := readWctl(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := image.Rect(-16, -1, 596, 396); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadFrameFlushWithDisplay(t *testing.T) {
+	s, _ := newTestScreen(65535, image.ZR)
+	s.opts.BorderWidth = 4
+	s.ctl.lastCtl = &DrawCtlMsg{DisplaySize: image.Rect(0, 0, 1024, 768)}
+	for _, tc := range []struct {
+		wctl       string
+		fullscreen bool
+		want       image.Rectangle
+		border     int
+	}{
+		// the window is the whole display, so nothing draws a border.
+		{"          0           0        1024         768 current visible", false, image.Rect(0, 0, 1024, 768), 0},
+		// but rio's border is inside a window it made fullscreen.
+		{"          0           0        1024         768 current visible", true, image.Rect(4, 4, 1020, 764), 4},
+		{"         10          20         640         480 current visible", false, image.Rect(14, 24, 636, 476), 4},
+	} {
+		useFS(t, &fakeFS{files: map[string]string{"/dev/wctl": tc.wctl}})
+		s.fullscreen = tc.fullscreen
+		got, border, err := s.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want || border != tc.border {
+			t.Errorf("%q, fullscreen %v: got %v with border %d, want %v with %d", tc.wctl, tc.fullscreen, got, border, tc.want, tc.border)
+		}
+	}
+}
+
+func TestReadWctlInvalid(t *testing.T) {
+	for _, wctl := range []string{
+		"",
+		"         10         20        640",
+		"         10         20       wide        480 current visible",
+		// not what rio writes at all, such as from a stub without a
+		// window system.
+		"no window\n",
+		"\n",
+	} {
+		useFS(t, &fakeFS{files: map[string]string{"/dev/wctl": wctl}})
+		r, err := readWctl(4)
+		if err == nil {
+			t.Errorf("%q: got %v, want an error", wctl, r)
+		} else if !strings.Contains(err.Error(), "/dev/wctl") {
+			t.Errorf("%q: got error %q, want one about /dev/wctl", wctl, err)
+		}
+	}
+}
+
+func TestParseWctlShortReads(t *testing.T) {
+	const (
+		wctl     = "         10          20         640         480 current visible"
+		wctl1480 = "         10          20         640        1480 current visible"
+	)
+	for _, tc := range []struct {
+		chunks []string
+		want   image.Rectangle
+		ok     bool
+	}{
+		{[]string{wctl}, image.Rect(14, 24, 636, 476), true},
+		// a number is split between reads.
+		{[]string{wctl[:30], wctl[30:40], wctl[40:]}, image.Rect(14, 24, 636, 476), true},
+		{[]string{wctl[:1], wctl[1:]}, image.Rect(14, 24, 636, 476), true},
+		// the state stops part of the way through.
+		{[]string{wctl[:30], wctl[30:40]}, image.ZR, false},
+		{[]string{wctl[:42]}, image.ZR, false},
+		// the last number is cut in the middle, which would still be a
+		// valid rectangle.
+		{[]string{wctl1480[:46]}, image.ZR, false},
+		{[]string{wctl1480[:46], wctl1480[46:]}, image.Rect(14, 24, 636, 1476), true},
+		{nil, image.ZR, false},
+	} {
+		got, err := parseWctl(&chunkReader{tc.chunks}, 4)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("%q: got %v, %v, want %v", tc.chunks, got, err, tc.want)
+		}
+	}
+
+	// once the rectangle has been read, nothing more is, since it would
+	// block until the window changes.
+	r := &chunkReader{[]string{wctl[:48], "current visible", "blocked"}}
+	if _, err := parseWctl(r, 4); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.chunks) != 2 {
+		t.Errorf("read %d chunks, want 1", 3-len(r.chunks))
+	}
+}
+
+// nextLifecycle returns the next lifecycle event sent to w, skipping over
+// everything else.
+func nextLifecycle(w screen.Window) lifecycle.Event {
+	for {
+		if e, ok := w.NextEvent().(lifecycle.Event); ok {
+			return e
+		}
+	}
+}
+
+func TestFocusDebounce(t *testing.T) {
+	defer func(old time.Duration) { focusDebounce = old }(focusDebounce)
+	focusDebounce = 20 * time.Millisecond
+
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w, _ := s.NewWindow(nil)
+	if e := nextLifecycle(w); e.To != lifecycle.StageVisible {
+		t.Fatalf("got %v, want the window to become visible", e)
+	}
+
+	msg := func(state string) string {
+		return "          0           0         100         100 " + state + " visible"
+	}
+	// rio flaps between current and not current while dragging.
+	readWctlEvents(&chunkReader{[]string{msg("current"), msg("notcurrent"), msg("current")}}, s, nil)
+	if e := nextLifecycle(w); e.From != lifecycle.StageVisible || e.To != lifecycle.StageFocused {
+		t.Fatalf("got %v, want a transition from visible to focused", e)
+	}
+	// and nothing else happens once it's settled.
+	time.Sleep(3 * focusDebounce)
+	w.Send("marker")
+	for {
+		e := w.NextEvent()
+		if e == "marker" {
+			break
+		}
+		if l, ok := e.(lifecycle.Event); ok {
+			t.Fatalf("got %v after the focus settled, want nothing", l)
+		}
+	}
+
+	readWctlEvents(&chunkReader{[]string{msg("notcurrent")}}, s, nil)
+	if e := nextLifecycle(w); e.From != lifecycle.StageFocused || e.To != lifecycle.StageVisible {
+		t.Fatalf("got %v, want a transition from focused to visible", e)
+	}
+}
+
+func TestTimersAfterRelease(t *testing.T) {
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	s.setCurrent(true)
+	s.release()
+	// the wctl reader may still be running until it's stopped.
+	s.setCurrent(false)
+	s.scheduleResize()
+	if s.focusTimer.Stop() {
+		t.Error("the focus timer was started again after the screen was released")
+	}
+	if s.resizeTimer != nil {
+		t.Error("a resize was scheduled after the screen was released")
+	}
+}
+
+func TestWinnameChange(t *testing.T) {
+	defer func(old time.Duration) { resizeDebounce = old }(resizeDebounce)
+	resizeDebounce = time.Hour
+	useLogger(t)
+	fs := &fakeFS{files: map[string]string{
+		"/dev/wctl":    "          0           0         100         100 current visible",
+		"/dev/winname": "window.1",
+	}}
+	useFS(t, fs)
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	s.winname = "window.1"
+	msg := "          0           0         100         100 notcurrent visible"
+
+	readWctlEvents(&chunkReader{[]string{msg}}, s, nil)
+	if s.resizeTimer != nil {
+		t.Fatalf("scheduled a resize without the window name changing")
+	}
+
+	// rio gave the window a new image without resizing it.
+	fs.files["/dev/winname"] = "window.2"
+	readWctlEvents(&chunkReader{[]string{msg}}, s, nil)
+	if s.resizeTimer == nil || !s.resizeTimer.Stop() {
+		t.Fatalf("no resize was scheduled after the window name changed")
+	}
+	f.msgs = nil
+	s.applyResize()
+	attached := false
+	for _, m := range f.msgs {
+		if m[0] == 'n' && string(m[6:]) == "window.2" {
+			attached = true
+		}
+	}
+	if !attached || s.winname != "window.2" {
+		t.Errorf("got messages %q and window name %q, want window.2 to be attached", f.cmds(), s.winname)
+	}
+}
+
+func TestReAttachWindowNewline(t *testing.T) {
+	useFS(t, &fakeFS{files: map[string]string{"/dev/winname": "window.3.7\n"}})
+	buf, err := reAttachWindow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// n id[4] j[1] winname[j], where the id is 0.
+	want := append([]byte{0, 0, 0, 0, 10}, "window.3.7"...)
+	if !bytes.Equal(buf, want) {
+		t.Errorf("got %q, want %q", buf, want)
+	}
+}
+
+func TestReAttachWindowLongName(t *testing.T) {
+	useFS(t, &fakeFS{files: map[string]string{"/dev/winname": strings.Repeat("w", 255)}})
+	if buf, err := reAttachWindow(); err != nil || buf[4] != 255 {
+		t.Fatalf("got %v, want a 255 byte name to fit", err)
+	}
+	useFS(t, &fakeFS{files: map[string]string{"/dev/winname": strings.Repeat("w", 256)}})
+	if _, err := reAttachWindow(); err == nil {
+		t.Errorf("expected an error for a 256 byte window name")
+	}
+}
+
+// rioFS is a fakeFS with a /dev/wctl that records the rectangles that
+// the window is resized to, and like rio, refuses ones that aren't
+// entirely on the display unless offscreen is set. Reading it gives the
+// rectangle that the window was last resized to.
+type rioFS struct {
+	*fakeFS
+	display   image.Rectangle
+	offscreen bool
+	resized   []image.Rectangle
+}
+
+func (f *rioFS) OpenFile(name string, flag int) (io.ReadWriteCloser, error) {
+	if name == "/dev/wctl" {
+		var state string
+		if n := len(f.resized); n > 0 {
+			r := f.resized[n-1]
+			state = fmt.Sprintf("%11d %11d %11d %11d current visible ", r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+		}
+		return rioWctl{f, strings.NewReader(state)}, nil
+	}
+	return f.fakeFS.OpenFile(name, flag)
+}
+
+type rioWctl struct {
+	fs    *rioFS
+	state io.Reader
+}
+
+func (w rioWctl) Write(p []byte) (int, error) {
+	var r image.Rectangle
+	if _, err := fmt.Sscanf(string(p), "resize -r %d %d %d %d", &r.Min.X, &r.Min.Y, &r.Max.X, &r.Max.Y); err != nil {
+		return 0, err
+	}
+	if !w.fs.offscreen && !r.In(w.fs.display) {
+		return 0, errors.New("bad rectangle")
+	}
+	w.fs.resized = append(w.fs.resized, r)
+	return len(p), nil
+}
+
+func (w rioWctl) Read(p []byte) (int, error) { return w.state.Read(p) }
+func (w rioWctl) Close() error               { return nil }
+
+func TestFullscreen(t *testing.T) {
+	display := image.Rect(0, 0, 1024, 768)
+	for _, tc := range []struct {
+		offscreen bool
+		want      image.Rectangle
+		size      image.Point
+	}{
+		// the border is outside of the display.
+		{true, image.Rect(-4, -4, 1028, 772), display.Size()},
+		// rio keeps the window on the display, so it's maximized, and
+		// the border takes up some of it.
+		{false, display, display.Inset(4).Size()},
+	} {
+		fs := &rioFS{fakeFS: &fakeFS{files: map[string]string{"/dev/winname": "window.1"}}, display: display, offscreen: tc.offscreen}
+		useFS(t, fs)
+		s, _ := newTestScreen(65535, image.Rect(104, 104, 396, 296))
+		s.opts.BorderWidth, s.border = 4, 4
+		s.ctl.lastCtl = &DrawCtlMsg{DisplaySize: display}
+		win, _ := s.NewWindow(nil)
+		win2, _ := s.NewWindow(nil)
+		w, w2 := win.(*windowImpl), win2.(*windowImpl)
+
+		var fw FullscreenWindow = w
+		if err := fw.SetFullscreen(true); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(fs.resized); n == 0 || fs.resized[n-1] != tc.want {
+			t.Errorf("offscreen %v: resized to %v, want %v", tc.offscreen, fs.resized, tc.want)
+		}
+		// rio then sends a resize, which the windows are fitted to.
+		s.applyResize()
+		for i, w := range []*windowImpl{w, w2} {
+			if got := w.rect.Size(); got != tc.size {
+				t.Errorf("offscreen %v: window %d is %v, want %v", tc.offscreen, i, got, tc.size)
+			}
+			if got := lastSize(w); got != tc.size {
+				t.Errorf("offscreen %v: window %d was told its size is %v, want %v", tc.offscreen, i, got, tc.size)
+			}
+		}
+
+		// it's already fullscreen.
+		fs.resized = nil
+		if err := fw.SetFullscreen(true); err != nil || len(fs.resized) != 0 {
+			t.Errorf("offscreen %v: resized to %v again, %v", tc.offscreen, fs.resized, err)
+		}
+		// going back restores the frame from before, with its border.
+		if err := fw.SetFullscreen(false); err != nil {
+			t.Fatal(err)
+		}
+		if want := image.Rect(100, 100, 400, 300); len(fs.resized) != 1 || fs.resized[0] != want {
+			t.Errorf("offscreen %v: restored to %v, want %v", tc.offscreen, fs.resized, want)
+		}
+	}
+}
+
+// lastSize returns the size in the last size.Event that w has been sent.
+func lastSize(w *windowImpl) image.Point {
+	w.Send("marker")
+	var sz image.Point
+	for {
+		switch e := w.NextEvent().(type) {
+		case size.Event:
+			sz = e.Size()
+		case string:
+			return sz
+		}
+	}
+}
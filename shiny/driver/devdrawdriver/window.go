@@ -5,179 +5,449 @@
 package devdrawdriver
 
 import (
-	"github.com/niconan/shiny-plan9/shiny/driver/internal/drawer"
+	"fmt"
 	"github.com/niconan/shiny-plan9/shiny/driver/internal/event"
+	"github.com/niconan/shiny-plan9/shiny/driver/internal/lifecycler"
 	"github.com/niconan/shiny-plan9/shiny/screen"
-	xdraw "golang.org/x/image/draw"
 	"golang.org/x/image/math/f64"
 	"golang.org/x/mobile/event/paint"
 	"golang.org/x/mobile/event/size"
 	"image"
 	"image/color"
 	"image/draw"
+	"io"
+	"os"
 )
 
 type windowId uint32
 
+// TitleWindow sets the label of the Plan 9 window:
+//
+//	w.(devdrawdriver.TitleWindow).SetTitle("hello")
+//
+// Every shiny window is drawn in the same Plan 9 window, so they all
+// share one title.
+type TitleWindow interface {
+	SetTitle(title string) error
+}
+
+// FlushWindow makes the display show what has been drawn onto the
+// screen so far, for callers that draw in steps, without compositing
+// the windows again like Publish does:
+//
+//	w.(devdrawdriver.FlushWindow).Flush()
+type FlushWindow interface {
+	Flush() error
+}
+
+// CaptureWindow reads back what's been drawn into a window, for example
+// for a screenshot:
+//
+//	img, err := w.(devdrawdriver.CaptureWindow).Capture()
+type CaptureWindow interface {
+	Capture() (*image.RGBA, error)
+}
+
+// SyncWindow waits until the server has drawn everything sent to it so
+// far. Messages to /dev/draw may still be on their way to the server
+// when the method that sent them returns, and unlike FlushWindow, which
+// only asks for them to be shown, SyncDraw returns once they've been
+// processed, so that callers that read back what they drew, such as
+// screenshot tests, see all of it:
+//
+//	w.(devdrawdriver.SyncWindow).SyncDraw()
+//	img, err := w.(devdrawdriver.CaptureWindow).Capture()
+type SyncWindow interface {
+	SyncDraw() error
+}
+
+// FullscreenWindow makes the Plan 9 window cover the whole display, and
+// puts it back afterwards:
+//
+//	w.(devdrawdriver.FullscreenWindow).SetFullscreen(true)
+//
+// Every shiny window is drawn in the same Plan 9 window, so they're all
+// affected, and the ones that cover the Plan 9 window are resized along
+// with it.
+type FullscreenWindow interface {
+	SetFullscreen(fullscreen bool) error
+}
+
+// OpacityWindow makes a window translucent without drawing it again,
+// such as to fade it in or out:
+//
+//	w.(devdrawdriver.OpacityWindow).SetOpacity(128)
+//
+// 255, the default, composites the window with its own alpha, and
+// anything less composites it over what's under it with that alpha
+// instead.
+type OpacityWindow interface {
+	SetOpacity(opacity uint8)
+}
+
 type windowImpl struct {
 	*uploadImpl
 	s *screenImpl
 	event.Deque
-}
 
-// Do an affine transformation on sr using src2dst.
-func affineTransform(src2dst f64.Aff3, sr image.Rectangle) image.Rectangle {
-	// helper function to do the calculations of src2dst..
-	mapPoint := func(p image.Point) image.Point {
-		xf, yf := float64(p.X), float64(p.Y)
-		return image.Point{
-			X: int(xf*src2dst[0] + yf*src2dst[1] + src2dst[2]),
-			Y: int(xf*src2dst[3] + yf*src2dst[4] + src2dst[5]),
-		}
-	}
+	lifecycler lifecycler.State
 
-	// map the top left corner, and assume it's both the min and the max
-	topLeft := mapPoint(sr.Min)
-	min, max := topLeft, topLeft
-	updateMinMax := func(p image.Point) {
-		if p.X < min.X {
-			min.X = p.X
-		}
-		if p.Y < min.Y {
-			min.Y = p.Y
-		}
-		if p.X > max.X {
-			max.X = p.X
-		}
-		if p.Y > max.Y {
-			max.Y = p.Y
-		}
-	}
-
-	// map the top right corner, and change the min or max as necessary
-	p := mapPoint(image.Point{sr.Max.X, sr.Min.Y})
-	updateMinMax(p)
-	// bottom left
-	p = mapPoint(image.Point{sr.Min.X, sr.Max.Y})
-	updateMinMax(p)
-	// bottom right
-	p = mapPoint(image.Point{sr.Max.X, sr.Max.Y})
-	updateMinMax(p)
+	// the rectangle covered by the window, relative to the top left of
+	// the Plan 9 window. It's changed along with the window's imageId
+	// when the Plan 9 window is resized, so both are protected by
+	// s.windowsMu.
+	rect image.Rectangle
+	// whether the window covers the whole Plan 9 window, and should be
+	// resized along with it.
+	fillFrame bool
+	// whether the window has been sent a size and paint because the
+	// Plan 9 window was resized. Protected by s.windowsMu.
+	resized bool
+	// opacity is set by SetOpacity, and opacityMask is the uniform
+	// mask that the window is composited with while it's less than
+	// 255, or 0 otherwise. Protected by s.windowsMu.
+	opacity     uint8
+	opacityMask uint32
+}
 
-	return image.Rectangle{min, max}
+// sendSize tells the window its current size, and then asks it to paint.
+func (w *windowImpl) sendSize() {
+	sz := w.rect.Size()
+	// tell the window it's current size before doing anything.
+	w.Deque.Send(size.Event{WidthPx: sz.X, HeightPx: sz.Y})
+	// and after it knows the size, tell the program using it to paint.
+	w.Deque.Send(paint.Event{})
 }
-func (w *windowImpl) Draw(src2dst f64.Aff3, src screen.Texture, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
-	// There's no direct way to do an affine transformation in /dev/draw,
-	// so this does the following steps:
-	//
-	// 1. Read the pixel data of the rectangle sr from texture.
-	// 2. Transform into dst space using src2dst
-	// 3. Create a new imageId of the transformed texture
-	// 4. Upload the transformed data to the new ImageId
-	// 5. Draw.
-
-	// step 0: Check if there's no rotation, in which case we don't need to bother with
-	// 	the expensive network traffic or CPU matrix multiplication.
-	//  We can just draw the already uploaded texture at the translated location.
-	if src2dst[0] == 1 && src2dst[1] == 0 &&
-		src2dst[3] == 0 && src2dst[4] == 1 {
-		srcT := src.(*textureImpl)
-		srSize := sr.Size()
-		newRectangle := image.Rectangle{
-			Min: image.Point{int(src2dst[2]), int(src2dst[5])},
-			Max: image.Point{int(src2dst[2]) + srSize.X, int(src2dst[5]) + srSize.Y},
-		}
-		w.s.ctl.Draw(uint32(w.imageId), uint32(srcT.imageId), uint32(srcT.imageId), newRectangle, sr.Min, image.ZP, op)
+
+// Release frees the window's image and removes it from the screen, so
+// that it's no longer composited onto the Plan 9 window. The screen
+// releases any windows that are left when it's released, so releasing a
+// window which is no longer on the screen does nothing.
+func (w *windowImpl) Release() {
+	if !w.s.removeWindow(w) {
 		return
+	}
+	w.uploadImpl.Release()
+}
 
+// SetTitle sets the title of the Plan 9 window by writing it to
+// /dev/label.
+func (w *windowImpl) SetTitle(title string) error {
+	f, err := openDev("label", os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
+	_, err = io.WriteString(f, title)
+	return err
+}
 
-	// step 1: read the subimage data
-	t := src.(*textureImpl)
-	pixels := w.s.ctl.ReadSubimage(uint32(t.imageId), sr)
-	// convert it to an image.RGBA to make life easier.
-	srcImage := image.NewRGBA(sr)
-	srcImage.Pix = pixels
+// SetFullscreen makes the Plan 9 window cover the display if fullscreen is
+// true, or restores it to where it was before if it's false.
+func (w *windowImpl) SetFullscreen(fullscreen bool) error {
+	return w.s.setFullscreen(fullscreen)
+}
 
-	// step 2: transform it into dst space
-	// 2a. Calculate the size of the translated buffer by multiplying
-	// the transformation through on sr.Min and sr.Max.
-	newRectangle := affineTransform(src2dst, sr)
+// SetOpacity sets how opaque the window is when it's composited onto the
+// Plan 9 window, from 0 for invisible to 255 for the window's own alpha.
+// It takes effect the next time the window is published.
+func (w *windowImpl) SetOpacity(opacity uint8) {
+	w.s.windowsMu.Lock()
+	defer w.s.windowsMu.Unlock()
+	w.ctl.drawMu.Lock()
+	defer w.ctl.drawMu.Unlock()
+	if opacity == w.opacity || w.released {
+		return
+	}
+	if w.opacityMask != 0 {
+		w.freeResource(w.opacityMask)
+		w.opacityMask = 0
+	}
+	if opacity < 255 {
+		w.opacityMask = w.ctl.AllocBuffer(0, true, image.Rect(0, 0, 1, 1), replClipr, color.Alpha{opacity})
+		w.addResource(w.opacityMask)
+	}
+	w.opacity = opacity
+	w.s.stale = true
+}
 
-	// 2b. Do the transformation itself. Create a new RGBA image to
-	// use temporarily to make this easier.
-	transformedImage := image.NewRGBA(newRectangle)
-	xdraw.NearestNeighbor.Transform(transformedImage, src2dst, srcImage, sr, xdraw.Op(op), nil)
+// replClipr is the clipping rectangle of a replicated image which can be
+// drawn anywhere, the same as libdraw uses.
+var replClipr = image.Rect(-0x3FFFFFFF, -0x3FFFFFFF, 0x3FFFFFFF, 0x3FFFFFFF)
 
-	// 3. Create a new imageId of the transformed texture
-	newOriginRectangle := image.Rectangle{image.ZP, newRectangle.Size()}
-	imageId := w.s.ctl.AllocBuffer(0, false, newOriginRectangle, newOriginRectangle, color.RGBA{0, 0, 0, 0})
+// ImageID returns the ID of the /dev/draw image that holds the window's
+// pixels, which is replaced when the window is resized. Since the caller
+// may draw into it, the window is composited again when it's published.
+func (w *windowImpl) ImageID() uint32 {
+	w.s.windowsMu.Lock()
+	id, r := w.imageId, image.Rectangle{image.ZP, w.rect.Size()}
+	w.s.windowsMu.Unlock()
+	w.markDirty(r)
+	return id
+}
 
-	// 4. Upload the transformed data to the new ImageId
-	w.s.ctl.ReplaceSubimage(imageId, newOriginRectangle, transformedImage.Pix)
+// DrawController returns the connection to /dev/draw that the window's
+// image was allocated on.
+func (w *windowImpl) DrawController() *DrawCtrler {
+	return w.ctl
+}
 
-	// 5. Draw.
-	w.s.ctl.Draw(uint32(w.imageId), imageId, imageId, newRectangle, image.ZP, image.ZP, op)
-	// the image is already used and there's no way to reference it, so we might as well free it
-	// now instead of waiting until Release() is called.
-	w.s.ctl.FreeID(imageId)
+// Capture returns the pixels of the whole window, with the window's top
+// left corner at the origin.
+func (w *windowImpl) Capture() (*image.RGBA, error) {
+	// the image is reallocated when the Plan 9 window is resized.
+	w.s.windowsMu.Lock()
+	id, r := w.imageId, image.Rectangle{image.ZP, w.rect.Size()}
+	w.s.windowsMu.Unlock()
 
+	img := image.NewRGBA(r)
+	if err := w.s.ctl.ReadSubimageInto(id, r, img.Pix); err != nil {
+		return nil, fmt.Errorf("capture window: %v", err)
+	}
+	return img, nil
 }
 
-func (w *windowImpl) Copy(dp image.Point, src screen.Texture, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
-	drawer.Copy(w, dp, src, sr, op, opts)
+// SyncDraw waits until the server has drawn everything that was sent to
+// it, as DrawCtrler.Sync does.
+func (w *windowImpl) SyncDraw() error {
+	return w.s.ctl.Sync()
 }
 
-func (w *windowImpl) Scale(dr image.Rectangle, src screen.Texture, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
-	drawer.Scale(w, dr, src, sr, op, opts)
+// Flush makes the display show anything that has already been drawn onto
+// the screen, without compositing the windows again like Publish does.
+func (w *windowImpl) Flush() error {
+	return w.s.ctl.Flush()
 }
 
+// Publish composites the windows onto the Plan 9 window, if any of them
+// have been drawn into since the last Publish. The window's image is kept
+// by /dev/draw, and compositing it doesn't change it, so the back buffer
+// is always preserved.
 func (w *windowImpl) Publish() screen.PublishResult {
-	redrawWindow(w.s, w.s.windowFrame)
-	return screen.PublishResult{false}
+	redrawWindow(w.s, w.s.frame())
+	w.s.checkConn()
+	return screen.PublishResult{BackBufferPreserved: true}
 }
 
 func (w *windowImpl) resize(r image.Rectangle) {
-	w.s.ctl.Reclip(uint32(w.imageId), false, r)
+	w.reclip(r)
+}
 
+// background returns the colour that window images are allocated with,
+// which the server fills them with: DevdrawOptions.BackgroundColor, or
+// white if it isn't set.
+func (s *screenImpl) background() color.Color {
+	if s.opts.BackgroundColor == nil {
+		return color.RGBA{255, 255, 255, 255}
+	}
+	return s.opts.BackgroundColor
 }
-func newWindowImpl(s *screenImpl) *windowImpl {
+
+// newWindowImpl allocates a window of size sz. If either dimension of sz
+// is zero, the window covers the whole Plan 9 window.
+func newWindowImpl(s *screenImpl, sz image.Point) *windowImpl {
 	// Allocate a /dev/draw image to represent our window.
-	// It has the same size as the current Plan 9 image, but in it's
-	// internal coordinate system the origin is 0, 0
-	r := image.Rectangle{image.ZP, s.windowFrame.Size()}
+	// By default, it has the same size as the current Plan 9 image, but
+	// in it's internal coordinate system the origin is 0, 0
+	fillFrame := sz.X <= 0 || sz.Y <= 0
+	if fillFrame {
+		sz = s.frame().Size()
+		// the frame is empty if it couldn't be read when the screen
+		// started, so read it again. It's only used for the size, and
+		// left for the next resize to store.
+		if sz.X <= 0 || sz.Y <= 0 {
+			if frame, _, err := s.readFrame(); err == nil {
+				sz = frame.Size()
+			}
+		}
+		// applications allocate their buffers from the first
+		// size.Event, and an empty one can't be allocated.
+		if sz.X < 1 {
+			sz.X = 1
+		}
+		if sz.Y < 1 {
+			sz.Y = 1
+		}
+	}
+	r := image.Rectangle{image.ZP, sz}
 
-	uploader := newUploadImpl(s, r, color.RGBA{255, 255, 255, 255})
+	uploader := newUploadImpl(s, r, s.opts.WindowRefresh, s.background())
 	w := &windowImpl{
 		uploadImpl: uploader,
 		s:          s,
+		rect:       r,
+		fillFrame:  fillFrame,
+		opacity:    255,
 	}
-	// tell the window it's current size before doing anything.
-	w.Deque.Send(size.Event{WidthPx: r.Max.X, HeightPx: r.Max.Y})
-	// and after it knows the size, tell the program using it to paint.
-	w.Deque.Send(paint.Event{})
+	// the window is overlaid on the Plan 9 window, so it's visible as
+	// soon as it exists.
+	w.lifecycler.SetVisible(true)
+	w.lifecycler.SendEvent(w, nil)
+	w.sendSize()
 	return w
 }
+
+// The drawing methods of uploadImpl send the window's imageId, which
+// repositionWindow frees and replaces when the Plan 9 window is resized.
+// So the window holds s.windowsMu around each of them, until the image
+// has been drawn into, as DrawLine does.
+
+func (w *windowImpl) Upload(dp image.Point, src screen.Buffer, sr image.Rectangle) {
+	w.s.windowsMu.Lock()
+	defer w.s.windowsMu.Unlock()
+	w.uploadImpl.Upload(dp, src, sr)
+}
+
+func (w *windowImpl) UploadImage(dp image.Point, img image.Image, sr image.Rectangle) {
+	w.s.windowsMu.Lock()
+	defer w.s.windowsMu.Unlock()
+	w.uploadImpl.UploadImage(dp, img, sr)
+}
+
+func (w *windowImpl) Fill(dr image.Rectangle, src color.Color, op draw.Op) {
+	w.s.windowsMu.Lock()
+	defer w.s.windowsMu.Unlock()
+	w.uploadImpl.Fill(dr, src, op)
+}
+
+func (w *windowImpl) Draw(src2dst f64.Aff3, src screen.Texture, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
+	w.s.windowsMu.Lock()
+	defer w.s.windowsMu.Unlock()
+	w.uploadImpl.Draw(src2dst, src, sr, op, opts)
+}
+
 func (w *windowImpl) DrawUniform(src2dst f64.Aff3, src color.Color, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
-	// check of we can skip the affine transformation to speed things up.
-	if src2dst[0] == 1 && src2dst[1] == 0 &&
-		src2dst[3] == 0 && src2dst[4] == 1 {
-		srSize := sr.Size()
-		newRectangle := image.Rectangle{
-			Min: image.Point{int(src2dst[2]), int(src2dst[5])},
-			Max: image.Point{int(src2dst[2]) + srSize.X, int(src2dst[5]) + srSize.Y},
-		}
-		colorID := w.s.ctl.AllocBuffer(0, true, newRectangle, sr, src)
-		defer w.s.ctl.FreeID(colorID)
+	w.s.windowsMu.Lock()
+	defer w.s.windowsMu.Unlock()
+	w.uploadImpl.DrawUniform(src2dst, src, sr, op, opts)
+}
+
+func (w *windowImpl) Copy(dp image.Point, src screen.Texture, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
+	w.s.windowsMu.Lock()
+	defer w.s.windowsMu.Unlock()
+	w.uploadImpl.Copy(dp, src, sr, op, opts)
+}
+
+func (w *windowImpl) Scale(dr image.Rectangle, src screen.Texture, sr image.Rectangle, op draw.Op, opts *screen.DrawOptions) {
+	w.s.windowsMu.Lock()
+	defer w.s.windowsMu.Unlock()
+	w.uploadImpl.Scale(dr, src, sr, op, opts)
+}
 
-		w.s.ctl.Draw(uint32(w.imageId), colorID, colorID, newRectangle, sr.Min, image.ZP, op)
+// DrawLine draws a line from p0 to p1 in the colour c with square ends,
+// using the /dev/draw line primitive instead of rasterizing it on the
+// client. As in line(2), the line is 1+2*thick pixels wide.
+func (w *windowImpl) DrawLine(p0, p1 image.Point, thick int, c color.Color, op draw.Op) {
+	// the window's image is reallocated when the Plan 9 window is
+	// resized, so it's held on to until the line has been sent.
+	w.s.windowsMu.Lock()
+	defer w.s.windowsMu.Unlock()
+	// don't bother the server with lines that are entirely outside
+	// of the window.
+	bounds := image.Rectangle{image.ZP, w.rect.Size()}
+	lineR := image.Rectangle{p0, p1}.Canon()
+	lineR.Max = lineR.Max.Add(image.Point{1, 1})
+	if !lineR.Inset(-thick).Overlaps(bounds) {
 		return
+	}
+
+	w.markDirty(lineR.Inset(-thick))
+	// the source point is aligned with p0, so the colour has to cover
+	// everywhere that the line can go from there, in every direction.
+	colorID := w.s.ctl.AllocBuffer(0, true, image.Rectangle{image.ZP, image.Point{1, 1}}, replClipr, c)
+	defer w.s.ctl.FreeID(colorID)
+
+	w.s.ctl.Line(w.imageId, p0, p1, EndSquare, EndSquare, thick, colorID, image.ZP, op)
+}
+
+// DrawEllipse draws the outline of an ellipse centred on center with
+// horizontal and vertical semi-axes a and b in the colour c, using the
+// /dev/draw ellipse primitive. As in ellipse(2), the outline is
+// 1+2*thick pixels wide.
+func (w *windowImpl) DrawEllipse(center image.Point, a, b, thick int, c color.Color, op draw.Op) {
+	w.drawEllipse(center, a, b, thick, c, false, 0, 0, op)
+}
 
+// DrawArc is like DrawEllipse, but only draws the part of the ellipse
+// starting at alpha degrees and extending phi degrees counter-clockwise,
+// where 0 degrees is at 3 o'clock.
+func (w *windowImpl) DrawArc(center image.Point, a, b, thick int, c color.Color, alpha, phi int, op draw.Op) {
+	w.drawEllipse(center, a, b, thick, c, true, alpha, phi, op)
+}
+
+func (w *windowImpl) drawEllipse(center image.Point, a, b, thick int, c color.Color, arc bool, alpha, phi int, op draw.Op) {
+	// as in DrawLine, the window's image can't be replaced while the
+	// ellipse is being sent.
+	w.s.windowsMu.Lock()
+	defer w.s.windowsMu.Unlock()
+	// don't bother the server with ellipses that are entirely outside
+	// of the window.
+	bounds := image.Rectangle{image.ZP, w.rect.Size()}
+	ellipseR := image.Rect(center.X-a, center.Y-b, center.X+a+1, center.Y+b+1)
+	if !ellipseR.Inset(-thick).Overlaps(bounds) {
+		return
 	}
 
-	newRectangle := affineTransform(src2dst, sr)
-	colorID := w.s.ctl.AllocBuffer(0, true, newRectangle, sr, src)
+	w.markDirty(ellipseR.Inset(-thick))
+	// the source point is aligned with center, so the colour has to
+	// cover the whole ellipse around it, as in DrawLine.
+	colorID := w.s.ctl.AllocBuffer(0, true, image.Rectangle{image.ZP, image.Point{1, 1}}, replClipr, c)
 	defer w.s.ctl.FreeID(colorID)
 
-	w.s.ctl.Draw(uint32(w.imageId), colorID, colorID, newRectangle, image.ZP, image.ZP, op)
+	w.s.ctl.Ellipse(w.imageId, colorID, center, a, b, thick, image.ZP, arc, alpha, phi, op)
+}
+
+// DrawString draws s in the colour c with its top left corner at p, using
+// the Plan 9 font (as described in font(6)) in the file fontPath, such as
+// /lib/font/bit/lucsans/unicode.8.font. The font is loaded into /dev/draw
+// the first time that it's used, and then the server renders the glyphs.
+// Characters that aren't in the font are skipped.
+func (w *windowImpl) DrawString(p image.Point, s string, fontPath string, c color.Color) {
+	f, err := w.s.loadFont(fontPath)
+	if err != nil {
+		Log.Errorf("draw string: %v", err)
+		return
+	}
+	// as in DrawLine, the window's image can't be replaced while the
+	// string is being sent.
+	w.s.windowsMu.Lock()
+	defer w.s.windowsMu.Unlock()
+	bounds := image.Rectangle{image.ZP, w.rect.Size()}
+	w.markDirty(bounds)
+	// the source point is aligned with p, which may be outside of the
+	// window, so the colour has to cover everywhere, as in DrawLine.
+	colorID := w.s.ctl.AllocBuffer(0, true, image.Rectangle{image.ZP, image.Point{1, 1}}, replClipr, c)
+	defer w.s.ctl.FreeID(colorID)
+
+	// consecutive characters from the same subfont are sent in a single
+	// message.
+	var (
+		run    []uint16
+		runSub *subfont
+		runP   image.Point
+	)
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		// the server takes the baseline, and finds the top of each
+		// subfont from its own ascent, so every subfont is aligned
+		// on the baseline of the font.
+		bp := runP.Add(image.Point{0, f.ascent})
+		w.s.ctl.String(w.imageId, colorID, runSub.cacheID, bp, bounds, image.ZP, run, draw.Over)
+		run = run[:0]
+	}
+	for _, r := range s {
+		sub, index, ok := w.s.fontChar(f, r)
+		if !ok {
+			continue
+		}
+		if sub != runSub || len(run) == maxStringChars {
+			flush()
+			runSub, runP = sub, p
+		}
+		run = append(run, uint16(index))
+		p.X += int(sub.chars[index].width)
+	}
+	flush()
 }
@@ -0,0 +1,1237 @@
+// Copyright 2016-2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package devdrawdriver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/niconan/shiny-plan9/shiny/screen"
+	"golang.org/x/image/math/f64"
+	"golang.org/x/mobile/event/paint"
+	"golang.org/x/mobile/event/size"
+)
+
+// newTestScreen returns a screenImpl overlaid on frame which writes its
+// messages to a fakeData instead of /dev/draw.
+//
+// The windows that it creates aren't kicked with their size and a paint
+// event, unless the test sets paintDelay itself, so that the kick can't
+// arrive in the middle of the events that the test is checking.
+func newTestScreen(iounitSize int, frame image.Rectangle) (*screenImpl, *fakeData) {
+	d, f := newTestCtrler(iounitSize)
+	return &screenImpl{ctl: d, windowFrame: frame, paintDelay: time.Hour}, f
+}
+
+func TestWindowCopy(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w := newWindowImpl(s, image.ZP)
+	tex := newTextureImpl(s, image.Point{50, 50})
+	f.msgs = nil
+
+	w.Copy(image.Point{10, 20}, tex, image.Rect(5, 5, 25, 15), draw.Over, nil)
+	if got, want := f.cmds(), "bOd"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	d := f.msgs[2][1:]
+	// the texture is drawn straight into the window, through a solid
+	// mask, since its alpha is already part of its pixels.
+	maskID := binary.LittleEndian.Uint32(f.msgs[0][1:])
+	dst, src, mask := binary.LittleEndian.Uint32(d), binary.LittleEndian.Uint32(d[4:]), binary.LittleEndian.Uint32(d[8:])
+	if dst != w.imageId || src != tex.imageId || mask != maskID {
+		t.Errorf("drew %d into %d with mask %d, want %d into %d with mask %d", src, dst, mask, tex.imageId, w.imageId, maskID)
+	}
+	if got, want := msgRect(d[12:]), image.Rect(10, 20, 30, 30); got != want {
+		t.Errorf("dst rectangle: got %v, want %v", got, want)
+	}
+	if got, want := msgPoint(d[28:]), image.Pt(5, 5); got != want {
+		t.Errorf("src point: got %v, want %v", got, want)
+	}
+	if got, want := msgPoint(d[36:]), image.ZP; got != want {
+		t.Errorf("mask point: got %v, want %v", got, want)
+	}
+}
+
+func BenchmarkWindowCopy(b *testing.B) {
+	r := image.Rect(0, 0, 1024, 768)
+	s, f := newTestScreen(65535, r)
+	w := newWindowImpl(s, image.ZP)
+	tex := newTextureImpl(s, r.Size())
+
+	written := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.msgs = f.msgs[:0]
+		w.Copy(image.ZP, tex, r, draw.Src, nil)
+		for _, m := range f.msgs {
+			written += len(m)
+		}
+	}
+	b.ReportMetric(float64(written)/float64(b.N), "bytes/op")
+}
+
+func TestWindowRelease(t *testing.T) {
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	var windows []screen.Window
+	for i := 0; i < 100; i++ {
+		w, err := s.NewWindow(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		windows = append(windows, w)
+	}
+	if len(s.windows) != 100 {
+		t.Fatalf("got %d windows, want 100", len(s.windows))
+	}
+	for _, w := range windows {
+		w.Release()
+	}
+	if len(s.windows) != 0 {
+		t.Errorf("got %d windows after releasing them all, want 0", len(s.windows))
+	}
+}
+
+func TestWindowReleaseFocused(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w1, _ := s.NewWindow(nil)
+	w2, _ := s.NewWindow(nil)
+	if s.focused() != w2 {
+		t.Fatalf("the newest window doesn't have the focus")
+	}
+	w2.Release()
+	if s.focused() != w1 {
+		t.Errorf("focus went to %v, want the remaining window", s.focused())
+	}
+
+	// only the remaining window is composited.
+	f.msgs = nil
+	w1.Publish()
+	if got, want := f.cmds(), "Odv"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	if got, want := binary.LittleEndian.Uint32(f.msgs[1][5:]), w1.(*windowImpl).imageId; got != want {
+		t.Errorf("composited image %d, want %d", got, want)
+	}
+
+	w1.Release()
+	if s.focused() != nil {
+		t.Errorf("focus is on %v after every window was released", s.focused())
+	}
+}
+
+func TestScreenReleaseFreesWindows(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w1, _ := s.NewWindow(nil)
+	w2, _ := s.NewWindow(nil)
+	w1.Release()
+	f.msgs = nil
+
+	s.release()
+	if got, want := f.cmds(), "fF"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	if got, want := binary.LittleEndian.Uint32(f.msgs[0][1:]), w2.(*windowImpl).imageId; got != want {
+		t.Errorf("freed %d, want the unreleased window %d", got, want)
+	}
+
+	// releasing a window after the screen doesn't free its image again.
+	f.msgs = nil
+	w2.Release()
+	if len(f.msgs) != 0 {
+		t.Errorf("got messages %q releasing a window after the screen", f.cmds())
+	}
+}
+
+func TestSolidMaskShared(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w := newWindowImpl(s, image.ZP)
+	tex := newTextureImpl(s, image.Point{10, 10})
+	f.msgs = nil
+
+	// every draw uses the same mask, which is only allocated once.
+	w.Fill(image.Rect(0, 0, 10, 10), color.Black, draw.Src)
+	w.Copy(image.ZP, tex, tex.Bounds(), draw.Over, nil)
+	tex.Fill(tex.Bounds(), color.White, draw.Over)
+	var masks []uint32
+	for _, m := range f.msgs {
+		if m[0] == 'd' {
+			masks = append(masks, binary.LittleEndian.Uint32(m[9:]))
+		}
+	}
+	if len(masks) != 3 || masks[0] != s.solidMask() || masks[1] != masks[0] || masks[2] != masks[0] {
+		t.Errorf("drew with masks %v, want the solid mask %d each time", masks, s.solidMask())
+	}
+	if got, want := f.cmds(), "bbOdfOdbOdf"; got != want {
+		t.Errorf("got messages %q, want %q", got, want)
+	}
+
+	// and it's freed with the screen.
+	mask := s.solidMask()
+	w.Release()
+	tex.Release()
+	f.msgs = nil
+	s.release()
+	if got, want := f.cmds(), "fF"; got != want {
+		t.Fatalf("released with messages %q, want %q", got, want)
+	}
+	if got := binary.LittleEndian.Uint32(f.msgs[0][1:]); got != mask {
+		t.Errorf("freed %d, want the solid mask %d", got, mask)
+	}
+}
+
+// logConn is a /dev/draw file which logs the command of each message
+// that's written to it, and its name when it's closed.
+type logConn struct {
+	name string
+	log  *[]string
+}
+
+func (c logConn) Write(p []byte) (int, error) {
+	*c.log = append(*c.log, string(p[:1]))
+	return len(p), nil
+}
+func (c logConn) Read(p []byte) (int, error) { return 0, io.EOF }
+func (c logConn) Close() error {
+	*c.log = append(*c.log, "close "+c.name)
+	return nil
+}
+
+func TestScreenReleaseOrder(t *testing.T) {
+	var log []string
+	d := NewDrawCtrlerFromTransport(logConn{"data", &log}, 65535)
+	d.ctl = logConn{"ctl", &log}
+	s := &screenImpl{ctl: d, windowFrame: image.Rect(0, 0, 100, 100)}
+	stopped := false
+	s.stopDevices = func() {
+		stopped = true
+		log = append(log, "stop")
+	}
+	win, _ := s.NewWindow(nil)
+	tex, _ := s.NewTexture(image.Point{10, 10})
+	released, _ := s.NewTexture(image.Point{10, 10})
+	released.Release()
+	log = nil
+
+	s.release()
+	want := "stop f f F close data close ctl"
+	if got := strings.Join(log, " "); got != want {
+		t.Errorf("released with %q, want %q", got, want)
+	}
+	if !stopped {
+		t.Errorf("the devices weren't stopped")
+	}
+
+	// everything has already been released, and stopping the devices
+	// again is harmless.
+	log = nil
+	win.Release()
+	tex.Release()
+	s.release()
+	if got := strings.Join(log, " "); got != "stop" {
+		t.Errorf("got %q releasing again", got)
+	}
+	if err := d.SendMessage('v', nil); err == nil {
+		t.Errorf("SendMessage succeeded after the screen was released")
+	}
+}
+
+func TestWindowRefresh(t *testing.T) {
+	for _, refresh := range []byte{RefBackup, RefNone} {
+		s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+		s.opts.WindowRefresh = refresh
+		newWindowImpl(s, image.ZP)
+		if f.msgs[0][0] != 'b' {
+			t.Fatalf("first message was %q, want an allocation", f.msgs[0][0])
+		}
+		if got := f.msgs[0][9]; got != refresh {
+			t.Errorf("window allocated with refresh %d, want %d", got, refresh)
+		}
+	}
+}
+
+func TestWindowBackgroundColor(t *testing.T) {
+	useFS(t, &fakeFS{files: map[string]string{"/dev/winname": "window.1"}})
+	for _, tc := range []struct {
+		bg   color.Color
+		want [4]byte // a, b, g, r as they appear in the message
+	}{
+		{nil, [4]byte{0xff, 0xff, 0xff, 0xff}},
+		{color.RGBA{0x10, 0x20, 0x30, 0xff}, [4]byte{0xff, 0x30, 0x20, 0x10}},
+	} {
+		s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+		s.opts.BackgroundColor = tc.bg
+		w := newWindowImpl(s, image.ZP)
+		s.windows = append(s.windows, w)
+		if f.msgs[0][0] != 'b' {
+			t.Fatalf("first message was %q, want an allocation", f.msgs[0][0])
+		}
+		var got [4]byte
+		copy(got[:], f.msgs[0][47:51])
+		if got != tc.want {
+			t.Errorf("background %v: allocated with colour % x, want % x", tc.bg, got, tc.want)
+		}
+
+		// the window's new image is filled with it as well when the
+		// Plan 9 window is resized.
+		f.msgs = nil
+		repositionWindow(s, image.Rect(0, 0, 150, 120))
+		if i := strings.LastIndexByte(f.cmds(), 'b'); i < 0 {
+			t.Errorf("background %v: got messages %q after a resize, want an allocation", tc.bg, f.cmds())
+		} else if copy(got[:], f.msgs[i][47:51]); got != tc.want {
+			t.Errorf("background %v: reallocated with colour % x, want % x", tc.bg, got, tc.want)
+		}
+	}
+}
+
+func TestWindowDrawLine(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w := newWindowImpl(s, image.ZP)
+	f.msgs = nil
+
+	w.DrawLine(image.Pt(10, 20), image.Pt(90, 5), 2, color.RGBA{0xff, 0, 0, 0xff}, draw.Over)
+	if got, want := f.cmds(), "bOLf"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	colorID := binary.LittleEndian.Uint32(f.msgs[0][1:])
+	l := f.msgs[2][1:]
+	u := func(off int) int { return int(int32(binary.LittleEndian.Uint32(l[off:]))) }
+	if got := uint32(u(0)); got != w.imageId {
+		t.Errorf("dst: got %d, want %d", got, w.imageId)
+	}
+	if p0, p1 := image.Pt(u(4), u(8)), image.Pt(u(12), u(16)); p0 != image.Pt(10, 20) || p1 != image.Pt(90, 5) {
+		t.Errorf("endpoints: got %v, %v, want (10,20), (90,5)", p0, p1)
+	}
+	if u(20) != EndSquare || u(24) != EndSquare {
+		t.Errorf("end styles: got %d, %d, want %d", u(20), u(24), EndSquare)
+	}
+	if got := u(28); got != 2 {
+		t.Errorf("thickness: got %d, want 2", got)
+	}
+	if got := uint32(u(32)); got != colorID {
+		t.Errorf("src: got %d, want the colour image %d", got, colorID)
+	}
+	if got := binary.LittleEndian.Uint32(f.msgs[3][1:]); got != colorID {
+		t.Errorf("freed %d, want the colour image %d", got, colorID)
+	}
+
+	// the server clips the source to its clipping rectangle, even when
+	// it's replicated, and lines up the source point with p0. So the
+	// colour has to cover a line that goes up and to the left of p0.
+	f.msgs = nil
+	p0, p1 := image.Pt(90, 90), image.Pt(10, 10)
+	w.DrawLine(p0, p1, 1, color.Black, draw.Over)
+	if got, want := f.cmds(), "bOLf"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	sp := msgPoint(f.msgs[2][37:])
+	need := image.Rectangle{p1, p0.Add(image.Pt(1, 1))}.Inset(-1).Sub(p0).Add(sp)
+	if clipr := msgRect(f.msgs[0][31:]); !need.In(clipr) {
+		t.Errorf("the colour is clipped to %v, which doesn't cover the line's source %v", clipr, need)
+	}
+
+	// a line outside of the window isn't sent.
+	f.msgs = nil
+	w.DrawLine(image.Pt(200, 200), image.Pt(300, 200), 1, color.Black, draw.Over)
+	if len(f.msgs) != 0 {
+		t.Errorf("got messages %q for a line outside the window, want none", f.cmds())
+	}
+}
+
+func TestWindowDrawEllipse(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w := newWindowImpl(s, image.ZP)
+
+	for _, tc := range []struct {
+		arc        bool
+		alpha, phi int
+		wantAlpha  uint32
+	}{
+		{false, 0, 0, 0},
+		{true, 90, 180, 90 | 1<<31},
+	} {
+		f.msgs = nil
+		if tc.arc {
+			w.DrawArc(image.Pt(50, 40), 20, 10, 1, color.Black, tc.alpha, tc.phi, draw.Over)
+		} else {
+			w.DrawEllipse(image.Pt(50, 40), 20, 10, 1, color.Black, draw.Over)
+		}
+		if got, want := f.cmds(), "bOef"; got != want {
+			t.Fatalf("arc %v: got messages %q, want %q", tc.arc, got, want)
+		}
+		colorID := binary.LittleEndian.Uint32(f.msgs[0][1:])
+		e := f.msgs[2][1:]
+		u := func(off int) uint32 { return binary.LittleEndian.Uint32(e[off:]) }
+		if u(0) != w.imageId || u(4) != colorID {
+			t.Errorf("arc %v: dst, src: got %d, %d, want %d, %d", tc.arc, u(0), u(4), w.imageId, colorID)
+		}
+		if u(8) != 50 || u(12) != 40 {
+			t.Errorf("arc %v: center: got (%d,%d), want (50,40)", tc.arc, u(8), u(12))
+		}
+		if u(16) != 20 || u(20) != 10 || u(24) != 1 {
+			t.Errorf("arc %v: a, b, thick: got %d, %d, %d, want 20, 10, 1", tc.arc, u(16), u(20), u(24))
+		}
+		if u(36) != tc.wantAlpha || u(40) != uint32(tc.phi) {
+			t.Errorf("arc %v: alpha, phi: got %#x, %d, want %#x, %d", tc.arc, u(36), u(40), tc.wantAlpha, tc.phi)
+		}
+		// the source point is lined up with the centre, and the server
+		// clips the source even though it's replicated, so the colour
+		// has to cover the ellipse on every side of it.
+		need := image.Rect(-21, -11, 22, 12).Add(msgPoint(e[28:]))
+		if clipr := msgRect(f.msgs[0][31:]); !need.In(clipr) {
+			t.Errorf("arc %v: the colour is clipped to %v, which doesn't cover the ellipse's source %v", tc.arc, clipr, need)
+		}
+	}
+
+	// an ellipse outside of the window isn't sent.
+	f.msgs = nil
+	w.DrawEllipse(image.Pt(-50, -50), 20, 20, 1, color.Black, draw.Over)
+	if len(f.msgs) != 0 {
+		t.Errorf("got messages %q for an ellipse outside the window, want none", f.cmds())
+	}
+}
+
+func TestWindowSetTitle(t *testing.T) {
+	fs := &fakeFS{files: map[string]string{"/dev/label": "old"}}
+	useFS(t, fs)
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	var w screen.Window = newWindowImpl(s, image.ZP)
+
+	tw, ok := w.(TitleWindow)
+	if !ok {
+		t.Fatal("window doesn't implement TitleWindow")
+	}
+	if err := tw.SetTitle("hello"); err != nil {
+		t.Fatal(err)
+	}
+	label := fs.data["/dev/label"]
+	if len(label.msgs) != 1 || string(label.msgs[0]) != "hello" {
+		t.Errorf("wrote %q to /dev/label, want hello", label.msgs)
+	}
+
+	delete(fs.files, "/dev/label")
+	if err := tw.SetTitle("hello"); err == nil {
+		t.Errorf("expected an error without /dev/label")
+	}
+}
+
+func TestWindowDrawFreesAfterUse(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w := newWindowImpl(s, image.ZP)
+	tex := newTextureImpl(s, image.Point{10, 10})
+	// the texture was drawn into by the server, so its pixels have to
+	// be read back.
+	tex.Fill(tex.Bounds(), color.Black, draw.Src)
+	f.msgs = nil
+
+	// a rotation needs a temporary image with the transformed pixels.
+	f.reads.Write(make([]byte, 10*10*4))
+	w.Draw(f64.Aff3{0, -1, 50, 1, 0, 20}, tex, tex.Bounds(), draw.Over, nil)
+	if got, want := f.cmds(), "rbyOdf"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	tmpID := binary.LittleEndian.Uint32(f.msgs[1][1:])
+	if got := binary.LittleEndian.Uint32(f.msgs[4][1+4:]); got != tmpID {
+		t.Errorf("draw src: got %d, want the temporary image %d", got, tmpID)
+	}
+	if got := binary.LittleEndian.Uint32(f.msgs[5][1:]); got != tmpID {
+		t.Errorf("freed %d, want the temporary image %d", got, tmpID)
+	}
+}
+
+func TestWindowDrawUniform(t *testing.T) {
+	transparent := color.NRGBA{0xff, 0, 0, 0x80}
+	ops := make(map[draw.Op]byte)
+	for _, op := range []draw.Op{draw.Over, draw.Src} {
+		for _, src2dst := range []f64.Aff3{{1, 0, 10, 0, 1, 10}, {0, -1, 50, 1, 0, 20}} {
+			s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+			w := newWindowImpl(s, image.ZP)
+			f.msgs = nil
+
+			w.DrawUniform(src2dst, transparent, image.Rect(0, 0, 10, 10), op, nil)
+			// the solid mask is allocated the first time it's used.
+			if got, want := f.cmds(), "bbOdf"; got != want {
+				t.Fatalf("got messages %q, want %q", got, want)
+			}
+			colorID := binary.LittleEndian.Uint32(f.msgs[0][1:])
+			maskID := binary.LittleEndian.Uint32(f.msgs[1][1:])
+			d := f.msgs[3][1:]
+			if got := binary.LittleEndian.Uint32(d[4:]); got != colorID {
+				t.Errorf("draw src: got %d, want the colour %d", got, colorID)
+			}
+			if got := binary.LittleEndian.Uint32(d[8:]); got != maskID {
+				t.Errorf("draw mask: got %d, want the mask %d", got, maskID)
+			}
+			// the mask is an opaque replicated image.
+			if m := f.msgs[1]; m[14] != 1 || m[47] != 0xff {
+				t.Errorf("mask allocated with repl %d and alpha %#x, want an opaque replicated image", m[14], m[47])
+			}
+			ops[op] = f.msgs[2][1]
+		}
+	}
+	// with a solid mask, only the operation decides whether the
+	// transparent colour replaces or blends with the window.
+	if ops[draw.Over] == ops[draw.Src] {
+		t.Errorf("draw.Over and draw.Src both sent operation %d", ops[draw.Over])
+	}
+}
+
+func TestWindowDrawUniformPixels(t *testing.T) {
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	for _, tc := range []struct {
+		name    string
+		src2dst f64.Aff3
+		// dr is where sr = (20,20)-(30,30) is drawn.
+		dr image.Rectangle
+	}{
+		{"translated", f64.Aff3{1, 0, -15, 0, 1, -5}, image.Rect(5, 15, 15, 25)},
+		{"rotated", f64.Aff3{0, -1, 30, 1, 0, -10}, image.Rect(0, 10, 10, 20)},
+	} {
+		for _, op := range []struct {
+			op   draw.Op
+			want color.RGBA
+		}{
+			// the half transparent red is blended with the window.
+			{draw.Over, color.RGBA{0x80, 0, 0x7f, 0xff}},
+			// or replaces it, alpha and all.
+			{draw.Src, color.RGBA{0x80, 0, 0, 0x80}},
+		} {
+			s, f := newTestScreen(65535, image.Rect(0, 0, 40, 40))
+			s.opts.BackgroundColor = blue
+			w := newWindowImpl(s, image.ZP)
+
+			w.DrawUniform(tc.src2dst, color.NRGBA{0xff, 0, 0, 0x80}, image.Rect(20, 20, 30, 30), op.op, nil)
+			img := renderImages(f.msgs, image.NewRGBA(image.Rect(0, 0, 40, 40)))[w.imageId]
+			for _, p := range []image.Point{tc.dr.Min, tc.dr.Max.Sub(image.Pt(1, 1))} {
+				if got := img.RGBAAt(p.X, p.Y); got != op.want {
+					t.Errorf("%s, %v: got %v at %v, want %v", tc.name, op.op, got, p, op.want)
+				}
+			}
+			for _, p := range []image.Point{{tc.dr.Max.X, tc.dr.Min.Y}, {tc.dr.Min.X, tc.dr.Max.Y}} {
+				if got := img.RGBAAt(p.X, p.Y); got != blue {
+					t.Errorf("%s, %v: got %v at %v outside %v, want the background", tc.name, op.op, got, p, tc.dr)
+				}
+			}
+		}
+	}
+}
+
+func TestWindowCopyPixels(t *testing.T) {
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	red := color.RGBA{0x80, 0, 0, 0x80}
+	for _, tc := range []struct {
+		op   draw.Op
+		want color.RGBA
+	}{
+		// the half transparent texture is blended with the window once.
+		{draw.Over, color.RGBA{0x80, 0, 0x7f, 0xff}},
+		// or replaces it.
+		{draw.Src, red},
+	} {
+		s, f := newTestScreen(65535, image.Rect(0, 0, 20, 20))
+		s.opts.BackgroundColor = blue
+		w := newWindowImpl(s, image.ZP)
+		tex := newTextureImpl(s, image.Point{4, 4})
+		buf, _ := s.NewBuffer(image.Point{4, 4})
+		draw.Draw(buf.RGBA(), buf.Bounds(), image.NewUniform(red), image.ZP, draw.Src)
+		tex.Upload(image.ZP, buf, buf.Bounds())
+
+		w.Copy(image.Pt(5, 5), tex, tex.Bounds(), tc.op, nil)
+		img := renderImages(f.msgs, image.NewRGBA(image.Rect(0, 0, 20, 20)))[w.imageId]
+		if got := img.RGBAAt(6, 6); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.op, got, tc.want)
+		}
+	}
+}
+
+func TestWindowDrawTextureOp(t *testing.T) {
+	sr := image.Rect(2, 3, 12, 13)
+	for _, tc := range []struct {
+		op   draw.Op
+		cmds string
+	}{
+		// the texture's alpha blends it with the window.
+		{draw.Over, "Od"},
+		// the texture replaces the window, alpha and all.
+		{draw.Src, "Od"},
+	} {
+		s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+		w := newWindowImpl(s, image.ZP)
+		tex := newTextureImpl(s, image.Point{20, 20})
+		f.msgs = nil
+		tex.Fill(tex.Bounds(), color.NRGBA{0xff, 0, 0, 0x80}, draw.Src)
+		// the fill allocated the solid mask.
+		b := f.msgs[1]
+		f.msgs = nil
+
+		w.Draw(f64.Aff3{1, 0, 30, 0, 1, 40}, tex, sr, tc.op, nil)
+		if got := f.cmds(); got != tc.cmds {
+			t.Fatalf("%v: got messages %q, want %q", tc.op, got, tc.cmds)
+		}
+		d := f.msgs[strings.IndexByte(tc.cmds, 'd')][1:]
+		// sr is translated where it is, not from the origin.
+		if got, want := msgRect(d[12:]), image.Rect(32, 43, 42, 53); got != want {
+			t.Errorf("%v: dst rectangle: got %v, want %v", tc.op, got, want)
+		}
+		if got := msgPoint(d[28:]); got != sr.Min {
+			t.Errorf("%v: src point: got %v, want %v", tc.op, got, sr.Min)
+		}
+		// either way, the mask is an opaque replicated image, since
+		// the texture's alpha is already part of its pixels.
+		mask := binary.LittleEndian.Uint32(d[8:])
+		if id := binary.LittleEndian.Uint32(b[1:]); mask != id || b[14] != 1 || b[47] != 0xff {
+			t.Errorf("%v: drew with mask %d, want the opaque replicated image %d", tc.op, mask, id)
+		}
+		if got := msgPoint(d[36:]); got != image.ZP {
+			t.Errorf("%v: mask point: got %v, want %v", tc.op, got, image.ZP)
+		}
+	}
+}
+
+// countPaints returns the number of paint events that w receives before
+// wait has passed.
+func countPaints(w screen.Window, wait time.Duration) int {
+	type stop struct{}
+	time.AfterFunc(wait, func() { w.Send(stop{}) })
+	n := 0
+	for {
+		switch w.NextEvent().(type) {
+		case paint.Event:
+			n++
+		case stop:
+			return n
+		}
+	}
+}
+
+func TestWindowEmptyFrame(t *testing.T) {
+	for _, tc := range []struct {
+		files map[string]string
+		want  image.Point
+	}{
+		// the frame is read again for the window's size.
+		{map[string]string{"/dev/wctl": "         10          20         640         480 current visible"}, image.Pt(622, 452)},
+		// and if it still can't be, the window isn't left empty.
+		{nil, image.Pt(1, 1)},
+	} {
+		useFS(t, &fakeFS{files: tc.files})
+		s, _ := newTestScreen(65535, image.ZR)
+		s.opts.BorderWidth = 4
+		w := newWindowImpl(s, image.ZP)
+		for {
+			if e, ok := w.NextEvent().(size.Event); ok {
+				if got := e.Size(); got != tc.want {
+					t.Errorf("wctl %q: got size %v, want %v", tc.files["/dev/wctl"], got, tc.want)
+				}
+				break
+			}
+		}
+		if s.windowFrame != image.ZR {
+			t.Errorf("wctl %q: the screen's frame was set to %v", tc.files["/dev/wctl"], s.windowFrame)
+		}
+	}
+}
+
+func TestWindowInitialPaint(t *testing.T) {
+	// no resize ever arrives, so the window is kicked once.
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	s.paintDelay = 10 * time.Millisecond
+	w, _ := s.NewWindow(nil)
+	if n := countPaints(w, 100*time.Millisecond); n != 2 {
+		t.Errorf("got %d paint events without a resize, want 2", n)
+	}
+
+	// a resize before the kick repaints the window instead.
+	w, _ = s.NewWindow(nil)
+	ww := w.(*windowImpl)
+	s.windowsMu.Lock()
+	ww.resized = true
+	ww.sendSize()
+	s.windowsMu.Unlock()
+	if n := countPaints(w, 100*time.Millisecond); n != 2 {
+		t.Errorf("got %d paint events with a resize, want 2", n)
+	}
+}
+
+func TestWindowFlush(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w := newWindowImpl(s, image.ZP)
+	f.msgs = nil
+
+	// there's nothing pending, but it should still work.
+	var fw FlushWindow = w
+	for i := 0; i < 2; i++ {
+		if err := fw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := f.cmds(), "vv"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	if len(f.msgs[0]) != 1 {
+		t.Errorf("flush message is % x, want a bare 'v'", f.msgs[0])
+	}
+}
+
+func TestWindowPublishClean(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w := newWindowImpl(s, image.ZP)
+	s.windows = append(s.windows, w)
+	f.msgs = nil
+
+	// a new window has to be shown, but once it has, publishing again
+	// without drawing anything doesn't send anything.
+	for i := 0; i < 2; i++ {
+		if res := w.Publish(); !res.BackBufferPreserved {
+			t.Errorf("Publish %d: back buffer wasn't preserved", i)
+		}
+	}
+	if got, want := f.cmds(), "Odv"; got != want {
+		t.Errorf("got messages %q, want one composite %q", got, want)
+	}
+
+	// drawing into a texture doesn't change the screen.
+	tex := newTextureImpl(s, image.Point{10, 10})
+	tex.Fill(tex.Bounds(), color.Black, draw.Src)
+	f.msgs = nil
+	w.Publish()
+	if len(f.msgs) != 0 {
+		t.Errorf("got messages %q after drawing into a texture", f.cmds())
+	}
+
+	// but drawing into the window does.
+	w.Copy(image.ZP, tex, tex.Bounds(), draw.Src, nil)
+	f.msgs = nil
+	id := w.imageId
+	w.Publish()
+	w.Publish()
+	if got, want := f.cmds(), "Odv"; got != want {
+		t.Fatalf("got messages %q after drawing, want %q", got, want)
+	}
+	// the window's image is only read from, and kept, which is what
+	// makes BackBufferPreserved true.
+	if d := f.msgs[1][1:]; binary.LittleEndian.Uint32(d) != 0 || binary.LittleEndian.Uint32(d[4:]) != id || w.imageId != id {
+		t.Errorf("published by drawing %d into %d, want the window's image %d into the screen", binary.LittleEndian.Uint32(d[4:]), binary.LittleEndian.Uint32(d), id)
+	}
+
+	// and so does removing a window, which might have been on top.
+	w2 := newWindowImpl(s, image.ZP)
+	s.windows = append(s.windows, w2)
+	w.Publish()
+	w2.Release()
+	f.msgs = nil
+	w.Publish()
+	if got, want := f.cmds(), "Odv"; got != want {
+		t.Errorf("got messages %q after removing a window, want %q", got, want)
+	}
+}
+
+func TestWindowOpacity(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	win, _ := s.NewWindow(nil)
+	w := win.(*windowImpl)
+	w.Publish()
+
+	f.msgs = nil
+	w.SetOpacity(128)
+	w.Publish()
+	// the area under the window is filled with the background before
+	// the window is blended with it.
+	if got, want := f.cmds(), "bbOdOdfv"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	// the mask is a replicated image of half alpha.
+	b := f.msgs[0][1:]
+	maskID := binary.LittleEndian.Uint32(b)
+	if b[13] != 1 || msgRect(b[14:]) != image.Rect(0, 0, 1, 1) {
+		t.Errorf("mask allocated as %v with repl %d, want a replicated pixel", msgRect(b[14:]), b[13])
+	}
+	if got, want := b[46:50], []byte{0x80, 0x80, 0x80, 0x80}; !bytes.Equal(got, want) {
+		t.Errorf("mask colour % x, want % x", got, want)
+	}
+	// and the window is blended with what's under it.
+	if got := f.msgs[4][1]; got != 11 {
+		t.Errorf("composited with op %d, want Over (11)", got)
+	}
+	d := f.msgs[5][1:]
+	if src, mask := binary.LittleEndian.Uint32(d[4:]), binary.LittleEndian.Uint32(d[8:]); src != w.imageId || mask != maskID {
+		t.Errorf("composited %d with mask %d, want %d with mask %d", src, mask, w.imageId, maskID)
+	}
+
+	// full opacity goes back to the window's own alpha.
+	f.msgs = nil
+	w.SetOpacity(255)
+	w.Publish()
+	if got, want := f.cmds(), "fOdv"; got != want {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	if id := binary.LittleEndian.Uint32(f.msgs[0][1:]); id != maskID {
+		t.Errorf("freed %d, want the mask %d", id, maskID)
+	}
+	if mask := binary.LittleEndian.Uint32(f.msgs[2][9:]); mask != w.imageId {
+		t.Errorf("composited with mask %d, want the window %d", mask, w.imageId)
+	}
+}
+
+// render draws msgs into the images that they allocate, as the server
+// would, with image ID 0 being screen, and returns screen.
+func render(msgs [][]byte, screen *image.RGBA) *image.RGBA {
+	return renderImages(msgs, screen)[0]
+}
+
+// renderImages draws msgs into the images that they allocate, as the server
+// would, with image ID 0 being screen, and returns every image that
+// hasn't been freed, by ID. It understands the 'b', 'f', 'O', 'y' and
+// 'd' messages that compositing, filling and uncompressed uploads send,
+// and clips drawing to the clipping rectangles that the images were
+// allocated with.
+func renderImages(msgs [][]byte, screen *image.RGBA) map[uint32]*image.RGBA {
+	images := map[uint32]*image.RGBA{0: screen}
+	clip := map[uint32]image.Rectangle{0: screen.Rect}
+	repl := make(map[uint32]bool)
+	op := draw.Over
+	// at returns the colour of the pixel p of the image id, which is
+	// tiled across the plane if it's replicated, or false if p is
+	// outside the image or its clipping rectangle.
+	at := func(id uint32, p image.Point) (color.Color, bool) {
+		img := images[id]
+		if !p.In(clip[id]) {
+			return nil, false
+		}
+		if repl[id] {
+			r := img.Rect
+			p.X = r.Min.X + ((p.X-r.Min.X)%r.Dx()+r.Dx())%r.Dx()
+			p.Y = r.Min.Y + ((p.Y-r.Min.Y)%r.Dy()+r.Dy())%r.Dy()
+		}
+		return img.At(p.X, p.Y), true
+	}
+	for _, m := range msgs {
+		switch m[0] {
+		case 'b':
+			id := binary.LittleEndian.Uint32(m[1:])
+			img := image.NewRGBA(msgRect(m[15:]))
+			c := color.RGBA{m[50], m[49], m[48], m[47]}
+			draw.Draw(img, img.Rect, image.NewUniform(c), image.ZP, draw.Src)
+			images[id], repl[id], clip[id] = img, m[14] == 1, msgRect(m[31:])
+			if !repl[id] {
+				clip[id] = clip[id].Intersect(img.Rect)
+			}
+		case 'f':
+			delete(images, binary.LittleEndian.Uint32(m[1:]))
+		case 'y':
+			img := images[binary.LittleEndian.Uint32(m[1:])]
+			r := msgRect(m[5:])
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				row := m[21+(y-r.Min.Y)*r.Dx()*4:]
+				copy(img.Pix[img.PixOffset(r.Min.X, y):], row[:r.Dx()*4])
+			}
+		case 'O':
+			op = draw.Over
+			if m[1] == 10 {
+				op = draw.Src
+			}
+		case 'd':
+			dstID := binary.LittleEndian.Uint32(m[1:])
+			dst := images[dstID]
+			src, mask := binary.LittleEndian.Uint32(m[5:]), binary.LittleEndian.Uint32(m[9:])
+			r := msgRect(m[13:]).Intersect(clip[dstID])
+			sp, mp := msgPoint(m[29:]), msgPoint(m[37:])
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					d := image.Pt(x, y).Sub(msgRect(m[13:]).Min)
+					sc, sok := at(src, sp.Add(d))
+					mc, mok := at(mask, mp.Add(d))
+					if !sok || !mok {
+						continue
+					}
+					pr := image.Rect(x, y, x+1, y+1)
+					draw.DrawMask(dst, pr, image.NewUniform(sc), image.ZP, image.NewUniform(mc), image.ZP, op)
+				}
+			}
+		}
+	}
+	return images
+}
+
+func TestWindowOpacityPixels(t *testing.T) {
+	frame := image.Rect(0, 0, 8, 8)
+	s, f := newTestScreen(65535, frame)
+	s.opts.BackgroundColor = color.RGBA{0, 0, 0xff, 0xff}
+	win, _ := s.NewWindow(nil)
+	w := win.(*windowImpl)
+	w.SetOpacity(128)
+
+	// the window is half blended with the background, however many
+	// times it's published.
+	want := color.RGBA{0x80, 0, 0x7f, 0xff}
+	for i := 0; i < 3; i++ {
+		w.Fill(w.rect, color.RGBA{0xff, 0, 0, 0xff}, draw.Src)
+		w.Publish()
+		// the Plan 9 window starts out with something else in it.
+		screen := image.NewRGBA(frame)
+		draw.Draw(screen, frame, image.NewUniform(color.RGBA{0, 0xff, 0, 0xff}), image.ZP, draw.Src)
+		got := render(f.msgs, screen).RGBAAt(4, 4)
+		if got != want {
+			t.Fatalf("publish %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestFirstPaint(t *testing.T) {
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	painted := s.FirstPaint()
+	isClosed := func() bool {
+		select {
+		case <-painted:
+			return true
+		default:
+			return false
+		}
+	}
+
+	w := newWindowImpl(s, image.ZP)
+	if isClosed() {
+		t.Fatalf("first paint before anything was published")
+	}
+	// publishing with no windows on the screen doesn't show anything.
+	w.Publish()
+	if isClosed() {
+		t.Fatalf("first paint before a window was composited")
+	}
+	s.windows = append(s.windows, w)
+	w.Publish()
+	if !isClosed() {
+		t.Fatalf("no first paint after a window was published")
+	}
+	// later frames don't close it again.
+	w.Fill(image.Rect(0, 0, 1, 1), color.Black, draw.Src)
+	w.Publish()
+	if s.FirstPaint() != painted {
+		t.Errorf("FirstPaint returned a different channel after the first paint")
+	}
+
+	// a frame that couldn't be sent isn't a paint.
+	s = &screenImpl{ctl: &DrawCtrler{data: &failingData{}, iounitSize: 65535}, windowFrame: image.Rect(0, 0, 100, 100)}
+	s.windows = append(s.windows, &windowImpl{uploadImpl: &uploadImpl{ctl: s.ctl, dirty: true}, s: s, rect: image.Rect(0, 0, 10, 10)})
+	useLogger(t)
+	redrawWindow(s, s.windowFrame)
+	select {
+	case <-s.FirstPaint():
+		t.Errorf("first paint after the frame failed")
+	default:
+	}
+}
+
+func TestWindowPublishError(t *testing.T) {
+	l := useLogger(t)
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w1 := newWindowImpl(s, image.ZP)
+	w2 := newWindowImpl(s, image.ZP)
+	s.windows = append(s.windows, w1, w2)
+
+	// the first composite fails.
+	f := &failingData{ok: 1}
+	s.ctl.data = f
+	w1.Publish()
+	if f.writes != 2 {
+		t.Errorf("wrote %d messages, want to stop after the failed composite", f.writes)
+	}
+	if len(l.errors) != 1 || !strings.Contains(l.errors[0], "composite") {
+		t.Errorf("got errors %q, want one about compositing", l.errors)
+	}
+}
+
+func TestWindowCapture(t *testing.T) {
+	s, f := newTestScreen(100, image.Rect(0, 0, 8, 6))
+	w := newWindowImpl(s, image.ZP)
+	w.Fill(image.Rect(0, 0, 8, 6), color.RGBA{0x10, 0x20, 0x30, 0xff}, draw.Src)
+	f.msgs = nil
+
+	// the server has the filled pixels.
+	want := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	draw.Draw(want, want.Rect, image.NewUniform(color.RGBA{0x10, 0x20, 0x30, 0xff}), image.ZP, draw.Src)
+	f.reads.Write(want.Pix)
+
+	var cw CaptureWindow = w
+	got, err := cw.Capture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Rect != want.Rect || !bytes.Equal(got.Pix, want.Pix) {
+		t.Errorf("captured %v %x, want %v %x", got.Rect, got.Pix, want.Rect, want.Pix)
+	}
+	// the image is bigger than the iounit, so it's read in pieces.
+	for i, m := range f.msgs {
+		if m[0] != 'r' || binary.LittleEndian.Uint32(m[1:]) != w.imageId {
+			t.Errorf("message %d is %q, want a read of the window", i, m[0])
+		}
+	}
+	if len(f.msgs) < 2 {
+		t.Errorf("got %d reads, want more than one", len(f.msgs))
+	}
+
+	// a failed read is returned, not a panic.
+	if _, err := cw.Capture(); err == nil {
+		t.Errorf("expected an error when there's nothing to read")
+	}
+}
+
+func TestDrawImage(t *testing.T) {
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	win, _ := s.NewWindow(nil)
+	tex, _ := s.NewTexture(image.Point{10, 10})
+	for _, img := range []interface{}{win, tex} {
+		di, ok := img.(DrawImage)
+		if !ok {
+			t.Fatalf("%T doesn't implement DrawImage", img)
+		}
+		if di.DrawController() != s.ctl {
+			t.Errorf("%T: DrawController isn't the screen's", img)
+		}
+	}
+
+	// the texture can no longer be transformed from its local copy.
+	tt := tex.(*textureImpl)
+	if id := tt.ImageID(); id != tt.imageId || tt.local != nil {
+		t.Errorf("texture ImageID = %d with local copy %v, want %d without", id, tt.local != nil, tt.imageId)
+	}
+
+	// a window drawn into directly is composited when it's published.
+	w := win.(*windowImpl)
+	w.Publish()
+	f.msgs = nil
+	w.Publish()
+	if got := f.cmds(); got != "" {
+		t.Fatalf("got messages %q for a clean window", got)
+	}
+	if id := w.ImageID(); id != w.imageId {
+		t.Errorf("window ImageID = %d, want %d", id, w.imageId)
+	}
+	w.Publish()
+	if got := f.cmds(); !strings.Contains(got, "d") {
+		t.Errorf("got messages %q after ImageID, want the window composited", got)
+	}
+
+	// and so is one drawn into later, with the ID that was handed out.
+	for _, send := range []func(msg []byte){
+		func(msg []byte) { s.ctl.SendMessage('d', msg) },
+		func(msg []byte) { s.ctl.NewBatch().Append('d', msg).Flush() },
+	} {
+		f.msgs = nil
+		w.Publish()
+		if got := f.cmds(); got != "" {
+			t.Fatalf("got messages %q for a clean window", got)
+		}
+		msg := make([]byte, 44)
+		binary.LittleEndian.PutUint32(msg, w.imageId)
+		send(msg)
+		f.msgs = nil
+		w.Publish()
+		if got := f.cmds(); !strings.Contains(got, "d") {
+			t.Errorf("got messages %q after drawing with the window's ID, want it composited", got)
+		}
+	}
+}
+
+// lazyServer is a /dev/draw/n/data which, like a server at the other end
+// of a network, doesn't process the messages written to it until a reply
+// has to be read. It understands just enough of them to fill images with
+// a colour and read them back.
+type lazyServer struct {
+	pending [][]byte
+	images  map[uint32]*image.RGBA
+	reply   []byte
+}
+
+func (l *lazyServer) Write(p []byte) (int, error) {
+	l.pending = append(l.pending, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (l *lazyServer) process() {
+	if l.images == nil {
+		l.images = make(map[uint32]*image.RGBA)
+	}
+	for _, m := range l.pending {
+		if len(m) < 5 {
+			continue
+		}
+		id := binary.LittleEndian.Uint32(m[1:])
+		switch m[0] {
+		case 'b':
+			img := image.NewRGBA(msgRect(m[15:]))
+			c := color.RGBA{m[50], m[49], m[48], m[47]}
+			draw.Draw(img, img.Rect, image.NewUniform(c), image.ZP, draw.Src)
+			l.images[id] = img
+		case 'f':
+			delete(l.images, id)
+		case 'd':
+			// the sources here are all replicated colours.
+			src := l.images[binary.LittleEndian.Uint32(m[5:])]
+			draw.Draw(l.images[id], msgRect(m[13:]), image.NewUniform(src.At(0, 0)), image.ZP, draw.Src)
+		case 'r':
+			r := msgRect(m[5:])
+			dst := image.NewRGBA(r)
+			draw.Draw(dst, r, l.images[id], r.Min, draw.Src)
+			l.reply = dst.Pix
+		}
+	}
+	l.pending = nil
+}
+
+func (l *lazyServer) Read(p []byte) (int, error) {
+	l.process()
+	n := copy(p, l.reply)
+	l.reply = l.reply[n:]
+	return n, nil
+}
+
+func (l *lazyServer) Close() error { return nil }
+
+func TestWindowSyncDraw(t *testing.T) {
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 10, 10))
+	l := &lazyServer{}
+	s.ctl.data = l
+	win, _ := s.NewWindow(nil)
+	w := win.(*windowImpl)
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	w.Fill(image.Rect(0, 0, 10, 10), red, draw.Src)
+	if len(l.pending) == 0 {
+		t.Fatal("the fill was processed before it was waited for")
+	}
+
+	var sw SyncWindow = w
+	if err := sw.SyncDraw(); err != nil {
+		t.Fatal(err)
+	}
+	// the server has drawn the fill before SyncDraw returns.
+	if got := l.images[w.imageId].RGBAAt(9, 9); got != red {
+		t.Fatalf("window is %v on the server after SyncDraw, want %v", got, red)
+	}
+	img, err := w.Capture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.RGBAAt(5, 5); got != red {
+		t.Errorf("captured %v, want %v", got, red)
+	}
+	// the image that was read isn't left allocated.
+	if live := s.ctl.LiveIDs(); len(live) != 2 || live[0] != w.imageId || live[1] != s.solidMask() {
+		t.Errorf("live images %v, want only the window's %d and the solid mask", live, w.imageId)
+	}
+}
+
+func TestNewWindowDuringResize(t *testing.T) {
+	// the race detector needs the goroutines to actually run at the
+	// same time.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	defer func(old time.Duration) { resizeDebounce = old }(resizeDebounce)
+	resizeDebounce = time.Millisecond
+	useLogger(t)
+	fs := &fakeFS{files: map[string]string{"/dev/wctl": ""}}
+	useFS(t, fs)
+	s, _ := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	s.opts.SoftwareCursor = true
+	wctl := func(i int) string {
+		return fmt.Sprintf("%11d %11d %11d %11d current visible", i, i, 100+2*i, 100+3*i)
+	}
+
+	// windows are created and published, and the cursor is moved, while
+	// the Plan 9 window is being moved and resized, which changes the
+	// frame and reallocates the images of the windows that fill it.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			w, _ := s.NewWindow(nil)
+			w.Publish()
+			s.moveCursor(image.Pt(i, i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			fs.mu.Lock()
+			fs.files["/dev/wctl"] = wctl(1 + i%7)
+			fs.mu.Unlock()
+			s.scheduleResize()
+			time.Sleep(2 * time.Millisecond)
+		}
+	}()
+	wg.Wait()
+	// wait for the last resize.
+	want := image.Rect(1, 1, 102, 103)
+	for deadline := time.Now().Add(5 * time.Second); s.frame() != want; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("frame is %v after the last resize, want %v", s.frame(), want)
+		}
+	}
+	s.windowsMu.Lock()
+	defer s.windowsMu.Unlock()
+
+	// no window is left with an image that has been freed.
+	live := make(map[uint32]bool)
+	for _, id := range s.ctl.LiveIDs() {
+		live[id] = true
+	}
+	for i, w := range s.windows {
+		if !live[w.imageId] {
+			t.Errorf("window %d: image %d has been freed", i, w.imageId)
+		}
+	}
+}
+
+func TestWindowDrawDuringResize(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	s, f := newTestScreen(65535, image.Rect(0, 0, 100, 100))
+	w := newWindowImpl(s, image.ZP)
+	s.windows = append(s.windows, w)
+	tex := newTextureImpl(s, image.Point{10, 10})
+	f.msgs = nil
+
+	// the window's image is replaced by each resize while it's drawn
+	// into.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			w.DrawLine(image.Pt(90, 90), image.Pt(10, 10), 1, color.Black, draw.Over)
+			w.DrawEllipse(image.Pt(50, 50), 20, 10, 1, color.Black, draw.Over)
+			w.Fill(image.Rect(10, 10, 20, 20), color.Black, draw.Src)
+			w.Draw(f64.Aff3{1, 0, 5, 0, 1, 5}, tex, tex.Bounds(), draw.Over, nil)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			repositionWindow(s, image.Rect(0, 0, 100+i, 100+i))
+		}
+	}()
+	wg.Wait()
+
+	// nothing is drawn into an image after it's been freed.
+	freed := make(map[uint32]bool)
+	for i, m := range f.msgs {
+		switch m[0] {
+		case 'f':
+			freed[binary.LittleEndian.Uint32(m[1:])] = true
+		case 'L', 'e', 'd':
+			if dst := binary.LittleEndian.Uint32(m[1:]); freed[dst] {
+				t.Fatalf("message %d: drew %c into %d after it was freed", i, m[0], dst)
+			}
+		}
+	}
+}
@@ -7,10 +7,20 @@
 package driver
 
 import (
+	"os"
+	"path"
+
+	"github.com/niconan/shiny-plan9/shiny/driver/acmedriver"
 	"github.com/niconan/shiny-plan9/shiny/driver/devdrawdriver"
 	"github.com/niconan/shiny-plan9/shiny/screen"
 )
 
 func main(f func(screen.Screen)) {
+	// a program run from acme without /dev/draw, such as in a cpu(1)
+	// session, can still get its events through acme.
+	if _, err := os.Stat(path.Join(devdrawdriver.DevRoot, "draw", "new")); err != nil && acmedriver.IsAcme() {
+		acmedriver.Main(f)
+		return
+	}
 	devdrawdriver.Main(f)
 }
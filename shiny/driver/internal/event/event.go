@@ -55,6 +55,25 @@ func (q *Deque) Send(event interface{}) {
 	q.cond.Signal()
 }
 
+// SendCoalesced is like Send, but if the last event in the queue hasn't
+// been returned by NextEvent yet and replaceable reports true for it,
+// event replaces it instead of being queued after it. It's for events such
+// as pointer motion, where only the latest one matters.
+func (q *Deque) SendCoalesced(event interface{}, replaceable func(interface{}) bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.cond.L == nil {
+		q.cond.L = &q.mu
+	}
+
+	if n := len(q.back); n > 0 && replaceable(q.back[n-1]) {
+		q.back[n-1] = event
+		return
+	}
+	q.back = append(q.back, event)
+	q.cond.Signal()
+}
+
 // SendFirst implements the screen.EventDeque interface.
 func (q *Deque) SendFirst(event interface{}) {
 	q.mu.Lock()